@@ -95,6 +95,11 @@ const createLocalizedFunction = async () => {
 };
 
 
+// Quellprofil aus ?source=. Alle Tabellen führen source im Primärschlüssel,
+// ohne Angabe werden die Daten aller Quellen geliefert.
+const sourceParam = (source: unknown): string | undefined =>
+    typeof source === 'string' && source !== '' ? source : undefined;
+
 // Startet den Server
 app.listen(port, async () => {
     console.log(`Server läuft auf http://localhost:${port}`);
@@ -105,6 +110,7 @@ app.listen(port, async () => {
 // Endpunkt für Rollen-Suche mit Paginierung und erweiterter Suche
 app.get('/api/roles', async (req, res) => {
     const { search, fields, from = 1, size = 10 } = req.query;
+    const source = sourceParam(req.query.source);
     const offset = Math.max(0, (parseInt(from as string, 10) || 1) - 1);
     const limit = parseInt(size as string, 10) || 10;
 
@@ -114,6 +120,7 @@ app.get('/api/roles', async (req, res) => {
     FROM viz_roles 
   `;
     const queryParams: any[] = [];
+    const conditions: string[] = [];
 
     if (search) {
         let searchCondition = '';
@@ -135,8 +142,15 @@ app.get('/api/roles', async (req, res) => {
             queryParams.push(searchTerm);
         });
 
-        totalCountQuery += ` WHERE ${searchCondition}`;
-        dataQuery += ` WHERE ${searchCondition}`;
+        conditions.push(`(${searchCondition})`);
+    }
+    if (source) {
+        queryParams.push(source);
+        conditions.push(`source = $${queryParams.length}`);
+    }
+    if (conditions.length > 0) {
+        totalCountQuery += ` WHERE ${conditions.join(' AND ')}`;
+        dataQuery += ` WHERE ${conditions.join(' AND ')}`;
     }
 
     try {
@@ -168,6 +182,7 @@ app.get('/api/roles', async (req, res) => {
 // Endpunkt für Ressourcen-Suche mit Paginierung und erweiterter Suche
 app.get('/api/resources', async (req, res) => {
     const { search, fields, from = 1, size = 10 } = req.query;
+    const source = sourceParam(req.query.source);
     const offset = Math.max(0, (parseInt(from as string, 10) || 1) - 1);
     const limit = parseInt(size as string, 10) || 10;
 
@@ -177,6 +192,7 @@ app.get('/api/resources', async (req, res) => {
     FROM viz_resources
   `;
     const queryParams: any[] = [];
+    const conditions: string[] = [];
 
     if (search) {
         let searchCondition = '';
@@ -198,8 +214,15 @@ app.get('/api/resources', async (req, res) => {
             queryParams.push(searchTerm);
         });
 
-        totalCountQuery += ` WHERE ${searchCondition}`;
-        dataQuery += ` WHERE ${searchCondition}`;
+        conditions.push(`(${searchCondition})`);
+    }
+    if (source) {
+        queryParams.push(source);
+        conditions.push(`source = $${queryParams.length}`);
+    }
+    if (conditions.length > 0) {
+        totalCountQuery += ` WHERE ${conditions.join(' AND ')}`;
+        dataQuery += ` WHERE ${conditions.join(' AND ')}`;
     }
 
     try {
@@ -232,7 +255,7 @@ app.get('/api/resources', async (req, res) => {
 app.get('/api/roles/:dn', async (req, res) => {
     const { dn } = req.params;
     try {
-        const result = await db.query('SELECT *, get_localized_text(nrflocalizednames, \'missing-name\') as "sortname", get_localized_text(nrflocalizeddescrs, \'\') as "sortdesc" FROM viz_roles WHERE dn = $1', [dn]);
+        const result = await db.query('SELECT *, get_localized_text(nrflocalizednames, \'missing-name\') as "sortname", get_localized_text(nrflocalizeddescrs, \'\') as "sortdesc" FROM viz_roles WHERE dn = $1 AND ($2::text IS NULL OR source = $2) ORDER BY source LIMIT 1', [dn, sourceParam(req.query.source) ?? null]);
         if (result.rows.length > 0) {
             res.json(result.rows[0]);
         } else {
@@ -247,7 +270,7 @@ app.get('/api/roles/:dn', async (req, res) => {
 app.get('/api/resources/:dn', async (req, res) => {
     const { dn } = req.params;
     try {
-        const result = await db.query('SELECT *, get_localized_text(nrflocalizednames, \'missing-name\') as "sortname", get_localized_text(nrflocalizeddescrs, \'\') as "sortdesc" FROM viz_resources WHERE dn = $1', [dn]);
+        const result = await db.query('SELECT *, get_localized_text(nrflocalizednames, \'missing-name\') as "sortname", get_localized_text(nrflocalizeddescrs, \'\') as "sortdesc" FROM viz_resources WHERE dn = $1 AND ($2::text IS NULL OR source = $2) ORDER BY source LIMIT 1', [dn, sourceParam(req.query.source) ?? null]);
         if (result.rows.length > 0) {
             res.json(result.rows[0]);
         } else {
@@ -258,20 +281,30 @@ app.get('/api/resources/:dn', async (req, res) => {
     }
 });
 
+// Assoziationen gelten nur im Status "active" (nrfStatus 50) als Zuweisung.
+// Mit ?status=all werden auch ausstehende, genehmigte, abgelehnte und
+// zurückgezogene Assoziationen geliefert; association_status unterscheidet sie.
+const associationStatusCondition = (status: unknown): string =>
+    status === 'all' ? '' : ` AND vrr.status_key = 'active'`;
+
 // Neuer Endpunkt, um direkt zugeordnete Ressourcen für eine Rolle abzurufen
 app.get('/api/roles/:dn/resources', async (req, res) => {
     const { dn } = req.params;
+    const source = sourceParam(req.query.source) ?? null;
+    const statusCondition = associationStatusCondition(req.query.status);
     try {
         const query = `
       SELECT
         res.*,
+        vrr.status_key AS "association_status",
+        vrr.status_name AS "association_status_name",
         get_localized_text(res.nrflocalizednames, 'missing-name') as "sortname",
         get_localized_text(res.nrflocalizeddescrs, '') as "sortdesc"
       FROM viz_roles_resources AS vrr
-      JOIN viz_resources AS res ON vrr.nrfresource = res.dn
-      WHERE vrr.nrfrole = $1;
+      JOIN viz_resources AS res ON vrr.nrfresource = res.dn AND vrr.source = res.source
+      WHERE vrr.nrfrole = $1 AND ($2::text IS NULL OR vrr.source = $2)${statusCondition};
     `;
-        const result = await db.query(query, [dn]);
+        const result = await db.query(query, [dn, source]);
         res.json({ data: result.rows });
     } catch (err) {
         console.error('Fehler beim Abrufen der Ressourcen für die Rolle:', err);
@@ -283,57 +316,61 @@ app.get('/api/roles/:dn/resources', async (req, res) => {
 // Rekursiver Endpunkt zur Abfrage der gesamten Rollen-Hierarchie
 app.get('/api/roles/:dn/full-hierarchy', async (req, res) => {
     const { dn } = req.params;
+    const source = sourceParam(req.query.source) ?? null;
+    const statusCondition = associationStatusCondition(req.query.status);
 
     try {
         const parentQuery = `
       WITH RECURSIVE parents_recursive AS (
-        SELECT rp.parent_dn AS dn, 1 AS depth
+        SELECT rp.parent_dn AS dn, rp.source, 1 AS depth
         FROM viz_roles_parents AS rp
-        WHERE rp.child_dn = $1
+        WHERE rp.child_dn = $1 AND ($2::text IS NULL OR rp.source = $2)
         UNION
-        SELECT r.parent_dn AS dn, pr.depth + 1
+        SELECT r.parent_dn AS dn, r.source, pr.depth + 1
         FROM viz_roles_parents AS r
-        JOIN parents_recursive AS pr ON r.child_dn = pr.dn
+        JOIN parents_recursive AS pr ON r.child_dn = pr.dn AND r.source = pr.source
       )
       SELECT r.*,
       get_localized_text(r.nrflocalizednames, 'missing-name') as "sortname",
       get_localized_text(r.nrflocalizeddescrs, '') as "sortdesc",
       pr.depth
       FROM viz_roles AS r
-      JOIN parents_recursive AS pr ON r.dn = pr.dn;
+      JOIN parents_recursive AS pr ON r.dn = pr.dn AND r.source = pr.source;
     `;
-        const parentsResult = await db.query(parentQuery, [dn]);
+        const parentsResult = await db.query(parentQuery, [dn, source]);
 
         const childrenQuery = `
       WITH RECURSIVE children_recursive AS (
-        SELECT rp.child_dn AS dn, 1 AS depth
+        SELECT rp.child_dn AS dn, rp.source, 1 AS depth
         FROM viz_roles_parents AS rp
-        WHERE rp.parent_dn = $1
+        WHERE rp.parent_dn = $1 AND ($2::text IS NULL OR rp.source = $2)
         UNION
-        SELECT r.child_dn AS dn, cr.depth + 1
+        SELECT r.child_dn AS dn, r.source, cr.depth + 1
         FROM viz_roles_parents AS r
-        JOIN children_recursive AS cr ON r.parent_dn = cr.dn
+        JOIN children_recursive AS cr ON r.parent_dn = cr.dn AND r.source = cr.source
       )
       SELECT r.*,
       get_localized_text(r.nrflocalizednames, 'missing-name') as "sortname",
       get_localized_text(r.nrflocalizeddescrs, '') as "sortdesc",
       cr.depth
       FROM viz_roles AS r
-      JOIN children_recursive AS cr ON r.dn = cr.dn;
+      JOIN children_recursive AS cr ON r.dn = cr.dn AND r.source = cr.source;
     `;
-        const childrenResult = await db.query(childrenQuery, [dn]);
+        const childrenResult = await db.query(childrenQuery, [dn, source]);
 
         // Für jedes Child die direkt zugeordneten Ressourcen abrufen
         const childrenWithResources = await Promise.all(childrenResult.rows.map(async (child: any) => {
             const resourcesQuery = `
         SELECT res.*,
+        vrr.status_key AS "association_status",
+        vrr.status_name AS "association_status_name",
         get_localized_text(res.nrflocalizednames, 'missing-name') as "sortname",
         get_localized_text(res.nrflocalizeddescrs, '') as "sortdesc"
         FROM viz_roles_resources AS vrr
-        JOIN viz_resources AS res ON vrr.nrfresource = res.dn
-        WHERE vrr.nrfrole = $1;
+        JOIN viz_resources AS res ON vrr.nrfresource = res.dn AND vrr.source = res.source
+        WHERE vrr.nrfrole = $1 AND vrr.source = $2${statusCondition};
       `;
-            const resourcesResult = await db.query(resourcesQuery, [child.dn]);
+            const resourcesResult = await db.query(resourcesQuery, [child.dn, child.source]);
             return { ...child, resources: resourcesResult.rows };
         }));
 
@@ -352,19 +389,23 @@ app.get('/api/roles/:dn/full-hierarchy', async (req, res) => {
 // Endpunkt zum Abrufen aller Rollen, die eine Ressource zuweisen
 app.get('/api/resources/:dn/roles', async (req, res) => {
     const { dn } = req.params;
+    const source = sourceParam(req.query.source) ?? null;
+    const statusCondition = associationStatusCondition(req.query.status);
 
     const query = `
     SELECT
       r.*,
+      vrr.status_key AS "association_status",
+      vrr.status_name AS "association_status_name",
       get_localized_text(r.nrflocalizednames, 'missing-name') as "sortname"
     FROM viz_roles_resources AS vrr
-    JOIN viz_roles AS r ON vrr.nrfrole = r.dn
-    WHERE vrr.nrfresource = $1
+    JOIN viz_roles AS r ON vrr.nrfrole = r.dn AND vrr.source = r.source
+    WHERE vrr.nrfresource = $1 AND ($2::text IS NULL OR vrr.source = $2)${statusCondition}
     ORDER BY sortname ASC;
   `;
 
     try {
-        const result = await db.query(query, [dn]);
+        const result = await db.query(query, [dn, source]);
         res.json({ data: result.rows });
     } catch (err) {
         console.error('Fehler beim Abrufen der Rollen für die Ressource:', err);
@@ -372,6 +413,27 @@ app.get('/api/resources/:dn/roles', async (req, res) => {
     }
 });
 
+// Endpunkt zum Abrufen der Eigentümer und Genehmiger einer Rolle oder Ressource
+app.get('/api/governance/:dn', async (req, res) => {
+    const { dn } = req.params;
+    const source = sourceParam(req.query.source) ?? null;
+
+    try {
+        const owners = await db.query(
+            'SELECT source, owner_dn, owner_type, display_name FROM viz_owners WHERE object_dn = $1 AND ($2::text IS NULL OR source = $2) ORDER BY display_name ASC;',
+            [dn, source]
+        );
+        const approvers = await db.query(
+            'SELECT source, kind, approver_dn, approver_type, display_name FROM viz_approvers WHERE object_dn = $1 AND ($2::text IS NULL OR source = $2) ORDER BY kind, display_name ASC;',
+            [dn, source]
+        );
+        res.json({ data: { owners: owners.rows, approvers: approvers.rows } });
+    } catch (err) {
+        console.error('Fehler beim Abrufen der Eigentümer und Genehmiger:', err);
+        res.status(500).send('Fehler beim Abrufen der Eigentümer und Genehmiger.');
+    }
+});
+
 // Fallback-Route für das Frontend
 app.get('*', (req, res) => {
     res.sendFile(path.join(frontendDistPath, 'index.html'));
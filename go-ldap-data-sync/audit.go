@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Spalten des Audit-Exports, eine Zeile je Rolle und vergebener Ressource.
+// Rollen ohne Ressourcen erscheinen einmal mit leeren Ressourcenspalten.
+var auditHeader = []string{
+	"source", "role_dn", "role_name", "role_level", "role_categories", "parent_roles",
+	"resource_dn", "resource_name", "entitlement_driver", "entitlement_value",
+	"assignment", "inherited_from", "path",
+}
+
+// Werte der Spalte assignment.
+const (
+	auditDirect    = "direkt"
+	auditInherited = "geerbt"
+)
+
+// loadDatabaseModel liest das Rollenmodell einer Quelle aus den synchronisierten
+// Tabellen. Als gelöscht markierte Datensätze werden ausgelassen.
+func loadDatabaseModel(run *syncRun, db *sql.DB) (roleModel, error) {
+	var model roleModel
+	tables := map[string]map[string]dbRow{}
+	for _, table := range managedTables {
+		rows, err := loadDatabaseRows(run, db, syncTableNamed(table))
+		if err != nil {
+			return model, err
+		}
+		tables[table] = rows
+	}
+
+	parentDNs := map[string][]string{}
+	for key, row := range tables["viz_roles_parents"] {
+		if child, parent, ok := strings.Cut(key, " -> "); ok && !row.isDeleted {
+			parentDNs[child] = append(parentDNs[child], parent)
+		}
+	}
+	for _, dn := range sortedRowKeys(tables["viz_roles"]) {
+		v := tables["viz_roles"][dn].values
+		sort.Strings(parentDNs[dn])
+		model.Roles = append(model.Roles, roleRecord{
+			DN:              dn,
+			RoleLevel:       v["nrfrolelevel"],
+			LocalizedNames:  jsonStringMap(v["nrflocalizednames"]),
+			LocalizedDescrs: jsonStringMap(v["nrflocalizeddescrs"]),
+			CategoryKey:     v["nrfrolecategorykey"],
+			ParentDNs:       parentDNs[dn],
+			identity:        rowIdentity(v),
+		})
+	}
+	for _, dn := range sortedRowKeys(tables["viz_resources"]) {
+		v := tables["viz_resources"][dn].values
+		model.Resources = append(model.Resources, resourceRecord{
+			DN:                     dn,
+			LocalizedNames:         jsonStringMap(v["nrflocalizednames"]),
+			LocalizedDescrs:        jsonStringMap(v["nrflocalizeddescrs"]),
+			CategoryKey:            v["nrfcategorykey"],
+			AllowMulti:             v["nrfallowmulti"],
+			EntitlementDriver:      v["entitlement_driver"],
+			EntitlementStatus:      v["entitlement_status"],
+			EntitlementXML:         v["entitlement_xml"],
+			EntitlementXMLSrc:      v["entitlement_xml_src"],
+			EntitlementXMLID:       v["entitlement_xml_id"],
+			EntitlementXMLParamID:  v["entitlement_xml_param_id"],
+			EntitlementXMLParamID2: v["entitlement_xml_param_id2"],
+			EntitlementXMLParamID3: v["entitlement_xml_param_id3"],
+			identity:               rowIdentity(v),
+		})
+	}
+	for _, dn := range sortedRowKeys(tables["viz_roles_resources"]) {
+		v := tables["viz_roles_resources"][dn].values
+		model.Associations = append(model.Associations, associationRecord{
+			DN:                       dn,
+			Role:                     v["nrfrole"],
+			Resource:                 v["nrfresource"],
+			DynamicParmVals:          v["nrfdynamicparmvals"],
+			DynamicParmValsValueJSON: v["nrfdynamicparmvals_value_json"],
+			Status:                   v["nrfstatus"],
+			CreateTimestamp:          v["createtimestamp"],
+			ModifyTimestamp:          v["modifytimestamp"],
+			identity:                 rowIdentity(v),
+		})
+	}
+	return model, nil
+}
+
+// rowIdentity liest den DN in der gelesenen Form und die GUID eines Datensatzes.
+func rowIdentity(values map[string]string) identity {
+	return identity{OriginalDN: values["original_dn"], GUID: values["guid"]}
+}
+
+// sortedRowKeys liefert die Schlüssel der nicht gelöschten Datensätze sortiert.
+func sortedRowKeys(rows map[string]dbRow) []string {
+	keys := make([]string, 0, len(rows))
+	for key, row := range rows {
+		if !row.isDeleted {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonStringMap liest eine JSONB-Spalte mit lokalisierten Werten.
+func jsonStringMap(value string) map[string]string {
+	result := map[string]string{}
+	if value != "" {
+		json.Unmarshal([]byte(value), &result)
+	}
+	return result
+}
+
+// entitlementValue ist der Wert der Berechtigung im Zielsystem, z.B. der DN
+// einer Gruppe. Ist im Param-Feld keine ID gesetzt, gilt die ID der Referenz.
+func (r resourceRecord) entitlementValue() string {
+	if r.EntitlementXMLParamID != "" {
+		return r.EntitlementXMLParamID
+	}
+	return r.EntitlementXMLID
+}
+
+// auditRows bildet das Rollenmodell auf die Zeilen des Audit-Exports ab.
+// Lokalisierte Namen folgen der Sprach-Fallback-Kette languages.
+func auditRows(source string, m roleModel, languages []string) [][]string {
+	roles := map[string]roleRecord{}
+	for _, role := range m.Roles {
+		roles[graphKey(role.DN)] = role
+	}
+	resources := map[string]resourceRecord{}
+	for _, res := range m.Resources {
+		resources[graphKey(res.DN)] = res
+	}
+	roleDN := func(dn string) string {
+		if role, ok := roles[graphKey(dn)]; ok {
+			return role.displayDN(role.DN)
+		}
+		return dn
+	}
+	roleName := func(dn string) string {
+		if role, ok := roles[graphKey(dn)]; ok {
+			return localizedLabel(role.LocalizedNames, languages, role.displayDN(role.DN))
+		}
+		return localizedLabel(nil, languages, dn)
+	}
+	grants := map[string][]effectiveGrant{}
+	resolved, _ := resolveEffectiveResources(m)
+	for _, g := range resolved {
+		grants[graphKey(g.RoleDN)] = append(grants[graphKey(g.RoleDN)], g)
+	}
+
+	var rows [][]string
+	for _, role := range m.Roles {
+		var parents []string
+		for _, parentDN := range role.ParentDNs {
+			parents = append(parents, roleName(parentDN))
+		}
+		roleColumns := []string{
+			source, role.displayDN(role.DN), roleName(role.DN), role.RoleLevel,
+			strings.ReplaceAll(role.CategoryKey, "|", ", "), strings.Join(parents, "; "),
+		}
+		if len(grants[graphKey(role.DN)]) == 0 {
+			rows = append(rows, append(roleColumns, make([]string, len(auditHeader)-len(roleColumns))...))
+			continue
+		}
+		for _, g := range grants[graphKey(role.DN)] {
+			res := resources[graphKey(g.ResourceDN)]
+			assignment, inheritedFrom := auditDirect, ""
+			if g.inherited() {
+				assignment, inheritedFrom = auditInherited, roleDN(g.inheritedFrom())
+			}
+			var path []string
+			for _, dn := range g.Path {
+				path = append(path, roleName(dn))
+			}
+			rows = append(rows, append(append([]string{}, roleColumns...),
+				res.displayDN(g.ResourceDN), localizedLabel(res.LocalizedNames, languages, res.displayDN(g.ResourceDN)), res.EntitlementDriver, res.entitlementValue(),
+				assignment, inheritedFrom, strings.Join(path, " > "),
+			))
+		}
+	}
+	return rows
+}
+
+// writeAuditCSV schreibt die Zeilen als CSV. Mit bom wird eine UTF-8-BOM
+// vorangestellt, damit Excel Umlaute richtig erkennt.
+func writeAuditCSV(w io.Writer, delimiter rune, bom bool, rows [][]string) error {
+	if bom {
+		if _, err := io.WriteString(w, "\ufeff"); err != nil {
+			return err
+		}
+	}
+	cw := csv.NewWriter(w)
+	cw.Comma = delimiter
+	cw.Write(auditHeader)
+	cw.WriteAll(rows)
+	return cw.Error()
+}
+
+// loadAuditModel liest das Rollenmodell für den Audit-Export. Die Quelle db
+// bzw. db:<quelle> liest aus den synchronisierten Tabellen, alle anderen
+// Angaben wie bei `snapshot` aus LDAP, LDIF oder einem Snapshot.
+func loadAuditModel(run *syncRun, cfg config, spec, user, password, driverDN string) (string, roleModel, error) {
+	if spec != "db" && !strings.HasPrefix(spec, "db:") {
+		model, err := loadModel(run, cfg, spec, user, password, driverDN)
+		return spec, model, err
+	}
+	run.source = defaultSourceName
+	if name := strings.TrimPrefix(spec, "db:"); name != spec {
+		run.source = name
+	}
+	run.tables = cfg.Target.names()
+	db, err := openDatabase(cfg, true)
+	if err != nil {
+		return run.source, roleModel{}, err
+	}
+	defer db.Close()
+	model, err := loadDatabaseModel(run, db)
+	if err != nil {
+		return run.source, model, err
+	}
+	run.log.Info("Rollenmodell aus der Datenbank gelesen", "source", run.source, "roles", len(model.Roles), "resources", len(model.Resources), "associations", len(model.Associations))
+	return run.source, model, nil
+}
+
+// runExportAuditCommand implementiert `export audit`, eine flache Liste aller
+// Rollen mit den Ressourcen, die sie direkt oder über die Hierarchie vergeben.
+func runExportAuditCommand(args []string) int {
+	fs := flag.NewFlagSet("export audit", flag.ExitOnError)
+	source := fs.String("source", "env", "Quelle (db, db:<quelle>, env, source:<name>, ldap://…, ldaps://…, ldif:<datei>, snapshot:<datei>)")
+	user := fs.String("user", "", "Bind-DN für eine LDAP-Quelle (Passwort aus EXPORT_PASSWORD)")
+	driver := fs.String("driver", "", "DN des User-Application-Treibers (Standard: "+defaultDriverDN+")")
+	format := fs.String("format", "csv", "Ausgabeformat: csv oder xlsx")
+	lang := fs.String("lang", "", "Sprache der lokalisierten Namen vor LANGUAGE_FALLBACK")
+	delimiter := fs.String("delimiter", ";", "Trennzeichen der CSV-Ausgabe")
+	bom := fs.Bool("bom", true, "CSV mit UTF-8-BOM beginnen (für Excel)")
+	out := fs.String("out", "", "Zieldatei (bei xlsx erforderlich); Standard: Standardausgabe")
+	fs.Parse(args)
+
+	if (*format != "csv" && *format != "xlsx") || (*format == "xlsx" && *out == "") || utf8.RuneCountInString(*delimiter) != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := initConfig()
+	var password string
+	if err == nil {
+		password, err = readSecret("EXPORT_PASSWORD")
+	}
+	if err != nil {
+		slog.Error("Konfiguration konnte nicht geladen werden", keyError, err)
+		return 1
+	}
+	run := newSyncRun("export")
+	run.languages = languageChain(*lang, cfg.Languages)
+
+	name, model, err := loadAuditModel(run, cfg, *source, *user, password, *driver)
+	if err != nil {
+		run.finish(err)
+		return 1
+	}
+	rows := auditRows(name, model, run.languages)
+
+	var file *os.File
+	if *out != "" {
+		if file, err = os.Create(*out); err != nil {
+			run.finish(fmt.Errorf("Fehler beim Erstellen der Ausgabedatei: %w", err))
+			return 1
+		}
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if file != nil {
+		w = bufio.NewWriter(file)
+	}
+	if *format == "xlsx" {
+		err = writeXLSX(w, "Audit", auditHeader, rows)
+	} else {
+		err = writeAuditCSV(w, []rune(*delimiter)[0], *bom, rows)
+	}
+	err = errors.Join(err, w.Flush())
+	if file != nil {
+		err = errors.Join(err, file.Close())
+	}
+	if err != nil {
+		run.finish(fmt.Errorf("Fehler beim Schreiben des Audit-Exports: %w", err))
+		return 1
+	}
+	run.log.Info("Audit-Export geschrieben", "format", *format, "file", *out, "rows", len(rows))
+	run.finish(nil)
+	return 0
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// columnKind bestimmt, wie der Trockenlauf eine Spalte aus der Datenbank liest
+// und mit dem Soll-Wert vergleicht.
+type columnKind int
+
+const (
+	columnText columnKind = iota
+	columnJSON
+	columnInt
+	columnBool
+	columnTime
+)
+
+// tableColumn ist eine fachliche Spalte einer Tabelle. Schlüsselspalten
+// bilden zusammen mit source den Primärschlüssel.
+type tableColumn struct {
+	name string
+	kind columnKind
+	key  bool
+}
+
+// recordColumn ist eine Spalte mit dem Wert, den die Sinks aus einem
+// Datensatz schreiben.
+type recordColumn[T any] struct {
+	tableColumn
+	value func(T) any
+}
+
+// column und keyColumn beschreiben eine Spalte bzw. eine Schlüsselspalte.
+func column[T any](name string, kind columnKind, value func(T) any) recordColumn[T] {
+	return recordColumn[T]{tableColumn{name: name, kind: kind}, value}
+}
+
+func keyColumn[T any](name string, kind columnKind, value func(T) any) recordColumn[T] {
+	return recordColumn[T]{tableColumn{name: name, kind: kind, key: true}, value}
+}
+
+// Die Spalten je Tabelle, wie sie die Sinks postgres und sqlite schreiben.
+// source und die Verwaltungsspalten (created_at, updated_at, is_deleted)
+// setzen die Sinks selbst. Der Trockenlauf vergleicht genau diese Spalten;
+// eine neue Spalte in den Sinks muss daher auch hier eingetragen werden.
+var (
+	roleColumns = slices.Concat([]recordColumn[roleRecord]{
+		keyColumn("dn", columnText, func(r roleRecord) any { return r.DN }),
+		column("nrfrolelevel", columnText, func(r roleRecord) any { return r.RoleLevel }),
+		column("nrflocalizednames", columnJSON, func(r roleRecord) any { return string(mustJSON(r.LocalizedNames)) }),
+		column("nrflocalizeddescrs", columnJSON, func(r roleRecord) any { return string(mustJSON(r.LocalizedDescrs)) }),
+		column("nrfrolecategorykey", columnText, func(r roleRecord) any { return r.CategoryKey }),
+		column("display_name", columnText, func(r roleRecord) any { return r.DisplayName }),
+		column("role_level", columnInt, func(r roleRecord) any { return nullInt(r.Level) }),
+		column("role_level_key", columnText, func(r roleRecord) any { return nullString(string(r.LevelKey)) }),
+		column("role_level_name", columnText, func(r roleRecord) any { return nullString(r.LevelName) }),
+	},
+		governanceColumns(func(r roleRecord) governance { return r.governance }),
+		identityColumns(func(r roleRecord) identity { return r.identity }),
+	)
+
+	parentColumns = []recordColumn[parentLink]{
+		keyColumn("child_dn", columnText, func(l parentLink) any { return l.ChildDN }),
+		keyColumn("parent_dn", columnText, func(l parentLink) any { return l.ParentDN }),
+	}
+
+	resourceColumns = slices.Concat([]recordColumn[resourceRecord]{
+		keyColumn("dn", columnText, func(r resourceRecord) any { return r.DN }),
+		column("nrflocalizednames", columnJSON, func(r resourceRecord) any { return string(mustJSON(r.LocalizedNames)) }),
+		column("nrflocalizeddescrs", columnJSON, func(r resourceRecord) any { return string(mustJSON(r.LocalizedDescrs)) }),
+		column("nrfcategorykey", columnText, func(r resourceRecord) any { return r.CategoryKey }),
+		column("nrfallowmulti", columnText, func(r resourceRecord) any { return r.AllowMulti }),
+		column("entitlement_driver", columnText, func(r resourceRecord) any { return r.EntitlementDriver }),
+		column("entitlement_status", columnText, func(r resourceRecord) any { return r.EntitlementStatus }),
+		column("entitlement_xml", columnText, func(r resourceRecord) any { return r.EntitlementXML }),
+		column("entitlement_xml_src", columnText, func(r resourceRecord) any { return r.EntitlementXMLSrc }),
+		column("entitlement_xml_id", columnText, func(r resourceRecord) any { return r.EntitlementXMLID }),
+		column("entitlement_xml_param_id", columnText, func(r resourceRecord) any { return r.EntitlementXMLParamID }),
+		column("entitlement_xml_param_id2", columnText, func(r resourceRecord) any { return r.EntitlementXMLParamID2 }),
+		column("entitlement_xml_param_id3", columnText, func(r resourceRecord) any { return r.EntitlementXMLParamID3 }),
+		column("display_name", columnText, func(r resourceRecord) any { return r.DisplayName }),
+		column("allow_multi", columnBool, func(r resourceRecord) any { return nullBool(r.AllowMultiFlag) }),
+	},
+		governanceColumns(func(r resourceRecord) governance { return r.governance }),
+		identityColumns(func(r resourceRecord) identity { return r.identity }),
+	)
+
+	// status_changed_at hängt vom bisherigen Status ab und wird von den Sinks
+	// beim Schreiben bestimmt.
+	associationColumns = slices.Concat([]recordColumn[associationRecord]{
+		keyColumn("dn", columnText, func(r associationRecord) any { return r.DN }),
+		column("nrfrole", columnText, func(r associationRecord) any { return r.Role }),
+		column("nrfresource", columnText, func(r associationRecord) any { return r.Resource }),
+		column("nrfdynamicparmvals", columnText, func(r associationRecord) any { return r.DynamicParmVals }),
+		column("nrfdynamicparmvals_value_json", columnText, func(r associationRecord) any { return r.DynamicParmValsValueJSON }),
+		column("nrfdynamicparmvals_parameters", columnJSON, func(r associationRecord) any { return r.parametersJSON() }),
+		column("nrfstatus", columnText, func(r associationRecord) any { return r.Status }),
+		column("createtimestamp", columnText, func(r associationRecord) any { return r.CreateTimestamp }),
+		column("modifytimestamp", columnText, func(r associationRecord) any { return r.ModifyTimestamp }),
+		column("status_code", columnInt, func(r associationRecord) any { return nullInt(r.StatusCode) }),
+		column("status_key", columnText, func(r associationRecord) any { return nullString(string(r.StatusKey)) }),
+		column("status_name", columnText, func(r associationRecord) any { return nullString(r.StatusName) }),
+		column("ldap_created_at", columnTime, func(r associationRecord) any { return nullTime(r.LDAPCreatedAt) }),
+		column("ldap_modified_at", columnTime, func(r associationRecord) any { return nullTime(r.LDAPModifiedAt) }),
+		column("approval", columnJSON, func(r associationRecord) any { return r.approvalJSON() }),
+		column("approval_required", columnBool, func(r associationRecord) any { return nullBool(r.ApprovalRequired) }),
+	},
+		identityColumns(func(r associationRecord) identity { return r.identity }),
+	)
+
+	parameterColumns = []recordColumn[associationParameter]{
+		keyColumn("association_dn", columnText, func(p associationParameter) any { return p.AssociationDN }),
+		keyColumn("position", columnInt, func(p associationParameter) any { return p.Position }),
+		column("name", columnText, func(p associationParameter) any { return p.Name }),
+		column("type", columnText, func(p associationParameter) any { return p.Type }),
+		column("value", columnText, func(p associationParameter) any { return p.Value }),
+		column("value_json", columnJSON, func(p associationParameter) any { return nullJSON(p.ValueJSON) }),
+	}
+
+	effectiveColumns = []recordColumn[effectiveGrant]{
+		keyColumn("role_dn", columnText, func(g effectiveGrant) any { return g.RoleDN }),
+		keyColumn("resource_dn", columnText, func(g effectiveGrant) any { return g.ResourceDN }),
+		column("association_dn", columnText, func(g effectiveGrant) any { return g.AssociationDN }),
+		column("inherited_from", columnText, func(g effectiveGrant) any { return g.inheritedFrom() }),
+		column("path", columnJSON, func(g effectiveGrant) any { return string(mustJSON(g.Path)) }),
+		column("depth", columnInt, func(g effectiveGrant) any { return len(g.Path) - 1 }),
+	}
+
+	ownerColumns = []recordColumn[principalLink]{
+		keyColumn("object_dn", columnText, func(l principalLink) any { return l.ObjectDN }),
+		column("object_type", columnText, func(l principalLink) any { return l.ObjectType }),
+		keyColumn("owner_dn", columnText, func(l principalLink) any { return l.PrincipalDN }),
+		column("owner_type", columnText, func(l principalLink) any { return l.PrincipalType }),
+		column("display_name", columnText, func(l principalLink) any { return l.DisplayName }),
+	}
+
+	approverColumns = []recordColumn[principalLink]{
+		keyColumn("object_dn", columnText, func(l principalLink) any { return l.ObjectDN }),
+		column("object_type", columnText, func(l principalLink) any { return l.ObjectType }),
+		keyColumn("kind", columnText, func(l principalLink) any { return l.Kind }),
+		keyColumn("approver_dn", columnText, func(l principalLink) any { return l.PrincipalDN }),
+		column("approver_type", columnText, func(l principalLink) any { return l.PrincipalType }),
+		column("display_name", columnText, func(l principalLink) any { return l.DisplayName }),
+	}
+)
+
+// governanceColumns liefert die Genehmigungseinstellungen von Rollen und Ressourcen.
+func governanceColumns[T any](g func(T) governance) []recordColumn[T] {
+	return []recordColumn[T]{
+		column("approval_required", columnBool, func(r T) any { return nullBool(g(r).ApprovalRequired) }),
+		column("approval_definition", columnText, func(r T) any { return nullString(g(r).ApprovalDefinition) }),
+		column("revoke_required", columnBool, func(r T) any { return nullBool(g(r).RevokeRequired) }),
+		column("revoke_definition", columnText, func(r T) any { return nullString(g(r).RevokeDefinition) }),
+	}
+}
+
+// identityColumns liefert den gelesenen DN und die GUID eines Datensatzes.
+func identityColumns[T any](id func(T) identity) []recordColumn[T] {
+	return []recordColumn[T]{
+		column("original_dn", columnText, func(r T) any { return nullString(id(r).OriginalDN) }),
+		column("guid", columnText, func(r T) any { return nullString(id(r).GUID) }),
+	}
+}
+
+// associationParameter ist ein Parameter einer Assoziation mit seiner
+// Position (viz_association_parameters).
+type associationParameter struct {
+	AssociationDN string
+	Position      int
+	dynamicParameter
+}
+
+// parameterRows liefert die Parameter der Assoziation in ihrer Reihenfolge.
+func (r associationRecord) parameterRows() []associationParameter {
+	rows := make([]associationParameter, len(r.DynamicParameters))
+	for i, param := range r.DynamicParameters {
+		rows[i] = associationParameter{AssociationDN: r.DN, Position: i, dynamicParameter: param}
+	}
+	return rows
+}
+
+// columnDefs liefert die Spalten ohne ihre Werte.
+func columnDefs[T any](columns []recordColumn[T]) []tableColumn {
+	defs := make([]tableColumn, len(columns))
+	for i, c := range columns {
+		defs[i] = c.tableColumn
+	}
+	return defs
+}
+
+// columnString bringt einen Spaltenwert in die Form, in der der Trockenlauf
+// Soll- und Ist-Zustand vergleicht. JSON wird neu serialisiert, da PostgreSQL
+// Schlüssel anders sortiert und formatiert als encoding/json, Zeitpunkte
+// werden in UTC verglichen. NULL und leerer Text sind gleich.
+func columnString(kind columnKind, value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case time.Time:
+		if v.IsZero() {
+			return ""
+		}
+		return v.UTC().Format(time.RFC3339Nano)
+	case string:
+		switch kind {
+		case columnJSON:
+			var decoded any
+			if v != "" && json.Unmarshal([]byte(v), &decoded) == nil {
+				return string(mustJSON(decoded))
+			}
+		case columnTime:
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				return columnString(kind, t)
+			}
+		}
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// rowKey bildet den Schlüssel eines Datensatzes aus den Schlüsselspalten,
+// DNs in kanonischer Form, damit Trockenlauf und Audit auch mit noch nicht
+// umgestellten Tabellen die Datensätze aus LDAP wiederfinden. Mehrteilige
+// Schlüssel werden mit " -> " verbunden.
+func rowKey(columns []tableColumn, values map[string]string) string {
+	var parts []string
+	for _, c := range columns {
+		if !c.key {
+			continue
+		}
+		if c.kind == columnText {
+			parts = append(parts, graphKey(values[c.name]))
+		} else {
+			parts = append(parts, values[c.name])
+		}
+	}
+	return strings.Join(parts, " -> ")
+}
+
+// columnStrings liefert Schlüssel und Spaltenwerte eines Datensatzes für den
+// Trockenlauf.
+func columnStrings[T any](columns []recordColumn[T], rec T) (string, map[string]string) {
+	values := make(map[string]string, len(columns))
+	for _, c := range columns {
+		values[c.name] = columnString(c.kind, c.value(rec))
+	}
+	return rowKey(columnDefs(columns), values), values
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Schlüssel der Konfigurationsdatei und die Umgebungsvariablen, auf die sie
+// abgebildet werden. Umgebungsvariablen haben immer Vorrang vor der Datei.
+var configFileKeys = map[string]string{
+	"ldap.host":                          "LDAP_HOST",
+	"ldap.port":                          "LDAP_PORT",
+	"ldap.username":                      "LDAP_USERNAME",
+	"ldap.password":                      "LDAP_PASSWORD",
+	"ldap.password_file":                 "LDAP_PASSWORD_FILE",
+	"ldap.timeout_seconds":               "LDAP_TIMEOUT_SECONDS",
+	"ldap.driver_dn":                     "LDAP_DRIVER_DN",
+	"ldap.roles_base":                    "LDAP_ROLES_BASE",
+	"ldap.resources_base":                "LDAP_RESOURCES_BASE",
+	"ldap.associations_base":             "LDAP_ASSOCIATIONS_BASE",
+	"database.host":                      "DB_HOST",
+	"database.port":                      "DB_PORT",
+	"database.user":                      "DBUSER",
+	"database.password":                  "DB_PASSWORD",
+	"database.password_file":             "DB_PASSWORD_FILE",
+	"database.name":                      "DB_DATABASE",
+	"database.url":                       "DATABASE_URL",
+	"database.url_file":                  "DATABASE_URL_FILE",
+	"database.sslmode":                   "DB_SSLMODE",
+	"database.sslrootcert":               "DB_SSLROOTCERT",
+	"database.sslcert":                   "DB_SSLCERT",
+	"database.sslkey":                    "DB_SSLKEY",
+	"database.application_name":          "DB_APPLICATION_NAME",
+	"database.statement_timeout_seconds": "DB_STATEMENT_TIMEOUT_SECONDS",
+	"database.search_path":               "DB_SEARCH_PATH",
+	"database.max_open_conns":            "DB_MAX_OPEN_CONNS",
+	"database.max_idle_conns":            "DB_MAX_IDLE_CONNS",
+	"database.conn_max_lifetime_seconds": "DB_CONN_MAX_LIFETIME_SECONDS",
+	"database.schema":                    "DB_SCHEMA",
+	"database.table_prefix":              "DB_TABLE_PREFIX",
+	"database.blue_green":                "DB_BLUE_GREEN",
+	"database.shadow_schema":             "DB_SHADOW_SCHEMA",
+	"database.blue_green_grant_roles":    "DB_BLUE_GREEN_GRANT_ROLES",
+	"output.sinks":                       "SINKS",
+	"localization.fallback":              "LANGUAGE_FALLBACK",
+	"dry_run.enabled":                    "DRY_RUN",
+	"dry_run.output":                     "DRY_RUN_OUTPUT",
+	"dry_run.detail_limit":               "DRY_RUN_DETAIL_LIMIT",
+	"logging.format":                     "LOG_FORMAT",
+	"logging.level":                      "LOG_LEVEL",
+	"metrics.textfile":                   "METRICS_TEXTFILE",
+	"metrics.pushgateway_url":            "METRICS_PUSHGATEWAY_URL",
+	"metrics.job":                        "METRICS_JOB",
+	"safety.max_drop_abs":                "SAFETY_MAX_DROP_ABS",
+	"safety.max_drop_percent":            "SAFETY_MAX_DROP_PERCENT",
+	"retention.days":                     "PURGE_AGE_IN_DAYS",
+	"retention.archive":                  "PURGE_ARCHIVE",
+	"retention.archive_dir":              "PURGE_ARCHIVE_DIR",
+	"watch.mode":                         "WATCH_MODE",
+	"watch.poll_interval_seconds":        "WATCH_POLL_INTERVAL_SECONDS",
+	"watch.reconcile_interval_minutes":   "WATCH_RECONCILE_INTERVAL_MINUTES",
+	"watch.batch_seconds":                "WATCH_BATCH_SECONDS",
+	"serve.addr":                         "SERVE_ADDR",
+	"serve.schedule":                     "SERVE_SCHEDULE",
+	"serve.token":                        "SERVE_TOKEN",
+	"serve.token_file":                   "SERVE_TOKEN_FILE",
+	"serve.history":                      "SERVE_HISTORY",
+	"lock.mode":                          "SYNC_LOCK_MODE",
+	"lock.timeout_seconds":               "SYNC_LOCK_TIMEOUT_SECONDS",
+}
+
+// Felder eines Quellprofils in der Konfigurationsdatei (Liste sources) und die
+// Endungen der zugehörigen Umgebungsvariablen LDAP_<NAME>_<ENDUNG>.
+var configSourceFields = map[string]string{
+	"host":              "HOST",
+	"port":              "PORT",
+	"username":          "USERNAME",
+	"password":          "PASSWORD",
+	"password_file":     "PASSWORD_FILE",
+	"driver_dn":         "DRIVER_DN",
+	"roles_base":        "ROLES_BASE",
+	"resources_base":    "RESOURCES_BASE",
+	"associations_base": "ASSOCIATIONS_BASE",
+}
+
+// effectiveSetting ist eine Einstellung mit ihrem wirksamen Wert und Herkunft.
+type effectiveSetting struct {
+	Name   string
+	Value  string
+	Origin string
+	Secret bool
+}
+
+// configSource liefert Einstellungen aus der Umgebung und der optionalen
+// Konfigurationsdatei. Ungültige Werte werden gesammelt statt sofort gemeldet,
+// damit `config check` alle Probleme auf einmal ausgeben kann.
+type configSource struct {
+	file     map[string]string
+	fileName string
+	problems []error
+	settings []effectiveSetting
+	seen     map[string]bool
+}
+
+// newConfigSource liest die Konfigurationsdatei, falls path gesetzt ist.
+func newConfigSource(path string) *configSource {
+	src := &configSource{file: make(map[string]string), fileName: path, seen: make(map[string]bool)}
+	if path == "" {
+		return src
+	}
+	values, err := readConfigFile(path)
+	if err != nil {
+		src.problem(err)
+		return src
+	}
+	if err := src.mapFileValues(values); err != nil {
+		src.problem(err)
+	}
+	return src
+}
+
+// problem hält ein Konfigurationsproblem fest.
+func (s *configSource) problem(err error) {
+	s.problems = append(s.problems, err)
+}
+
+// err fasst alle Konfigurationsprobleme zusammen.
+func (s *configSource) err() error {
+	if len(s.problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("Ungültige Konfiguration: %w", errors.Join(s.problems...))
+}
+
+// lookup liefert den Wert einer Einstellung und ihre Herkunft.
+func (s *configSource) lookup(name string) (value, origin string) {
+	if v := os.Getenv(name); v != "" {
+		return v, "env"
+	}
+	if v, ok := s.file[name]; ok && v != "" {
+		return v, "file"
+	}
+	return "", ""
+}
+
+// record merkt sich den wirksamen Wert einer Einstellung für `config check`.
+func (s *configSource) record(name, value, origin string, secret bool) {
+	if s.seen[name] {
+		return
+	}
+	s.seen[name] = true
+	if origin == "" {
+		origin = "default"
+	}
+	s.settings = append(s.settings, effectiveSetting{Name: name, Value: value, Origin: origin, Secret: secret})
+}
+
+// str liefert eine Zeichenkette oder den Standardwert.
+func (s *configSource) str(name, fallback string) string {
+	value, origin := s.lookup(name)
+	if origin == "" {
+		value = fallback
+	}
+	s.record(name, value, origin, false)
+	return value
+}
+
+// secret liefert ein Geheimnis. Ist name nicht gesetzt, wird es aus der in
+// name_FILE angegebenen Datei gelesen (z.B. ein gemountetes Kubernetes-Secret).
+func (s *configSource) secret(name string) string {
+	value, origin := s.lookup(name)
+	if origin == "" {
+		if path, fileOrigin := s.lookup(name + "_FILE"); fileOrigin != "" {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				s.problem(fmt.Errorf("%s_FILE: %w", name, err))
+			} else {
+				value, origin = strings.TrimRight(string(data), "\r\n"), fileOrigin+" ("+name+"_FILE)"
+			}
+		}
+	}
+	s.record(name, value, origin, true)
+	return value
+}
+
+// int liefert eine nicht-negative Ganzzahl. Ungültige Werte sind ein Problem.
+func (s *configSource) int(name string, fallback int) int {
+	value, origin := s.lookup(name)
+	if origin == "" {
+		s.record(name, strconv.Itoa(fallback), origin, false)
+		return fallback
+	}
+	s.record(name, value, origin, false)
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || n < 0 {
+		s.problem(fmt.Errorf("%s: %q ist keine nicht-negative Ganzzahl", name, value))
+		return fallback
+	}
+	return n
+}
+
+// float liefert eine nicht-negative Zahl. Ungültige Werte sind ein Problem.
+func (s *configSource) float(name string, fallback float64) float64 {
+	value, origin := s.lookup(name)
+	if origin == "" {
+		s.record(name, strconv.FormatFloat(fallback, 'g', -1, 64), origin, false)
+		return fallback
+	}
+	s.record(name, value, origin, false)
+	f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || f < 0 {
+		s.problem(fmt.Errorf("%s: %q ist keine nicht-negative Zahl", name, value))
+		return fallback
+	}
+	return f
+}
+
+// bool liefert einen Wahrheitswert (true/false, 1/0). Ungültige Werte sind ein Problem.
+func (s *configSource) bool(name string, fallback bool) bool {
+	value, origin := s.lookup(name)
+	if origin == "" {
+		s.record(name, strconv.FormatBool(fallback), origin, false)
+		return fallback
+	}
+	s.record(name, value, origin, false)
+	b, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		s.problem(fmt.Errorf("%s: %q ist kein Wahrheitswert (true/false)", name, value))
+		return fallback
+	}
+	return b
+}
+
+// oneOf liefert einen Wert aus einer festen Auswahl (ohne Beachtung der
+// Groß-/Kleinschreibung). Andere Werte sind ein Problem.
+func (s *configSource) oneOf(name, fallback string, allowed ...string) string {
+	value := strings.ToLower(s.str(name, fallback))
+	for _, a := range allowed {
+		if value == a {
+			return value
+		}
+	}
+	s.problem(fmt.Errorf("%s: %q ist ungültig (erlaubt: %s)", name, value, strings.Join(allowed, ", ")))
+	return fallback
+}
+
+// readSecret liest ein Geheimnis aus der Umgebungsvariablen name oder aus der
+// Datei in name_FILE. Gedacht für kommandospezifische Passwörter.
+func readSecret(name string) (string, error) {
+	if v := os.Getenv(name); v != "" {
+		return v, nil
+	}
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("%s_FILE: %w", name, err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// readConfigFile liest eine YAML- oder TOML-Datei (nach Dateiendung) als
+// verschachtelte Map.
+func readConfigFile(path string) (map[string]any, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Konfigurationsdatei: %w", err)
+	}
+	values := make(map[string]any)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return nil, fmt.Errorf("Konfigurationsdatei %s: unbekanntes Format (erlaubt: .yaml, .yml, .toml)", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Konfigurationsdatei %s: %w", path, err)
+	}
+	return values, nil
+}
+
+// mapFileValues bildet die Schlüssel der Datei auf Umgebungsvariablen ab.
+// Unbekannte Schlüssel werden als Problem gemeldet, damit Tippfehler auffallen.
+func (s *configSource) mapFileValues(values map[string]any) error {
+	var errs []error
+	for key, value := range values {
+		if key == "sources" {
+			errs = append(errs, s.mapFileSources(value))
+			continue
+		}
+		flat := make(map[string]string)
+		flattenConfig(key, value, flat)
+		for path, v := range flat {
+			if name, ok := configFileKeys[path]; ok {
+				s.file[name] = v
+			} else if name, ok := tableConfigKey(path); ok {
+				s.file[name] = v
+			} else {
+				errs = append(errs, fmt.Errorf("Konfigurationsdatei: unbekannter Schlüssel %q", path))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// tableConfigKey bildet tabellenspezifische Schlüssel ab, z.B.
+// safety.tables.roles.max_drop_percent auf SAFETY_MAX_DROP_PERCENT_ROLES oder
+// retention.tables.associations.days auf PURGE_AGE_IN_DAYS_ASSOCIATIONS.
+func tableConfigKey(path string) (string, bool) {
+	parts := strings.Split(path, ".")
+	if len(parts) != 4 || parts[1] != "tables" {
+		return "", false
+	}
+	suffix := strings.ToUpper(parts[2])
+	known := false
+	for _, s := range tableEnvSuffix {
+		known = known || s == suffix
+	}
+	if !known {
+		return "", false
+	}
+	switch parts[0] + "." + parts[3] {
+	case "safety.max_drop_abs":
+		return "SAFETY_MAX_DROP_ABS_" + suffix, true
+	case "safety.max_drop_percent":
+		return "SAFETY_MAX_DROP_PERCENT_" + suffix, true
+	case "retention.days":
+		return "PURGE_AGE_IN_DAYS_" + suffix, true
+	}
+	return "", false
+}
+
+// mapFileSources bildet die Liste sources auf LDAP_SOURCES und die
+// Umgebungsvariablen der einzelnen Profile ab.
+func (s *configSource) mapFileSources(value any) error {
+	list, ok := value.([]any)
+	if !ok {
+		if tables, isTables := value.([]map[string]any); isTables {
+			for _, t := range tables {
+				list = append(list, t)
+			}
+		} else {
+			return errors.New("Konfigurationsdatei: sources muss eine Liste sein")
+		}
+	}
+	var errs []error
+	var names []string
+	for i, item := range list {
+		fields, ok := item.(map[string]any)
+		if !ok {
+			errs = append(errs, fmt.Errorf("Konfigurationsdatei: sources[%d] muss ein Objekt sein", i))
+			continue
+		}
+		name := strings.ToLower(strings.TrimSpace(fmt.Sprint(fields["name"])))
+		if fields["name"] == nil || name == "" {
+			errs = append(errs, fmt.Errorf("Konfigurationsdatei: sources[%d] hat keinen Namen", i))
+			continue
+		}
+		names = append(names, name)
+		prefix := sourceEnvPrefix(name)
+		for field, v := range fields {
+			if field == "name" {
+				continue
+			}
+			suffix, ok := configSourceFields[field]
+			if !ok {
+				errs = append(errs, fmt.Errorf("Konfigurationsdatei: unbekannter Schlüssel sources[%d].%s", i, field))
+				continue
+			}
+			s.file[prefix+suffix] = fmt.Sprint(v)
+		}
+	}
+	s.file["LDAP_SOURCES"] = strings.Join(names, ",")
+	return errors.Join(errs...)
+}
+
+// flattenConfig wandelt verschachtelte Maps in Schlüssel der Form a.b.c um.
+func flattenConfig(prefix string, value any, out map[string]string) {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, child := range v {
+			flattenConfig(prefix+"."+key, child, out)
+		}
+	case nil:
+	default:
+		out[prefix] = fmt.Sprint(v)
+	}
+}
+
+// validate prüft Einstellungen, die erst beim Verbindungsaufbau auffallen
+// würden. Genutzt von `config check`, damit alle Probleme vorab sichtbar sind.
+func (cfg config) validate() []error {
+	var errs []error
+	for _, p := range cfg.Sources {
+		if err := p.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("Quelle %s: %w", p.Name, err))
+		}
+	}
+	if cfg.hasSink(sinkPostgres) && (!cfg.DryRun || cfg.Database.configured()) {
+		if err := cfg.Database.validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if cfg.MetricsPushURL != "" {
+		if u, err := url.Parse(cfg.MetricsPushURL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("METRICS_PUSHGATEWAY_URL: %q ist keine gültige URL", cfg.MetricsPushURL))
+		}
+	}
+	if cfg.Retention.Archive == archiveFile {
+		if info, err := os.Stat(cfg.Retention.ArchiveDir); err != nil || !info.IsDir() {
+			errs = append(errs, fmt.Errorf("PURGE_ARCHIVE_DIR: %q ist kein Verzeichnis", cfg.Retention.ArchiveDir))
+		}
+	}
+	return errs
+}
+
+// printEffectiveConfig gibt alle wirksamen Einstellungen mit ihrer Herkunft
+// aus. Geheimnisse werden nicht ausgegeben, nur ob sie gesetzt sind.
+func printEffectiveConfig(w io.Writer, settings []effectiveSetting) {
+	sorted := append([]effectiveSetting(nil), settings...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+	for _, s := range sorted {
+		value := s.Value
+		if s.Secret && value != "" {
+			value = "***"
+		}
+		fmt.Fprintf(w, "%s=%s  # %s\n", s.Name, value, s.Origin)
+	}
+}
+
+// runConfigCommand implementiert das Kommando `config check`. Es meldet alle
+// Konfigurationsprobleme auf einmal und gibt die wirksame Konfiguration aus.
+func runConfigCommand(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "Verwendung: config check [--file <datei>]")
+		return 2
+	}
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	file := fs.String("file", os.Getenv("CONFIG_FILE"), "Konfigurationsdatei (YAML oder TOML, Standard: CONFIG_FILE)")
+	fs.Parse(args[1:])
+
+	cfg, src := loadConfig(*file)
+	problems := append(src.problems, cfg.validate()...)
+
+	if *file != "" {
+		fmt.Printf("# Konfigurationsdatei: %s\n", *file)
+	}
+	printEffectiveConfig(os.Stdout, src.settings)
+	if len(problems) == 0 {
+		fmt.Println("\nKonfiguration ist gültig.")
+		return 0
+	}
+	fmt.Printf("\n%d Problem(e) gefunden:\n", len(problems))
+	for _, p := range problems {
+		fmt.Printf("  - %s\n", p)
+	}
+	return 1
+}
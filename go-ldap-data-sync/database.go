@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// databaseConfig enthält die Verbindungsdaten der PostgreSQL-Datenbank. Ist URL
+// gesetzt (DATABASE_URL, als URL oder libpq-Schlüssel/Wert-Zeichenkette), wird
+// sie als Grundlage verwendet; die einzelnen Einstellungen ergänzen sie.
+type databaseConfig struct {
+	URL      string
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Database string
+	// TLS: sslmode (disable, allow, prefer, require, verify-ca, verify-full)
+	// sowie CA-Zertifikat, Client-Zertifikat und -Schlüssel
+	SSLMode     string
+	SSLRootCert string
+	SSLCert     string
+	SSLKey      string
+	// Sitzungsparameter
+	ApplicationName  string
+	StatementTimeout time.Duration
+	SearchPath       string
+	// Grenzen des Verbindungspools (0 = unbegrenzt)
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// initDatabaseConfig liest die Datenbankeinstellungen. Ohne DATABASE_URL bleibt
+// sslmode wie bisher standardmäßig disable.
+func initDatabaseConfig(src *configSource) databaseConfig {
+	cfg := databaseConfig{
+		URL:      src.secret("DATABASE_URL"),
+		Host:     src.str("DB_HOST", ""),
+		Port:     src.str("DB_PORT", "5432"),
+		User:     src.str("DBUSER", ""),
+		Password: src.secret("DB_PASSWORD"),
+		Database: src.str("DB_DATABASE", "idm_rolemanagement_prod"),
+
+		SSLRootCert: src.str("DB_SSLROOTCERT", ""),
+		SSLCert:     src.str("DB_SSLCERT", ""),
+		SSLKey:      src.str("DB_SSLKEY", ""),
+
+		ApplicationName:  src.str("DB_APPLICATION_NAME", "idm_ldap_sync"),
+		StatementTimeout: time.Duration(src.int("DB_STATEMENT_TIMEOUT_SECONDS", 0)) * time.Second,
+		SearchPath:       src.str("DB_SEARCH_PATH", ""),
+
+		MaxOpenConns:    src.int("DB_MAX_OPEN_CONNS", 0),
+		MaxIdleConns:    src.int("DB_MAX_IDLE_CONNS", 2),
+		ConnMaxLifetime: time.Duration(src.int("DB_CONN_MAX_LIFETIME_SECONDS", 0)) * time.Second,
+	}
+	defaultMode := "disable"
+	if cfg.URL != "" {
+		// Bei DATABASE_URL gilt das sslmode der URL bzw. der pgx-Standard
+		defaultMode = ""
+	}
+	cfg.SSLMode = src.oneOf("DB_SSLMODE", defaultMode, "", "disable", "allow", "prefer", "require", "verify-ca", "verify-full")
+	return cfg
+}
+
+// configured meldet, ob genug Angaben für eine Verbindung vorhanden sind.
+func (c databaseConfig) configured() bool {
+	return c.URL != "" || (c.Host != "" && c.User != "" && c.Password != "")
+}
+
+// validate prüft, ob die Verbindungszeichenkette gültig ist. Dabei werden auch
+// die Zertifikatsdateien gelesen.
+func (c databaseConfig) validate() error {
+	if !c.configured() {
+		return errors.New("Bitte setzen Sie die erforderlichen Umgebungsvariablen für die Datenbank (DATABASE_URL oder DB_HOST, DBUSER, DB_PASSWORD).")
+	}
+	if _, err := pgx.ParseConfig(c.connString(false)); err != nil {
+		return fmt.Errorf("ungültige Datenbankverbindung: %w", err)
+	}
+	return nil
+}
+
+// connString baut die Verbindungszeichenkette für pgx. Einstellungen, die
+// pgx nicht selbst kennt (statement_timeout, search_path,
+// default_transaction_read_only), werden beim Verbindungsaufbau als
+// Sitzungsparameter an den Server gesendet.
+func (c databaseConfig) connString(readOnly bool) string {
+	params := map[string]string{
+		"sslmode":          c.SSLMode,
+		"sslrootcert":      c.SSLRootCert,
+		"sslcert":          c.SSLCert,
+		"sslkey":           c.SSLKey,
+		"application_name": c.ApplicationName,
+		"search_path":      c.SearchPath,
+	}
+	if c.StatementTimeout > 0 {
+		params["statement_timeout"] = strconv.FormatInt(c.StatementTimeout.Milliseconds(), 10)
+	}
+	if readOnly {
+		params["default_transaction_read_only"] = "on"
+	}
+
+	if c.URL == "" {
+		params["host"] = c.Host
+		params["port"] = c.Port
+		params["user"] = c.User
+		params["password"] = c.Password
+		params["dbname"] = c.Database
+		return keywordConnString("", params)
+	}
+	if u, err := url.Parse(c.URL); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		query := u.Query()
+		for key, value := range params {
+			if value != "" {
+				query.Set(key, value)
+			}
+		}
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	// libpq-Schlüssel/Wert-Zeichenkette: spätere Angaben überschreiben frühere
+	return keywordConnString(c.URL, params)
+}
+
+// keywordConnString hängt die gesetzten Parameter im libpq-Format an base an.
+func keywordConnString(base string, params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for key, value := range params {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	if strings.TrimSpace(base) != "" {
+		parts = append(parts, strings.TrimSpace(base))
+	}
+	for _, key := range keys {
+		parts = append(parts, key+"="+quoteConnValue(params[key]))
+	}
+	return strings.Join(parts, " ")
+}
+
+// quoteConnValue maskiert einen Wert für die libpq-Schlüssel/Wert-Syntax.
+func quoteConnValue(v string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(v) + "'"
+}
+
+// openDatabase öffnet die Verbindung zur PostgreSQL-Datenbank und prüft sie.
+// Mit readOnly lehnt die Datenbank jede schreibende Transaktion ab.
+func openDatabase(cfg config, readOnly bool) (*sql.DB, error) {
+	dbCfg := cfg.Database
+	if !dbCfg.configured() {
+		return nil, errors.New("Bitte setzen Sie die erforderlichen Umgebungsvariablen für die Datenbank (DATABASE_URL oder DB_HOST, DBUSER, DB_PASSWORD).")
+	}
+
+	db, err := sql.Open("pgx", dbCfg.connString(readOnly))
+	if err != nil {
+		return nil, fmt.Errorf("Fehler beim Öffnen der Datenbank: %w", err)
+	}
+	db.SetMaxOpenConns(dbCfg.MaxOpenConns)
+	db.SetMaxIdleConns(dbCfg.MaxIdleConns)
+	db.SetConnMaxLifetime(dbCfg.ConnMaxLifetime)
+
+	// Prüfe die Datenbankverbindung
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Fehler beim Verbinden zur Datenbank: %w", err)
+	}
+	return db, nil
+}
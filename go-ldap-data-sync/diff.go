@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Objektarten, die beim Vergleich zweier Umgebungen unterschieden werden.
+var modelKinds = []string{"roles", "resources", "associations", "hierarchy"}
+
+// roleModel ist das aus einer Quelle gelesene Rollenmodell einer IDM-Umgebung.
+type roleModel struct {
+	Roles        []roleRecord
+	Resources    []resourceRecord
+	Associations []associationRecord
+}
+
+// extractModel liest Rollen, Ressourcen und Assoziationen aus der Quelle und
+// bildet sie auf Datensätze ab. Parse-Fehler werden protokolliert und gezählt,
+// die Datensätze bleiben mit den übrigen Attributen erhalten.
+func extractModel(run *syncRun, src entrySource, bases searchBases, phase string) (roleModel, error) {
+	defer run.timePhase("extract")()
+	var model roleModel
+
+	roleEntries, err := src.search(bases.Roles, rolesFilter, roleAttributes)
+	if err != nil {
+		return model, fmt.Errorf("Fehler beim Lesen der Rollen: %w", err)
+	}
+	var roleCounts, parentCounts tableCounts
+	for _, entry := range roleEntries {
+		role, parseErr := mapRole(entry, run.languages)
+		if parseErr != nil {
+			roleCounts.ParseErrors++
+			logDecision(run.phaseLogger(phase, "viz_roles"), role.DN, decisionParseError, keyError, parseErr)
+		}
+		roleCounts.Found++
+		parentCounts.Found += len(role.ParentDNs)
+		model.Roles = append(model.Roles, role)
+	}
+	run.recordCounts("viz_roles", roleCounts)
+	run.recordCounts("viz_roles_parents", parentCounts)
+
+	resourceEntries, err := src.search(bases.Resources, resourcesFilter, resourceAttributes)
+	if err != nil {
+		return model, fmt.Errorf("Fehler beim Lesen der Ressourcen: %w", err)
+	}
+	resourceCounts := tableCounts{Found: len(resourceEntries)}
+	for _, entry := range resourceEntries {
+		res, parseErr := mapResource(entry, run.languages)
+		if parseErr != nil {
+			resourceCounts.ParseErrors++
+			logDecision(run.phaseLogger(phase, "viz_resources"), res.DN, decisionParseError, keyError, parseErr)
+		}
+		model.Resources = append(model.Resources, res)
+	}
+	run.recordCounts("viz_resources", resourceCounts)
+
+	associationEntries, err := src.search(bases.Associations, associationsFilter, associationAttributes)
+	if err != nil {
+		return model, fmt.Errorf("Fehler beim Lesen der Assoziationen: %w", err)
+	}
+	associationCounts := tableCounts{Found: len(associationEntries)}
+	for _, entry := range associationEntries {
+		assoc, parseErr := mapAssociation(entry)
+		if parseErr != nil {
+			associationCounts.ParseErrors++
+			logDecision(run.phaseLogger(phase, "viz_roles_resources"), assoc.DN, decisionParseError, keyError, parseErr)
+		}
+		model.Associations = append(model.Associations, assoc)
+	}
+	run.recordCounts("viz_roles_resources", associationCounts)
+
+	return model, nil
+}
+
+// relativeDN liefert den DN relativ zum Driver-Set in normalisierter Form
+// (Kleinschreibung, ohne überflüssige Leerzeichen). Abgeschnitten wird alles
+// oberhalb des User-Application-Treibers, also oberhalb von cn=AppConfig und
+// dessen Elternobjekt. DNs außerhalb der AppConfig werden nur normalisiert.
+func relativeDN(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(dn))
+	}
+	rdns := parsed.RDNs
+	for i, rdn := range rdns {
+		if len(rdn.Attributes) == 1 && strings.EqualFold(rdn.Attributes[0].Type, "cn") && strings.EqualFold(rdn.Attributes[0].Value, "AppConfig") {
+			if i+2 <= len(rdns) {
+				rdns = rdns[:i+2]
+			}
+			break
+		}
+	}
+	return strings.ToLower((&ldap.DN{RDNs: rdns}).String())
+}
+
+// objects liefert je Objektart die vergleichbaren Attribute aller Objekte,
+// geschlüsselt nach relativem DN. Verweise auf andere Objekte werden ebenfalls
+// relativ dargestellt, Zeitstempel werden nicht verglichen.
+func (m roleModel) objects() map[string]map[string]map[string]string {
+	objects := map[string]map[string]map[string]string{}
+	for _, kind := range modelKinds {
+		objects[kind] = map[string]map[string]string{}
+	}
+	for _, role := range m.Roles {
+		objects["roles"][relativeDN(role.DN)] = role.columns()
+		for _, link := range role.parentLinks() {
+			objects["hierarchy"][relativeDN(link.ChildDN)+" -> "+relativeDN(link.ParentDN)] = map[string]string{}
+		}
+	}
+	for _, res := range m.Resources {
+		objects["resources"][relativeDN(res.DN)] = res.columns()
+	}
+	for _, assoc := range m.Associations {
+		columns := assoc.columns()
+		delete(columns, "createtimestamp")
+		delete(columns, "modifytimestamp")
+		columns["nrfrole"] = relativeDN(assoc.Role)
+		columns["nrfresource"] = relativeDN(assoc.Resource)
+		objects["associations"][relativeDN(assoc.DN)] = columns
+	}
+	return objects
+}
+
+// attributeDiff ist ein Attribut, das sich zwischen den beiden Quellen unterscheidet.
+type attributeDiff struct {
+	Attribute string `json:"attribute"`
+	Left      string `json:"left"`
+	Right     string `json:"right"`
+}
+
+// objectDiff ist ein Objekt, das in beiden Quellen existiert, aber abweicht.
+type objectDiff struct {
+	Key        string          `json:"key"`
+	Attributes []attributeDiff `json:"attributes"`
+}
+
+// kindDiff enthält die Unterschiede einer Objektart. Missing sind Objekte, die
+// nur links existieren, Extra solche, die nur rechts existieren.
+type kindDiff struct {
+	Kind      string       `json:"kind"`
+	Missing   []string     `json:"missing"`
+	Extra     []string     `json:"extra"`
+	Differing []objectDiff `json:"differing"`
+}
+
+// diffReport ist das Ergebnis des Kommandos `diff`.
+type diffReport struct {
+	Left        string     `json:"left"`
+	Right       string     `json:"right"`
+	GeneratedAt time.Time  `json:"generated_at"`
+	Kinds       []kindDiff `json:"kinds"`
+}
+
+// empty meldet, ob die beiden Quellen übereinstimmen.
+func (r diffReport) empty() bool {
+	for _, k := range r.Kinds {
+		if len(k.Missing)+len(k.Extra)+len(k.Differing) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// diffModels vergleicht zwei Rollenmodelle Objektart für Objektart.
+func diffModels(left, right roleModel) []kindDiff {
+	l, r := left.objects(), right.objects()
+	var kinds []kindDiff
+	for _, kind := range modelKinds {
+		d := kindDiff{Kind: kind, Missing: []string{}, Extra: []string{}, Differing: []objectDiff{}}
+		for key, lv := range l[kind] {
+			rv, ok := r[kind][key]
+			if !ok {
+				d.Missing = append(d.Missing, key)
+				continue
+			}
+			if attrs := diffAttributes(lv, rv); len(attrs) > 0 {
+				d.Differing = append(d.Differing, objectDiff{Key: key, Attributes: attrs})
+			}
+		}
+		for key := range r[kind] {
+			if _, ok := l[kind][key]; !ok {
+				d.Extra = append(d.Extra, key)
+			}
+		}
+		sort.Strings(d.Missing)
+		sort.Strings(d.Extra)
+		sort.Slice(d.Differing, func(i, j int) bool { return d.Differing[i].Key < d.Differing[j].Key })
+		kinds = append(kinds, d)
+	}
+	return kinds
+}
+
+// diffAttributes vergleicht die Attribute eines Objekts in sortierter Reihenfolge.
+func diffAttributes(left, right map[string]string) []attributeDiff {
+	names := make(map[string]bool)
+	for name := range left {
+		names[name] = true
+	}
+	for name := range right {
+		names[name] = true
+	}
+	var diffs []attributeDiff
+	for name := range names {
+		if left[name] != right[name] {
+			diffs = append(diffs, attributeDiff{Attribute: name, Left: left[name], Right: right[name]})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool { return diffs[i].Attribute < diffs[j].Attribute })
+	return diffs
+}
+
+// markdownCell maskiert einen Wert für eine Markdown-Tabellenzelle.
+func markdownCell(value string) string {
+	value = strings.ReplaceAll(value, "|", `\|`)
+	value = strings.ReplaceAll(value, "\n", " ")
+	if value == "" {
+		return "_(leer)_"
+	}
+	return "`" + strings.ReplaceAll(value, "`", "'") + "`"
+}
+
+// writeDiffMarkdown gibt den Bericht als Markdown aus.
+func writeDiffMarkdown(w io.Writer, report diffReport) {
+	fmt.Fprintf(w, "# Vergleich der Rollenmodelle\n\n")
+	fmt.Fprintf(w, "- Links: `%s`\n- Rechts: `%s`\n- Erstellt: %s\n\n", report.Left, report.Right, report.GeneratedAt.Format(time.RFC3339))
+	fmt.Fprintf(w, "| Objektart | Nur links | Nur rechts | Abweichend |\n|---|---:|---:|---:|\n")
+	for _, k := range report.Kinds {
+		fmt.Fprintf(w, "| %s | %d | %d | %d |\n", k.Kind, len(k.Missing), len(k.Extra), len(k.Differing))
+	}
+	if report.empty() {
+		fmt.Fprintf(w, "\nKeine Unterschiede gefunden.\n")
+		return
+	}
+
+	for _, k := range report.Kinds {
+		if len(k.Missing)+len(k.Extra)+len(k.Differing) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n## %s\n", k.Kind)
+		if len(k.Missing) > 0 {
+			fmt.Fprintf(w, "\n### Nur links (fehlen rechts)\n\n")
+			for _, key := range k.Missing {
+				fmt.Fprintf(w, "- `%s`\n", key)
+			}
+		}
+		if len(k.Extra) > 0 {
+			fmt.Fprintf(w, "\n### Nur rechts (zusätzlich)\n\n")
+			for _, key := range k.Extra {
+				fmt.Fprintf(w, "- `%s`\n", key)
+			}
+		}
+		if len(k.Differing) > 0 {
+			fmt.Fprintf(w, "\n### Abweichend\n")
+			for _, obj := range k.Differing {
+				fmt.Fprintf(w, "\n#### `%s`\n\n| Attribut | Links | Rechts |\n|---|---|---|\n", obj.Key)
+				for _, a := range obj.Attributes {
+					fmt.Fprintf(w, "| %s | %s | %s |\n", a.Attribute, markdownCell(a.Left), markdownCell(a.Right))
+				}
+			}
+		}
+	}
+}
+
+// loadModel öffnet eine Quelle und liest ihr Rollenmodell unterhalb des
+// angegebenen Treibers. Ohne Angabe gelten die Suchbasen der Quelle, also die
+// des Quellprofils bzw. Snapshots oder die Standardsuchbasen.
+func loadModel(run *syncRun, cfg config, spec, user, password, driverDN string) (roleModel, error) {
+	src, bases, err := openSource(cfg, spec, user, password)
+	if err != nil {
+		return roleModel{}, fmt.Errorf("Quelle %s: %w", spec, err)
+	}
+	defer src.Close()
+	if driverDN != "" {
+		bases = searchBasesFor(driverDN)
+	}
+	model, err := extractModel(run, src, bases, "diff")
+	if err != nil {
+		return model, fmt.Errorf("Quelle %s: %w", spec, err)
+	}
+	run.log.Info("Rollenmodell gelesen", "source", spec, "roles", len(model.Roles), "resources", len(model.Resources), "associations", len(model.Associations))
+	return model, nil
+}
+
+// runDiffCommand implementiert das Kommando `diff`. Der Exit-Code folgt diff(1):
+// 0 ohne Unterschiede, 1 mit Unterschieden, 2 bei einem Fehler.
+func runDiffCommand(args []string) int {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	left := fs.String("left", "", "Linke Quelle (env, source:<name>, ldap://…, ldaps://…, ldif:<datei>, snapshot:<datei>)")
+	right := fs.String("right", "", "Rechte Quelle (env, source:<name>, ldap://…, ldaps://…, ldif:<datei>, snapshot:<datei>)")
+	leftUser := fs.String("left-user", "", "Bind-DN für eine linke LDAP-Quelle (Passwort aus DIFF_LEFT_PASSWORD)")
+	rightUser := fs.String("right-user", "", "Bind-DN für eine rechte LDAP-Quelle (Passwort aus DIFF_RIGHT_PASSWORD)")
+	leftDriver := fs.String("left-driver", "", "DN des User-Application-Treibers der linken Quelle (Standard: "+defaultDriverDN+")")
+	rightDriver := fs.String("right-driver", "", "DN des User-Application-Treibers der rechten Quelle (Standard: "+defaultDriverDN+")")
+	format := fs.String("format", "markdown", "Ausgabeformat: markdown oder json")
+	out := fs.String("out", "", "Bericht in diese Datei schreiben statt auf die Standardausgabe")
+	fs.Parse(args)
+
+	if *left == "" || *right == "" || (*format != "markdown" && *format != "json") {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := initConfig()
+	if err != nil {
+		slog.Error("Konfiguration konnte nicht geladen werden", keyError, err)
+		return 2
+	}
+	leftPassword, leftErr := readSecret("DIFF_LEFT_PASSWORD")
+	rightPassword, rightErr := readSecret("DIFF_RIGHT_PASSWORD")
+	if err := errors.Join(leftErr, rightErr); err != nil {
+		slog.Error("Konfiguration konnte nicht geladen werden", keyError, err)
+		return 2
+	}
+	run := newSyncRun("diff")
+
+	leftModel, err := loadModel(run, cfg, *left, *leftUser, leftPassword, *leftDriver)
+	if err != nil {
+		run.finish(err)
+		return 2
+	}
+	rightModel, err := loadModel(run, cfg, *right, *rightUser, rightPassword, *rightDriver)
+	if err != nil {
+		run.finish(err)
+		return 2
+	}
+
+	report := diffReport{Left: *left, Right: *right, GeneratedAt: time.Now(), Kinds: diffModels(leftModel, rightModel)}
+	for _, k := range report.Kinds {
+		run.log.Info("Unterschiede berechnet", "kind", k.Kind, keyCounts, map[string]int{"missing": len(k.Missing), "extra": len(k.Extra), "differing": len(k.Differing)})
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			run.finish(fmt.Errorf("Fehler beim Erstellen des Berichts: %w", err))
+			return 2
+		}
+		defer file.Close()
+		w = file
+	}
+	if *format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	} else {
+		writeDiffMarkdown(w, report)
+	}
+	if err != nil {
+		run.finish(fmt.Errorf("Fehler beim Schreiben des Berichts: %w", err))
+		return 2
+	}
+
+	run.finish(nil)
+	if !report.empty() {
+		return 1
+	}
+	return 0
+}
+
+// runSnapshotCommand implementiert das Kommando `snapshot`, das das
+// Rollenmodell einer Quelle für spätere Vergleiche in eine Datei schreibt.
+func runSnapshotCommand(args []string) int {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	source := fs.String("source", "env", "Quelle (env, source:<name>, ldap://…, ldaps://…, ldif:<datei>)")
+	user := fs.String("user", "", "Bind-DN für eine LDAP-Quelle (Passwort aus SNAPSHOT_PASSWORD)")
+	driver := fs.String("driver", "", "DN des User-Application-Treibers (Standard: "+defaultDriverDN+")")
+	out := fs.String("out", "", "Zieldatei des Snapshots (JSON)")
+	fs.Parse(args)
+	var password string
+
+	if *out == "" {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := initConfig()
+	if err == nil {
+		password, err = readSecret("SNAPSHOT_PASSWORD")
+	}
+	if err != nil {
+		slog.Error("Konfiguration konnte nicht geladen werden", keyError, err)
+		return 1
+	}
+	run := newSyncRun("snapshot")
+
+	src, bases, err := openSource(cfg, *source, *user, password)
+	if err != nil {
+		run.finish(err)
+		return 1
+	}
+	defer src.Close()
+	if *driver != "" {
+		bases = searchBasesFor(*driver)
+	}
+
+	snap, err := takeSnapshot(src, *source, bases)
+	if err == nil {
+		var data []byte
+		data, err = json.MarshalIndent(snap, "", "  ")
+		if err == nil {
+			err = os.WriteFile(*out, data, 0o644)
+		}
+	}
+	if err != nil {
+		run.finish(fmt.Errorf("Fehler beim Erstellen des Snapshots: %w", err))
+		return 1
+	}
+	run.log.Info("Snapshot geschrieben", "file", *out, "entries", len(snap.Entries))
+	run.finish(nil)
+	return 0
+}
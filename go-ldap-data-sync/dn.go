@@ -0,0 +1,301 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// DNs werden in allen Schlüssel- und Verweisspalten in kanonischer Form
+// gespeichert: geparst mit dem DN-Parser von go-ldap, Attributtypen und Werte
+// in Kleinbuchstaben, ohne Leerzeichen um Trennzeichen und mit einheitlicher
+// Maskierung. So passen entry.DN und die Verweise in nrfRole, nrfResource,
+// nrfParentRoles usw. zusammen, auch wenn eDirectory sie unterschiedlich
+// schreibt. Der DN in der gelesenen Form bleibt für die Anzeige in original_dn
+// erhalten.
+
+// Attribute mit der umbenennungsstabilen Kennung eines Eintrags. eDirectory
+// liefert GUID binär, entryUUID als Text.
+var identityAttributes = []string{"GUID", "entryUUID"}
+
+// identity enthält den DN eines Eintrags in der gelesenen Form und seine GUID.
+type identity struct {
+	OriginalDN string `json:"original_dn,omitempty"`
+	GUID       string `json:"guid,omitempty"`
+}
+
+// displayDN liefert den DN für die Anzeige, ohne gelesene Form den
+// kanonischen DN.
+func (id identity) displayDN(dn string) string {
+	if id.OriginalDN != "" {
+		return id.OriginalDN
+	}
+	return dn
+}
+
+// canonicalDN liefert die kanonische Form eines DN. Ein DN, den der Parser
+// nicht lesen kann, wird nur in Kleinbuchstaben umgewandelt und getrimmt; der
+// Fehler wird zusätzlich zurückgegeben.
+func canonicalDN(dn string) (string, error) {
+	dn = strings.TrimSpace(dn)
+	if dn == "" {
+		return "", nil
+	}
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return strings.ToLower(dn), fmt.Errorf("ungültiger DN %q: %w", dn, err)
+	}
+	return strings.ToLower(parsed.String()), nil
+}
+
+// canonicalDNs wandelt die DNs eines mehrwertigen Verweisattributs um.
+func canonicalDNs(attribute string, dns []string) ([]string, error) {
+	if len(dns) == 0 {
+		return nil, nil
+	}
+	result := make([]string, len(dns))
+	var errs []error
+	for i, dn := range dns {
+		var err error
+		if result[i], err = canonicalDN(dn); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", attribute, err))
+		}
+	}
+	return result, errors.Join(errs...)
+}
+
+// mapIdentity liefert den kanonischen DN eines Eintrags, seinen DN in der
+// gelesenen Form und seine GUID.
+func mapIdentity(entry *ldap.Entry) (string, identity, error) {
+	dn, err := canonicalDN(entry.DN)
+	return dn, identity{OriginalDN: entry.DN, GUID: entryGUID(entry)}, err
+}
+
+// entryGUID liefert die GUID eines Eintrags als UUID in Kleinbuchstaben.
+// entryUUID hat Vorrang, das binäre GUID-Attribut wird in der Bytefolge
+// formatiert, in der eDirectory es liefert. Andere Werte werden unverändert
+// übernommen.
+func entryGUID(entry *ldap.Entry) string {
+	if uuid := strings.TrimSpace(entry.GetAttributeValue("entryUUID")); uuid != "" {
+		return strings.ToLower(uuid)
+	}
+	raw := entry.GetRawAttributeValue("GUID")
+	switch len(raw) {
+	case 0:
+		return ""
+	case 16:
+		return fmt.Sprintf("%x-%x-%x-%x-%x", raw[0:4], raw[4:6], raw[6:8], raw[8:10], raw[10:16])
+	default:
+		return strings.ToLower(strings.TrimSpace(string(raw)))
+	}
+}
+
+// dnMigration beschreibt die DN-Spalten einer Tabelle, die für bestehende
+// Datensätze auf die kanonische Form umgestellt werden.
+type dnMigration struct {
+	table string
+	// Primärschlüssel ohne source
+	key []string
+	// Spalten mit DNs, Schlüssel- wie Verweisspalten
+	dns []string
+	// Spalte für den DN in der gelesenen Form, sofern vorhanden
+	original string
+}
+
+// Übergeordnete Tabellen stehen vor den Tabellen, die auf sie verweisen.
+var dnMigrations = []dnMigration{
+	{table: "viz_roles", key: []string{"dn"}, dns: []string{"dn"}, original: "original_dn"},
+	{table: "viz_resources", key: []string{"dn"}, dns: []string{"dn"}, original: "original_dn"},
+	{table: "viz_roles_resources", key: []string{"dn"}, dns: []string{"dn", "nrfRole", "nrfResource"}, original: "original_dn"},
+	{table: "viz_roles_parents", key: []string{"child_dn", "parent_dn"}, dns: []string{"child_dn", "parent_dn"}},
+	{table: "viz_association_parameters", key: []string{"association_dn", "position"}, dns: []string{"association_dn"}},
+	{table: "viz_role_effective_resources", key: []string{"role_dn", "resource_dn"}, dns: []string{"role_dn", "resource_dn", "association_dn", "inherited_from"}},
+	{table: "viz_owners", key: []string{"object_dn", "owner_dn"}, dns: []string{"object_dn", "owner_dn"}},
+	{table: "viz_approvers", key: []string{"object_dn", "kind", "approver_dn"}, dns: []string{"object_dn", "approver_dn"}},
+}
+
+// dnMigrationResult zählt die umgestellten Datensätze. Merged sind Datensätze,
+// deren kanonischer Schlüssel bereits vorhanden war; erhalten bleibt der zuletzt
+// aktualisierte.
+type dnMigrationResult struct {
+	Converted int64
+	Merged    int64
+}
+
+// migrateCanonicalDNs stellt die DN-Spalten bestehender Datensätze in einer
+// Transaktion auf die kanonische Form um. table liefert den maskierten
+// Tabellennamen, param den Platzhalter für den n-ten Parameter ($n bzw. ?n).
+// deferKeys schiebt die Prüfung der Fremdschlüssel an das Ende der
+// Transaktion, weil Schlüssel und Verweise nacheinander umgestellt werden.
+// Datensätze in kanonischer Form werden über eine Vorauswahl in SQL
+// übersprungen, die Migration ist daher bei jedem Start günstig.
+func migrateCanonicalDNs(db *sql.DB, table func(string) string, param func(int) string, deferKeys func(*sql.Tx) error) (dnMigrationResult, error) {
+	var result dnMigrationResult
+	tx, err := db.Begin()
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback()
+
+	var pending bool
+	for _, m := range dnMigrations {
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM ` + table(m.table) + ` WHERE ` + m.pending() + `)`).Scan(&pending); err != nil {
+			return result, fmt.Errorf("Fehler beim Prüfen der DNs in Tabelle %s: %w", m.table, err)
+		}
+		if pending {
+			break
+		}
+	}
+	if !pending {
+		return result, nil
+	}
+	if err := deferKeys(tx); err != nil {
+		return result, fmt.Errorf("Fehler beim Zurückstellen der Fremdschlüssel: %w", err)
+	}
+	for _, m := range dnMigrations {
+		if err := m.run(tx, table(m.table), param, &result); err != nil {
+			return result, fmt.Errorf("Fehler beim Umstellen der DNs in Tabelle %s: %w", m.table, err)
+		}
+	}
+	return result, tx.Commit()
+}
+
+// pending ist die Vorauswahl der Datensätze, deren DNs möglicherweise nicht
+// kanonisch sind: Großbuchstaben, Leerzeichen an Trennzeichen oder Maskierungen.
+// Die Verkettung mit einem leeren Text umgeht die Sortierfolge NOCASE der
+// SQLite-Spalten.
+func (m dnMigration) pending() string {
+	var conditions []string
+	for _, column := range m.dns {
+		conditions = append(conditions,
+			"lower("+column+") <> "+column+" || ''",
+			column+" LIKE '%, %'", column+" LIKE '% ,%'", column+" LIKE '%= %'", column+" LIKE '% =%'",
+			column+" LIKE ' %'", column+" LIKE '% '",
+			"replace("+column+", '\\', '') <> "+column+" || ''",
+		)
+	}
+	return strings.Join(conditions, " OR ")
+}
+
+// keyMatch liefert die Bedingung auf source und den Primärschlüssel mit den
+// Platzhaltern ab first. Spalten ohne DN werden als Text verglichen.
+func (m dnMigration) keyMatch(param func(int) string, first int) string {
+	conditions := []string{"source = " + param(first)}
+	for i, column := range m.key {
+		if !slices.Contains(m.dns, column) {
+			column = "CAST(" + column + " AS TEXT)"
+		}
+		conditions = append(conditions, column+" = "+param(first+i+1))
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+func (m dnMigration) run(tx *sql.Tx, table string, param func(int) string, result *dnMigrationResult) error {
+	// Erst alle Datensätze lesen, eine Verbindung kann nicht gleichzeitig
+	// lesen und schreiben
+	names, selects := slices.Clone(m.dns), slices.Clone(m.dns)
+	for _, column := range m.key {
+		if !slices.Contains(m.dns, column) {
+			names, selects = append(names, column), append(selects, "CAST("+column+" AS TEXT)")
+		}
+	}
+	rows, err := tx.Query(`SELECT source, ` + strings.Join(selects, ", ") + ` FROM ` + table + ` WHERE ` + m.pending())
+	if err != nil {
+		return err
+	}
+	type pendingRow struct {
+		source string
+		values map[string]sql.NullString
+	}
+	var pending []pendingRow
+	for rows.Next() {
+		row := pendingRow{values: map[string]sql.NullString{}}
+		values := make([]sql.NullString, len(names))
+		dest := []any{&row.source}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return err
+		}
+		for i, name := range names {
+			row.values[name] = values[i]
+		}
+		pending = append(pending, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, row := range pending {
+		oldKey, newKey := []any{row.source}, []any{row.source}
+		changedKey := false
+		for _, column := range m.key {
+			value := row.values[column].String
+			canonical := value
+			if slices.Contains(m.dns, column) {
+				canonical, _ = canonicalDN(value)
+			}
+			oldKey, newKey = append(oldKey, value), append(newKey, canonical)
+			changedKey = changedKey || canonical != value
+		}
+		sets, args := []string{}, []any{}
+		changed := false
+		for _, column := range m.dns {
+			value := row.values[column]
+			canonical := value
+			if value.Valid {
+				canonical.String, _ = canonicalDN(value.String)
+			}
+			changed = changed || canonical != value
+			args = append(args, canonical)
+			sets = append(sets, column+" = "+param(len(args)))
+		}
+		if !changed {
+			continue
+		}
+		if m.original != "" {
+			args = append(args, row.values["dn"])
+			sets = append(sets, m.original+" = COALESCE("+m.original+", "+param(len(args))+")")
+		}
+
+		if changedKey {
+			// Gibt es den kanonischen Schlüssel schon, bleibt der zuletzt
+			// aktualisierte Datensatz erhalten. Der Datensatz selbst wird
+			// ausgenommen, in SQLite passt er wegen NOCASE auch zum neuen Schlüssel.
+			other := m.keyMatch(param, 1) + ` AND NOT (` + m.keyMatch(param, len(newKey)+1) + `)`
+			keys := append(slices.Clone(newKey), oldKey...)
+			deleted, err := tx.Exec(`DELETE FROM `+table+` WHERE `+other+
+				` AND updated_at <= (SELECT updated_at FROM `+table+` WHERE `+m.keyMatch(param, len(newKey)+1)+`)`, keys...)
+			if err != nil {
+				return err
+			}
+			if n, _ := deleted.RowsAffected(); n > 0 {
+				result.Merged += n
+			} else {
+				var exists bool
+				if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM `+table+` WHERE `+other+`)`, keys...).Scan(&exists); err != nil {
+					return err
+				}
+				if exists {
+					if _, err := tx.Exec(`DELETE FROM `+table+` WHERE `+m.keyMatch(param, 1), oldKey...); err != nil {
+						return err
+					}
+					result.Merged++
+					continue
+				}
+			}
+		}
+		if _, err := tx.Exec(`UPDATE `+table+` SET `+strings.Join(sets, ", ")+` WHERE `+m.keyMatch(param, len(args)+1), append(args, oldKey...)...); err != nil {
+			return err
+		}
+		result.Converted++
+	}
+	return nil
+}
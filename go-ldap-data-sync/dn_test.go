@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestCanonicalDN(t *testing.T) {
+	tests := []struct {
+		dn      string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"cn=Admin,ou=Roles,o=Data", "cn=admin,ou=roles,o=data", false},
+		{" CN=Admin, OU=Roles ,O=Data ", "cn=admin,ou=roles,o=data", false},
+		// Nicht-ASCII-Zeichen maskiert der Parser hexadezimal
+		{`cn=Müller\, Hans,o=Data`, `cn=m\c3\bcller\, hans,o=data`, false},
+		{"kein DN", "kein dn", true},
+	}
+	for _, tt := range tests {
+		got, err := canonicalDN(tt.dn)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("canonicalDN(%q) = %v, Fehler erwartet: %v", tt.dn, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("canonicalDN(%q) = %q, erwartet %q", tt.dn, got, tt.want)
+		}
+	}
+}
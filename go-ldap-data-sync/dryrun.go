@@ -0,0 +1,575 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// syncTable ist eine Tabelle, wie die Sinks sie schreiben.
+type syncTable struct {
+	name    string
+	columns []tableColumn
+	// Je Lauf vollständig ersetzt statt als gelöscht markiert
+	replaced bool
+	// derive setzt die Spalten, die die Sinks erst beim Schreiben bestimmen.
+	// current ist bei neuen Datensätzen nil.
+	derive func(desired, current map[string]string, now time.Time)
+}
+
+// Die Tabellen in der Reihenfolge, in der der Trockenlauf sie ausgibt.
+var syncTables = []syncTable{
+	{name: "viz_roles", columns: columnDefs(roleColumns)},
+	{name: "viz_resources", columns: columnDefs(resourceColumns)},
+	{name: "viz_roles_resources", columns: append(columnDefs(associationColumns), tableColumn{name: "status_changed_at", kind: columnTime}), derive: deriveStatusChangedAt},
+	{name: "viz_roles_parents", columns: columnDefs(parentColumns)},
+	{name: "viz_association_parameters", columns: columnDefs(parameterColumns), replaced: true},
+	{name: "viz_role_effective_resources", columns: columnDefs(effectiveColumns), replaced: true},
+	{name: "viz_owners", columns: columnDefs(ownerColumns), replaced: true},
+	{name: "viz_approvers", columns: columnDefs(approverColumns), replaced: true},
+}
+
+// syncTableNamed liefert die Beschreibung einer Tabelle aus syncTables.
+func syncTableNamed(name string) syncTable {
+	for _, t := range syncTables {
+		if t.name == name {
+			return t
+		}
+	}
+	panic("unbekannte Tabelle " + name)
+}
+
+// deriveStatusChangedAt bildet status_changed_at wie die Sinks: gesetzt beim
+// Einfügen und wenn sich status_key ändert.
+func deriveStatusChangedAt(desired, current map[string]string, now time.Time) {
+	if current == nil || current["status_key"] != desired["status_key"] {
+		desired["status_changed_at"] = columnString(columnTime, now)
+	} else {
+		desired["status_changed_at"] = current["status_changed_at"]
+	}
+}
+
+// attributeChange ist eine geänderte Spalte eines bestehenden Datensatzes.
+type attributeChange struct {
+	Attribute string `json:"attribute"`
+	Old       string `json:"old"`
+	New       string `json:"new"`
+}
+
+// rowInsert ist ein neu einzufügender Datensatz.
+type rowInsert struct {
+	Key    string            `json:"key"`
+	Values map[string]string `json:"values,omitempty"`
+}
+
+// rowUpdate ist ein Datensatz mit Änderungen auf Attributebene.
+type rowUpdate struct {
+	Key     string            `json:"key"`
+	Changes []attributeChange `json:"changes"`
+}
+
+// tableChanges enthält alle Änderungen, die ein Lauf an einer Tabelle
+// vornehmen würde. Umbenennungen werden vor dem Vergleich angewendet, die
+// umgestellten Datensätze erscheinen also nur mit ihren übrigen Änderungen
+// unter Update. Delete betrifft die je Lauf ersetzten Tabellen.
+type tableChanges struct {
+	Source     string        `json:"source"`
+	Table      string        `json:"table"`
+	Rename     []renameEvent `json:"rename,omitempty"`
+	Insert     []rowInsert   `json:"insert"`
+	Update     []rowUpdate   `json:"update"`
+	SoftDelete []string      `json:"soft_delete"`
+	Purge      []string      `json:"purge"`
+	Delete     []string      `json:"delete,omitempty"`
+}
+
+// changeset ist das Ergebnis eines Trockenlaufs.
+type changeset struct {
+	RunID       string         `json:"run_id"`
+	GeneratedAt time.Time      `json:"generated_at"`
+	Tables      []tableChanges `json:"tables"`
+	Safety      []string       `json:"safety,omitempty"`
+}
+
+// dbRow ist ein bestehender Datensatz aus der Datenbank mit allen Spalten
+// aus syncTable.columns, Schlüssel eingeschlossen.
+type dbRow struct {
+	values    map[string]string
+	isDeleted bool
+	updatedAt time.Time
+}
+
+// tableExists prüft, ob eine Tabelle existiert. table ist ein maskierter,
+// ggf. schemaqualifizierter Name (siehe syncRun.table).
+func tableExists(db *sql.DB, table string) (bool, error) {
+	var exists bool
+	err := db.QueryRow(`SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists)
+	return exists, err
+}
+
+// existingColumns liefert die Spalten einer Tabelle, für eine nicht
+// vorhandene Tabelle keine. table ist wie bei tableExists ein maskierter, ggf.
+// schemaqualifizierter Name.
+func existingColumns(db *sql.DB, table string) (map[string]bool, error) {
+	rows, err := db.Query(`SELECT attname FROM pg_attribute WHERE attrelid = to_regclass($1) AND attnum > 0 AND NOT attisdropped`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
+
+// loadDatabaseRows liest alle Datensätze einer Quelle aus einer Tabelle mit
+// allen Spalten, die die Sinks schreiben. Spalten, die eine ältere Tabelle
+// noch nicht hat, sind leer. Ist die Tabelle noch nicht auf Quellprofile
+// umgestellt, gehören alle Datensätze zur Quelle "default".
+func loadDatabaseRows(run *syncRun, db *sql.DB, t syncTable) (map[string]dbRow, error) {
+	rows := make(map[string]dbRow)
+	existing, err := existingColumns(db, run.table(t.name))
+	if err != nil {
+		return nil, fmt.Errorf("Fehler beim Prüfen der Tabelle %s: %w", t.name, err)
+	}
+	if len(existing) == 0 || (!existing["source"] && run.source != defaultSourceName) {
+		return rows, nil
+	}
+
+	selects := []string{"FALSE", "COALESCE(updated_at, NOW())"}
+	if !t.replaced {
+		selects[0] = "COALESCE(is_deleted, FALSE)"
+	}
+	for _, c := range t.columns {
+		switch {
+		case !existing[c.name] && c.kind == columnTime:
+			selects = append(selects, "NULL::timestamptz")
+		case !existing[c.name]:
+			selects = append(selects, "''")
+		case c.kind == columnTime:
+			selects = append(selects, c.name)
+		default:
+			selects = append(selects, "COALESCE("+c.name+"::text, '')")
+		}
+	}
+	query, args := `SELECT `+strings.Join(selects, ", ")+` FROM `+run.table(t.name), []any{}
+	if existing["source"] {
+		query, args = query+` WHERE source = $1`, append(args, run.source)
+	}
+	result, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("Fehler beim Lesen der Tabelle %s: %w", t.name, err)
+	}
+	defer result.Close()
+
+	for result.Next() {
+		var row dbRow
+		values := make([]any, len(t.columns))
+		dest := []any{&row.isDeleted, &row.updatedAt}
+		for i, c := range t.columns {
+			if c.kind == columnTime {
+				values[i] = new(sql.NullTime)
+			} else {
+				values[i] = new(string)
+			}
+			dest = append(dest, values[i])
+		}
+		if err := result.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("Fehler beim Lesen der Tabelle %s: %w", t.name, err)
+		}
+		row.values = make(map[string]string, len(t.columns))
+		for i, c := range t.columns {
+			switch v := values[i].(type) {
+			case *sql.NullTime:
+				row.values[c.name] = columnString(c.kind, v.Time)
+			case *string:
+				row.values[c.name] = columnString(c.kind, *v)
+			}
+		}
+		rows[rowKey(t.columns, row.values)] = row
+	}
+	return rows, result.Err()
+}
+
+// applyStateRenames bildet applyRenames auf dem gelesenen Datenbankinhalt nach:
+// Ist die GUID eines Soll-Datensatzes unter einem anderen DN gespeichert und
+// gibt es den neuen DN noch nicht, werden der Datensatz und seine Verweise in
+// current auf den neuen DN umgestellt. Geliefert werden die Umbenennungen je
+// Tabelle.
+func applyStateRenames(state map[string]map[string]map[string]string, current map[string]map[string]dbRow) map[string][]renameEvent {
+	events := map[string][]renameEvent{}
+	for _, target := range []renameTarget{roleRenames, resourceRenames, associationRenames} {
+		// Je GUID gilt der zuletzt aktualisierte Datensatz
+		known := map[string]string{}
+		updated := map[string]time.Time{}
+		for key, row := range current[target.table] {
+			guid := row.values["guid"]
+			if guid != "" && (known[guid] == "" || row.updatedAt.After(updated[guid])) {
+				known[guid], updated[guid] = key, row.updatedAt
+			}
+		}
+
+		keys := make([]string, 0, len(state[target.table]))
+		for key := range state[target.table] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			desired := state[target.table][key]
+			oldKey, ok := known[desired["guid"]]
+			if desired["guid"] == "" || !ok || oldKey == key {
+				continue
+			}
+			if _, exists := current[target.table][key]; exists {
+				continue
+			}
+			oldDN := current[target.table][oldKey].values["dn"]
+			for _, ref := range append([]columnRef{{target.table, "dn"}}, target.refs...) {
+				renameReferences(current, ref, oldKey, desired["dn"])
+			}
+			events[target.table] = append(events[target.table], renameEvent{Table: target.table, GUID: desired["guid"], OldDN: oldDN, NewDN: desired["dn"], Kind: renameKind(oldDN, desired["dn"])})
+		}
+	}
+	return events
+}
+
+// renameReferences stellt in current die Spalte ref aller Datensätze mit dem
+// DN oldKey auf newDN um. Ist die Spalte Teil des Schlüssels, ändert sich
+// auch der Schlüssel des Datensatzes. Spaltennamen sind wie in PostgreSQL
+// klein geschrieben.
+func renameReferences(current map[string]map[string]dbRow, ref columnRef, oldKey, newDN string) {
+	columns := syncTableNamed(ref.table).columns
+	column := strings.ToLower(ref.column)
+	rows := current[ref.table]
+	for key, row := range rows {
+		if graphKey(row.values[column]) != oldKey {
+			continue
+		}
+		row.values[column] = newDN
+		delete(rows, key)
+		rows[rowKey(columns, row.values)] = row
+	}
+}
+
+// diffTable vergleicht den Soll-Zustand aus LDAP mit dem Datenbankinhalt und
+// bildet die Schritte der Sinks und von markAndPurge nach. now ist der
+// Zeitstempel des Laufs.
+func diffTable(source string, t syncTable, desired map[string]map[string]string, current map[string]dbRow, purgeCutoff, now time.Time) tableChanges {
+	changes := tableChanges{Source: source, Table: t.name}
+
+	for key, values := range desired {
+		row, ok := current[key]
+		if !ok {
+			if t.derive != nil {
+				t.derive(values, nil, now)
+			}
+			changes.Insert = append(changes.Insert, rowInsert{Key: key, Values: values})
+			continue
+		}
+		if t.derive != nil {
+			t.derive(values, row.values, now)
+		}
+		var diffs []attributeChange
+		if row.isDeleted {
+			diffs = append(diffs, attributeChange{Attribute: "is_deleted", Old: "true", New: "false"})
+		}
+		for _, c := range t.columns {
+			if c.key {
+				continue
+			}
+			if row.values[c.name] != values[c.name] {
+				diffs = append(diffs, attributeChange{Attribute: c.name, Old: row.values[c.name], New: values[c.name]})
+			}
+		}
+		if len(diffs) > 0 {
+			changes.Update = append(changes.Update, rowUpdate{Key: key, Changes: diffs})
+		}
+	}
+
+	for key, row := range current {
+		if _, ok := desired[key]; ok {
+			continue
+		}
+		// Je Lauf ersetzte Tabellen werden ohne Markieren neu geschrieben
+		if t.replaced {
+			changes.Delete = append(changes.Delete, key)
+			continue
+		}
+		if !row.isDeleted {
+			changes.SoftDelete = append(changes.SoftDelete, key)
+		}
+		// Nach dem Markieren sind alle fehlenden Datensätze gelöscht; entfernt
+		// werden die, deren letzte Aktualisierung vor der Aufbewahrungsfrist liegt.
+		if row.updatedAt.Before(purgeCutoff) {
+			changes.Purge = append(changes.Purge, key)
+		}
+	}
+
+	sort.Slice(changes.Insert, func(i, j int) bool { return changes.Insert[i].Key < changes.Insert[j].Key })
+	sort.Slice(changes.Update, func(i, j int) bool { return changes.Update[i].Key < changes.Update[j].Key })
+	sort.Strings(changes.SoftDelete)
+	sort.Strings(changes.Purge)
+	sort.Strings(changes.Delete)
+	return changes
+}
+
+// desiredState liest alle Objekte aus der Quelle und liefert sie je Tabelle
+// als Schlüssel → Spalten, so wie die Synchronisation sie schreiben würde.
+func desiredState(run *syncRun, conn *ldap.Conn, bases searchBases) (map[string]map[string]map[string]string, error) {
+	model, err := extractModel(run, ldapSource{conn: conn}, bases, "dry-run")
+	if err != nil {
+		return nil, err
+	}
+	links, missing, err := governanceLinks(conn, model.Roles, model.Resources)
+	if err != nil {
+		return nil, fmt.Errorf("Fehler beim Auflösen der Eigentümer und Genehmiger: %w", err)
+	}
+	for _, dn := range missing {
+		run.log.Warn("Referenzierter Eintrag nicht gefunden", keyPhase, "dry-run", keyDN, dn)
+	}
+	grants, _ := resolveEffectiveResources(model)
+
+	var parents []parentLink
+	for _, role := range model.Roles {
+		parents = append(parents, role.parentLinks()...)
+	}
+	var params []associationParameter
+	for _, assoc := range model.Associations {
+		params = append(params, assoc.parameterRows()...)
+	}
+	var owners, approvers []principalLink
+	for _, link := range links {
+		if link.isOwner() {
+			owners = append(owners, link)
+		} else {
+			approvers = append(approvers, link)
+		}
+	}
+
+	return map[string]map[string]map[string]string{
+		"viz_roles":                    stateRows(roleColumns, model.Roles),
+		"viz_resources":                stateRows(resourceColumns, model.Resources),
+		"viz_roles_resources":          stateRows(associationColumns, model.Associations),
+		"viz_roles_parents":            stateRows(parentColumns, parents),
+		"viz_association_parameters":   stateRows(parameterColumns, params),
+		"viz_role_effective_resources": stateRows(effectiveColumns, grants),
+		"viz_owners":                   stateRows(ownerColumns, owners),
+		"viz_approvers":                stateRows(approverColumns, approvers),
+	}, nil
+}
+
+// stateRows liefert die Datensätze einer Tabelle als Schlüssel → Spalten.
+func stateRows[T any](columns []recordColumn[T], records []T) map[string]map[string]string {
+	rows := make(map[string]map[string]string, len(records))
+	for _, rec := range records {
+		key, values := columnStrings(columns, rec)
+		rows[key] = values
+	}
+	return rows
+}
+
+// runDryRun berechnet für alle Quellprofile die exakten Änderungen, die ein
+// Lauf vornehmen würde, ohne schreibend auf die Datenbank zuzugreifen. Ohne
+// Datenbankkonfiguration werden wie bisher nur die Einträge in LDAP gezählt.
+func runDryRun(run *syncRun, cfg config) error {
+	log := run.log.With(keyPhase, "dry-run")
+	// Verglichen wird immer mit dem Zielschema, auch im Blue/Green-Betrieb
+	run.tables = cfg.Target.names()
+
+	if !cfg.Database.configured() {
+		log.Warn("Keine Datenbank konfiguriert, Trockenlauf zählt nur die Einträge in LDAP.")
+		var errs []error
+		for _, profile := range cfg.Sources {
+			if err := countSource(run.forSource(profile.Name), cfg, profile); err != nil {
+				errs = append(errs, fmt.Errorf("Quelle %s: %w", profile.Name, err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	db, err := openDatabase(cfg, true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	log.Info("Erfolgreich mit PostgreSQL (nur lesend) verbunden.")
+
+	cs := changeset{RunID: run.id, GeneratedAt: time.Now()}
+	var errs []error
+	for _, profile := range cfg.Sources {
+		srun := run.forSource(profile.Name)
+		tables, err := dryRunSource(srun, cfg, db, profile)
+		if err != nil {
+			srun.log.Error("Trockenlauf der Quelle fehlgeschlagen", keyError, err)
+			errs = append(errs, fmt.Errorf("Quelle %s: %w", profile.Name, err))
+			continue
+		}
+		cs.Tables = append(cs.Tables, tables...)
+
+		if exists, err := tableExists(db, run.table("viz_sync_runs")); err == nil && exists {
+			if err := checkSafetyThresholds(srun, db, cfg.Safety, nil); err != nil {
+				cs.Safety = append(cs.Safety, fmt.Sprintf("Quelle %s: %s", profile.Name, err))
+			}
+		}
+	}
+
+	printChangeset(os.Stdout, cs, cfg.DryRunDetailLimit)
+	if cfg.DryRunOutput != "" {
+		writeJSONToFile(log, cfg.DryRunOutput, cs)
+	}
+	return errors.Join(errs...)
+}
+
+// countSource zählt im Trockenlauf ohne Datenbank die Einträge einer Quelle.
+func countSource(run *syncRun, cfg config, profile sourceProfile) error {
+	if err := profile.validate(); err != nil {
+		return err
+	}
+	conn, err := dialLDAP(profile.url(), profile.LDAPUser, profile.LDAPPassword, cfg.LDAPTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return errors.Join(
+		countRoles(run, conn, profile.Bases.Roles),
+		countResources(run, conn, profile.Bases.Resources),
+		countAssociations(run, conn, profile.Bases.Associations),
+	)
+}
+
+// dryRunSource vergleicht den Soll-Zustand einer Quelle mit deren Datensätzen
+// in der Datenbank.
+func dryRunSource(run *syncRun, cfg config, db *sql.DB, profile sourceProfile) ([]tableChanges, error) {
+	if err := profile.validate(); err != nil {
+		return nil, err
+	}
+	conn, err := dialLDAP(profile.url(), profile.LDAPUser, profile.LDAPPassword, cfg.LDAPTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	state, err := desiredState(run, conn, profile.Bases)
+	if err != nil {
+		return nil, err
+	}
+
+	defer run.timePhase("diff")()
+	current := map[string]map[string]dbRow{}
+	for _, t := range syncTables {
+		if current[t.name], err = loadDatabaseRows(run, db, t); err != nil {
+			return nil, err
+		}
+	}
+	renames := applyStateRenames(state, current)
+
+	var tables []tableChanges
+	for _, t := range syncTables {
+		changes := diffTable(run.source, t, state[t.name], current[t.name], cfg.Retention.purgeCutoff(t.name, run.start), run.start)
+		changes.Rename = renames[t.name]
+		run.log.Info("Änderungen berechnet", keyPhase, "dry-run", keyTable, t.name, keyCounts, changes.counts())
+		tables = append(tables, changes)
+	}
+	return tables, nil
+}
+
+// counts fasst die Änderungen einer Tabelle für das Log zusammen.
+func (c tableChanges) counts() any {
+	return map[string]int{
+		"rename":      len(c.Rename),
+		"insert":      len(c.Insert),
+		"update":      len(c.Update),
+		"soft_delete": len(c.SoftDelete),
+		"purge":       len(c.Purge),
+		"delete":      len(c.Delete),
+	}
+}
+
+// printChangeset gibt eine lesbare Zusammenfassung des Changesets aus. Je
+// Tabelle und Art werden höchstens limit Datensätze aufgelistet (0 = keine).
+func printChangeset(w io.Writer, cs changeset, limit int) {
+	fmt.Fprintf(w, "Trockenlauf %s – Änderungen, die eine Synchronisation vornehmen würde:\n", cs.RunID)
+	for _, t := range cs.Tables {
+		if syncTableNamed(t.Table).replaced {
+			fmt.Fprintf(w, "\n%s [%s]: %d neu, %d geändert, %d gelöscht\n",
+				t.Table, t.Source, len(t.Insert), len(t.Update), len(t.Delete))
+		} else {
+			fmt.Fprintf(w, "\n%s [%s]: %d umbenannt, %d neu, %d geändert, %d als gelöscht markiert, %d endgültig gelöscht\n",
+				t.Table, t.Source, len(t.Rename), len(t.Insert), len(t.Update), len(t.SoftDelete), len(t.Purge))
+		}
+
+		printed := 0
+		more := func(total int) {
+			if total > printed {
+				fmt.Fprintf(w, "  ... und %d weitere\n", total-printed)
+			}
+			printed = 0
+		}
+		for _, r := range t.Rename {
+			if printed == limit {
+				break
+			}
+			fmt.Fprintf(w, "  > %s -> %s (%s)\n", r.OldDN, r.NewDN, r.Kind)
+			printed++
+		}
+		more(len(t.Rename))
+		for _, ins := range t.Insert {
+			if printed == limit {
+				break
+			}
+			fmt.Fprintf(w, "  + %s\n", ins.Key)
+			printed++
+		}
+		more(len(t.Insert))
+		for _, upd := range t.Update {
+			if printed == limit {
+				break
+			}
+			fmt.Fprintf(w, "  ~ %s\n", upd.Key)
+			for _, c := range upd.Changes {
+				fmt.Fprintf(w, "      %s: %q -> %q\n", c.Attribute, c.Old, c.New)
+			}
+			printed++
+		}
+		more(len(t.Update))
+		for _, key := range t.SoftDelete {
+			if printed == limit {
+				break
+			}
+			fmt.Fprintf(w, "  - %s\n", key)
+			printed++
+		}
+		more(len(t.SoftDelete))
+		for _, key := range t.Purge {
+			if printed == limit {
+				break
+			}
+			fmt.Fprintf(w, "  x %s\n", key)
+			printed++
+		}
+		more(len(t.Purge))
+		for _, key := range t.Delete {
+			if printed == limit {
+				break
+			}
+			fmt.Fprintf(w, "  x %s\n", key)
+			printed++
+		}
+		more(len(t.Delete))
+	}
+	for _, msg := range cs.Safety {
+		fmt.Fprintf(w, "\nACHTUNG: %s\n", msg)
+	}
+}
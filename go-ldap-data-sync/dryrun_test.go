@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// dbRows bildet gelesene Datensätze aus Soll-Datensätzen nach.
+func dbRows(t syncTable, rows map[string]map[string]string) map[string]dbRow {
+	current := map[string]dbRow{}
+	for _, values := range rows {
+		copied := map[string]string{}
+		for k, v := range values {
+			copied[k] = v
+		}
+		current[rowKey(t.columns, copied)] = dbRow{values: copied}
+	}
+	return current
+}
+
+func TestDryRunRenameBeforeDiff(t *testing.T) {
+	now := time.Date(2024, 3, 1, 5, 0, 0, 0, time.UTC)
+	oldRole := roleRecord{DN: "cn=alt,cn=roles", RoleLevel: "10", identity: identity{GUID: "g1"}}
+	newRole := oldRole
+	newRole.DN = "cn=neu,cn=roles"
+	newRole.DisplayName = "Neu"
+	assoc := func(role string) associationRecord {
+		return associationRecord{DN: "cn=a1,cn=assocs", Role: role, Resource: "cn=r1", Status: "50"}
+	}
+
+	state := map[string]map[string]map[string]string{
+		"viz_roles":           stateRows(roleColumns, []roleRecord{newRole}),
+		"viz_roles_resources": stateRows(associationColumns, []associationRecord{assoc(newRole.DN)}),
+	}
+	before := map[string]map[string]map[string]string{
+		"viz_roles":           stateRows(roleColumns, []roleRecord{oldRole}),
+		"viz_roles_resources": stateRows(associationColumns, []associationRecord{assoc(oldRole.DN)}),
+	}
+	current := map[string]map[string]dbRow{}
+	for _, table := range syncTables {
+		current[table.name] = dbRows(table, before[table.name])
+	}
+	for key, row := range current["viz_roles_resources"] {
+		row.values["status_changed_at"] = columnString(columnTime, now.Add(-time.Hour))
+		current["viz_roles_resources"][key] = row
+	}
+
+	renames := applyStateRenames(state, current)
+	if len(renames["viz_roles"]) != 1 || renames["viz_roles"][0].OldDN != oldRole.DN || renames["viz_roles"][0].NewDN != newRole.DN || renames["viz_roles"][0].Kind != renameRename {
+		t.Fatalf("Umbenennungen = %+v", renames)
+	}
+
+	roles := diffTable("default", syncTableNamed("viz_roles"), state["viz_roles"], current["viz_roles"], now, now)
+	if len(roles.Insert) != 0 || len(roles.SoftDelete) != 0 {
+		t.Fatalf("Umbenennung als Einfügen/Löschen gemeldet: %+v", roles)
+	}
+	if len(roles.Update) != 1 || len(roles.Update[0].Changes) != 1 || roles.Update[0].Changes[0].Attribute != "display_name" {
+		t.Fatalf("Änderungen der Rolle = %+v", roles.Update)
+	}
+
+	// Der Verweis nrfRole ist mitgeführt, die Assoziation bleibt unverändert
+	assocs := diffTable("default", syncTableNamed("viz_roles_resources"), state["viz_roles_resources"], current["viz_roles_resources"], now, now)
+	if len(assocs.Insert)+len(assocs.Update)+len(assocs.SoftDelete) != 0 {
+		t.Fatalf("Änderungen der Assoziation = %+v", assocs)
+	}
+}
+
+func TestDiffTableComparesSinkColumns(t *testing.T) {
+	now := time.Date(2024, 3, 1, 5, 0, 0, 0, time.UTC)
+	yes := true
+	table := syncTableNamed("viz_resources")
+	old := resourceRecord{DN: "cn=r1", DisplayName: "Alt", identity: identity{OriginalDN: "CN=r1"}}
+	changed := old
+	changed.DisplayName = "Neu"
+	changed.ApprovalRequired = &yes
+	changed.GUID = "g1"
+
+	changes := diffTable("default", table, stateRows(resourceColumns, []resourceRecord{changed}), dbRows(table, stateRows(resourceColumns, []resourceRecord{old})), now, now)
+	if len(changes.Update) != 1 {
+		t.Fatalf("Update = %+v", changes.Update)
+	}
+	got := map[string]attributeChange{}
+	for _, c := range changes.Update[0].Changes {
+		got[c.Attribute] = c
+	}
+	want := map[string][2]string{"display_name": {"Alt", "Neu"}, "approval_required": {"", "true"}, "guid": {"", "g1"}}
+	if len(got) != len(want) {
+		t.Fatalf("Änderungen = %+v", changes.Update[0].Changes)
+	}
+	for attr, values := range want {
+		if c := got[attr]; c.Old != values[0] || c.New != values[1] {
+			t.Errorf("%s: %q -> %q, erwartet %q -> %q", attr, c.Old, c.New, values[0], values[1])
+		}
+	}
+}
+
+func TestDiffTableReplacedTables(t *testing.T) {
+	now := time.Date(2024, 3, 1, 5, 0, 0, 0, time.UTC)
+	table := syncTableNamed("viz_role_effective_resources")
+	desired := stateRows(effectiveColumns, []effectiveGrant{
+		{RoleDN: "cn=business", ResourceDN: "cn=r1", AssociationDN: "cn=a1", Path: []string{"cn=business", "cn=it"}},
+	})
+	current := dbRows(table, stateRows(effectiveColumns, []effectiveGrant{
+		{RoleDN: "cn=business", ResourceDN: "cn=r1", AssociationDN: "cn=a1", Path: []string{"cn=business", "cn=it", "cn=perm"}},
+		{RoleDN: "cn=business", ResourceDN: "cn=r2", AssociationDN: "cn=a2", Path: []string{"cn=business"}},
+	}))
+
+	changes := diffTable("default", table, desired, current, now, now)
+	if len(changes.Update) != 1 {
+		t.Fatalf("Update = %+v", changes.Update)
+	}
+	got := map[string]attributeChange{}
+	for _, c := range changes.Update[0].Changes {
+		got[c.Attribute] = c
+	}
+	if len(got) != 3 || got["inherited_from"].New != "cn=it" || got["path"].New != `["cn=business","cn=it"]` || got["depth"].Old != "2" || got["depth"].New != "1" {
+		t.Fatalf("Änderungen = %+v", changes.Update[0].Changes)
+	}
+	if len(changes.Delete) != 1 || changes.Delete[0] != "cn=business -> cn=r2" || len(changes.SoftDelete)+len(changes.Purge) != 0 {
+		t.Fatalf("Löschungen = %+v", changes)
+	}
+}
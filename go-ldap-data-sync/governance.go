@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Attribute von Rollen und Ressourcen zu Verantwortlichen und Genehmigungen.
+var governanceAttributes = []string{
+	"owner", "nrfApprovers", "nrfRevokeApprovers",
+	"nrfApprovalRequired", "nrfApprovalDefinition", "nrfRevokeRequired", "nrfRevokeDefinition",
+}
+
+// Attribute der referenzierten Benutzer und Gruppen für Art und Anzeigename.
+var principalAttributes = []string{"objectClass", "displayName", "fullName", "givenName", "sn", "cn"}
+
+// Arten von Verantwortlichen in viz_owners und viz_approvers.
+const (
+	principalOwner          = "owner"
+	principalApprover       = "approver"
+	principalRevokeApprover = "revoke_approver"
+)
+
+// governance enthält Eigentümer, Genehmiger und Genehmigungseinstellungen
+// einer Rolle oder Ressource. Die Definitionen verweisen auf die
+// Genehmigungs-PRDs (Provisioning Request Definitions).
+type governance struct {
+	Owners             []string `json:"owners,omitempty"`
+	Approvers          []string `json:"approvers,omitempty"`
+	RevokeApprovers    []string `json:"revoke_approvers,omitempty"`
+	ApprovalRequired   *bool    `json:"approval_required,omitempty"`
+	ApprovalDefinition string   `json:"approval_definition,omitempty"`
+	RevokeRequired     *bool    `json:"revoke_required,omitempty"`
+	RevokeDefinition   string   `json:"revoke_definition,omitempty"`
+}
+
+// mapGovernance liest die Governance-Attribute eines Eintrags. Die DNs der
+// Eigentümer und Genehmiger werden kanonisch gespeichert. Fehler bei den DNs
+// und den booleschen Attributen werden zurückgegeben, die übrigen Werte sind
+// trotzdem gesetzt.
+func mapGovernance(entry *ldap.Entry) (governance, error) {
+	g := governance{
+		ApprovalDefinition: entry.GetAttributeValue("nrfApprovalDefinition"),
+		RevokeDefinition:   entry.GetAttributeValue("nrfRevokeDefinition"),
+	}
+	var ownerErr, approverErr, revokeApproverErr, approvalErr, revokeErr error
+	g.Owners, ownerErr = canonicalDNs("owner", entry.GetAttributeValues("owner"))
+	g.Approvers, approverErr = canonicalDNs("nrfApprovers", entry.GetAttributeValues("nrfApprovers"))
+	g.RevokeApprovers, revokeApproverErr = canonicalDNs("nrfRevokeApprovers", entry.GetAttributeValues("nrfRevokeApprovers"))
+	g.ApprovalRequired, approvalErr = parseLDAPBool("nrfApprovalRequired", entry.GetAttributeValue("nrfApprovalRequired"))
+	g.RevokeRequired, revokeErr = parseLDAPBool("nrfRevokeRequired", entry.GetAttributeValue("nrfRevokeRequired"))
+	return g, errors.Join(ownerErr, approverErr, revokeApproverErr, approvalErr, revokeErr)
+}
+
+// principals liefert alle referenzierten Benutzer und Gruppen nach Art.
+func (g governance) principals() map[string][]string {
+	return map[string][]string{
+		principalOwner:          g.Owners,
+		principalApprover:       g.Approvers,
+		principalRevokeApprover: g.RevokeApprovers,
+	}
+}
+
+// principal ist ein aufgelöster Benutzer oder eine Gruppe.
+type principal struct {
+	DN          string
+	Type        string
+	DisplayName string
+}
+
+// principalLink ordnet einer Rolle oder Ressource einen Eigentümer oder
+// Genehmiger zu (viz_owners bzw. viz_approvers).
+type principalLink struct {
+	ObjectDN      string `json:"object_dn"`
+	ObjectType    string `json:"object_type"`
+	Kind          string `json:"kind"`
+	PrincipalDN   string `json:"principal_dn"`
+	PrincipalType string `json:"principal_type"`
+	DisplayName   string `json:"display_name"`
+}
+
+// isOwner meldet, ob die Zuordnung nach viz_owners gehört.
+func (l principalLink) isOwner() bool {
+	return l.Kind == principalOwner
+}
+
+// principalLinks bildet die Zuordnungen aller Rollen und Ressourcen mit den
+// aufgelösten Benutzern und Gruppen. Mehrfach genannte DNs werden nur einmal
+// übernommen.
+func principalLinks(roles []roleRecord, resources []resourceRecord, resolved map[string]principal) []principalLink {
+	var links []principalLink
+	add := func(objectDN, objectType string, g governance) {
+		for _, kind := range []string{principalOwner, principalApprover, principalRevokeApprover} {
+			seen := map[string]bool{}
+			for _, dn := range g.principals()[kind] {
+				if seen[graphKey(dn)] {
+					continue
+				}
+				seen[graphKey(dn)] = true
+				p := resolved[graphKey(dn)]
+				links = append(links, principalLink{
+					ObjectDN:      objectDN,
+					ObjectType:    objectType,
+					Kind:          kind,
+					PrincipalDN:   dn,
+					PrincipalType: p.Type,
+					DisplayName:   p.DisplayName,
+				})
+			}
+		}
+	}
+	for _, role := range roles {
+		add(role.DN, graphRole, role.governance)
+	}
+	for _, res := range resources {
+		add(res.DN, graphResource, res.governance)
+	}
+	return links
+}
+
+// resolvePrincipals liest Art und Anzeigenamen der referenzierten Einträge.
+// Nicht vorhandene Einträge werden mit Art "unknown" und dem Wert des ersten
+// RDN aufgenommen und als zweite Rückgabe geliefert.
+func resolvePrincipals(conn *ldap.Conn, dns []string) (map[string]principal, []string, error) {
+	resolved := map[string]principal{}
+	var missing []string
+	for _, dn := range dns {
+		key := graphKey(dn)
+		if _, done := resolved[key]; done {
+			continue
+		}
+		sr, err := conn.Search(ldap.NewSearchRequest(dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false, "(objectClass=*)", principalAttributes, nil))
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) || (err == nil && len(sr.Entries) == 0) {
+			resolved[key] = principal{DN: dn, Type: "unknown", DisplayName: localizedLabel(nil, nil, dn)}
+			missing = append(missing, dn)
+			continue
+		}
+		if err != nil {
+			return resolved, missing, fmt.Errorf("LDAP-Suchfehler für %s: %w", dn, err)
+		}
+		resolved[key] = principalFromEntry(sr.Entries[0])
+	}
+	return resolved, missing, nil
+}
+
+// principalFromEntry bestimmt Art und Anzeigenamen eines Eintrags.
+func principalFromEntry(entry *ldap.Entry) principal {
+	p := principal{DN: entry.DN, Type: "other"}
+	classes := entry.GetAttributeValues("objectClass")
+	hasClass := func(names ...string) bool {
+		return slices.ContainsFunc(classes, func(class string) bool {
+			return slices.ContainsFunc(names, func(name string) bool { return strings.EqualFold(class, name) })
+		})
+	}
+	switch {
+	case hasClass("groupOfNames", "groupOfUniqueNames", "group", "dynamicGroup"):
+		p.Type = "group"
+	case hasClass("inetOrgPerson", "organizationalPerson", "person", "user"):
+		p.Type = "user"
+	case hasClass("nrfRole"):
+		p.Type = graphRole
+	}
+	given, sn := entry.GetAttributeValue("givenName"), entry.GetAttributeValue("sn")
+	for _, name := range []string{
+		entry.GetAttributeValue("displayName"),
+		entry.GetAttributeValue("fullName"),
+		strings.TrimSpace(given + " " + sn),
+		entry.GetAttributeValue("cn"),
+	} {
+		if name != "" {
+			p.DisplayName = name
+			return p
+		}
+	}
+	p.DisplayName = localizedLabel(nil, nil, entry.DN)
+	return p
+}
+
+// governanceLinks löst die Eigentümer und Genehmiger der Rollen und
+// Ressourcen über LDAP auf. Die zweite Rückgabe sind die nicht gefundenen Einträge.
+func governanceLinks(conn *ldap.Conn, roles []roleRecord, resources []resourceRecord) ([]principalLink, []string, error) {
+	var dns []string
+	for _, role := range roles {
+		for _, values := range role.principals() {
+			dns = append(dns, values...)
+		}
+	}
+	for _, res := range resources {
+		for _, values := range res.principals() {
+			dns = append(dns, values...)
+		}
+	}
+	resolved, missing, err := resolvePrincipals(conn, dns)
+	if err != nil {
+		return nil, missing, err
+	}
+	return principalLinks(roles, resources, resolved), missing, nil
+}
+
+// syncGovernance löst die Eigentümer und Genehmiger der Rollen und Ressourcen
+// über LDAP auf und ersetzt viz_owners und viz_approvers der Quelle.
+func syncGovernance(run *syncRun, conn *ldap.Conn, sinks []Sink, roles []roleRecord, resources []resourceRecord) error {
+	defer run.timePhase("governance")()
+	log := run.phaseLogger("governance", "viz_owners")
+	log.Info("Löse Eigentümer und Genehmiger auf...")
+
+	links, missing, err := governanceLinks(conn, roles, resources)
+	if err != nil {
+		log.Error("Fehler beim Auflösen der Eigentümer und Genehmiger", keyError, err)
+		return fmt.Errorf("Fehler beim Auflösen der Eigentümer und Genehmiger: %w", err)
+	}
+	for _, dn := range missing {
+		log.Warn("Referenzierter Eintrag nicht gefunden", keyDN, dn)
+	}
+
+	var ownerCounts, approverCounts tableCounts
+	for _, link := range links {
+		if link.isOwner() {
+			ownerCounts.Found++
+		} else {
+			approverCounts.Found++
+		}
+	}
+	defer func() {
+		run.recordCounts("viz_owners", ownerCounts)
+		run.recordCounts("viz_approvers", approverCounts)
+	}()
+
+	err = writeToSinks(log, sinks, []*tableCounts{&ownerCounts, &approverCounts}, func(s Sink) ([]tableCounts, error) {
+		owners, approvers, err := s.WriteGovernance(run, links)
+		return []tableCounts{owners, approvers}, err
+	})
+	if err != nil {
+		return err
+	}
+	log.Info("Eigentümer und Genehmiger geschrieben.", "owners", ownerCounts, "approvers", approverCounts, "unresolved", len(missing))
+	return nil
+}
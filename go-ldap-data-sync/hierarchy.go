@@ -0,0 +1,116 @@
+package main
+
+import "strconv"
+
+// effectiveGrant ist eine Ressource, die eine Rolle direkt oder über die
+// Rollenhierarchie vergibt. Path enthält die DNs von der Rolle bis zu der Rolle,
+// der die Ressource zugeordnet ist; bei direkter Zuordnung nur die Rolle selbst.
+type effectiveGrant struct {
+	RoleDN        string   `json:"role_dn"`
+	ResourceDN    string   `json:"resource_dn"`
+	AssociationDN string   `json:"association_dn"`
+	Path          []string `json:"path"`
+}
+
+// inheritedFrom ist die untergeordnete Rolle, der die Ressource zugeordnet
+// ist, bei direkter Zuordnung leer.
+func (g effectiveGrant) inheritedFrom() string {
+	if !g.inherited() {
+		return ""
+	}
+	return g.Path[len(g.Path)-1]
+}
+
+// inherited meldet, ob die Ressource über eine untergeordnete Rolle vergeben wird.
+func (g effectiveGrant) inherited() bool {
+	return len(g.Path) > 1
+}
+
+// resolveEffectiveResources ermittelt je Rolle alle Ressourcen, die sie direkt
+// oder über untergeordnete Rollen vergibt. Eine höhere Rolle enthält die
+// Rollen, die sie in ihrem nrfParentRoles nennen, sofern deren nrfRoleLevel
+// niedriger ist. Erreicht eine Rolle eine Ressource auf mehreren Wegen, gilt
+// der kürzeste (direkt vor geerbt). Nur aktive Assoziationen vergeben
+// Ressourcen. Die zweite Rückgabe sind die Parent-Beziehungen, die wegen ihrer
+// Level nicht berücksichtigt wurden.
+func resolveEffectiveResources(m roleModel) ([]effectiveGrant, []parentLink) {
+	roleDNs := map[string]string{}
+	levels := map[string]string{}
+	for _, role := range m.Roles {
+		roleDNs[graphKey(role.DN)] = role.DN
+		levels[graphKey(role.DN)] = role.RoleLevel
+	}
+	children := map[string][]string{}
+	var ignored []parentLink
+	for _, role := range m.Roles {
+		for _, link := range role.parentLinks() {
+			parent, child := graphKey(link.ParentDN), graphKey(link.ChildDN)
+			if !containsLevel(levels[parent], levels[child]) {
+				ignored = append(ignored, link)
+				continue
+			}
+			children[parent] = append(children[parent], child)
+		}
+	}
+	associations := map[string][]associationRecord{}
+	for _, assoc := range m.Associations {
+		if !assoc.active() {
+			continue
+		}
+		associations[graphKey(assoc.Role)] = append(associations[graphKey(assoc.Role)], assoc)
+	}
+
+	var grants []effectiveGrant
+	for _, role := range m.Roles {
+		// Breitensuche über die untergeordneten Rollen, Zyklen werden über
+		// previous abgefangen
+		start := graphKey(role.DN)
+		previous := map[string]string{start: ""}
+		queue := []string{start}
+		granted := map[string]bool{}
+		for len(queue) > 0 {
+			key := queue[0]
+			queue = queue[1:]
+			for _, assoc := range associations[key] {
+				if granted[graphKey(assoc.Resource)] {
+					continue
+				}
+				granted[graphKey(assoc.Resource)] = true
+				grants = append(grants, effectiveGrant{
+					RoleDN:        role.DN,
+					ResourceDN:    assoc.Resource,
+					AssociationDN: assoc.DN,
+					Path:          hierarchyPath(previous, roleDNs, key),
+				})
+			}
+			for _, child := range children[key] {
+				if _, seen := previous[child]; !seen {
+					previous[child] = key
+					queue = append(queue, child)
+				}
+			}
+		}
+	}
+	return grants, ignored
+}
+
+// containsLevel meldet, ob eine Rolle mit Level parent eine Rolle mit Level
+// child enthalten kann (z.B. 30 → 20 → 10). Ist ein Level nicht numerisch
+// oder unbekannt, wird die Beziehung berücksichtigt.
+func containsLevel(parent, child string) bool {
+	p, perr := strconv.Atoi(parent)
+	c, cerr := strconv.Atoi(child)
+	if perr != nil || cerr != nil {
+		return true
+	}
+	return c < p
+}
+
+// hierarchyPath setzt den Weg von der Ausgangsrolle bis key zusammen.
+func hierarchyPath(previous, roleDNs map[string]string, key string) []string {
+	var path []string
+	for ; key != ""; key = previous[key] {
+		path = append([]string{roleDNs[key]}, path...)
+	}
+	return path
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestResolveEffectiveResources(t *testing.T) {
+	role := func(dn, level string, parents ...string) roleRecord {
+		return roleRecord{DN: dn, RoleLevel: level, ParentDNs: parents}
+	}
+	assoc := func(dn, role, resource, status string) associationRecord {
+		return associationRecord{DN: dn, Role: role, Resource: resource, Status: status}
+	}
+	// grants gibt die Zuweisungen als "rolle: ressource über pfad" aus
+	grants := func(g []effectiveGrant) []string {
+		var lines []string
+		for _, grant := range g {
+			lines = append(lines, grant.RoleDN+": "+grant.ResourceDN+" über "+strings.Join(grant.Path, " > "))
+		}
+		slices.Sort(lines)
+		return lines
+	}
+
+	tests := []struct {
+		name        string
+		model       roleModel
+		want        []string
+		wantIgnored int
+	}{
+		{
+			name: "direkt und geerbt",
+			model: roleModel{
+				Roles: []roleRecord{
+					role("cn=business", "30"),
+					role("cn=it", "20", "cn=business"),
+					role("cn=perm", "10", "CN=IT"),
+				},
+				Associations: []associationRecord{
+					assoc("cn=a1", "cn=perm", "cn=res1", "50"),
+					assoc("cn=a2", "cn=it", "cn=res2", "50"),
+				},
+			},
+			want: []string{
+				"cn=business: cn=res1 über cn=business > cn=it > cn=perm",
+				"cn=business: cn=res2 über cn=business > cn=it",
+				"cn=it: cn=res1 über cn=it > cn=perm",
+				"cn=it: cn=res2 über cn=it",
+				"cn=perm: cn=res1 über cn=perm",
+			},
+		},
+		{
+			name: "kürzester Weg gewinnt",
+			model: roleModel{
+				Roles: []roleRecord{
+					role("cn=business", "30"),
+					role("cn=it", "20", "cn=business"),
+					role("cn=perm", "10", "cn=it"),
+				},
+				Associations: []associationRecord{
+					assoc("cn=a1", "cn=perm", "cn=res", "50"),
+					assoc("cn=a2", "cn=business", "cn=res", "50"),
+				},
+			},
+			want: []string{
+				"cn=business: cn=res über cn=business",
+				"cn=it: cn=res über cn=it > cn=perm",
+				"cn=perm: cn=res über cn=perm",
+			},
+		},
+		{
+			name: "nur aktive Assoziationen",
+			model: roleModel{
+				Roles: []roleRecord{role("cn=it", "20")},
+				Associations: []associationRecord{
+					assoc("cn=a1", "cn=it", "cn=res1", "50"),
+					assoc("cn=a2", "cn=it", "cn=res2", "10"),
+					assoc("cn=a3", "cn=it", "cn=res3", ""),
+				},
+			},
+			want: []string{"cn=it: cn=res1 über cn=it"},
+		},
+		{
+			name: "Level nicht absteigend",
+			model: roleModel{
+				Roles: []roleRecord{
+					role("cn=perm", "10"),
+					role("cn=it", "20", "cn=perm"),
+					role("cn=other", "20", "cn=it"),
+				},
+				Associations: []associationRecord{assoc("cn=a1", "cn=it", "cn=res", "50")},
+			},
+			want: []string{
+				"cn=it: cn=res über cn=it",
+			},
+			wantIgnored: 2,
+		},
+		{
+			name: "Zyklus bei nicht numerischen Leveln",
+			model: roleModel{
+				Roles: []roleRecord{
+					role("cn=a", "x", "cn=b"),
+					role("cn=b", "x", "cn=a"),
+				},
+				Associations: []associationRecord{assoc("cn=a1", "cn=a", "cn=res", "50")},
+			},
+			want: []string{
+				"cn=a: cn=res über cn=a",
+				"cn=b: cn=res über cn=b > cn=a",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ignored := resolveEffectiveResources(tt.model)
+			if lines := grants(got); !slices.Equal(lines, tt.want) {
+				t.Errorf("effektive Ressourcen:\n%s\nerwartet:\n%s", strings.Join(lines, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if len(ignored) != tt.wantIgnored {
+				t.Errorf("%d ignorierte Parent-Beziehungen, erwartet %d: %v", len(ignored), tt.wantIgnored, ignored)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Schlüssel für einen Wert ohne Sprachkennung.
+const rawLanguage = "raw"
+
+// Standard der Sprach-Fallback-Kette für display_name.
+const defaultLanguageFallback = "de,en"
+
+// Gültige Sprachkennungen nach der Normalisierung, z.B. de, en_US oder de_AT.
+var languagePattern = regexp.MustCompile(`^[a-z]{2,3}(_[A-Z]{2})?$`)
+
+// normalizeLanguage bringt eine Sprachkennung in die Form sprache_REGION,
+// z.B. "DE-at" zu "de_AT".
+func normalizeLanguage(code string) string {
+	code = strings.ReplaceAll(strings.TrimSpace(code), "-", "_")
+	lang, region, found := strings.Cut(code, "_")
+	if !found {
+		return strings.ToLower(lang)
+	}
+	return strings.ToLower(lang) + "_" + strings.ToUpper(region)
+}
+
+// parseLanguages liest eine kommagetrennte Liste von Sprachkennungen, z.B.
+// aus LANGUAGE_FALLBACK.
+func parseLanguages(value string) ([]string, error) {
+	var languages []string
+	var errs []error
+	for _, code := range strings.Split(value, ",") {
+		if strings.TrimSpace(code) == "" {
+			continue
+		}
+		lang := normalizeLanguage(code)
+		if !languagePattern.MatchString(lang) {
+			errs = append(errs, fmt.Errorf("LANGUAGE_FALLBACK: %q ist keine gültige Sprachkennung", code))
+			continue
+		}
+		languages = append(languages, lang)
+	}
+	return languages, errors.Join(errs...)
+}
+
+// parseLocalized parst einen mehrsprachigen Wert im IDM-Format
+// "en~Name|de_AT~Name". Ein Backslash maskiert das folgende Zeichen, so dass
+// "|", "~" und "\" auch in Werten vorkommen können. Sprachkennungen werden
+// normalisiert. Auffälligkeiten wie doppelte Sprachen oder Werte ohne
+// Sprachkennung werden als Warnungen zurückgegeben; der erste Wert gewinnt.
+func parseLocalized(attribute, value string) (map[string]string, error) {
+	result := make(map[string]string)
+	var warnings []error
+	warn := func(format string, args ...any) {
+		warnings = append(warnings, fmt.Errorf("%s: "+format, append([]any{attribute}, args...)...))
+	}
+
+	add := func(lang string, hasLang bool, text string) {
+		if !hasLang {
+			if text == "" {
+				return
+			}
+			warn("Wert %q ohne Sprachkennung", text)
+			lang = rawLanguage
+		} else {
+			code := lang
+			lang = normalizeLanguage(lang)
+			if !languagePattern.MatchString(lang) {
+				warn("ungültige Sprachkennung %q", code)
+			}
+		}
+		if _, exists := result[lang]; exists {
+			warn("Sprache %s mehrfach vorhanden, %q wird ignoriert", lang, text)
+			return
+		}
+		result[lang] = text
+	}
+
+	var lang, text strings.Builder
+	hasLang, escaped := false, false
+	for _, r := range value {
+		switch {
+		case escaped:
+			text.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '~' && !hasLang:
+			lang.WriteString(text.String())
+			text.Reset()
+			hasLang = true
+		case r == '|':
+			add(lang.String(), hasLang, text.String())
+			lang.Reset()
+			text.Reset()
+			hasLang = false
+		default:
+			text.WriteRune(r)
+		}
+	}
+	if escaped {
+		warn("Backslash am Ende des Werts")
+		text.WriteRune('\\')
+	}
+	add(lang.String(), hasLang, text.String())
+	return result, errors.Join(warnings...)
+}
+
+// localizedLabel liefert den Namen nach der Sprach-Fallback-Kette. Für jede
+// Sprache wird zuerst der exakte Eintrag gesucht, dann die Sprache ohne
+// Region (de_AT → de) und dann eine beliebige Region der Sprache (de → de_AT).
+// Danach folgen ein Wert ohne Sprachkennung, der erste vorhandene Name und
+// zuletzt der Wert des ersten RDN.
+func localizedLabel(names map[string]string, languages []string, dn string) string {
+	keys := make([]string, 0, len(names))
+	for key := range names {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, lang := range languages {
+		if name := names[lang]; name != "" {
+			return name
+		}
+		base, _, _ := strings.Cut(lang, "_")
+		if name := names[base]; name != "" {
+			return name
+		}
+		for _, key := range keys {
+			if strings.HasPrefix(key, base+"_") && names[key] != "" {
+				return names[key]
+			}
+		}
+	}
+	if name := names[rawLanguage]; name != "" {
+		return name
+	}
+	for _, key := range keys {
+		if names[key] != "" {
+			return names[key]
+		}
+	}
+	if parsed, err := ldap.ParseDN(dn); err == nil && len(parsed.RDNs) > 0 && len(parsed.RDNs[0].Attributes) > 0 {
+		return parsed.RDNs[0].Attributes[0].Value
+	}
+	return dn
+}
+
+// languageChain stellt eine explizit gewünschte Sprache, z.B. aus --lang, vor
+// die konfigurierte Fallback-Kette.
+func languageChain(lang string, fallback []string) []string {
+	if lang == "" {
+		return fallback
+	}
+	return append([]string{normalizeLanguage(lang)}, fallback...)
+}
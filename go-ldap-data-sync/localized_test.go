@@ -0,0 +1,62 @@
+package main
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestParseLocalized(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		want     map[string]string
+		wantWarn bool
+	}{
+		{"leer", "", map[string]string{}, false},
+		{"mehrere Sprachen", "en~Admin|de~Verwalter", map[string]string{"en": "Admin", "de": "Verwalter"}, false},
+		{"Region normalisiert", "DE-at~Verwalter", map[string]string{"de_AT": "Verwalter"}, false},
+		{"maskierte Zeichen", `en~a\|b\~c\\d`, map[string]string{"en": `a|b~c\d`}, false},
+		{"Tilde im Wert", "en~a~b", map[string]string{"en": "a~b"}, false},
+		{"ohne Sprachkennung", "Verwalter", map[string]string{rawLanguage: "Verwalter"}, true},
+		{"doppelte Sprache", "en~A|EN~B", map[string]string{"en": "A"}, true},
+		{"ungültige Sprachkennung", "deutsch~Verwalter", map[string]string{"deutsch": "Verwalter"}, true},
+		{"Backslash am Ende", `en~a\`, map[string]string{"en": `a\`}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLocalized("nrfLocalizedNames", tt.value)
+			if (err != nil) != tt.wantWarn {
+				t.Fatalf("parseLocalized(%q) = %v, Warnung erwartet: %v", tt.value, err, tt.wantWarn)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("parseLocalized(%q) = %v, erwartet %v", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalizedLabel(t *testing.T) {
+	const dn = "cn=Admin,cn=Level20,cn=RoleDefs"
+	tests := []struct {
+		name      string
+		names     map[string]string
+		languages []string
+		want      string
+	}{
+		{"exakte Sprache", map[string]string{"de": "Verwalter", "en": "Admin"}, []string{"de", "en"}, "Verwalter"},
+		{"Fallback-Reihenfolge", map[string]string{"en": "Admin"}, []string{"de", "en"}, "Admin"},
+		{"Sprache ohne Region", map[string]string{"de": "Verwalter"}, []string{"de_AT"}, "Verwalter"},
+		{"beliebige Region", map[string]string{"de_CH": "Verwalter CH", "de_AT": "Verwalter AT"}, []string{"de"}, "Verwalter AT"},
+		{"leerer Wert übersprungen", map[string]string{"de": "", "en": "Admin"}, []string{"de", "en"}, "Admin"},
+		{"ohne Sprachkennung", map[string]string{rawLanguage: "Roh", "fr": "Admin FR"}, []string{"de"}, "Roh"},
+		{"erster vorhandener Name", map[string]string{"it": "Admin IT", "fr": "Admin FR"}, []string{"de"}, "Admin FR"},
+		{"RDN", map[string]string{}, []string{"de"}, "Admin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := localizedLabel(tt.names, tt.languages, dn); got != tt.want {
+				t.Errorf("localizedLabel(%v, %v) = %q, erwartet %q", tt.names, tt.languages, got, tt.want)
+			}
+		})
+	}
+}
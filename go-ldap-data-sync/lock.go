@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	lockFail = "fail"
+	lockWait = "wait"
+)
+
+// runLockClass ist der erste Teil des Schlüssels der Advisory-Sperre ("ldsp"),
+// damit sich die Sperre nicht mit Sperren anderer Anwendungen überschneidet.
+// Der zweite Teil ist der Hash von Zielschema und Tabellenpräfix.
+const runLockClass = 0x6c647370
+
+// runLockPoll ist der Abstand der Versuche, die Sperre im Modus wait zu erhalten.
+const runLockPoll = 5 * time.Second
+
+// lockConfig steuert die Sperre, die überlappende Läufe gegen dieselben
+// Tabellen verhindert.
+type lockConfig struct {
+	// fail: sofort abbrechen, wait: auf das Ende des anderen Laufs warten
+	Mode string
+	// Höchstens so lange warten, 0 = unbegrenzt
+	Timeout time.Duration
+}
+
+// initLockConfig liest SYNC_LOCK_MODE und SYNC_LOCK_TIMEOUT_SECONDS.
+func initLockConfig(src *configSource) lockConfig {
+	return lockConfig{
+		Mode:    src.oneOf("SYNC_LOCK_MODE", lockFail, lockFail, lockWait),
+		Timeout: time.Duration(src.int("SYNC_LOCK_TIMEOUT_SECONDS", 0)) * time.Second,
+	}
+}
+
+// runLock ist eine gehaltene Advisory-Sperre. Sie gehört zur Sitzung der
+// eigenen Verbindung und endet spätestens, wenn diese abbricht.
+type runLock struct {
+	conn *sql.Conn
+	key  string
+	log  *slog.Logger
+}
+
+// runLockKey bildet den Schlüssel aus Zielschema und Tabellenpräfix, sodass
+// Läufe in getrennte Tabellen einander nicht blockieren.
+func runLockKey(target targetConfig) string {
+	return target.Schema + "|" + target.Prefix
+}
+
+// acquireRunLock holt die Sperre für die Tabellen des Ziels. Hält ein anderer
+// Lauf sie, wird je nach SYNC_LOCK_MODE abgebrochen oder gewartet.
+func acquireRunLock(run *syncRun, db *sql.DB, cfg lockConfig, target targetConfig) (*runLock, error) {
+	log := run.log.With(keyPhase, "lock")
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Fehler beim Öffnen der Verbindung für die Laufsperre: %w", err)
+	}
+	lock := &runLock{conn: conn, key: runLockKey(target), log: log}
+
+	start := time.Now()
+	waiting := false
+	for {
+		var acquired bool
+		if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1, hashtext($2))`, runLockClass, lock.key).Scan(&acquired); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Fehler beim Holen der Laufsperre: %w", err)
+		}
+		if acquired {
+			if waiting {
+				log.Info("Laufsperre erhalten", "waited", time.Since(start).Round(time.Second).String())
+			} else {
+				log.Debug("Laufsperre erhalten", "key", lock.key)
+			}
+			return lock, nil
+		}
+
+		holder := lock.holder(ctx)
+		if cfg.Mode != lockWait {
+			conn.Close()
+			return nil, fmt.Errorf("ein anderer Lauf hält die Laufsperre (%s), SYNC_LOCK_MODE=wait wartet auf dessen Ende", holder)
+		}
+		if cfg.Timeout > 0 && time.Since(start) >= cfg.Timeout {
+			conn.Close()
+			return nil, fmt.Errorf("Laufsperre nach %s nicht erhalten, sie hält weiterhin ein anderer Lauf (%s)", cfg.Timeout, holder)
+		}
+		if !waiting {
+			log.Warn("Ein anderer Lauf hält die Laufsperre, warte auf dessen Ende", "holder", holder, "timeout", cfg.Timeout.String())
+			waiting = true
+		}
+		delay := runLockPoll
+		if cfg.Timeout > 0 {
+			delay = min(delay, cfg.Timeout-time.Since(start))
+		}
+		time.Sleep(max(delay, 0))
+	}
+}
+
+// holder beschreibt die Sitzung, die die Sperre hält, soweit sie sichtbar ist.
+func (l *runLock) holder(ctx context.Context) string {
+	var pid int
+	var application, client string
+	err := l.conn.QueryRowContext(ctx, `SELECT a.pid, coalesce(a.application_name, ''), coalesce(host(a.client_addr), '')
+		FROM pg_locks l JOIN pg_stat_activity a ON a.pid = l.pid
+		WHERE l.locktype = 'advisory' AND l.granted AND l.database = (SELECT oid FROM pg_database WHERE datname = current_database())
+			AND l.classid = $1::int4::oid AND l.objid = hashtext($2)::oid AND l.objsubid = 2`, runLockClass, l.key).Scan(&pid, &application, &client)
+	if err != nil {
+		return "Sitzung unbekannt"
+	}
+	return fmt.Sprintf("pid %d, application_name %q, client %q", pid, application, client)
+}
+
+// release gibt die Sperre frei und gibt die Verbindung zurück. War die Sperre
+// nicht mehr gehalten, ist die Sitzung während des Laufs abgebrochen.
+func (l *runLock) release() {
+	var released bool
+	err := l.conn.QueryRowContext(context.Background(), `SELECT pg_advisory_unlock($1, hashtext($2))`, runLockClass, l.key).Scan(&released)
+	switch {
+	case err != nil:
+		l.log.Warn("Fehler beim Freigeben der Laufsperre, sie endet mit der Verbindung", keyError, err)
+		// Die Verbindung verwerfen statt sie mit der Sperre in den Pool zurückzugeben
+		l.conn.Raw(func(any) error { return driver.ErrBadConn })
+	case !released:
+		l.log.Warn("Laufsperre war nicht mehr gehalten, die Verbindung ist während des Laufs abgebrochen")
+	}
+	l.conn.Close()
+}
+
+// runLocker ist eine Sink, die gemeinsam genutzte Tabellen beschreibt und deshalb
+// während des Schreibens die Laufsperre hält.
+type runLocker interface {
+	lockRun(run *syncRun) error
+	unlockRun()
+}
+
+// lockSinks holt die Laufsperre aller Sinks, die eine führen. Die gelieferte
+// Funktion gibt sie wieder frei.
+func lockSinks(run *syncRun, sinks []Sink) (unlock func(), err error) {
+	var locked []runLocker
+	unlock = func() {
+		for _, l := range locked {
+			l.unlockRun()
+		}
+	}
+	for _, s := range sinks {
+		l, ok := s.(runLocker)
+		if !ok {
+			continue
+		}
+		if err := l.lockRun(run); err != nil {
+			unlock()
+			return nil, fmt.Errorf("Sink %s: %w", s.Name(), err)
+		}
+		locked = append(locked, l)
+	}
+	return unlock, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Stabile Schlüssel für strukturierte Log-Einträge. Die Log-Plattform filtert
+// auf diese Namen, daher dürfen sie nicht ohne Abstimmung geändert werden.
+const (
+	keyRunID    = "run_id"
+	keyCommand  = "command"
+	keySource   = "source"
+	keySink     = "sink"
+	keyPhase    = "phase"
+	keyTable    = "table"
+	keyDN       = "dn"
+	keyCounts   = "counts"
+	keyError    = "error"
+	keyDecision = "decision"
+)
+
+// Entscheidungen, die im ausführlichen Log-Level pro Eintrag protokolliert werden.
+const (
+	decisionInserted   = "inserted"
+	decisionUpdated    = "updated"
+	decisionSkipped    = "skipped"
+	decisionParseError = "parse-error"
+)
+
+// newLogger erstellt einen slog-Logger im gewünschten Format (json oder text)
+// und mit dem gewünschten Level (debug/verbose, info, warn, error).
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	switch strings.ToLower(level) {
+	case "debug", "verbose":
+		lvl = slog.LevelDebug
+	case "", "info":
+		lvl = slog.LevelInfo
+	case "warn", "warning":
+		lvl = slog.LevelWarn
+	case "error":
+		lvl = slog.LevelError
+	default:
+		return nil, fmt.Errorf("unbekanntes Log-Level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unbekanntes Log-Format %q", format)
+	}
+}
+
+// setupLogging konfiguriert den Standard-Logger anhand von LOG_FORMAT und
+// LOG_LEVEL. Ungültige Werte führen zu einem Text-Logger auf Level info.
+func setupLogging() {
+	logger, err := newLogger(os.Stderr, os.Getenv("LOG_FORMAT"), os.Getenv("LOG_LEVEL"))
+	if err != nil {
+		logger, _ = newLogger(os.Stderr, "text", "info")
+		logger.Warn("Ungültige Logging-Konfiguration, verwende Text-Format mit Level info", keyError, err)
+	}
+	slog.SetDefault(logger)
+}
+
+// newRunID erzeugt eine zufällige Korrelations-ID für einen Synchronisationslauf.
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// fatal protokolliert einen Fehler und beendet das Programm mit Exit-Code 1.
+func fatal(log *slog.Logger, msg string, args ...any) {
+	log.Error(msg, args...)
+	os.Exit(1)
+}
+
+// tableCounts sammelt die Zähler einer Tabelle innerhalb eines Laufs.
+type tableCounts struct {
+	Found       int
+	Inserted    int
+	Updated     int
+	Skipped     int
+	ParseErrors int
+	// Über die GUID erkannte Umbenennungen und Verschiebungen
+	Renamed int
+}
+
+// LogValue sorgt dafür, dass Zähler immer als Gruppe "counts" mit festen
+// Schlüsseln im Log erscheinen.
+func (c tableCounts) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("found", c.Found),
+		slog.Int("inserted", c.Inserted),
+		slog.Int("updated", c.Updated),
+		slog.Int("skipped", c.Skipped),
+		slog.Int("parse_errors", c.ParseErrors),
+		slog.Int("renamed", c.Renamed),
+	)
+}
+
+// syncRun bündelt den Zustand eines einzelnen Synchronisationslaufs. Innerhalb
+// eines Laufs wird je Quellprofil eine Kopie mit gesetztem source verwendet.
+type syncRun struct {
+	id      string
+	start   time.Time
+	log     *slog.Logger
+	metrics *runMetrics
+	source  string
+	// Physische Tabellennamen (Schema und Präfix) des Laufs
+	tables tableNames
+	// Sprach-Fallback-Kette für display_name
+	languages []string
+}
+
+// newSyncRun startet einen neuen Lauf eines Kommandos mit eigener Korrelations-ID.
+func newSyncRun(command string) *syncRun {
+	id := newRunID()
+	return &syncRun{
+		id:      id,
+		start:   time.Now(),
+		log:     slog.Default().With(keyRunID, id, keyCommand, command),
+		metrics: newRunMetrics(),
+		tables:  defaultTableNames,
+	}
+}
+
+// forSource liefert den Lauf für ein Quellprofil. Er teilt ID, Startzeit und
+// Metriken mit dem Gesamtlauf, protokolliert aber zusätzlich die Quelle.
+func (r *syncRun) forSource(name string) *syncRun {
+	return &syncRun{
+		id:        r.id,
+		start:     r.start,
+		log:       r.log.With(keySource, name),
+		metrics:   r.metrics,
+		source:    name,
+		tables:    r.tables,
+		languages: r.languages,
+	}
+}
+
+// table liefert den physischen, maskierten Namen einer Tabelle für SQL.
+func (r *syncRun) table(name string) string {
+	return r.tables.qualified(name)
+}
+
+// recordCounts übernimmt die Zähler einer Tabelle für die Quelle des Laufs.
+func (r *syncRun) recordCounts(table string, c tableCounts) {
+	r.metrics.recordCounts(r.source, table, c)
+}
+
+// tableMetrics liefert die Metrik-Zähler einer Tabelle für die Quelle des Laufs.
+func (r *syncRun) tableMetrics(table string) *tableMetrics {
+	return r.metrics.table(r.source, table)
+}
+
+// timePhase startet die Zeitmessung einer Phase. Die zurückgegebene Funktion
+// beendet die Messung und ist für den Einsatz mit defer gedacht.
+func (r *syncRun) timePhase(phase string) func() {
+	started := time.Now()
+	return func() {
+		r.metrics.phaseDurations[phase] += time.Since(started)
+	}
+}
+
+// finish schließt den Lauf ab und hält Dauer und Exit-Status fest.
+func (r *syncRun) finish(err error) {
+	r.metrics.finishedAt = time.Now()
+	r.metrics.duration = r.metrics.finishedAt.Sub(r.start)
+	if err != nil {
+		r.metrics.exitStatus = 1
+		r.log.Error("Lauf fehlgeschlagen", keyError, err, "duration", r.metrics.duration.String())
+		return
+	}
+	r.log.Info("Lauf abgeschlossen. Programm wird beendet.", "duration", r.metrics.duration.String())
+}
+
+// phaseLogger liefert einen Logger für eine Phase und die zugehörige Tabelle.
+func (r *syncRun) phaseLogger(phase, table string) *slog.Logger {
+	return r.log.With(keyPhase, phase, keyTable, table)
+}
+
+// logDecision protokolliert im ausführlichen Level, was mit einem Eintrag passiert ist.
+func logDecision(log *slog.Logger, dn, decision string, args ...any) {
+	log.Debug("Eintrag verarbeitet", append([]any{keyDN, dn, keyDecision, decision}, args...)...)
+}
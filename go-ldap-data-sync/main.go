@@ -15,23 +15,267 @@
  * `go get github.com/jackc/pgx/v5`
  * 5. Erstellen Sie eine `.env`-Datei mit den Konfigurationen.
  * 6. Führen Sie das Programm aus:
- * - Für den normalen Betrieb: `go run main.go`
- * - Für den Trockenlauf (nur lesen, nicht schreiben): `DRY_RUN=true go run main.go`
+ * - Für den normalen Betrieb: `go run .`
+ * - Für den Trockenlauf (nur lesen, nicht schreiben): `DRY_RUN=true go run .`
+ *   Ist eine Datenbank konfiguriert, wird sie nur lesend geöffnet und die exakten
+ *   Änderungen (umbenannt, neu, geändert, als gelöscht markiert, endgültig
+ *   gelöscht) werden ausgegeben. Verglichen werden alle Spalten, die die Sinks
+ *   schreiben, auch in den je Lauf ersetzten Tabellen (Parameter, effektive
+ *   Ressourcen, Eigentümer und Genehmiger).
+ *   DRY_RUN_OUTPUT=/pfad/changeset.json schreibt sie zusätzlich als JSON,
+ *   DRY_RUN_DETAIL_LIMIT (Standard: 50) begrenzt die gelisteten Datensätze.
+ *
+ * Konfigurationsdatei und Geheimnisse:
+ * - CONFIG_FILE=/pfad/config.yaml (oder .toml) liest alle Einstellungen aus einer
+ *   Datei (z.B. ldap.host, database.name, safety.tables.roles.max_drop_percent,
+ *   sources: [{name: prod, host: ...}]). Umgebungsvariablen haben Vorrang.
+ * - Passwörter können statt direkt über <NAME>_FILE aus einer Datei gelesen
+ *   werden (z.B. DB_PASSWORD_FILE=/run/secrets/db für Kubernetes-Secrets).
+ * - Ungültige Zahlen oder Werte brechen den Start mit einer Fehlermeldung ab.
+ * - `config check [--file datei]` meldet alle Probleme auf einmal und gibt die
+ *   wirksame Konfiguration mit Herkunft aus (Geheimnisse als ***).
+ *
+ * Datenbankverbindung:
+ * - DB_HOST, DB_PORT, DBUSER, DB_PASSWORD und DB_DATABASE oder DATABASE_URL
+ *   (postgres://... oder libpq-Schlüssel/Wert-Zeichenkette, auch DATABASE_URL_FILE).
+ * - DB_SSLMODE=disable|allow|prefer|require|verify-ca|verify-full (Standard ohne
+ *   DATABASE_URL: disable) mit DB_SSLROOTCERT, DB_SSLCERT und DB_SSLKEY.
+ * - DB_APPLICATION_NAME (Standard: idm_ldap_sync), DB_STATEMENT_TIMEOUT_SECONDS
+ *   (Standard: 0 = aus) und DB_SEARCH_PATH setzen Sitzungsparameter.
+ * - DB_MAX_OPEN_CONNS (Standard: 0 = unbegrenzt), DB_MAX_IDLE_CONNS (Standard: 2)
+ *   und DB_CONN_MAX_LIFETIME_SECONDS (Standard: 0 = unbegrenzt) begrenzen den Pool.
+ *
+ * Zielschema und Tabellennamen:
+ * - DB_SCHEMA (Standard: Suchpfad) und DB_TABLE_PREFIX (Standard: viz_) legen
+ *   fest, wohin geschrieben wird, z.B. DB_TABLE_PREFIX=idm_ für idm_roles.
+ * - DB_BLUE_GREEN=true lädt in ein Schattenschema (DB_SHADOW_SCHEMA, Standard:
+ *   <DB_SCHEMA>_shadow), das den Stand des Zielschemas übernimmt und nach einem
+ *   fehlerfreien Lauf atomar gegen DB_SCHEMA getauscht wird. Der vorherige Stand
+ *   bleibt bis zum nächsten Tausch als <DB_SCHEMA>_previous erhalten. Das
+ *   Zielschema muss dem Programm allein gehören. DB_BLUE_GREEN_GRANT_ROLES
+ *   vergibt vor dem Tausch Leserechte an die angegebenen Rollen.
+ *
+ * Ausgabeziele (Sinks):
+ * - SINKS ist eine kommagetrennte Liste (Standard: postgres). Neben postgres gibt es
+ *   sqlite:<datei>, jsonl:<datei> (JSON Lines, wird am Ende des Laufs atomar
+ *   ersetzt) und stdout.
+ *   Jede Zeile von jsonl und stdout enthält type (role, parent, resource,
+ *   association, effective_resource, owner, approver), source, run_id und record.
+ * - sqlite:<datei> schreibt dieselben Tabellen (mit DB_TABLE_PREFIX) samt Indizes
+ *   für Abfragen Rolle → Ressource in eine SQLite-Datei, z.B. für die Analyse ohne
+ *   PostgreSQL-Server. Der Treiber ist CGO-frei. Nicht mehr gefundene Datensätze
+ *   werden als gelöscht markiert, aber nicht gelöscht.
+ * - Als gelöscht markiert wird in postgres und sqlite, endgültig gelöscht und im
+ *   Laufprotokoll festgehalten nur in postgres; die Metriken zählen die
+ *   Schreibergebnisse der ersten Sink.
+ *
+ * Lokalisierte Namen:
+ * - nrfLocalizedNames/nrfLocalizedDescrs werden im Format "en~Name|de_AT~Name"
+ *   gelesen; ein Backslash maskiert "|", "~" und "\". Sprachkennungen werden
+ *   normalisiert (de-at → de_AT). Doppelte Sprachen, Werte ohne Sprachkennung
+ *   ("raw") und ungültige Kennungen zählen als Parse-Fehler und werden im Level
+ *   debug protokolliert; der erste Wert gewinnt.
+ * - LANGUAGE_FALLBACK (Standard: de,en) bestimmt die Spalte display_name von
+ *   Rollen und Ressourcen: je Sprache der exakte Eintrag, dann die Sprache ohne
+ *   Region, dann eine beliebige Region; danach "raw", der erste Name und der RDN.
+ *
+ * Typisierte Spalten:
+ * - Die LDAP-Rohwerte bleiben unverändert erhalten. Zusätzlich enthalten
+ *   viz_roles role_level (Zahl), role_level_key (permission, it, business,
+ *   custom) und role_level_name, viz_resources allow_multi (boolean) und
+ *   viz_roles_resources status_code, status_key (z.B. 50 = active), status_name
+ *   sowie ldap_created_at/ldap_modified_at (timestamptz aus Generalized Time).
+ * - Nicht lesbare Werte zählen als Parse-Fehler, die typisierte Spalte bleibt
+ *   NULL. Bestehende Datensätze werden beim Start aus den Rohwerten befüllt.
+ *
+ * Status der Assoziationen:
+ * - Assoziationen werden mit jedem nrfStatus synchronisiert (z.B. ausstehende
+ *   Genehmigung, abgelehnt, zurückgezogen), nicht nur aktive (50). Verlässt eine
+ *   Assoziation den Status 50, bleibt sie mit ihrem neuen Status erhalten;
+ *   is_deleted kennzeichnet nur Assoziationen, die es in LDAP nicht mehr gibt.
+ * - status_changed_at ist der Zeitpunkt des Laufs, der zuletzt eine Änderung von
+ *   status_key festgestellt hat. approval enthält die Genehmigungsattribute
+ *   (nrfApprovalRequired, nrfApprovalOverride, nrfApprovalDefinition),
+ *   approval_required den Wert von nrfApprovalRequired als boolean.
+ * - Effektive Ressourcen, Audit und Hierarchie berücksichtigen nur aktive
+ *   Assoziationen; im Graph-Export sind die übrigen gepunktet. Die API des
+ *   Backends liefert ebenfalls nur aktive, mit ?status=all alle Assoziationen.
+ *
+ * Eigentümer und Genehmiger:
+ * - Von Rollen und Ressourcen werden owner, nrfApprovers, nrfRevokeApprovers,
+ *   nrfApprovalRequired/nrfApprovalDefinition und nrfRevokeRequired/
+ *   nrfRevokeDefinition gelesen. Die Einstellungen stehen in den Spalten
+ *   approval_required, approval_definition (DN der Genehmigungs-PRD),
+ *   revoke_required und revoke_definition.
+ * - Die referenzierten Benutzer und Gruppen werden per LDAP aufgelöst (Art und
+ *   Anzeigename aus displayName, fullName, givenName/sn oder cn) und in
+ *   viz_owners bzw. viz_approvers (kind approver oder revoke_approver)
+ *   gespeichert. Nicht gefundene Einträge werden protokolliert und mit Art
+ *   unknown übernommen. Beide Tabellen werden je Quelle vollständig ersetzt,
+ *   aber nur, wenn Rollen und Ressourcen fehlerfrei gelesen wurden.
+ *
+ * Kanonische DNs:
+ * - Alle Schlüssel- und Verweisspalten (dn, nrfRole, nrfResource, child_dn,
+ *   parent_dn, object_dn, owner_dn usw.) enthalten den DN in kanonischer Form:
+ *   mit dem DN-Parser von go-ldap gelesen, in Kleinbuchstaben, ohne Leerzeichen
+ *   um Trennzeichen und einheitlich maskiert. Joins zwischen entry.DN und den
+ *   Verweisattributen scheitern so nicht mehr an abweichender Schreibweise.
+ * - original_dn enthält den DN, wie eDirectory ihn liefert, für die Anzeige;
+ *   guid die GUID (entryUUID bzw. das binäre GUID-Attribut als UUID), die bei
+ *   Umbenennungen erhalten bleibt. Nicht lesbare DNs zählen als Parse-Fehler.
+ * - Bestehende Datensätze werden beim Start umgestellt. Fallen dabei zwei
+ *   Datensätze auf denselben Schlüssel, bleibt der zuletzt aktualisierte.
+ *
+ * Umbenennungen und Verschiebungen:
+ * - Liefert eine Quelle eine bekannte GUID unter einem neuen DN, wird der
+ *   Datensatz samt aller Verweise (Hierarchie, Assoziationen, effektive
+ *   Ressourcen, Owner, Approver, Parameter) auf den neuen DN umgestellt, statt
+ *   den alten als gelöscht zu markieren und einen neuen anzulegen.
+ * - Jede Umstellung wird als rename, move oder rename_move in viz_sync_renames
+ *   (nur postgres) festgehalten und in counts.renamed gezählt.
+ *
+ * Dynamische Parameter:
+ * - nrfDynamicParmVals wird als XML gelesen, alle <parameter>-Elemente mit Name,
+ *   Typ und Wert; zusätzlich HTML-kodierte Entities in den Werten (&quot;,
+ *   &amp;, &#34; usw.) werden dekodiert. Mehrere <value>-Elemente ergeben ein
+ *   JSON-Array.
+ * - viz_roles_resources.nrfdynamicparmvals_parameters enthält alle Parameter als
+ *   JSONB, nrfdynamicparmvals_value_json wie bisher den Wert des ersten.
+ * - viz_association_parameters enthält je Parameter eine Zeile (position, name,
+ *   type, value, value_json) und macht z.B. AD-Gruppen oder SAP-Systeme suchbar.
+ *
+ * Effektive Ressourcen:
+ * - viz_role_effective_resources enthält je Rolle alle Ressourcen, die sie direkt
+ *   oder über untergeordnete Rollen vergibt, mit inherited_from, path (DNs von der
+ *   Rolle bis zur Rolle mit der Assoziation) und depth. Eine Rolle enthält nur
+ *   Rollen mit niedrigerem nrfRoleLevel; abweichende Parent-Beziehungen werden
+ *   protokolliert und ignoriert. Die Tabelle wird je Quelle vollständig ersetzt,
+ *   aber nur, wenn Rollen und Assoziationen fehlerfrei gelesen wurden.
+ *
+ * Daemon-Modus (Änderungen nahezu in Echtzeit):
+ * - `watch [--force]` läuft dauerhaft: Nach einem vollständigen Abgleich wie bei
+ *   `sync` werden Änderungen unterhalb der Suchbasen je Quelle verfolgt und
+ *   einzeln in postgres bzw. sqlite übernommen (Dateisinks nur beim Abgleich).
+ * - WATCH_MODE=auto|persistent|poll (Standard: auto): Persistent Search von
+ *   eDirectory mit Entry Change Notification; ohne dieses Control wird alle
+ *   WATCH_POLL_INTERVAL_SECONDS (Standard: 30) nach modifyTimestamp gesucht.
+ *   Löschungen erkennt nur die Persistent Search, sonst der nächste Abgleich.
+ * - Änderungen der Persistent Search werden WATCH_BATCH_SECONDS (Standard: 5)
+ *   gesammelt. Danach werden effektive Ressourcen sowie Eigentümer und
+ *   Genehmiger der Quelle aus dem fortgeschriebenen Rollenmodell neu berechnet.
+ * - WATCH_RECONCILE_INTERVAL_MINUTES (Standard: 60, 0 = nur beim Start)
+ *   wiederholt den vollständigen Abgleich mit Markieren, Löschen, Laufprotokoll
+ *   und Metriken und holt so verpasste Änderungen nach. Nach Verbindungsfehlern
+ *   wird die Änderungserkennung mit den seither geänderten Einträgen fortgesetzt.
+ *
+ * Service-Modus (Zeitplan und HTTP-API):
+ * - `serve` läuft dauerhaft und startet Läufe wie `sync` nach SERVE_SCHEDULE
+ *   (Cron-Format mit fünf Feldern in der Zeitzone TZ, Standard: 0 5 * * *,
+ *   off = nur auf Anforderung) und über die API auf SERVE_ADDR (Standard: :8080).
+ * - Es läuft höchstens ein Lauf gleichzeitig. Ein geplanter Lauf entfällt, wenn
+ *   noch einer läuft; die API antwortet dann mit 409 und dem laufenden Lauf.
+ * - Die API erfordert "Authorization: Bearer <SERVE_TOKEN>" (auch SERVE_TOKEN_FILE):
+ *   POST /api/runs[?force=true] startet einen Lauf, GET /api/runs liefert den
+ *   laufenden Lauf und die letzten SERVE_HISTORY (Standard: 50) Läufe, GET
+ *   /api/runs/<run_id> einen Lauf, GET /api/status den Gesamtstatus mit dem
+ *   nächsten geplanten Lauf und GET /api/last-error den letzten fehlgeschlagenen.
+ * - GET /healthz (Liveness) und GET /readyz (Readiness, prüft die Datenbank der
+ *   Sink postgres) sind ohne Token erreichbar.
+ *
+ * Laufsperre (keine überlappenden Läufe):
+ * - Jeder Lauf mit der Sink postgres hält für seine gesamte Dauer eine
+ *   PostgreSQL-Advisory-Sperre je Zielschema und Tabellenpräfix, ebenso `purge
+ *   --execute` und der Daemon-Modus während jedes Abgleichs und jeder Übernahme.
+ * - Die Sperre gehört zur Datenbanksitzung und endet auch, wenn ein Lauf abbricht.
+ * - SYNC_LOCK_MODE=fail (Standard) bricht einen zweiten Lauf sofort mit Fehler ab,
+ *   SYNC_LOCK_MODE=wait wartet auf das Ende des anderen Laufs, höchstens
+ *   SYNC_LOCK_TIMEOUT_SECONDS (Standard: 0 = unbegrenzt).
+ *
+ * Logging:
+ * - LOG_FORMAT=json|text (Standard: text)
+ * - LOG_LEVEL=debug|verbose|info|warn|error (Standard: info). Im Level
+ *   debug/verbose wird für jeden Eintrag protokolliert, ob er eingefügt,
+ *   aktualisiert, übersprungen oder wegen eines Parse-Fehlers beanstandet wurde.
+ *
+ * Metriken (Prometheus-Textformat, optional):
+ * - METRICS_TEXTFILE=/pfad/datei.prom schreibt die Metriken atomar in eine Datei.
+ * - METRICS_PUSHGATEWAY_URL=http://pushgateway:9091 sendet sie an ein Pushgateway.
+ * - METRICS_JOB=idm_ldap_sync legt den Job-Namen für das Pushgateway fest.
+ *
+ * Sicherheitsschwellen für das Markieren als gelöscht:
+ * - SAFETY_MAX_DROP_PERCENT (Standard: 50) und SAFETY_MAX_DROP_ABS (Standard: 0 = aus)
+ *   begrenzen den Rückgang gefundener Einträge gegenüber dem letzten erfolgreichen Lauf.
+ * - Tabellenspezifisch mit den Suffixen _ROLES, _RESOURCES, _ASSOCIATIONS und _PARENTS.
+ * - Bei Überschreitung wird das Markieren/Löschen abgebrochen, außer mit `--force`.
+ * - Nach einer fehlerhaften Synchronisation einer Quelle wird nie markiert oder
+ *   gelöscht, auch nicht mit `--force`.
+ *
+ * Aufbewahrung und Archivierung:
+ * - PURGE_AGE_IN_DAYS (Standard: 7) gilt für alle Tabellen, tabellenspezifisch
+ *   mit den Suffixen _ROLES, _RESOURCES, _ASSOCIATIONS und _PARENTS.
+ * - PURGE_ARCHIVE=none|table|file archiviert gelöschte Datensätze vorher in
+ *   <tabelle>_archive oder als gzip-komprimierte JSON Lines in PURGE_ARCHIVE_DIR
+ *   (je Lauf und Quelle eine Datei purge-<zeit>-<run_id>-<quelle>.jsonl.gz,
+ *   nur wenn etwas gelöscht wurde).
+ * - `purge` zeigt an, was gelöscht würde; `purge --execute` löscht ohne Synchronisation.
+ *
+ * Mehrere IDM-Instanzen (Quellprofile):
+ * - LDAP_SOURCES=prod,tochter_a synchronisiert mehrere Instanzen in dieselbe
+ *   Datenbank. Je Profil werden LDAP_<NAME>_HOST, _PORT, _USERNAME, _PASSWORD
+ *   und optional _DRIVER_DN bzw. _ROLES_BASE, _RESOURCES_BASE und
+ *   _ASSOCIATIONS_BASE gelesen. Ohne LDAP_SOURCES gibt es das Profil "default".
+ * - Die Spalte source ist Teil des Schlüssels aller Tabellen. Markieren,
+ *   Löschen und Sicherheitsschwellen gelten je Quelle; schlägt eine Quelle fehl,
+ *   werden die übrigen trotzdem synchronisiert.
+ *
+ * Vergleich zweier Umgebungen (z.B. Test und Produktion):
+ * - `snapshot --out test.json` sichert das Rollenmodell der konfigurierten Umgebung.
+ * - `diff --left <quelle> --right <quelle> [--format markdown|json] [--out datei]`
+ *   vergleicht Rollen, Ressourcen, Assoziationen und Hierarchie. Quellen sind
+ *   env, source:<name>, ldap://host:port (mit --left-user/--right-user und den Passwörtern aus
+ *   DIFF_LEFT_PASSWORD/DIFF_RIGHT_PASSWORD), ldif:<datei> oder snapshot:<datei>.
+ *   Objekte werden über ihren DN relativ zum Driver-Set abgeglichen; weicht der
+ *   Treiber-DN ab, wird er mit --left-driver/--right-driver angegeben.
+ *
+ * Graph-Export für die Visualisierung:
+ * - `export graph --source <quelle> --format graphml|dot|cypher|csv [--out datei]`
+ *   gibt Rollen, Ressourcen, Parent-Beziehungen (Kind → Elternrolle) und
+ *   Zuordnungen (Rolle → Ressource) mit ihren Attributen aus: GraphML für yEd und
+ *   Gephi, DOT für Graphviz, ein Cypher-Skript oder CSV-Dateien für
+ *   neo4j-admin database import (--out ist dann ein Verzeichnis).
+ * - Quellen wie bei `snapshot`, das Passwort einer ldap://-Quelle aus EXPORT_PASSWORD.
+ * - --role <dn> beschränkt den Export auf die Rolle und alle darunterliegenden
+ *   Rollen mit ihren Ressourcen, --resource <dn> auf die Ressource und alle
+ *   Rollen, die sie direkt oder über die Hierarchie vergeben.
+ * - --lang stellt der Sprach-Fallback-Kette (LANGUAGE_FALLBACK) für die
+ *   Beschriftung eine Sprache voran.
+ *
+ * Audit-Export (Rolle → Ressource):
+ * - `export audit --source <quelle> [--format csv|xlsx] [--lang de] [--out datei]`
+ *   listet jede Rolle mit Name, Level, Kategorien und Elternrollen sowie jede
+ *   Ressource, die sie vergibt, mit Entitlement-Treiber und -Wert. Ressourcen
+ *   untergeordneter Rollen erscheinen als "geerbt" mit dem Weg durch die Hierarchie.
+ * - --lang wie bei `export graph`.
+ * - Quelle db bzw. db:<quelle> liest aus den synchronisierten Tabellen (DB_SCHEMA,
+ *   DB_TABLE_PREFIX), alle übrigen Quellen wie bei `export graph`.
+ * - CSV standardmäßig mit Semikolon und UTF-8-BOM für Excel (--delimiter, --bom=false);
+ *   xlsx erfordert --out.
  */
 package main
 
 import (
 	"database/sql"
 	"encoding/json"
-	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
-	"net"
+	"log/slog"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/go-ldap/ldap/v3"
+	"github.com/jackc/pgx/v5"
 	_ "github.com/jackc/pgx/v5/stdlib" // Wichtig: Blank Import zur Registrierung des "pgx"-Treibers
 )
 
@@ -42,29 +286,12 @@ const (
 	resourcesSearchBase    = "cn=ResourceDefs,cn=RoleConfig,cn=AppConfig,cn=UserApplication,cn=DriverSet,o=System"
 	resourcesFilter        = "(objectClass=nrfResource)"
 	associationsSearchBase = "cn=ResourceAssociations,cn=RoleConfig,cn=AppConfig,cn=UserApplication,cn=DriverSet,o=System"
-	associationsFilter     = "(&(objectClass=nrfResourceAssociation)(nrfStatus=50))"
+	associationsFilter     = "(objectClass=nrfResourceAssociation)"
 )
 
-// Definition der Go-Struktur für die XML-Entität nrfEntitlementRef
-type EntitlementRefXML struct {
-	XMLName xml.Name `xml:"ref"`
-	Src     string   `xml:"src"`
-	ID      string   `xml:"id"`
-	Param   string   `xml:"param"`
-}
-
-// Definition der Go-Struktur für das JSON-Objekt innerhalb von Param
-type EntitlementParamJSON struct {
-	ID  string `json:"ID"`
-	ID2 string `json:"ID2"`
-	ID3 string `json:"ID3"`
-}
-
-// Definition der Go-Struktur für den XML-Knoten in nrfdynamicparmvals
-type DynamicParmValsXML struct {
-	XMLName xml.Name `xml:"parameter"`
-	Value   string   `xml:"value"`
-}
+// Tabellen, deren Einträge von markAndPurge als gelöscht markiert und nach
+// Ablauf der Aufbewahrungsfrist gelöscht werden.
+var managedTables = []string{"viz_roles", "viz_resources", "viz_roles_resources", "viz_roles_parents"}
 
 // Konfiguration aus Umgebungsvariablen
 type config struct {
@@ -72,143 +299,261 @@ type config struct {
 	LDAPPort     string
 	LDAPUser     string
 	LDAPPassword string
-	DBHost       string
-	DBPort       string
-	DBUser       string
-	DBPassword   string
-	DBDatabase   string
 	DryRun       bool
-	PurgeAgeInDays int
-	LDAPTimeout    time.Duration
+	// Ausgabe des Trockenlaufs: optionale JSON-Datei und Anzahl gelisteter Datensätze
+	DryRunOutput      string
+	DryRunDetailLimit int
+	PurgeAgeInDays    int
+	LDAPTimeout       time.Duration
+	// Ziele für die Metrik-Ausgabe im Prometheus-Format (optional)
+	MetricsTextfile string
+	MetricsPushURL  string
+	MetricsJob      string
+	// Schwellen, die ein Markieren bei auffälligen Rückgängen verhindern
+	Safety safetyConfig
+	// Aufbewahrungsfristen je Tabelle und Archivierung vor dem Löschen
+	Retention retentionConfig
+	// Quellprofile, die nacheinander in dieselbe Datenbank synchronisiert werden
+	Sources []sourceProfile
+	// Verbindung zur PostgreSQL-Datenbank
+	Database databaseConfig
+	// Zielschema, Tabellenpräfix und Blue/Green-Betrieb
+	Target targetConfig
+	// Sperre gegen überlappende Läufe in dieselben Tabellen
+	Lock lockConfig
+	// Ausgabeziele eines Laufs (SINKS), z.B. postgres oder jsonl:<datei>
+	Sinks []string
+	// Sprach-Fallback-Kette für display_name (LANGUAGE_FALLBACK)
+	Languages []string
+	// Änderungserkennung und Abgleich im Daemon-Modus (Kommando watch)
+	Watch watchConfig
+	// Zeitplan und HTTP-API im Service-Modus (Kommando serve)
+	Serve serveConfig
 }
 
-// initConfig liest die Konfiguration aus den Umgebungsvariablen.
-func initConfig() config {
-	cfg := config{
-		LDAPHost:     os.Getenv("LDAP_HOST"),
-		LDAPPort:     os.Getenv("LDAP_PORT"),
-		LDAPUser:     os.Getenv("LDAP_USERNAME"),
-		LDAPPassword: os.Getenv("LDAP_PASSWORD"),
-		DBHost:       os.Getenv("DB_HOST"),
-		DBPort:       os.Getenv("DB_PORT"),
-		DBUser:       os.Getenv("DBUSER"),
-		DBPassword:   os.Getenv("DB_PASSWORD"),
-		DBDatabase:   os.Getenv("DB_DATABASE"),
-		DryRun:       os.Getenv("DRY_RUN") == "true",
+// initConfig liest die Konfiguration aus den Umgebungsvariablen und der
+// optionalen Konfigurationsdatei in CONFIG_FILE. Alle ungültigen Werte werden
+// gemeinsam als Fehler zurückgegeben.
+func initConfig() (config, error) {
+	cfg, src := loadConfig(os.Getenv("CONFIG_FILE"))
+	return cfg, src.err()
+}
+
+// loadConfig liest die Konfiguration und liefert zusätzlich die Quelle mit den
+// wirksamen Einstellungen und gesammelten Problemen (für `config check`).
+func loadConfig(path string) (config, *configSource) {
+	src := newConfigSource(path)
+
+	// Logging zuerst übernehmen, damit die weiteren Meldungen im gewünschten Format erscheinen
+	logFormat := src.oneOf("LOG_FORMAT", "text", "text", "json")
+	logLevel := src.oneOf("LOG_LEVEL", "info", "debug", "verbose", "info", "warn", "warning", "error")
+	if logger, err := newLogger(os.Stderr, logFormat, logLevel); err == nil {
+		slog.SetDefault(logger)
 	}
 
-	if cfg.LDAPPort == "" {
-		cfg.LDAPPort = "389" // Geändert auf Standard-LDAP-Port
+	cfg := config{
+		LDAPHost:     src.str("LDAP_HOST", ""),
+		LDAPPort:     src.str("LDAP_PORT", "389"), // Geändert auf Standard-LDAP-Port
+		LDAPUser:     src.str("LDAP_USERNAME", ""),
+		LDAPPassword: src.secret("LDAP_PASSWORD"),
+		DryRun:       src.bool("DRY_RUN", false),
+		DryRunOutput: src.str("DRY_RUN_OUTPUT", ""),
+
+		DryRunDetailLimit: src.int("DRY_RUN_DETAIL_LIMIT", 50),
+		PurgeAgeInDays:    src.int("PURGE_AGE_IN_DAYS", 7),
+		LDAPTimeout:       time.Duration(src.int("LDAP_TIMEOUT_SECONDS", 150)) * time.Second, // Standard-Timeout: 150 Sekunden
+
+		MetricsTextfile: src.str("METRICS_TEXTFILE", ""),
+		MetricsPushURL:  src.str("METRICS_PUSHGATEWAY_URL", ""),
+		MetricsJob:      src.str("METRICS_JOB", "idm_ldap_sync"),
+
+		Safety:   initSafetyConfig(src),
+		Database: initDatabaseConfig(src),
+		Target:   initTargetConfig(src),
+		Lock:     initLockConfig(src),
+		Watch:    initWatchConfig(src),
+		Serve:    initServeConfig(src),
 	}
-	if cfg.DBPort == "" {
-		cfg.DBPort = "5432"
+	cfg.Retention = initRetentionConfig(src, cfg.PurgeAgeInDays)
+	cfg.Sources = initSourceProfiles(src)
+	sinks, err := parseSinks(src.str("SINKS", sinkPostgres))
+	if err != nil {
+		src.problem(err)
+		sinks = []string{sinkPostgres}
 	}
-	if cfg.DBDatabase == "" {
-		cfg.DBDatabase = "idm_rolemanagement_prod"
+	cfg.Sinks = sinks
+	languages, err := parseLanguages(src.str("LANGUAGE_FALLBACK", defaultLanguageFallback))
+	if err != nil {
+		src.problem(err)
 	}
-
-	ldapTimeoutStr := os.Getenv("LDAP_TIMEOUT_SECONDS")
-	if ldapTimeoutStr == "" {
-		cfg.LDAPTimeout = 150 * time.Second // Standard-Timeout: 150 Sekunden
-	} else {
-		timeout, err := time.ParseDuration(ldapTimeoutStr + "s")
-		if err != nil {
-			log.Printf("Ungültiger Wert für LDAP_TIMEOUT_SECONDS, verwende Standardwert 150. Fehler: %v", err)
-			cfg.LDAPTimeout = 150 * time.Second
-		} else {
-			cfg.LDAPTimeout = timeout
-		}
+	cfg.Languages = languages
+	if err := cfg.Target.validate(); err != nil {
+		src.problem(err)
 	}
-	
-	purgeAgeStr := os.Getenv("PURGE_AGE_IN_DAYS")
-	if purgeAgeStr == "" {
-		cfg.PurgeAgeInDays = 7
-	} else {
-		_, err := fmt.Sscan(purgeAgeStr, &cfg.PurgeAgeInDays)
-		if err != nil {
-			log.Printf("Ungültiger Wert für PURGE_AGE_IN_DAYS, verwende Standardwert 7. Fehler: %v", err)
-			cfg.PurgeAgeInDays = 7
-		}
+	if cfg.Database.MaxOpenConns == 1 {
+		// Die Laufsperre belegt eine eigene Verbindung neben den Transaktionen
+		src.problem(errors.New("DB_MAX_OPEN_CONNS: muss wegen der Laufsperre mindestens 2 sein"))
 	}
 
+	return cfg, src
+}
+
+// main ist der Haupteinstiegspunkt des Programms. Ohne Kommando wird `sync` ausgeführt.
+func main() {
+	setupLogging()
 
-	if cfg.LDAPHost == "" || cfg.LDAPUser == "" || cfg.LDAPPassword == "" {
-		log.Fatal("Bitte setzen Sie die erforderlichen Umgebungsvariablen für LDAP (LDAP_HOST, LDAP_USERNAME, LDAP_PASSWORD).")
+	command, args := "sync", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
 
-	return cfg
+	switch command {
+	case "sync":
+		os.Exit(runSyncCommand(args))
+	case "watch":
+		os.Exit(runWatchCommand(args))
+	case "serve":
+		os.Exit(runServeCommand(args))
+	case "purge":
+		os.Exit(runPurgeCommand(args))
+	case "diff":
+		os.Exit(runDiffCommand(args))
+	case "snapshot":
+		os.Exit(runSnapshotCommand(args))
+	case "config":
+		os.Exit(runConfigCommand(args))
+	case "export":
+		os.Exit(runExportCommand(args))
+	default:
+		fmt.Fprintf(os.Stderr, "Unbekanntes Kommando %q. Verfügbare Kommandos: sync, watch, serve, purge, diff, snapshot, config, export\n", command)
+		os.Exit(2)
+	}
 }
 
-// main ist der Haupteinstiegspunkt des Programms.
-func main() {
-	cfg := initConfig()
+// runSyncCommand implementiert das Kommando `sync` und liefert den Exit-Code.
+func runSyncCommand(args []string) int {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	force := fs.Bool("force", false, "Sicherheitsschwellen für das Markieren und Löschen übersteuern")
+	fs.Parse(args)
 
-	if cfg.DryRun {
-		log.Println("Starte den Trockenlauf-Modus: Es werden KEINE Daten in die Datenbank geschrieben.")
-	} else {
-		if cfg.DBHost == "" || cfg.DBUser == "" || cfg.DBPassword == "" {
-			log.Fatal("Bitte setzen Sie die erforderlichen Umgebungsvariablen für die Datenbank (DB_HOST, DBUSER, DB_PASSWORD).")
-		}
-		log.Println("Starte den normalen Modus: Daten werden von LDAP gelesen und in die Datenbank geschrieben.")
-	}
-	
-	// Konfiguriere einen Dialer mit Timeout
-	dialer := &net.Dialer{Timeout: cfg.LDAPTimeout}
-	
-	// Verbinde zur LDAP-Datenbank über unverschlüsselte Verbindung
-	ldapConn, err := ldap.DialURL(fmt.Sprintf("ldap://%s:%s", cfg.LDAPHost, cfg.LDAPPort), ldap.DialWithDialer(dialer))
+	cfg, err := initConfig()
 	if err != nil {
-		log.Fatalf("Fehler beim Verbinden zu LDAP: %v", err)
+		slog.Error("Konfiguration konnte nicht geladen werden", keyError, err)
+		return 1
 	}
-	defer ldapConn.Close()
+	cfg.Safety.Force = *force
+	run := newSyncRun("sync")
+	run.languages = cfg.Languages
 
-	err = ldapConn.Bind(cfg.LDAPUser, cfg.LDAPPassword)
+	_, err = runSync(run, cfg)
+	run.finish(err)
+	publishMetrics(run, cfg)
 	if err != nil {
-		log.Fatalf("Fehler beim Binden an LDAP: %v", err)
+		return 1
 	}
+	return 0
+}
 
-	if !cfg.DryRun {
-		// Verbinde zur PostgreSQL-Datenbank
-		dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-			cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, cfg.DBDatabase)
+// runSync führt einen vollständigen Lauf aus: Synchronisation aller
+// Quellprofile in alle Sinks und Markierungs-/Löschlogik bzw. den Trockenlauf.
+// Der Fehler einer Quelle verhindert nicht die Synchronisation der übrigen Quellen.
+// Zurückgegeben wird das Rollenmodell je Quelle, die vollständig gelesen wurde.
+func runSync(run *syncRun, cfg config) (map[string]*roleModel, error) {
+	log := run.log.With(keyPhase, "setup")
 
-		db, err := sql.Open("pgx", dsn)
-		if err != nil {
-			log.Fatalf("Fehler beim Öffnen der Datenbank: %v", err)
+	if cfg.DryRun {
+		log.Info("Starte den Trockenlauf-Modus: Es werden KEINE Daten in die Datenbank geschrieben.")
+		// Im Trockenlauf-Modus nur lesend vergleichen und die Änderungen ausgeben
+		return nil, runDryRun(run, cfg)
+	}
+	log.Info("Starte den normalen Modus: Daten werden von LDAP gelesen und in die Sinks geschrieben.", "sources", len(cfg.Sources), "sinks", strings.Join(cfg.Sinks, ","))
+
+	sinks, err := openSinks(run, cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer closeSinks(run, sinks)
+
+	for _, s := range sinks {
+		if err := s.Prepare(run); err != nil {
+			return nil, fmt.Errorf("Sink %s: %w", s.Name(), err)
 		}
-		defer db.Close()
+	}
 
-		// Prüfe die Datenbankverbindung
-		err = db.Ping()
+	var errs []error
+	models := make(map[string]*roleModel)
+	for _, profile := range cfg.Sources {
+		srun := run.forSource(profile.Name)
+		model, err := syncSource(srun, cfg, sinks, profile)
 		if err != nil {
-			log.Fatalf("Fehler beim Verbinden zur Datenbank: %v", err)
+			srun.log.Error("Synchronisation der Quelle fehlgeschlagen", keyError, err)
+			errs = append(errs, fmt.Errorf("Quelle %s: %w", profile.Name, err))
 		}
+		if model != nil {
+			models[profile.Name] = model
+		}
+	}
 
-		log.Println("Erfolgreich mit LDAP und PostgreSQL verbunden.")
-		
-		// Sicherstellen, dass die Tabellen existieren, bevor Daten eingefügt werden
-		createTables(db)
-
-		// Hole den Zeitstempel für den aktuellen Synchronisationslauf
-		syncStartTimestamp := time.Now()
+	syncErr := errors.Join(errs...)
+	for _, s := range sinks {
+		if err := s.Finish(run, syncErr); err != nil {
+			run.log.Error("Fehler beim Abschließen der Sink", keySink, s.Name(), keyError, err)
+			syncErr = errors.Join(syncErr, fmt.Errorf("Sink %s: %w", s.Name(), err))
+		}
+	}
+	return models, syncErr
+}
 
-		// Synchronisiere alle Daten
-		syncRoles(ldapConn, db, syncStartTimestamp)
-		syncResources(ldapConn, db, syncStartTimestamp)
-		syncAssociations(ldapConn, db, syncStartTimestamp)
+// syncSource synchronisiert ein Quellprofil in alle Sinks. Danach schließt
+// jede Sink die Quelle ab, die Postgres-Sink markiert bzw. löscht dabei nur die
+// veralteten Datensätze dieser Quelle. Das Rollenmodell wird nur geliefert,
+// wenn Rollen, Ressourcen und Assoziationen fehlerfrei gelesen wurden.
+func syncSource(run *syncRun, cfg config, sinks []Sink, profile sourceProfile) (model *roleModel, err error) {
+	defer func() {
+		for _, s := range sinks {
+			if finishErr := s.FinishSource(run, err); finishErr != nil {
+				err = errors.Join(err, fmt.Errorf("Sink %s: %w", s.Name(), finishErr))
+			}
+		}
+	}()
 
-		// Führe die Markierungs- und Löschlogik aus
-		markAndPurge(db, syncStartTimestamp, cfg.PurgeAgeInDays)
+	if err := profile.validate(); err != nil {
+		return nil, err
+	}
 
+	// Verbinde zur LDAP-Datenbank über unverschlüsselte Verbindung
+	ldapConn, err := dialLDAP(profile.url(), profile.LDAPUser, profile.LDAPPassword, cfg.LDAPTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer ldapConn.Close()
+	run.log.Info("Erfolgreich mit LDAP verbunden.", "host", profile.LDAPHost)
+
+	// Synchronisiere alle Daten
+	roles, rolesErr := syncRoles(run, ldapConn, sinks, profile.Bases.Roles)
+	resources, resourcesErr := syncResources(run, ldapConn, sinks, profile.Bases.Resources)
+	associations, associationsErr := syncAssociations(run, ldapConn, sinks, profile.Bases.Associations)
+
+	// Die effektiven Ressourcen nur aus vollständigen Rollen und Assoziationen
+	// ableiten, sonst bleibt der bisherige Stand erhalten
+	var effectiveErr error
+	if rolesErr == nil && associationsErr == nil {
+		effectiveErr = syncEffectiveResources(run, sinks, roleModel{Roles: roles, Associations: associations})
 	} else {
-		// Im Trockenlauf-Modus nur die Anzahl der Einträge ausgeben
-		log.Println("Verbindung zu PostgreSQL übersprungen.")
-		countRoles(ldapConn)
-		countResources(ldapConn)
-		countAssociations(ldapConn)
+		run.log.Warn("Effektive Ressourcen werden wegen Fehlern nicht neu berechnet", keyPhase, "effective")
 	}
 
-	log.Println("Synchronisation abgeschlossen. Programm wird beendet.")
+	// Eigentümer und Genehmiger werden ebenfalls vollständig ersetzt
+	var governanceErr error
+	if rolesErr == nil && resourcesErr == nil {
+		governanceErr = syncGovernance(run, ldapConn, sinks, roles, resources)
+	} else {
+		run.log.Warn("Eigentümer und Genehmiger werden wegen Fehlern nicht neu geschrieben", keyPhase, "governance")
+	}
+	if rolesErr == nil && resourcesErr == nil && associationsErr == nil {
+		model = &roleModel{Roles: roles, Resources: resources, Associations: associations}
+	}
+	return model, errors.Join(rolesErr, resourcesErr, associationsErr, effectiveErr, governanceErr)
 }
 
 // ldapSearch führt eine LDAP-Abfrage aus und gibt die Ergebnisse zurück.
@@ -234,89 +579,128 @@ func ldapSearch(conn *ldap.Conn, searchBase, filter string, attributes []string)
 }
 
 // countRoles gibt nur die Anzahl der Rollen aus.
-func countRoles(conn *ldap.Conn) {
-	log.Println("Zähle Rollen...")
+func countRoles(run *syncRun, conn *ldap.Conn, searchBase string) error {
+	defer run.timePhase("count")()
+	log := run.phaseLogger("count", "viz_roles")
+	log.Info("Zähle Rollen...")
 	entries, err := ldapSearch(
 		conn,
-		rolesSearchBase, // Verwendung der Konstante
-		rolesFilter,     // Verwendung der Konstante
+		searchBase,
+		rolesFilter, // Verwendung der Konstante
 		[]string{"dn"},
 	)
 	if err != nil {
-		log.Printf("Fehler beim Zählen der Rollen: %v", err)
-		return
+		log.Error("Fehler beim Zählen der Rollen", keyError, err)
+		return fmt.Errorf("Fehler beim Zählen der Rollen: %w", err)
 	}
-	log.Printf("Anzahl der gefundenen Rollen: %d", len(entries))
+	counts := tableCounts{Found: len(entries)}
+	run.recordCounts("viz_roles", counts)
+	log.Info("Anzahl der gefundenen Rollen", keyCounts, counts)
+	return nil
 }
 
 // countResources gibt nur die Anzahl der Ressourcen aus.
-func countResources(conn *ldap.Conn) {
-	log.Println("Zähle Ressourcen...")
+func countResources(run *syncRun, conn *ldap.Conn, searchBase string) error {
+	defer run.timePhase("count")()
+	log := run.phaseLogger("count", "viz_resources")
+	log.Info("Zähle Ressourcen...")
 	entries, err := ldapSearch(
 		conn,
-		resourcesSearchBase, // Verwendung der Konstante
-		resourcesFilter,     // Verwendung der Konstante
+		searchBase,
+		resourcesFilter, // Verwendung der Konstante
 		[]string{"dn"},
 	)
 	if err != nil {
-		log.Printf("Fehler beim Zählen der Ressourcen: %v", err)
-		return
+		log.Error("Fehler beim Zählen der Ressourcen", keyError, err)
+		return fmt.Errorf("Fehler beim Zählen der Ressourcen: %w", err)
 	}
-	log.Printf("Anzahl der gefundenen Ressourcen: %d", len(entries))
+	counts := tableCounts{Found: len(entries)}
+	run.recordCounts("viz_resources", counts)
+	log.Info("Anzahl der gefundenen Ressourcen", keyCounts, counts)
+	return nil
 }
 
 // countAssociations gibt nur die Anzahl der Assoziationen aus.
-func countAssociations(conn *ldap.Conn) {
-	log.Println("Zähle Assoziationen...")
+func countAssociations(run *syncRun, conn *ldap.Conn, searchBase string) error {
+	defer run.timePhase("count")()
+	log := run.phaseLogger("count", "viz_roles_resources")
+	log.Info("Zähle Assoziationen...")
 	entries, err := ldapSearch(
 		conn,
-		associationsSearchBase, // Verwendung der Konstante
-		associationsFilter,     // Verwendung der Konstante
+		searchBase,
+		associationsFilter, // Verwendung der Konstante
 		[]string{"dn"},
 	)
 	if err != nil {
-		log.Printf("Fehler beim Zählen der Assoziationen: %v", err)
-		return
+		log.Error("Fehler beim Zählen der Assoziationen", keyError, err)
+		return fmt.Errorf("Fehler beim Zählen der Assoziationen: %w", err)
 	}
-	log.Printf("Anzahl der gefundenen Assoziationen: %d", len(entries))
+	counts := tableCounts{Found: len(entries)}
+	run.recordCounts("viz_roles_resources", counts)
+	log.Info("Anzahl der gefundenen Assoziationen", keyCounts, counts)
+	return nil
 }
 
 // createTables stellt sicher, dass alle notwendigen Datenbanktabellen existieren.
-func createTables(db *sql.DB) {
-	log.Println("Überprüfe und erstelle Datenbanktabellen...")
+func createTables(run *syncRun, db *sql.DB) error {
+	defer run.timePhase("schema")()
+	log := run.log.With(keyPhase, "schema")
+	log.Info("Überprüfe und erstelle Datenbanktabellen...", "schema", run.tables.schema, "prefix", run.tables.prefix)
+	if run.tables.schema != "" {
+		if _, err := db.Exec(`CREATE SCHEMA IF NOT EXISTS ` + pgx.Identifier{run.tables.schema}.Sanitize()); err != nil {
+			return fmt.Errorf("Fehler beim Erstellen des Schemas %s: %w", run.tables.schema, err)
+		}
+	}
 	// Die Spalte `nrfParentRoles` wurde aus dieser Tabelle entfernt
 	_, err := db.Exec(`
-      CREATE TABLE IF NOT EXISTS viz_roles (
-        dn TEXT PRIMARY KEY,
+      CREATE TABLE IF NOT EXISTS ` + run.table("viz_roles") + ` (
+        source TEXT NOT NULL DEFAULT 'default',
+        dn TEXT NOT NULL,
         nrfRoleLevel TEXT,
         nrflocalizednames JSONB,
         nrflocalizeddescrs JSONB,
         nrfRoleCategoryKey TEXT,
         created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
         updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
-        is_deleted BOOLEAN DEFAULT FALSE
+        is_deleted BOOLEAN DEFAULT FALSE,
+        PRIMARY KEY (source, dn)
       );
     `)
 	if err != nil {
-		log.Fatalf("Fehler beim Erstellen der Tabelle viz_roles: %v", err)
+		return fmt.Errorf("Fehler beim Erstellen der Tabelle viz_roles: %w", err)
 	}
 
 	// Neue Junction-Tabelle für die Parent-Child-Beziehung
 	// Der Fremdschlüssel auf parent_dn wird entfernt, um den Fehler zu beheben.
 	_, err = db.Exec(`
-		CREATE TABLE IF NOT EXISTS viz_roles_parents (
-			child_dn TEXT REFERENCES viz_roles(dn) ON DELETE CASCADE,
-			parent_dn TEXT,
-			PRIMARY KEY (child_dn, parent_dn)
+		CREATE TABLE IF NOT EXISTS ` + run.table("viz_roles_parents") + ` (
+			source TEXT NOT NULL DEFAULT 'default',
+			child_dn TEXT NOT NULL,
+			parent_dn TEXT NOT NULL,
+			PRIMARY KEY (source, child_dn, parent_dn),
+			CONSTRAINT ` + pgx.Identifier{run.tables.name("viz_roles_parents") + "_source_child_dn_fkey"}.Sanitize() + ` FOREIGN KEY (source, child_dn) REFERENCES ` + run.table("viz_roles") + `(source, dn) ON DELETE CASCADE
 		);
 	`)
 	if err != nil {
-		log.Fatalf("Fehler beim Erstellen der Tabelle viz_roles_parents: %v", err)
+		return fmt.Errorf("Fehler beim Erstellen der Tabelle viz_roles_parents: %w", err)
 	}
 
+	// Parent-Beziehungen werden wie die übrigen Tabellen als gelöscht markiert
+	// statt bei jedem Lauf neu geschrieben, damit Aufbewahrungsfristen greifen.
 	_, err = db.Exec(`
-      CREATE TABLE IF NOT EXISTS viz_resources (
-        dn TEXT PRIMARY KEY,
+		ALTER TABLE ` + run.table("viz_roles_parents") + `
+			ADD COLUMN IF NOT EXISTS created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			ADD COLUMN IF NOT EXISTS is_deleted BOOLEAN DEFAULT FALSE;
+	`)
+	if err != nil {
+		return fmt.Errorf("Fehler beim Erweitern der Tabelle viz_roles_parents: %w", err)
+	}
+
+	_, err = db.Exec(`
+      CREATE TABLE IF NOT EXISTS ` + run.table("viz_resources") + ` (
+        source TEXT NOT NULL DEFAULT 'default',
+        dn TEXT NOT NULL,
         nrflocalizednames JSONB,
         nrflocalizeddescrs JSONB,
         nrfCategoryKey TEXT,
@@ -331,16 +715,18 @@ func createTables(db *sql.DB) {
         entitlement_xml_param_id3 TEXT,
         created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
         updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
-        is_deleted BOOLEAN DEFAULT FALSE
+        is_deleted BOOLEAN DEFAULT FALSE,
+        PRIMARY KEY (source, dn)
       );
     `)
 	if err != nil {
-		log.Fatalf("Fehler beim Erstellen der Tabelle viz_resources: %v", err)
+		return fmt.Errorf("Fehler beim Erstellen der Tabelle viz_resources: %w", err)
 	}
 
 	_, err = db.Exec(`
-      CREATE TABLE IF NOT EXISTS viz_roles_resources (
-        dn TEXT PRIMARY KEY,
+      CREATE TABLE IF NOT EXISTS ` + run.table("viz_roles_resources") + ` (
+        source TEXT NOT NULL DEFAULT 'default',
+        dn TEXT NOT NULL,
         nrfRole TEXT,
         nrfResource TEXT,
         nrfDynamicParmVals TEXT,
@@ -350,409 +736,552 @@ func createTables(db *sql.DB) {
         modifyTimestamp TEXT,
         created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
         updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
-        is_deleted BOOLEAN DEFAULT FALSE
+        is_deleted BOOLEAN DEFAULT FALSE,
+        PRIMARY KEY (source, dn)
       );
     `)
 	if err != nil {
-		log.Fatalf("Fehler beim Erstellen der Tabelle viz_roles_resources: %v", err)
+		return fmt.Errorf("Fehler beim Erstellen der Tabelle viz_roles_resources: %w", err)
 	}
-	log.Println("Datenbanktabellen wurden erstellt oder existieren bereits.")
-}
-
-// writeJSONToFile saves data to a JSON file for debugging.
-func writeJSONToFile(filename string, data interface{}) {
-    file, err := os.Create(filename)
-    if err != nil {
-        log.Printf("Fehler beim Erstellen der Debug-Datei %s: %v", filename, err)
-        return
-    }
-    defer file.Close()
-
-    encoder := json.NewEncoder(file)
-    encoder.SetIndent("", "  ")
-    if err := encoder.Encode(data); err != nil {
-        log.Printf("Fehler beim Schreiben in die Debug-Datei %s: %v", filename, err)
-    } else {
-        log.Printf("Raw LDAP-Daten in %s geschrieben.", filename)
-    }
-}
-
-// markAndPurge markiert nicht aktualisierte Einträge als gelöscht und löscht alte Einträge.
-func markAndPurge(db *sql.DB, syncStartTimestamp time.Time, purgeAgeInDays int) {
-	// Zeitstempel für die Markierung
-	timestampStr := syncStartTimestamp.Format(time.RFC3339)
 
-	// Markiere veraltete Datensätze als gelöscht
-	log.Println("Markiere veraltete Datensätze als gelöscht...")
-	tables := []string{"viz_roles", "viz_resources", "viz_roles_resources"}
-	for _, table := range tables {
-		result, err := db.Exec(`UPDATE `+ table +` SET is_deleted = TRUE WHERE updated_at < $1`, timestampStr)
-		if err != nil {
-			log.Printf("Fehler beim Markieren von Datensätzen in Tabelle %s: %v", table, err)
-			continue
+	// Name nach der Sprach-Fallback-Kette, nachträglich hinzugefügt
+	for _, table := range []string{"viz_roles", "viz_resources"} {
+		if _, err := db.Exec(`ALTER TABLE ` + run.table(table) + ` ADD COLUMN IF NOT EXISTS display_name TEXT`); err != nil {
+			return fmt.Errorf("Fehler beim Erweitern der Tabelle %s: %w", table, err)
 		}
-		rowsAffected, _ := result.RowsAffected()
-		log.Printf("Tabelle %s: %d Datensätze als gelöscht markiert.", table, rowsAffected)
 	}
 
-	// Lösche alte Datensätze
-	log.Println("Lösche alte, gelöschte Datensätze...")
-	purgeTimestamp := syncStartTimestamp.AddDate(0, 0, -purgeAgeInDays).Format(time.RFC3339)
-	for _, table := range tables {
-		result, err := db.Exec(`DELETE FROM `+ table +` WHERE is_deleted = TRUE AND updated_at < $1`, purgeTimestamp)
-		if err != nil {
-			log.Printf("Fehler beim Löschen alter Datensätze in Tabelle %s: %v", table, err)
-			continue
-		}
-		rowsAffected, _ := result.RowsAffected()
-		log.Printf("Tabelle %s: %d alte Datensätze gelöscht.", table, rowsAffected)
+	// Typisierte Spalten zu den LDAP-Rohwerten, nachträglich hinzugefügt
+	_, err = db.Exec(`
+      ALTER TABLE ` + run.table("viz_roles") + `
+        ADD COLUMN IF NOT EXISTS role_level INTEGER,
+        ADD COLUMN IF NOT EXISTS role_level_key TEXT,
+        ADD COLUMN IF NOT EXISTS role_level_name TEXT;
+      ALTER TABLE ` + run.table("viz_resources") + `
+        ADD COLUMN IF NOT EXISTS allow_multi BOOLEAN;
+      ALTER TABLE ` + run.table("viz_roles_resources") + `
+        ADD COLUMN IF NOT EXISTS status_code INTEGER,
+        ADD COLUMN IF NOT EXISTS status_key TEXT,
+        ADD COLUMN IF NOT EXISTS status_name TEXT,
+        ADD COLUMN IF NOT EXISTS ldap_created_at TIMESTAMP WITH TIME ZONE,
+        ADD COLUMN IF NOT EXISTS ldap_modified_at TIMESTAMP WITH TIME ZONE;
+      ALTER TABLE ` + run.table("viz_roles_resources") + `
+        ADD COLUMN IF NOT EXISTS approval JSONB,
+        ADD COLUMN IF NOT EXISTS approval_required BOOLEAN,
+        ADD COLUMN IF NOT EXISTS status_changed_at TIMESTAMP WITH TIME ZONE;
+      CREATE INDEX IF NOT EXISTS ` + pgx.Identifier{run.tables.name("viz_roles_resources") + "_status_idx"}.Sanitize() + `
+        ON ` + run.table("viz_roles_resources") + ` (source, status_key);
+    `)
+	if err != nil {
+		return fmt.Errorf("Fehler beim Ergänzen der typisierten Spalten: %w", err)
 	}
-}
 
-// syncRoles synchronisiert die Rollen von LDAP zur Datenbank.
-func syncRoles(conn *ldap.Conn, db *sql.DB, syncStartTimestamp time.Time) {
-	log.Println("Synchronisiere Rollen...")
-	entries, err := ldapSearch(
-		conn,
-		rolesSearchBase, // Verwendung der Konstante
-		rolesFilter,     // Verwendung der Konstante
-		[]string{"dn", "nrfRoleLevel", "nrfLocalizedNames", "nrfLocalizedDescrs", "nrfRoleCategoryKey", "nrfParentRoles"},
-	)
+	// Genehmigungseinstellungen von Rollen und Ressourcen sowie Eigentümer und
+	// Genehmiger, die je Quelle vollständig ersetzt werden
+	_, err = db.Exec(`
+      ALTER TABLE ` + run.table("viz_roles") + `
+        ADD COLUMN IF NOT EXISTS approval_required BOOLEAN,
+        ADD COLUMN IF NOT EXISTS approval_definition TEXT,
+        ADD COLUMN IF NOT EXISTS revoke_required BOOLEAN,
+        ADD COLUMN IF NOT EXISTS revoke_definition TEXT;
+      ALTER TABLE ` + run.table("viz_resources") + `
+        ADD COLUMN IF NOT EXISTS approval_required BOOLEAN,
+        ADD COLUMN IF NOT EXISTS approval_definition TEXT,
+        ADD COLUMN IF NOT EXISTS revoke_required BOOLEAN,
+        ADD COLUMN IF NOT EXISTS revoke_definition TEXT;
+      CREATE TABLE IF NOT EXISTS ` + run.table("viz_owners") + ` (
+        source TEXT NOT NULL DEFAULT 'default',
+        object_dn TEXT NOT NULL,
+        object_type TEXT NOT NULL,
+        owner_dn TEXT NOT NULL,
+        owner_type TEXT,
+        display_name TEXT,
+        updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+        PRIMARY KEY (source, object_dn, owner_dn)
+      );
+      CREATE INDEX IF NOT EXISTS ` + pgx.Identifier{run.tables.name("viz_owners") + "_owner_idx"}.Sanitize() + `
+        ON ` + run.table("viz_owners") + ` (source, owner_dn);
+      CREATE TABLE IF NOT EXISTS ` + run.table("viz_approvers") + ` (
+        source TEXT NOT NULL DEFAULT 'default',
+        object_dn TEXT NOT NULL,
+        object_type TEXT NOT NULL,
+        kind TEXT NOT NULL,
+        approver_dn TEXT NOT NULL,
+        approver_type TEXT,
+        display_name TEXT,
+        updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+        PRIMARY KEY (source, object_dn, kind, approver_dn)
+      );
+      CREATE INDEX IF NOT EXISTS ` + pgx.Identifier{run.tables.name("viz_approvers") + "_approver_idx"}.Sanitize() + `
+        ON ` + run.table("viz_approvers") + ` (source, approver_dn);
+    `)
 	if err != nil {
-		log.Printf("Fehler beim Synchronisieren der Rollen: %v", err)
-		writeJSONToFile("roles_raw_data.json", entries)
-		return
+		return fmt.Errorf("Fehler beim Erstellen der Tabellen für Eigentümer und Genehmiger: %w", err)
 	}
-	log.Printf("Gefundene Rollen: %d", len(entries))
-	writeJSONToFile("roles_raw_data.json", entries)
 
-	tx, err := db.Begin()
+	// Aus der Hierarchie abgeleitete Ressourcen je Rolle, wird je Quelle
+	// vollständig ersetzt. path enthält die DNs von der Rolle bis zur Rolle mit
+	// der Assoziation.
+	_, err = db.Exec(`
+      CREATE TABLE IF NOT EXISTS ` + run.table("viz_role_effective_resources") + ` (
+        source TEXT NOT NULL DEFAULT 'default',
+        role_dn TEXT NOT NULL,
+        resource_dn TEXT NOT NULL,
+        association_dn TEXT,
+        inherited_from TEXT,
+        path JSONB,
+        depth INTEGER,
+        updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+        PRIMARY KEY (source, role_dn, resource_dn)
+      );
+      CREATE INDEX IF NOT EXISTS ` + pgx.Identifier{run.tables.name("viz_role_effective_resources") + "_resource_idx"}.Sanitize() + `
+        ON ` + run.table("viz_role_effective_resources") + ` (source, resource_dn);
+    `)
 	if err != nil {
-		log.Printf("Fehler beim Starten der Transaktion für Rollen: %v", err)
-		return
+		return fmt.Errorf("Fehler beim Erstellen der Tabelle viz_role_effective_resources: %w", err)
 	}
-	defer tx.Rollback()
-
-	// Phase 1: Rollen in die viz_roles-Tabelle einfügen
-	log.Println("Phase 1: Füge Rollen in die Tabelle viz_roles ein...")
-	roleStmt, err := tx.Prepare(
-		`INSERT INTO viz_roles (dn, nrfRoleLevel, nrflocalizednames, nrflocalizeddescrs, nrfRoleCategoryKey, created_at, updated_at, is_deleted)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
-		ON CONFLICT (dn) DO UPDATE SET
-			nrfrolelevel = EXCLUDED.nrfrolelevel,
-			nrflocalizednames = EXCLUDED.nrflocalizednames,
-			nrflocalizeddescrs = EXCLUDED.nrflocalizeddescrs,
-			nrfrolecategorykey = EXCLUDED.nrfrolecategorykey,
-			updated_at = $7,
-			is_deleted = FALSE`,
-	)
+
+	// Laufprotokoll, dient u.a. als Vergleichsbasis für die Sicherheitsschwellen
+	_, err = db.Exec(`
+      CREATE TABLE IF NOT EXISTS ` + run.table("viz_sync_runs") + ` (
+        run_id TEXT PRIMARY KEY,
+        started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+        finished_at TIMESTAMP WITH TIME ZONE,
+        status TEXT NOT NULL,
+        counts JSONB,
+        error TEXT
+      );
+    `)
 	if err != nil {
-		log.Printf("Fehler beim Vorbereiten des Statements für Rollen: %v", err)
-		return
+		return fmt.Errorf("Fehler beim Erstellen der Tabelle viz_sync_runs: %w", err)
 	}
-	defer roleStmt.Close()
 
-	timestampStr := syncStartTimestamp.Format(time.RFC3339)
+	// Ergebnis je Quelle, Vergleichsbasis für die Sicherheitsschwellen der Quelle
+	_, err = db.Exec(`
+      CREATE TABLE IF NOT EXISTS ` + run.table("viz_sync_source_runs") + ` (
+        run_id TEXT NOT NULL,
+        source TEXT NOT NULL,
+        started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+        finished_at TIMESTAMP WITH TIME ZONE,
+        status TEXT NOT NULL,
+        counts JSONB,
+        error TEXT,
+        PRIMARY KEY (run_id, source)
+      );
+    `)
+	if err != nil {
+		return fmt.Errorf("Fehler beim Erstellen der Tabelle viz_sync_source_runs: %w", err)
+	}
 
-	// Alle Rollen in der ersten Schleife einfügen
-	for _, entry := range entries {
-		var nrfRoleCategoryKey string
-		nrfRoleLevel := entry.GetAttributeValue("nrfRoleLevel")
-		nrfLocalizedNames := entry.GetAttributeValue("nrfLocalizedNames")
-		nrfLocalizedDescrs := entry.GetAttributeValue("nrfLocalizedDescrs")
-		
-		roleCategoryKeys := entry.GetAttributeValues("nrfRoleCategoryKey")
-		if len(roleCategoryKeys) > 0 {
-			nrfRoleCategoryKey = strings.Join(roleCategoryKeys, "|")
-		}
+	// Über die GUID erkannte Umbenennungen und Verschiebungen je Lauf
+	_, err = db.Exec(`
+      CREATE TABLE IF NOT EXISTS ` + run.table("viz_sync_renames") + ` (
+        run_id TEXT NOT NULL,
+        source TEXT NOT NULL,
+        object_table TEXT NOT NULL,
+        guid TEXT NOT NULL,
+        old_dn TEXT NOT NULL,
+        new_dn TEXT NOT NULL,
+        kind TEXT NOT NULL,
+        detected_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+        PRIMARY KEY (run_id, source, object_table, guid)
+      );
+      CREATE INDEX IF NOT EXISTS ` + pgx.Identifier{run.tables.name("viz_sync_renames") + "_guid_idx"}.Sanitize() + ` ON ` + run.table("viz_sync_renames") + ` (source, guid);
+    `)
+	if err != nil {
+		return fmt.Errorf("Fehler beim Erstellen der Tabelle viz_sync_renames: %w", err)
+	}
 
-		localizedNamesJSON, _ := json.Marshal(parseLocalizedAttributes(nrfLocalizedNames))
-		localizedDescrsJSON, _ := json.Marshal(parseLocalizedAttributes(nrfLocalizedDescrs))
+	// Tabellen aus der Zeit vor den Quellprofilen auf die Spalte source umstellen
+	if err := migrateSourceKeys(run, db); err != nil {
+		return err
+	}
 
-		_, err := roleStmt.Exec(entry.DN, nrfRoleLevel, localizedNamesJSON, localizedDescrsJSON, nrfRoleCategoryKey, timestampStr, timestampStr, false)
-		if err != nil {
-			log.Printf("Fehler beim Einfügen der Rolle %s: %v", entry.DN, err)
-			tx.Rollback()
-			return
-		}
+	// Bestehende Datensätze auf die typisierten Spalten umstellen
+	converted, err := migrateTypedColumns(db, run.table, func(n int) string { return fmt.Sprintf("$%d", n) })
+	if err != nil {
+		return err
 	}
-	log.Println("Phase 1 abgeschlossen. Rollen erfolgreich eingefügt.")
-	
-	// Phase 2: Junction-Tabelle mit den Parent-Beziehungen füllen
-	log.Println("Phase 2: Füge Parent-Beziehungen in die Tabelle viz_roles_parents ein...")
-	_, err = tx.Exec(`DELETE FROM viz_roles_parents`)
+	if converted > 0 {
+		log.Info("Typisierte Spalten für bestehende Datensätze befüllt", keyCounts, slog.GroupValue(slog.Int64("converted", converted)))
+	}
+
+	// Alle Parameter aus nrfDynamicParmVals, einmal als JSONB an der Assoziation
+	// und normalisiert je Parameter für die Suche nach Werten. Die Tabelle
+	// hängt am Primärschlüssel (source, dn) und entsteht daher erst nach der
+	// Migration.
+	_, err = db.Exec(`
+      ALTER TABLE ` + run.table("viz_roles_resources") + ` ADD COLUMN IF NOT EXISTS nrfdynamicparmvals_parameters JSONB;
+      CREATE TABLE IF NOT EXISTS ` + run.table("viz_association_parameters") + ` (
+        source TEXT NOT NULL DEFAULT 'default',
+        association_dn TEXT NOT NULL,
+        position INTEGER NOT NULL,
+        name TEXT,
+        type TEXT,
+        value TEXT,
+        value_json JSONB,
+        updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+        PRIMARY KEY (source, association_dn, position),
+        FOREIGN KEY (source, association_dn) REFERENCES ` + run.table("viz_roles_resources") + `(source, dn) ON DELETE CASCADE
+      );
+      CREATE INDEX IF NOT EXISTS ` + pgx.Identifier{run.tables.name("viz_association_parameters") + "_value_idx"}.Sanitize() + `
+        ON ` + run.table("viz_association_parameters") + ` (source, name, value);
+    `)
 	if err != nil {
-		log.Printf("Fehler beim Löschen alter Rollenbeziehungen: %v", err)
-		tx.Rollback()
-		return
+		return fmt.Errorf("Fehler beim Erstellen der Tabelle viz_association_parameters: %w", err)
 	}
-	parentStmt, err := tx.Prepare(
-		`INSERT INTO viz_roles_parents (child_dn, parent_dn) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
-	)
+
+	// DN in der gelesenen Form und GUID, die Schlüssel- und Verweisspalten
+	// enthalten kanonische DNs. Bestehende Datensätze werden umgestellt.
+	_, err = db.Exec(`
+      ALTER TABLE ` + run.table("viz_roles") + `
+        ADD COLUMN IF NOT EXISTS original_dn TEXT,
+        ADD COLUMN IF NOT EXISTS guid TEXT;
+      ALTER TABLE ` + run.table("viz_resources") + `
+        ADD COLUMN IF NOT EXISTS original_dn TEXT,
+        ADD COLUMN IF NOT EXISTS guid TEXT;
+      ALTER TABLE ` + run.table("viz_roles_resources") + `
+        ADD COLUMN IF NOT EXISTS original_dn TEXT,
+        ADD COLUMN IF NOT EXISTS guid TEXT;
+      CREATE INDEX IF NOT EXISTS ` + pgx.Identifier{run.tables.name("viz_roles") + "_guid_idx"}.Sanitize() + `
+        ON ` + run.table("viz_roles") + ` (source, guid);
+      CREATE INDEX IF NOT EXISTS ` + pgx.Identifier{run.tables.name("viz_resources") + "_guid_idx"}.Sanitize() + `
+        ON ` + run.table("viz_resources") + ` (source, guid);
+      CREATE INDEX IF NOT EXISTS ` + pgx.Identifier{run.tables.name("viz_roles_resources") + "_guid_idx"}.Sanitize() + `
+        ON ` + run.table("viz_roles_resources") + ` (source, guid);
+    `)
 	if err != nil {
-		log.Printf("Fehler beim Vorbereiten des Statements für Rollenbeziehungen: %v", err)
-		tx.Rollback()
-		return
+		return fmt.Errorf("Fehler beim Ergänzen der Spalten original_dn und guid: %w", err)
+	}
+	if err := makeForeignKeysDeferrable(run, db); err != nil {
+		return err
 	}
-	defer parentStmt.Close()
+	normalized, err := migrateCanonicalDNs(db, run.table, func(n int) string { return fmt.Sprintf("$%d", n) }, deferConstraints)
+	if err != nil {
+		return err
+	}
+	if normalized.Converted > 0 || normalized.Merged > 0 {
+		log.Info("DNs bestehender Datensätze kanonisiert", keyCounts, slog.GroupValue(slog.Int64("converted", normalized.Converted), slog.Int64("merged", normalized.Merged)))
+	}
+	log.Info("Datenbanktabellen wurden erstellt oder existieren bereits.")
+	return nil
+}
 
-	for _, entry := range entries {
-		parentRoles := entry.GetAttributeValues("nrfParentRoles")
-		if len(parentRoles) > 0 {
-			for _, parentDN := range parentRoles {
-				_, err := parentStmt.Exec(entry.DN, parentDN)
-				if err != nil {
-					log.Printf("Fehler beim Einfügen der Parent-Beziehung für %s: %v", entry.DN, err)
-					tx.Rollback()
-					return
-				}
+// makeForeignKeysDeferrable macht die Fremdschlüssel auf viz_roles und
+// viz_roles_resources zurückstellbar. Migration und Umbenennungen stellen
+// Schlüssel und Verweise nacheinander um und prüfen sie erst beim Commit.
+func makeForeignKeysDeferrable(run *syncRun, db *sql.DB) error {
+	for _, table := range []string{"viz_roles_parents", "viz_association_parameters"} {
+		rows, err := db.Query(`SELECT conname FROM pg_constraint WHERE conrelid = $1::regclass AND contype = 'f' AND NOT condeferrable`, run.table(table))
+		if err != nil {
+			return fmt.Errorf("Fehler beim Lesen der Fremdschlüssel von Tabelle %s: %w", table, err)
+		}
+		var names []string
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				rows.Close()
+				return fmt.Errorf("Fehler beim Lesen der Fremdschlüssel von Tabelle %s: %w", table, err)
+			}
+			names = append(names, name)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("Fehler beim Lesen der Fremdschlüssel von Tabelle %s: %w", table, err)
+		}
+		for _, name := range names {
+			if _, err := db.Exec(`ALTER TABLE ` + run.table(table) + ` ALTER CONSTRAINT ` + pgx.Identifier{name}.Sanitize() + ` DEFERRABLE INITIALLY IMMEDIATE`); err != nil {
+				return fmt.Errorf("Fehler beim Ändern des Fremdschlüssels %s: %w", name, err)
 			}
 		}
 	}
-	log.Println("Phase 2 abgeschlossen. Parent-Beziehungen erfolgreich eingefügt.")
+	return nil
+}
 
-	tx.Commit()
-	log.Println("Rollensynchronisation abgeschlossen.")
+// deferConstraints stellt die Prüfung der Fremdschlüssel bis zum Ende der
+// Transaktion zurück.
+func deferConstraints(tx *sql.Tx) error {
+	_, err := tx.Exec(`SET CONSTRAINTS ALL DEFERRED`)
+	return err
 }
 
-// syncResources synchronisiert die Ressourcen von LDAP zur Datenbank.
-func syncResources(conn *ldap.Conn, db *sql.DB, syncStartTimestamp time.Time) {
-	log.Println("Synchronisiere Ressourcen...")
-	entries, err := ldapSearch(
-		conn,
-		resourcesSearchBase, // Verwendung der Konstante
-		resourcesFilter,     // Verwendung der Konstante
-		[]string{"dn", "nrfLocalizedNames", "nrfLocalizedDescrs", "nrfCategoryKey", "nrfAllowMulti", "nrfEntitlementRef"},
-	)
+// writeJSONToFile saves data to a JSON file for debugging.
+func writeJSONToFile(log *slog.Logger, filename string, data interface{}) {
+	file, err := os.Create(filename)
 	if err != nil {
-		log.Printf("Fehler beim Synchronisieren der Ressourcen: %v", err)
-        writeJSONToFile("resources_raw_data.json", entries)
+		log.Warn("Fehler beim Erstellen der Debug-Datei", "file", filename, keyError, err)
 		return
 	}
-	log.Printf("Gefundene Ressourcen: %d", len(entries))
-    writeJSONToFile("resources_raw_data.json", entries)
+	defer file.Close()
 
-	tx, err := db.Begin()
-	if err != nil {
-		log.Printf("Fehler beim Starten der Transaktion für Ressourcen: %v", err)
-		return
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(data); err != nil {
+		log.Warn("Fehler beim Schreiben in die Debug-Datei", "file", filename, keyError, err)
+	} else {
+		log.Debug("Raw LDAP-Daten geschrieben", "file", filename)
 	}
-	defer tx.Rollback()
-
-	stmt, err := tx.Prepare(
-		`INSERT INTO viz_resources (
-            dn, nrflocalizednames, nrflocalizeddescrs, nrfCategoryKey, nrfAllowMulti, 
-            entitlement_driver, entitlement_status, entitlement_xml, entitlement_xml_src, 
-            entitlement_xml_id, entitlement_xml_param_id, entitlement_xml_param_id2, entitlement_xml_param_id3,
-            created_at, updated_at, is_deleted
-        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
-        ON CONFLICT (dn) DO UPDATE SET 
-            nrflocalizednames = EXCLUDED.nrflocalizednames, 
-            nrflocalizeddescrs = EXCLUDED.nrflocalizeddescrs, 
-            nrfcategorykey = EXCLUDED.nrfcategorykey, 
-            nrfallowmulti = EXCLUDED.nrfallowmulti, 
-            entitlement_driver = EXCLUDED.entitlement_driver,
-            entitlement_status = EXCLUDED.entitlement_status,
-            entitlement_xml = EXCLUDED.entitlement_xml,
-            entitlement_xml_src = EXCLUDED.entitlement_xml_src,
-            entitlement_xml_id = EXCLUDED.entitlement_xml_id,
-            entitlement_xml_param_id = EXCLUDED.entitlement_xml_param_id,
-            entitlement_xml_param_id2 = EXCLUDED.entitlement_xml_param_id2,
-            entitlement_xml_param_id3 = EXCLUDED.entitlement_xml_param_id3,
-            updated_at = $15,
-            is_deleted = FALSE`,
-	)
-	if err != nil {
-		log.Printf("Fehler beim Vorbereiten des Statements für Ressourcen: %v", err)
-		return
+}
+
+// rawDataFile liefert den Namen der Debug-Datei mit den LDAP-Rohdaten einer
+// Objektart. Für andere Quellen als "default" enthält er den Namen der Quelle.
+func rawDataFile(run *syncRun, kind string) string {
+	if run.source == "" || run.source == defaultSourceName {
+		return kind + "_raw_data.json"
 	}
-	defer stmt.Close()
-	
-	timestampStr := syncStartTimestamp.Format(time.RFC3339)
+	return kind + "_raw_data_" + run.source + ".json"
+}
 
-	for _, entry := range entries {
-		// Ursprüngliche Attribute
-		nrfLocalizedNames := entry.GetAttributeValue("nrfLocalizedNames")
-		nrfLocalizedDescrs := entry.GetAttributeValue("nrfLocalizedDescrs")
-		nrfCategoryKey := entry.GetAttributeValue("nrfCategoryKey")
-		nrfAllowMulti := entry.GetAttributeValue("nrfAllowMulti")
-		nrfEntitlementRef := entry.GetAttributeValue("nrfEntitlementRef")
-
-		// Standardwerte für die neuen Felder
-		var entitlementDriver, entitlementStatus, entitlementXML string
-		var entitlementXMLSrc, entitlementXMLID string
-		var entitlementXMLParamID, entitlementXMLParamID2, entitlementXMLParamID3 string
-
-		// Schritt 1: Parsen des nrfEntitlementRef-Strings
-		refParts := strings.SplitN(nrfEntitlementRef, "#", 3)
-		if len(refParts) > 0 {
-			entitlementDriver = refParts[0]
-		}
-		if len(refParts) > 1 {
-			entitlementStatus = refParts[1]
-		}
-		if len(refParts) > 2 {
-			entitlementXML = refParts[2]
-		}
+// markAndPurge markiert nicht aktualisierte Einträge der Quelle des Laufs als
+// gelöscht und löscht alte Einträge.
+func markAndPurge(run *syncRun, db *sql.DB, retention retentionConfig) error {
+	var errs []error
 
-		// Schritt 2: Parsen des XML-Blocks
-		if entitlementXML != "" {
-			var ref EntitlementRefXML
-			err := xml.Unmarshal([]byte(entitlementXML), &ref)
-			if err == nil {
-				entitlementXMLSrc = ref.Src
-				entitlementXMLID = ref.ID
-
-				// Schritt 3: Parsen des JSON-Blocks im Param-Feld
-				if ref.Param != "" {
-					var param EntitlementParamJSON
-					err := json.Unmarshal([]byte(ref.Param), &param)
-					if err == nil {
-						entitlementXMLParamID = param.ID
-						entitlementXMLParamID2 = param.ID2
-						entitlementXMLParamID3 = param.ID3
-					} else {
-						// Wenn das Param-Feld kein JSON ist, versuchen wir, es direkt zu übernehmen.
-						// Das ist in den Beispielen nicht der Fall, aber es ist eine gute
-						// Absicherung gegen unerwartete Daten.
-						entitlementXMLParamID = ref.Param
-					}
-				}
-			}
+	// Zeitstempel für die Markierung
+	timestampStr := run.start.Format(time.RFC3339)
+
+	// Markiere veraltete Datensätze als gelöscht
+	stop := run.timePhase("mark")
+	log := run.log.With(keyPhase, "mark")
+	log.Info("Markiere veraltete Datensätze als gelöscht...")
+	for _, table := range managedTables {
+		result, err := db.Exec(`UPDATE `+run.table(table)+` SET is_deleted = TRUE WHERE source = $2 AND updated_at < $1 AND is_deleted = FALSE`, timestampStr, run.source)
+		if err != nil {
+			log.Error("Fehler beim Markieren von Datensätzen", keyTable, table, keyError, err)
+			errs = append(errs, fmt.Errorf("Fehler beim Markieren von Datensätzen in Tabelle %s: %w", table, err))
+			continue
 		}
+		rowsAffected, _ := result.RowsAffected()
+		run.tableMetrics(table).markedDeleted += rowsAffected
+		log.Info("Datensätze als gelöscht markiert", keyTable, table, keyCounts, slog.GroupValue(slog.Int64("marked_deleted", rowsAffected)))
+	}
+	stop()
+
+	// Lösche alte Datensätze
+	errs = append(errs, purgeTables(run, db, retention))
+	return errors.Join(errs...)
+}
+
+// countUpsert zählt das Ergebnis eines Upserts und protokolliert die Entscheidung.
+func countUpsert(log *slog.Logger, counts *tableCounts, dn string, inserted bool) {
+	if inserted {
+		counts.Inserted++
+		logDecision(log, dn, decisionInserted)
+	} else {
+		counts.Updated++
+		logDecision(log, dn, decisionUpdated)
+	}
+}
 
-		localizedNamesJSON, _ := json.Marshal(parseLocalizedAttributes(nrfLocalizedNames))
-		localizedDescrsJSON, _ := json.Marshal(parseLocalizedAttributes(nrfLocalizedDescrs))
-		
-		_, err = stmt.Exec(
-			entry.DN,
-			localizedNamesJSON,
-			localizedDescrsJSON,
-			nrfCategoryKey,
-			nrfAllowMulti,
-			entitlementDriver,
-			entitlementStatus,
-			entitlementXML,
-			entitlementXMLSrc,
-			entitlementXMLID,
-			entitlementXMLParamID,
-			entitlementXMLParamID2,
-			entitlementXMLParamID3,
-			timestampStr,
-			timestampStr,
-			false,
-		)
+// addWritten übernimmt die Schreibergebnisse einer Sink in die Zähler.
+func (c *tableCounts) addWritten(w tableCounts) {
+	c.Inserted += w.Inserted
+	c.Updated += w.Updated
+	c.Skipped += w.Skipped
+	c.Renamed += w.Renamed
+}
+
+// writeToSinks übergibt Datensätze an alle Sinks. In die Zähler des Laufs
+// gehen nur die Ergebnisse der ersten Sink ein, damit Metriken bei mehreren
+// Sinks nicht mehrfach zählen; die übrigen werden nur protokolliert.
+func writeToSinks(log *slog.Logger, sinks []Sink, counts []*tableCounts, write func(Sink) ([]tableCounts, error)) error {
+	var errs []error
+	for i, s := range sinks {
+		written, err := write(s)
 		if err != nil {
-			log.Printf("Fehler beim Einfügen der Ressource %s: %v", entry.DN, err)
-			tx.Rollback()
-			return
+			errs = append(errs, fmt.Errorf("Sink %s: %w", s.Name(), err))
+			continue
+		}
+		for j, w := range written {
+			if i == 0 {
+				counts[j].addWritten(w)
+			}
+			log.Debug("Datensätze an Sink übergeben", keySink, s.Name(), keyCounts, w)
 		}
 	}
-	tx.Commit()
-	log.Println("Ressourcensynchronisation abgeschlossen.")
+	return errors.Join(errs...)
 }
 
-// syncAssociations synchronisiert die Assoziationen von LDAP zur Datenbank.
-func syncAssociations(conn *ldap.Conn, db *sql.DB, syncStartTimestamp time.Time) {
-	log.Println("Synchronisiere Assoziationen...")
+// syncRoles liest die Rollen aus LDAP und schreibt sie mit ihren
+// Parent-Beziehungen in alle Sinks. Die gelesenen Rollen werden für die
+// effektiven Ressourcen zurückgegeben.
+func syncRoles(run *syncRun, conn *ldap.Conn, sinks []Sink, searchBase string) ([]roleRecord, error) {
+	defer run.timePhase("roles")()
+	log := run.phaseLogger("roles", "viz_roles")
+	log.Info("Synchronisiere Rollen...")
 	entries, err := ldapSearch(
 		conn,
-		associationsSearchBase, // Verwendung der Konstante
-		associationsFilter,     // Verwendung der Konstante
-		[]string{"dn", "nrfRole", "nrfResource", "nrfDynamicParmVals", "nrfStatus", "createTimestamp", "modifyTimestamp"},
+		searchBase,
+		rolesFilter, // Verwendung der Konstante
+		roleAttributes,
 	)
 	if err != nil {
-		log.Printf("Fehler beim Synchronisieren der Assoziationen: %v", err)
-        writeJSONToFile("associations_raw_data.json", entries)
-		return
+		log.Error("Fehler beim Synchronisieren der Rollen", keyError, err)
+		writeJSONToFile(log, rawDataFile(run, "roles"), entries)
+		return nil, fmt.Errorf("Fehler beim Synchronisieren der Rollen: %w", err)
 	}
-	log.Printf("Gefundene Assoziationen: %d", len(entries))
-    writeJSONToFile("associations_raw_data.json", entries)
+	writeJSONToFile(log, rawDataFile(run, "roles"), entries)
+	return writeRoles(run, log, sinks, entries)
+}
 
-	tx, err := db.Begin()
+// writeRoles bildet gelesene Rolleneinträge ab und schreibt sie mit ihren
+// Parent-Beziehungen in alle Sinks. Im Daemon-Modus sind es nur die geänderten.
+func writeRoles(run *syncRun, log *slog.Logger, sinks []Sink, entries []*ldap.Entry) ([]roleRecord, error) {
+	counts := tableCounts{Found: len(entries)}
+	var parentCounts tableCounts
+	defer func() {
+		run.recordCounts("viz_roles", counts)
+		run.recordCounts("viz_roles_parents", parentCounts)
+	}()
+	log.Info("Rollen gefunden", keyCounts, counts)
+
+	roles := make([]roleRecord, 0, len(entries))
+	for _, entry := range entries {
+		role, parseErr := mapRole(entry, run.languages)
+		if parseErr != nil {
+			counts.ParseErrors++
+			logDecision(log, role.DN, decisionParseError, keyError, parseErr)
+		}
+		parentCounts.Found += len(role.ParentDNs)
+		roles = append(roles, role)
+	}
+
+	err := writeToSinks(log, sinks, []*tableCounts{&counts, &parentCounts}, func(s Sink) ([]tableCounts, error) {
+		roleResult, parentResult, err := s.WriteRoles(run, roles)
+		return []tableCounts{roleResult, parentResult}, err
+	})
 	if err != nil {
-		log.Printf("Fehler beim Starten der Transaktion für Assoziationen: %v", err)
-		return
+		return nil, err
 	}
-	defer tx.Rollback()
-
-	stmt, err := tx.Prepare(
-		`INSERT INTO viz_roles_resources (
-			dn, nrfRole, nrfResource, nrfDynamicParmVals, nrfdynamicparmvals_value_json, nrfStatus, createTimestamp, modifyTimestamp, 
-			created_at, updated_at, is_deleted
-		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) 
-		 ON CONFLICT (dn) DO UPDATE SET 
-		 	nrfrole = EXCLUDED.nrfrole, 
-		 	nrfresource = EXCLUDED.nrfresource, 
-		 	nrfdynamicparmvals = EXCLUDED.nrfdynamicparmvals, 
-		 	nrfdynamicparmvals_value_json = EXCLUDED.nrfdynamicparmvals_value_json,
-		 	nrfstatus = EXCLUDED.nrfstatus, 
-		 	createTimestamp = EXCLUDED.createTimestamp, 
-		 	modifyTimestamp = EXCLUDED.modifyTimestamp,
-			updated_at = $10,
-			is_deleted = FALSE`,
+	log.Info("Rollensynchronisation abgeschlossen.", keyCounts, counts)
+	return roles, nil
+}
+
+// syncResources liest die Ressourcen aus LDAP und schreibt sie in alle Sinks.
+// Die gelesenen Ressourcen werden für Eigentümer und Genehmiger zurückgegeben.
+func syncResources(run *syncRun, conn *ldap.Conn, sinks []Sink, searchBase string) ([]resourceRecord, error) {
+	defer run.timePhase("resources")()
+	log := run.phaseLogger("resources", "viz_resources")
+	log.Info("Synchronisiere Ressourcen...")
+	entries, err := ldapSearch(
+		conn,
+		searchBase,
+		resourcesFilter, // Verwendung der Konstante
+		resourceAttributes,
 	)
 	if err != nil {
-		log.Printf("Fehler beim Vorbereiten des Statements für Assoziationen: %v", err)
-		return
+		log.Error("Fehler beim Synchronisieren der Ressourcen", keyError, err)
+		writeJSONToFile(log, rawDataFile(run, "resources"), entries)
+		return nil, fmt.Errorf("Fehler beim Synchronisieren der Ressourcen: %w", err)
 	}
-	defer stmt.Close()
-	
-	timestampStr := syncStartTimestamp.Format(time.RFC3339)
+	writeJSONToFile(log, rawDataFile(run, "resources"), entries)
+	return writeResources(run, log, sinks, entries)
+}
+
+// writeResources bildet gelesene Ressourceneinträge ab und schreibt sie in alle Sinks.
+func writeResources(run *syncRun, log *slog.Logger, sinks []Sink, entries []*ldap.Entry) ([]resourceRecord, error) {
+	counts := tableCounts{Found: len(entries)}
+	defer func() { run.recordCounts("viz_resources", counts) }()
+	log.Info("Ressourcen gefunden", keyCounts, counts)
 
+	resources := make([]resourceRecord, 0, len(entries))
 	for _, entry := range entries {
-		nrfRole := entry.GetAttributeValue("nrfRole")
-		nrfResource := entry.GetAttributeValue("nrfResource")
-		nrfDynamicParmVals := entry.GetAttributeValue("nrfDynamicParmVals")
-		nrfStatus := entry.GetAttributeValue("nrfStatus")
-		createTimestamp := entry.GetAttributeValue("createTimestamp")
-		modifyTimestamp := entry.GetAttributeValue("modifyTimestamp")
-		
-		var nrfdynamicparmvalsValueJSON string
-		if nrfDynamicParmVals != "" {
-			// Extract the content of the <value> tag, which is the JSON string
-			var dynamicParmValsXML DynamicParmValsXML
-			if err := xml.Unmarshal([]byte(nrfDynamicParmVals), &dynamicParmValsXML); err == nil {
-				// The JSON is HTML-encoded, so we need to decode it
-				value := strings.ReplaceAll(dynamicParmValsXML.Value, "&quot;", "\"")
-				value = strings.ReplaceAll(value, "&lt;", "<")
-				value = strings.ReplaceAll(value, "&gt;", ">")
-				// We need to unmarshal to check if it's an array or object
-				var jsonValue interface{}
-				if err := json.Unmarshal([]byte(value), &jsonValue); err == nil {
-					// We can re-marshal it to be sure it's valid JSON
-					jsonBytes, err := json.Marshal(jsonValue)
-					if err == nil {
-						nrfdynamicparmvalsValueJSON = string(jsonBytes)
-					}
-				}
-			}
+		res, parseErr := mapResource(entry, run.languages)
+		if parseErr != nil {
+			counts.ParseErrors++
+			logDecision(log, res.DN, decisionParseError, keyError, parseErr)
 		}
+		resources = append(resources, res)
+	}
 
-		_, err := stmt.Exec(entry.DN, nrfRole, nrfResource, nrfDynamicParmVals, nrfdynamicparmvalsValueJSON, nrfStatus, createTimestamp, modifyTimestamp, timestampStr, timestampStr, false)
-		if err != nil {
-			log.Printf("Fehler beim Einfügen der Assoziation %s: %v", entry.DN, err)
-		}
+	err := writeToSinks(log, sinks, []*tableCounts{&counts}, func(s Sink) ([]tableCounts, error) {
+		result, err := s.WriteResources(run, resources)
+		return []tableCounts{result}, err
+	})
+	if err != nil {
+		return nil, err
 	}
-	tx.Commit()
-	log.Println("Assoziationssynchronisation abgeschlossen.")
+	log.Info("Ressourcensynchronisation abgeschlossen.", keyCounts, counts)
+	return resources, nil
 }
 
-// parseLocalizedAttributes parst mehrsprachige Attribute.
-func parseLocalizedAttributes(localizedString string) map[string]string {
-	result := make(map[string]string)
-	if localizedString == "" {
-		return result
-	}
-	parts := strings.Split(localizedString, "|")
-	for _, part := range parts {
-		if strings.Contains(part, "~") {
-			split := strings.SplitN(part, "~", 2)
-			result[split[0]] = split[1]
-		} else if part != "" {
-			// Handle cases where the string does not contain a '~'
-			result["raw"] = part
+// syncAssociations liest die Assoziationen aus LDAP und schreibt sie in alle
+// Sinks. Die gelesenen Assoziationen werden für die effektiven Ressourcen
+// zurückgegeben.
+func syncAssociations(run *syncRun, conn *ldap.Conn, sinks []Sink, searchBase string) ([]associationRecord, error) {
+	defer run.timePhase("associations")()
+	log := run.phaseLogger("associations", "viz_roles_resources")
+	log.Info("Synchronisiere Assoziationen...")
+	entries, err := ldapSearch(
+		conn,
+		searchBase,
+		associationsFilter, // Verwendung der Konstante
+		associationAttributes,
+	)
+	if err != nil {
+		log.Error("Fehler beim Synchronisieren der Assoziationen", keyError, err)
+		writeJSONToFile(log, rawDataFile(run, "associations"), entries)
+		return nil, fmt.Errorf("Fehler beim Synchronisieren der Assoziationen: %w", err)
+	}
+	writeJSONToFile(log, rawDataFile(run, "associations"), entries)
+	return writeAssociations(run, log, sinks, entries)
+}
+
+// writeAssociations bildet gelesene Assoziationseinträge ab und schreibt sie in alle Sinks.
+func writeAssociations(run *syncRun, log *slog.Logger, sinks []Sink, entries []*ldap.Entry) ([]associationRecord, error) {
+	counts := tableCounts{Found: len(entries)}
+	defer func() { run.recordCounts("viz_roles_resources", counts) }()
+	log.Info("Assoziationen gefunden", keyCounts, counts)
+
+	associations := make([]associationRecord, 0, len(entries))
+	for _, entry := range entries {
+		assoc, parseErr := mapAssociation(entry)
+		if parseErr != nil {
+			counts.ParseErrors++
+			logDecision(log, assoc.DN, decisionParseError, keyError, parseErr)
 		}
+		associations = append(associations, assoc)
+	}
+	// Alle Status werden synchronisiert, nur aktive vergeben Ressourcen
+	byStatus := map[associationStatus]int{}
+	for _, assoc := range associations {
+		byStatus[assoc.StatusKey]++
+	}
+	log.Info("Assoziationen nach Status", "status", byStatus)
+
+	err := writeToSinks(log, sinks, []*tableCounts{&counts}, func(s Sink) ([]tableCounts, error) {
+		result, err := s.WriteAssociations(run, associations)
+		return []tableCounts{result}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Assoziationssynchronisation abgeschlossen.", keyCounts, counts)
+	return associations, nil
+}
+
+// syncEffectiveResources berechnet aus Rollen, Parent-Beziehungen und
+// Assoziationen die effektiven Ressourcen jeder Rolle und schreibt sie in
+// alle Sinks. Parent-Beziehungen entgegen den Rollenleveln werden ignoriert.
+func syncEffectiveResources(run *syncRun, sinks []Sink, model roleModel) error {
+	defer run.timePhase("effective")()
+	log := run.phaseLogger("effective", "viz_role_effective_resources")
+	log.Info("Berechne effektive Ressourcen...")
+
+	grants, ignored := resolveEffectiveResources(model)
+	for _, link := range ignored {
+		log.Warn("Parent-Beziehung widerspricht den Rollenleveln und wird ignoriert", keyDN, link.ChildDN, "parent_dn", link.ParentDN)
+	}
+	counts := tableCounts{Found: len(grants)}
+	defer func() { run.recordCounts("viz_role_effective_resources", counts) }()
+
+	err := writeToSinks(log, sinks, []*tableCounts{&counts}, func(s Sink) ([]tableCounts, error) {
+		result, err := s.WriteEffectiveResources(run, grants)
+		return []tableCounts{result}, err
+	})
+	if err != nil {
+		return err
 	}
-	return result
+	log.Info("Effektive Ressourcen geschrieben.", keyCounts, counts)
+	return nil
 }
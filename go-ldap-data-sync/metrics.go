@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Präfix aller Metriken dieses Programms.
+const metricsPrefix = "idm_ldap_sync_"
+
+// Name der Metrik mit dem Zeitpunkt des letzten erfolgreichen Laufs. Sie wird
+// bei fehlgeschlagenen Läufen aus der vorherigen Ausgabe übernommen.
+const lastSuccessMetric = metricsPrefix + "last_success_timestamp_seconds"
+
+// tableMetrics enthält die Zähler einer Tabelle für die Metrik-Ausgabe.
+type tableMetrics struct {
+	found         int
+	upserted      int
+	markedDeleted int64
+	purged        int64
+	parseErrors   int
+	renamed       int
+}
+
+// sourceTable identifiziert die Zähler einer Tabelle innerhalb eines Quellprofils.
+type sourceTable struct {
+	source string
+	table  string
+}
+
+// runMetrics sammelt alle Messwerte eines Laufs.
+type runMetrics struct {
+	phaseDurations map[string]time.Duration
+	tables         map[sourceTable]*tableMetrics
+	duration       time.Duration
+	exitStatus     int
+	finishedAt     time.Time
+}
+
+func newRunMetrics() *runMetrics {
+	return &runMetrics{
+		phaseDurations: make(map[string]time.Duration),
+		tables:         make(map[sourceTable]*tableMetrics),
+	}
+}
+
+// table liefert die Zähler einer Tabelle einer Quelle und legt sie bei Bedarf an.
+func (m *runMetrics) table(source, name string) *tableMetrics {
+	key := sourceTable{source: source, table: name}
+	t, ok := m.tables[key]
+	if !ok {
+		t = &tableMetrics{}
+		m.tables[key] = t
+	}
+	return t
+}
+
+// foundBySource liefert die gefundenen Einträge je Tabelle, für eine Quelle
+// oder – mit leerem source – summiert über alle Quellen.
+func (m *runMetrics) foundBySource(source string) map[string]int {
+	counts := make(map[string]int)
+	for key, t := range m.tables {
+		if source == "" || key.source == source {
+			counts[key.table] += t.found
+		}
+	}
+	return counts
+}
+
+// recordCounts übernimmt die Zähler eines Synchronisationsschritts.
+func (m *runMetrics) recordCounts(source, table string, c tableCounts) {
+	t := m.table(source, table)
+	t.found += c.Found
+	t.upserted += c.Inserted + c.Updated
+	t.parseErrors += c.ParseErrors
+	t.renamed += c.Renamed
+}
+
+// metricSample ist ein einzelner Messwert mit optionalen Labels.
+type metricSample struct {
+	labels map[string]string
+	value  float64
+}
+
+// metricFamily entspricht einer Metrik im Prometheus-Textformat.
+type metricFamily struct {
+	name    string
+	help    string
+	kind    string
+	samples []metricSample
+}
+
+// families wandelt die Messwerte in Metrik-Familien um. Der Zeitpunkt des
+// letzten Erfolgs wird nur bei erfolgreichen Läufen ausgegeben.
+func (m *runMetrics) families() []metricFamily {
+	keys := make([]sourceTable, 0, len(m.tables))
+	for key := range m.tables {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].source != keys[j].source {
+			return keys[i].source < keys[j].source
+		}
+		return keys[i].table < keys[j].table
+	})
+
+	perTable := func(name, help string, value func(*tableMetrics) float64) metricFamily {
+		f := metricFamily{name: metricsPrefix + name, help: help, kind: "gauge"}
+		for _, key := range keys {
+			labels := map[string]string{"table": key.table}
+			if key.source != "" {
+				labels["source"] = key.source
+			}
+			f.samples = append(f.samples, metricSample{labels: labels, value: value(m.tables[key])})
+		}
+		return f
+	}
+
+	phases := metricFamily{name: metricsPrefix + "phase_duration_seconds", help: "Dauer der einzelnen Phasen des letzten Laufs in Sekunden.", kind: "gauge"}
+	phaseNames := make([]string, 0, len(m.phaseDurations))
+	for name := range m.phaseDurations {
+		phaseNames = append(phaseNames, name)
+	}
+	sort.Strings(phaseNames)
+	for _, name := range phaseNames {
+		phases.samples = append(phases.samples, metricSample{labels: map[string]string{"phase": name}, value: m.phaseDurations[name].Seconds()})
+	}
+
+	families := []metricFamily{
+		{name: metricsPrefix + "run_duration_seconds", help: "Gesamtdauer des letzten Laufs in Sekunden.", kind: "gauge", samples: []metricSample{{value: m.duration.Seconds()}}},
+		phases,
+		perTable("entries_found", "Anzahl der im letzten Lauf in LDAP gefundenen Einträge.", func(t *tableMetrics) float64 { return float64(t.found) }),
+		perTable("entries_upserted", "Anzahl der im letzten Lauf eingefügten oder aktualisierten Einträge.", func(t *tableMetrics) float64 { return float64(t.upserted) }),
+		perTable("entries_marked_deleted", "Anzahl der im letzten Lauf als gelöscht markierten Einträge.", func(t *tableMetrics) float64 { return float64(t.markedDeleted) }),
+		perTable("entries_purged", "Anzahl der im letzten Lauf endgültig gelöschten Einträge.", func(t *tableMetrics) float64 { return float64(t.purged) }),
+		perTable("entries_renamed", "Anzahl der im letzten Lauf über die GUID erkannten Umbenennungen und Verschiebungen.", func(t *tableMetrics) float64 { return float64(t.renamed) }),
+		perTable("parse_errors", "Anzahl der Parse-Fehler im letzten Lauf.", func(t *tableMetrics) float64 { return float64(t.parseErrors) }),
+		{name: metricsPrefix + "exit_status", help: "Exit-Status des letzten Laufs (0 = erfolgreich).", kind: "gauge", samples: []metricSample{{value: float64(m.exitStatus)}}},
+		{name: metricsPrefix + "last_run_timestamp_seconds", help: "Unix-Zeitstempel des Endes des letzten Laufs.", kind: "gauge", samples: []metricSample{{value: float64(m.finishedAt.Unix())}}},
+	}
+	if m.exitStatus == 0 {
+		families = append(families, metricFamily{name: lastSuccessMetric, help: "Unix-Zeitstempel des letzten erfolgreichen Laufs.", kind: "gauge", samples: []metricSample{{value: float64(m.finishedAt.Unix())}}})
+	}
+	return families
+}
+
+// writeExposition schreibt Metrik-Familien im Prometheus-Textformat (Version 0.0.4).
+func writeExposition(w io.Writer, families []metricFamily) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		if len(f.samples) == 0 {
+			continue
+		}
+		fmt.Fprintf(bw, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.name, f.kind)
+		for _, s := range f.samples {
+			bw.WriteString(f.name)
+			if len(s.labels) > 0 {
+				keys := make([]string, 0, len(s.labels))
+				for k := range s.labels {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				pairs := make([]string, 0, len(keys))
+				for _, k := range keys {
+					pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", k, escapeLabelValue(s.labels[k])))
+				}
+				bw.WriteString("{" + strings.Join(pairs, ",") + "}")
+			}
+			bw.WriteString(" " + strconv.FormatFloat(s.value, 'g', -1, 64) + "\n")
+		}
+	}
+	return bw.Flush()
+}
+
+// escapeLabelValue maskiert Label-Werte gemäß dem Prometheus-Textformat.
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// readPreviousSample liest einen Messwert ohne Labels aus einer bestehenden Textdatei.
+func readPreviousSample(path, name string) (float64, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, name+" "); ok {
+			v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			return v, err == nil
+		}
+	}
+	return 0, false
+}
+
+// writeMetricsTextfile schreibt die Metriken atomar in eine Datei, z.B. für
+// den Textfile-Collector des node_exporters. Bei fehlgeschlagenen Läufen wird
+// der Zeitpunkt des letzten Erfolgs aus der bisherigen Datei übernommen.
+func writeMetricsTextfile(path string, m *runMetrics) error {
+	families := m.families()
+	if m.exitStatus != 0 {
+		if v, ok := readPreviousSample(path, lastSuccessMetric); ok {
+			families = append(families, metricFamily{name: lastSuccessMetric, help: "Unix-Zeitstempel des letzten erfolgreichen Laufs.", kind: "gauge", samples: []metricSample{{value: v}}})
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".metrics-*.prom")
+	if err != nil {
+		return fmt.Errorf("temporäre Metrik-Datei konnte nicht erstellt werden: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if err := writeExposition(tmp, families); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Metriken konnten nicht geschrieben werden: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Metriken konnten nicht geschrieben werden: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return fmt.Errorf("Rechte der Metrik-Datei konnten nicht gesetzt werden: %w", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// pushMetrics sendet die Metriken an einen Pushgateway-kompatiblen Endpunkt.
+// Erfolgreiche Läufe ersetzen die Gruppe (PUT), fehlgeschlagene aktualisieren
+// nur die enthaltenen Metriken (POST), damit der letzte Erfolg erhalten bleibt.
+func pushMetrics(client *http.Client, baseURL, job string, m *runMetrics) error {
+	var body bytes.Buffer
+	if err := writeExposition(&body, m.families()); err != nil {
+		return err
+	}
+
+	method := http.MethodPut
+	if m.exitStatus != 0 {
+		method = http.MethodPost
+	}
+	target := strings.TrimRight(baseURL, "/") + "/metrics/job/" + url.PathEscape(job)
+	req, err := http.NewRequest(method, target, &body)
+	if err != nil {
+		return fmt.Errorf("ungültige Pushgateway-URL: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Pushgateway nicht erreichbar: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Pushgateway antwortete mit %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// publishMetrics gibt die Metriken eines Laufs an alle konfigurierten Ziele aus.
+// Fehler werden nur protokolliert, damit sie den Exit-Status nicht verfälschen.
+func publishMetrics(run *syncRun, cfg config) {
+	log := run.log.With(keyPhase, "metrics")
+	if cfg.MetricsTextfile != "" {
+		if err := writeMetricsTextfile(cfg.MetricsTextfile, run.metrics); err != nil {
+			log.Error("Fehler beim Schreiben der Metrik-Datei", "file", cfg.MetricsTextfile, keyError, err)
+		} else {
+			log.Info("Metriken geschrieben", "file", cfg.MetricsTextfile)
+		}
+	}
+	if cfg.MetricsPushURL != "" {
+		client := &http.Client{Timeout: 10 * time.Second}
+		if err := pushMetrics(client, cfg.MetricsPushURL, cfg.MetricsJob, run.metrics); err != nil {
+			log.Error("Fehler beim Senden der Metriken", "url", cfg.MetricsPushURL, keyError, err)
+		} else {
+			log.Info("Metriken an Pushgateway gesendet", "url", cfg.MetricsPushURL)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteExposition(t *testing.T) {
+	families := []metricFamily{
+		{name: "ldap_sync_run_duration_seconds", help: "Dauer.", kind: "gauge", samples: []metricSample{{value: 1.5}}},
+		{name: "ldap_sync_empty", help: "Ohne Werte.", kind: "gauge"},
+		{name: "ldap_sync_entries_found", help: "Gefunden.", kind: "gauge", samples: []metricSample{
+			{labels: map[string]string{"table": "viz_roles", "source": "default"}, value: 42},
+			{labels: map[string]string{"table": `a"b\c` + "\n"}, value: 0},
+		}},
+	}
+	want := `# HELP ldap_sync_run_duration_seconds Dauer.
+# TYPE ldap_sync_run_duration_seconds gauge
+ldap_sync_run_duration_seconds 1.5
+# HELP ldap_sync_entries_found Gefunden.
+# TYPE ldap_sync_entries_found gauge
+ldap_sync_entries_found{source="default",table="viz_roles"} 42
+ldap_sync_entries_found{table="a\"b\\c\n"} 0
+`
+	var b strings.Builder
+	if err := writeExposition(&b, families); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != want {
+		t.Errorf("writeExposition() =\n%s\nerwartet\n%s", b.String(), want)
+	}
+}
+
+func TestPushMetrics(t *testing.T) {
+	tests := []struct {
+		name       string
+		exitStatus int
+		status     int
+		wantMethod string
+		wantErr    bool
+	}{
+		{"erfolgreicher Lauf ersetzt die Gruppe", 0, http.StatusOK, http.MethodPut, false},
+		{"fehlgeschlagener Lauf aktualisiert", 1, http.StatusAccepted, http.MethodPost, false},
+		{"Fehler des Pushgateways", 0, http.StatusBadRequest, http.MethodPut, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var method, path, contentType, body string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				method, path, contentType, body = r.Method, r.URL.EscapedPath(), r.Header.Get("Content-Type"), string(data)
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			m := newRunMetrics()
+			m.exitStatus = tt.exitStatus
+			m.finishedAt = time.Unix(1700000000, 0)
+			m.recordCounts("default", "viz_roles", tableCounts{Found: 3})
+			err := pushMetrics(server.Client(), server.URL+"/", "ldap sync", m)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("pushMetrics() = %v, Fehler erwartet: %v", err, tt.wantErr)
+			}
+			if method != tt.wantMethod {
+				t.Errorf("Methode %s, erwartet %s", method, tt.wantMethod)
+			}
+			if path != "/metrics/job/ldap%20sync" {
+				t.Errorf("Pfad %s, erwartet /metrics/job/ldap%%20sync", path)
+			}
+			if contentType != "text/plain; version=0.0.4" {
+				t.Errorf("Content-Type %q", contentType)
+			}
+			if !strings.Contains(body, `table="viz_roles"} 3`) {
+				t.Errorf("Metriken fehlen im Body:\n%s", body)
+			}
+			if hasSuccess := strings.Contains(body, lastSuccessMetric+" "); hasSuccess != (tt.exitStatus == 0) {
+				t.Errorf("%s im Body: %v, erwartet %v", lastSuccessMetric, hasSuccess, tt.exitStatus == 0)
+			}
+		})
+	}
+}
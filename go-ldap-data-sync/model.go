@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Attribute, die für die einzelnen Objektklassen aus LDAP gelesen werden.
+var (
+	roleAttributes        = slices.Concat([]string{"dn", "nrfRoleLevel", "nrfLocalizedNames", "nrfLocalizedDescrs", "nrfRoleCategoryKey", "nrfParentRoles"}, governanceAttributes, identityAttributes)
+	resourceAttributes    = slices.Concat([]string{"dn", "nrfLocalizedNames", "nrfLocalizedDescrs", "nrfCategoryKey", "nrfAllowMulti", "nrfEntitlementRef"}, governanceAttributes, identityAttributes)
+	associationAttributes = slices.Concat([]string{"dn", "nrfRole", "nrfResource", "nrfDynamicParmVals", "nrfStatus", "createTimestamp", "modifyTimestamp"}, approvalAttributes, identityAttributes)
+	// Genehmigungsdaten einer Assoziation, werden unverändert in approval übernommen
+	approvalAttributes = []string{"nrfApprovalRequired", "nrfApprovalOverride", "nrfApprovalDefinition"}
+)
+
+// Definition der Go-Struktur für die XML-Entität nrfEntitlementRef
+type EntitlementRefXML struct {
+	XMLName xml.Name `xml:"ref"`
+	Src     string   `xml:"src"`
+	ID      string   `xml:"id"`
+	Param   string   `xml:"param"`
+}
+
+// Definition der Go-Struktur für das JSON-Objekt innerhalb von Param
+type EntitlementParamJSON struct {
+	ID  string `json:"ID"`
+	ID2 string `json:"ID2"`
+	ID3 string `json:"ID3"`
+}
+
+// Definition der Go-Struktur für einen <parameter>-Knoten in nrfDynamicParmVals.
+// Name und Typ stehen je nach Version als Attribut oder als Kindelement.
+type DynamicParameterXML struct {
+	NameAttr string                     `xml:"name,attr"`
+	TypeAttr string                     `xml:"type,attr"`
+	Name     string                     `xml:"name"`
+	Type     string                     `xml:"type"`
+	Values   []DynamicParameterValueXML `xml:"value"`
+}
+
+// Definition der Go-Struktur für einen <value>-Knoten eines Parameters
+type DynamicParameterValueXML struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+// dynamicParameter ist ein dekodierter Parameter einer Assoziation
+// (viz_association_parameters). ValueJSON ist gesetzt, wenn der Wert gültiges
+// JSON ist; mehrere <value>-Knoten ergeben ein JSON-Array.
+type dynamicParameter struct {
+	Name      string          `json:"name"`
+	Type      string          `json:"type"`
+	Value     string          `json:"value"`
+	ValueJSON json.RawMessage `json:"value_json,omitempty"`
+}
+
+// roleRecord ist eine Rolle, wie sie in viz_roles gespeichert wird.
+type roleRecord struct {
+	DN              string            `json:"dn"`
+	RoleLevel       string            `json:"nrfRoleLevel"`
+	LocalizedNames  map[string]string `json:"nrfLocalizedNames"`
+	LocalizedDescrs map[string]string `json:"nrfLocalizedDescrs"`
+	CategoryKey     string            `json:"nrfRoleCategoryKey"`
+	ParentDNs       []string          `json:"nrfParentRoles,omitempty"`
+	// Name nach der Sprach-Fallback-Kette (LANGUAGE_FALLBACK)
+	DisplayName string `json:"display_name"`
+	// Typisiertes nrfRoleLevel
+	Level     *int      `json:"role_level,omitempty"`
+	LevelKey  roleLevel `json:"role_level_key,omitempty"`
+	LevelName string    `json:"role_level_name,omitempty"`
+	// Eigentümer, Genehmiger und Genehmigungseinstellungen
+	governance
+	// DN in der gelesenen Form und GUID
+	identity
+}
+
+// parentLink ist eine Parent-Child-Beziehung zwischen zwei Rollen (viz_roles_parents).
+type parentLink struct {
+	ChildDN  string `json:"child_dn"`
+	ParentDN string `json:"parent_dn"`
+}
+
+// resourceRecord ist eine Ressource, wie sie in viz_resources gespeichert wird.
+type resourceRecord struct {
+	DN                     string            `json:"dn"`
+	DisplayName            string            `json:"display_name"`
+	LocalizedNames         map[string]string `json:"nrfLocalizedNames"`
+	LocalizedDescrs        map[string]string `json:"nrfLocalizedDescrs"`
+	CategoryKey            string            `json:"nrfCategoryKey"`
+	AllowMulti             string            `json:"nrfAllowMulti"`
+	AllowMultiFlag         *bool             `json:"allow_multi,omitempty"`
+	EntitlementDriver      string            `json:"entitlement_driver"`
+	EntitlementStatus      string            `json:"entitlement_status"`
+	EntitlementXML         string            `json:"entitlement_xml"`
+	EntitlementXMLSrc      string            `json:"entitlement_xml_src"`
+	EntitlementXMLID       string            `json:"entitlement_xml_id"`
+	EntitlementXMLParamID  string            `json:"entitlement_xml_param_id"`
+	EntitlementXMLParamID2 string            `json:"entitlement_xml_param_id2"`
+	EntitlementXMLParamID3 string            `json:"entitlement_xml_param_id3"`
+	// Eigentümer, Genehmiger und Genehmigungseinstellungen
+	governance
+	// DN in der gelesenen Form und GUID
+	identity
+}
+
+// associationRecord ist eine Rollen-Ressourcen-Zuordnung (viz_roles_resources).
+type associationRecord struct {
+	DN                       string             `json:"dn"`
+	Role                     string             `json:"nrfRole"`
+	Resource                 string             `json:"nrfResource"`
+	DynamicParmVals          string             `json:"nrfDynamicParmVals"`
+	DynamicParmValsValueJSON string             `json:"nrfdynamicparmvals_value_json"`
+	DynamicParameters        []dynamicParameter `json:"nrfdynamicparmvals_parameters,omitempty"`
+	Status                   string             `json:"nrfStatus"`
+	CreateTimestamp          string             `json:"createTimestamp"`
+	ModifyTimestamp          string             `json:"modifyTimestamp"`
+	// Typisierte Werte von nrfStatus, createTimestamp und modifyTimestamp
+	StatusCode     *int              `json:"status_code,omitempty"`
+	StatusKey      associationStatus `json:"status_key,omitempty"`
+	StatusName     string            `json:"status_name,omitempty"`
+	LDAPCreatedAt  time.Time         `json:"ldap_created_at,omitzero"`
+	LDAPModifiedAt time.Time         `json:"ldap_modified_at,omitzero"`
+	// Vorhandene Genehmigungsattribute (approvalAttributes) mit ihren Werten
+	Approval         map[string][]string `json:"approval,omitempty"`
+	ApprovalRequired *bool               `json:"approval_required,omitempty"`
+	// DN in der gelesenen Form und GUID
+	identity
+}
+
+// mapRole wandelt einen LDAP-Eintrag in eine Rolle um. DN und Verweise werden
+// kanonisch gespeichert. Warnungen beim Parsen der lokalisierten Attribute und
+// der DNs werden zurückgegeben, der Datensatz ist trotzdem verwendbar.
+func mapRole(entry *ldap.Entry, languages []string) (roleRecord, error) {
+	var nrfRoleCategoryKey string
+	roleCategoryKeys := entry.GetAttributeValues("nrfRoleCategoryKey")
+	if len(roleCategoryKeys) > 0 {
+		nrfRoleCategoryKey = strings.Join(roleCategoryKeys, "|")
+	}
+
+	names, nameErr := parseLocalized("nrfLocalizedNames", entry.GetAttributeValue("nrfLocalizedNames"))
+	descrs, descrErr := parseLocalized("nrfLocalizedDescrs", entry.GetAttributeValue("nrfLocalizedDescrs"))
+	dn, id, dnErr := mapIdentity(entry)
+	parentDNs, parentErr := canonicalDNs("nrfParentRoles", entry.GetAttributeValues("nrfParentRoles"))
+	rec := roleRecord{
+		DN:              dn,
+		RoleLevel:       entry.GetAttributeValue("nrfRoleLevel"),
+		LocalizedNames:  names,
+		LocalizedDescrs: descrs,
+		CategoryKey:     nrfRoleCategoryKey,
+		ParentDNs:       parentDNs,
+		DisplayName:     localizedLabel(names, languages, entry.DN),
+		identity:        id,
+	}
+	levelErr := rec.decodeTyped()
+	var governanceErr error
+	rec.governance, governanceErr = mapGovernance(entry)
+	return rec, errors.Join(dnErr, parentErr, nameErr, descrErr, levelErr, governanceErr)
+}
+
+// decodeTyped setzt die typisierten Felder aus nrfRoleLevel.
+func (r *roleRecord) decodeTyped() (err error) {
+	r.Level, r.LevelKey, r.LevelName, err = decodeRoleLevel(r.RoleLevel)
+	return err
+}
+
+// parentLinks liefert die Parent-Beziehungen der Rolle.
+func (r roleRecord) parentLinks() []parentLink {
+	links := make([]parentLink, 0, len(r.ParentDNs))
+	for _, parentDN := range r.ParentDNs {
+		links = append(links, parentLink{ChildDN: r.DN, ParentDN: parentDN})
+	}
+	return links
+}
+
+// mapResource wandelt einen LDAP-Eintrag in eine Ressource um. Fehler beim
+// Parsen des nrfEntitlementRef, der lokalisierten Attribute und der DNs werden
+// zurückgegeben, der Datensatz ist trotzdem mit den übrigen Attributen verwendbar.
+func mapResource(entry *ldap.Entry, languages []string) (resourceRecord, error) {
+	names, nameErr := parseLocalized("nrfLocalizedNames", entry.GetAttributeValue("nrfLocalizedNames"))
+	descrs, descrErr := parseLocalized("nrfLocalizedDescrs", entry.GetAttributeValue("nrfLocalizedDescrs"))
+	dn, id, dnErr := mapIdentity(entry)
+	localizedErr := errors.Join(dnErr, nameErr, descrErr)
+	rec := resourceRecord{
+		DN:              dn,
+		identity:        id,
+		DisplayName:     localizedLabel(names, languages, entry.DN),
+		LocalizedNames:  names,
+		LocalizedDescrs: descrs,
+		CategoryKey:     entry.GetAttributeValue("nrfCategoryKey"),
+		AllowMulti:      entry.GetAttributeValue("nrfAllowMulti"),
+	}
+	var governanceErr error
+	rec.governance, governanceErr = mapGovernance(entry)
+	localizedErr = errors.Join(localizedErr, rec.decodeTyped(), governanceErr)
+	nrfEntitlementRef := entry.GetAttributeValue("nrfEntitlementRef")
+
+	// Schritt 1: Parsen des nrfEntitlementRef-Strings
+	refParts := strings.SplitN(nrfEntitlementRef, "#", 3)
+	if len(refParts) > 0 {
+		rec.EntitlementDriver = refParts[0]
+	}
+	if len(refParts) > 1 {
+		rec.EntitlementStatus = refParts[1]
+	}
+	if len(refParts) > 2 {
+		rec.EntitlementXML = refParts[2]
+	}
+
+	// Schritt 2: Parsen des XML-Blocks
+	if rec.EntitlementXML != "" {
+		var ref EntitlementRefXML
+		if err := xml.Unmarshal([]byte(rec.EntitlementXML), &ref); err != nil {
+			return rec, errors.Join(localizedErr, fmt.Errorf("nrfEntitlementRef: %w", err))
+		}
+		rec.EntitlementXMLSrc = ref.Src
+		rec.EntitlementXMLID = ref.ID
+
+		// Schritt 3: Parsen des JSON-Blocks im Param-Feld
+		if ref.Param != "" {
+			var param EntitlementParamJSON
+			if err := json.Unmarshal([]byte(ref.Param), &param); err == nil {
+				rec.EntitlementXMLParamID = param.ID
+				rec.EntitlementXMLParamID2 = param.ID2
+				rec.EntitlementXMLParamID3 = param.ID3
+			} else {
+				// Wenn das Param-Feld kein JSON ist, versuchen wir, es direkt zu übernehmen.
+				// Das ist in den Beispielen nicht der Fall, aber es ist eine gute
+				// Absicherung gegen unerwartete Daten.
+				rec.EntitlementXMLParamID = ref.Param
+			}
+		}
+	}
+	return rec, localizedErr
+}
+
+// decodeTyped setzt das typisierte nrfAllowMulti.
+func (r *resourceRecord) decodeTyped() (err error) {
+	r.AllowMultiFlag, err = parseLDAPBool("nrfAllowMulti", r.AllowMulti)
+	return err
+}
+
+// mapAssociation wandelt einen LDAP-Eintrag in eine Assoziation um. DN,
+// nrfRole und nrfResource werden kanonisch gespeichert. Fehler beim Parsen von
+// nrfDynamicParmVals, nrfStatus, der Zeitstempel und der DNs werden
+// zurückgegeben, der Datensatz ist trotzdem verwendbar.
+func mapAssociation(entry *ldap.Entry) (associationRecord, error) {
+	dn, id, dnErr := mapIdentity(entry)
+	role, roleErr := canonicalDN(entry.GetAttributeValue("nrfRole"))
+	resource, resourceErr := canonicalDN(entry.GetAttributeValue("nrfResource"))
+	if roleErr != nil {
+		roleErr = fmt.Errorf("nrfRole: %w", roleErr)
+	}
+	if resourceErr != nil {
+		resourceErr = fmt.Errorf("nrfResource: %w", resourceErr)
+	}
+	rec := associationRecord{
+		DN:              dn,
+		identity:        id,
+		Role:            role,
+		Resource:        resource,
+		DynamicParmVals: entry.GetAttributeValue("nrfDynamicParmVals"),
+		Status:          entry.GetAttributeValue("nrfStatus"),
+		CreateTimestamp: entry.GetAttributeValue("createTimestamp"),
+		ModifyTimestamp: entry.GetAttributeValue("modifyTimestamp"),
+	}
+	for _, attribute := range approvalAttributes {
+		if values := entry.GetAttributeValues(attribute); len(values) > 0 {
+			if rec.Approval == nil {
+				rec.Approval = map[string][]string{}
+			}
+			rec.Approval[attribute] = values
+		}
+	}
+	typedErr := errors.Join(dnErr, roleErr, resourceErr, rec.decodeTyped())
+
+	if rec.DynamicParmVals != "" {
+		params, err := parseDynamicParameters(rec.DynamicParmVals)
+		if err != nil {
+			return rec, errors.Join(typedErr, fmt.Errorf("nrfDynamicParmVals: %w", err))
+		}
+		rec.DynamicParameters = params
+		// Der JSON-Wert des ersten Parameters bleibt für bestehende Abfragen erhalten
+		if len(params) > 0 && params[0].ValueJSON != nil {
+			rec.DynamicParmValsValueJSON = string(params[0].ValueJSON)
+		}
+	}
+	return rec, typedErr
+}
+
+// decodeTyped setzt die typisierten Felder aus nrfStatus, createTimestamp,
+// modifyTimestamp und nrfApprovalRequired.
+func (r *associationRecord) decodeTyped() error {
+	var statusErr, createErr, modifyErr, approvalErr error
+	r.StatusCode, r.StatusKey, r.StatusName, statusErr = decodeStatus(r.Status)
+	r.LDAPCreatedAt, createErr = parseGeneralizedTime("createTimestamp", r.CreateTimestamp)
+	r.LDAPModifiedAt, modifyErr = parseGeneralizedTime("modifyTimestamp", r.ModifyTimestamp)
+	if values := r.Approval["nrfApprovalRequired"]; len(values) > 0 {
+		r.ApprovalRequired, approvalErr = parseLDAPBool("nrfApprovalRequired", values[0])
+	}
+	return errors.Join(statusErr, createErr, modifyErr, approvalErr)
+}
+
+// active meldet, ob die Assoziation aktiv ist (nrfStatus 50). Nur aktive
+// Assoziationen vergeben Ressourcen; die übrigen werden mit ihrem Status
+// synchronisiert, damit z.B. ausstehende Genehmigungen sichtbar sind.
+func (r associationRecord) active() bool {
+	_, status, _, _ := decodeStatus(r.Status)
+	return status == statusActive
+}
+
+// approvalJSON liefert die Genehmigungsattribute für die JSONB-Spalte approval.
+func (r associationRecord) approvalJSON() any {
+	if len(r.Approval) == 0 {
+		return nil
+	}
+	return string(mustJSON(r.Approval))
+}
+
+// parseDynamicParameters liest alle <parameter>-Knoten aus nrfDynamicParmVals,
+// unabhängig davon, ob sie einzeln oder in einem umschließenden Element stehen.
+// Die Werte sind zusätzlich HTML-kodiert (z.B. &quot; oder &#34;) und werden
+// nach dem XML-Parsen ein weiteres Mal dekodiert.
+func parseDynamicParameters(value string) ([]dynamicParameter, error) {
+	decoder := xml.NewDecoder(strings.NewReader(value))
+	params := []dynamicParameter{}
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return params, err
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "parameter" {
+			continue
+		}
+		var p DynamicParameterXML
+		if err := decoder.DecodeElement(&p, &start); err != nil {
+			return params, err
+		}
+		params = append(params, p.decode())
+	}
+	if len(params) == 0 {
+		return params, errors.New("kein <parameter>-Element gefunden")
+	}
+	return params, nil
+}
+
+// decode bildet einen XML-Parameter auf einen dynamicParameter ab.
+func (p DynamicParameterXML) decode() dynamicParameter {
+	param := dynamicParameter{Name: p.Name, Type: p.Type}
+	if param.Name == "" {
+		param.Name = p.NameAttr
+	}
+	if param.Type == "" {
+		param.Type = p.TypeAttr
+	}
+	values := make([]string, len(p.Values))
+	for i, v := range p.Values {
+		values[i] = html.UnescapeString(strings.TrimSpace(v.Text))
+		if param.Type == "" {
+			param.Type = v.Type
+		}
+	}
+	switch len(values) {
+	case 0:
+	case 1:
+		param.Value = values[0]
+		// Wie bisher neu serialisiert: Schlüssel sortiert, HTML-Zeichen maskiert
+		var v any
+		if json.Unmarshal([]byte(values[0]), &v) == nil {
+			param.ValueJSON = mustJSON(v)
+		}
+	default:
+		param.Value = strings.Join(values, "\n")
+		param.ValueJSON = mustJSON(values)
+	}
+	return param
+}
+
+// mustJSON serialisiert einen Wert für JSONB-Spalten. Die verwendeten Typen
+// (Maps und Slices von Strings) lassen sich immer serialisieren.
+func mustJSON(v any) []byte {
+	b, _ := json.Marshal(v)
+	return b
+}
+
+// nullJSON liefert serialisiertes JSON als Spaltenwert, leeres JSON als NULL.
+func nullJSON(b []byte) any {
+	if len(b) == 0 {
+		return nil
+	}
+	return string(b)
+}
+
+// parametersJSON liefert die Parameter für die JSONB-Spalte
+// nrfdynamicparmvals_parameters, ohne Parameter NULL.
+func (r associationRecord) parametersJSON() any {
+	if len(r.DynamicParameters) == 0 {
+		return nil
+	}
+	return string(mustJSON(r.DynamicParameters))
+}
+
+// Die columns-Methoden liefern die LDAP-Attribute eines Datensatzes für den
+// Vergleich zweier Quellen und die Attribute im Graph-Export. Der Trockenlauf
+// vergleicht stattdessen alle Spalten der Sinks (siehe columns.go).
+
+func (r roleRecord) columns() map[string]string {
+	return map[string]string{
+		"nrfrolelevel":       r.RoleLevel,
+		"nrflocalizednames":  string(mustJSON(r.LocalizedNames)),
+		"nrflocalizeddescrs": string(mustJSON(r.LocalizedDescrs)),
+		"nrfrolecategorykey": r.CategoryKey,
+	}
+}
+
+func (r resourceRecord) columns() map[string]string {
+	return map[string]string{
+		"nrflocalizednames":         string(mustJSON(r.LocalizedNames)),
+		"nrflocalizeddescrs":        string(mustJSON(r.LocalizedDescrs)),
+		"nrfcategorykey":            r.CategoryKey,
+		"nrfallowmulti":             r.AllowMulti,
+		"entitlement_driver":        r.EntitlementDriver,
+		"entitlement_status":        r.EntitlementStatus,
+		"entitlement_xml":           r.EntitlementXML,
+		"entitlement_xml_src":       r.EntitlementXMLSrc,
+		"entitlement_xml_id":        r.EntitlementXMLID,
+		"entitlement_xml_param_id":  r.EntitlementXMLParamID,
+		"entitlement_xml_param_id2": r.EntitlementXMLParamID2,
+		"entitlement_xml_param_id3": r.EntitlementXMLParamID3,
+	}
+}
+
+func (r associationRecord) columns() map[string]string {
+	return map[string]string{
+		"nrfrole":                       r.Role,
+		"nrfresource":                   r.Resource,
+		"nrfdynamicparmvals":            r.DynamicParmVals,
+		"nrfdynamicparmvals_value_json": r.DynamicParmValsValueJSON,
+		"nrfstatus":                     r.Status,
+		"createtimestamp":               r.CreateTimestamp,
+		"modifytimestamp":               r.ModifyTimestamp,
+	}
+}
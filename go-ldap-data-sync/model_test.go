@@ -0,0 +1,78 @@
+package main
+
+import "testing"
+
+func TestParseDynamicParametersValueJSON(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		// Wie bisher neu serialisiert: Schlüssel sortiert, ohne Leerraum
+		{"Objekt", `<parameter><name>p</name><value>{"b": 1, "a": "x"}</value></parameter>`, `{"a":"x","b":1}`},
+		{"HTML maskiert", `<parameter><name>p</name><value>{"a": "&lt;b&gt;"}</value></parameter>`, `{"a":"\u003cb\u003e"}`},
+		{"kein JSON", `<parameter><name>p</name><value>cn=group</value></parameter>`, ``},
+		{"mehrere Werte", `<parameter><name>p</name><value>a</value><value>b</value></parameter>`, `["a","b"]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := parseDynamicParameters(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(params[0].ValueJSON); got != tt.want {
+				t.Errorf("ValueJSON = %s, erwartet %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDynamicParameters(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []dynamicParameter
+		wantErr bool
+	}{
+		{
+			"einzeln",
+			`<parameter><name>p</name><type>string</type><value>x</value></parameter>`,
+			[]dynamicParameter{{Name: "p", Type: "string", Value: "x"}},
+			false,
+		},
+		{
+			"umschlossen mit Attributen",
+			`<parameters><parameter name="a" type="dn"><value>cn=x</value></parameter><parameter name="b"><value type="int">1</value></parameter></parameters>`,
+			[]dynamicParameter{{Name: "a", Type: "dn", Value: "cn=x"}, {Name: "b", Type: "int", Value: "1", ValueJSON: []byte("1")}},
+			false,
+		},
+		{
+			"HTML-kodierter Wert",
+			`<parameter><name>p</name><value>&amp;quot;a&amp;quot;</value></parameter>`,
+			[]dynamicParameter{{Name: "p", Value: `"a"`, ValueJSON: []byte(`"a"`)}},
+			false,
+		},
+		{"kein Parameter", `<values/>`, nil, true},
+		{"kein XML", `<parameter><name>p</name>`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params, err := parseDynamicParameters(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDynamicParameters() = %v, Fehler erwartet: %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(params) != len(tt.want) {
+				t.Fatalf("%d Parameter, erwartet %d: %+v", len(params), len(tt.want), params)
+			}
+			for i, want := range tt.want {
+				got := params[i]
+				if got.Name != want.Name || got.Type != want.Type || got.Value != want.Value || string(got.ValueJSON) != string(want.ValueJSON) {
+					t.Errorf("Parameter %d = %+v, erwartet %+v", i, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// postgresSink schreibt in die PostgreSQL-Datenbank. Sie ist die einzige Sink
+// mit Zustand über Läufe hinweg: Nicht mehr gefundene Datensätze werden als
+// gelöscht markiert und nach Ablauf der Aufbewahrungsfrist gelöscht.
+type postgresSink struct {
+	db  *sql.DB
+	cfg config
+	// Laufsperre, gehalten von Prepare bis Close bzw. während einer Übernahme im Daemon-Modus
+	lock *runLock
+}
+
+// newPostgresSink verbindet sich mit der Datenbank.
+func newPostgresSink(run *syncRun, cfg config) (*postgresSink, error) {
+	db, err := openDatabase(cfg, false)
+	if err != nil {
+		return nil, err
+	}
+	run.log.Info("Erfolgreich mit PostgreSQL verbunden.", keyPhase, "setup")
+	return &postgresSink{db: db, cfg: cfg}, nil
+}
+
+func (s *postgresSink) Name() string { return sinkPostgres }
+
+// Prepare holt die Laufsperre und legt die Tabellen an bzw. bereitet im
+// Blue/Green-Betrieb das Schattenschema vor. Die Tabellennamen gelten danach
+// für alle Quellen des Laufs.
+func (s *postgresSink) Prepare(run *syncRun) error {
+	if err := s.lockRun(run); err != nil {
+		return err
+	}
+	if s.cfg.Target.BlueGreen {
+		// In ein frisches Schattenschema laden und es erst nach Erfolg aktivieren
+		return prepareShadow(run, s.db, s.cfg.Target)
+	}
+	// Sicherstellen, dass die Tabellen existieren, bevor Daten eingefügt werden
+	run.tables = s.cfg.Target.names()
+	return createTables(run, s.db)
+}
+
+// WriteRoles schreibt Rollen und Parent-Beziehungen in einer Transaktion.
+func (s *postgresSink) WriteRoles(run *syncRun, roles []roleRecord) (counts, parentCounts tableCounts, err error) {
+	log := run.phaseLogger("roles", "viz_roles").With(keySink, s.Name())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Error("Fehler beim Starten der Transaktion für Rollen", keyError, err)
+		return counts, parentCounts, fmt.Errorf("Fehler beim Starten der Transaktion für Rollen: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Umbenannte Rollen vor dem Einfügen auf ihren neuen DN umstellen
+	if counts.Renamed, err = s.renameByGUID(run, tx, log, roleRenames, roleGUIDs(roles)); err != nil {
+		log.Error("Fehler beim Umstellen umbenannter Rollen", keyError, err)
+		return counts, parentCounts, err
+	}
+
+	// Phase 1: Rollen in die viz_roles-Tabelle einfügen
+	log.Info("Phase 1: Füge Rollen in die Tabelle viz_roles ein...")
+	roleStmt, err := tx.Prepare(
+		`INSERT INTO ` + run.table("viz_roles") + ` (dn, nrfRoleLevel, nrflocalizednames, nrflocalizeddescrs, nrfRoleCategoryKey, created_at, updated_at, is_deleted, source, display_name,
+			role_level, role_level_key, role_level_name,
+			approval_required, approval_definition, revoke_required, revoke_definition, original_dn, guid)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)
+		ON CONFLICT (source, dn) DO UPDATE SET
+			original_dn = EXCLUDED.original_dn,
+			guid = EXCLUDED.guid,
+			approval_required = EXCLUDED.approval_required,
+			approval_definition = EXCLUDED.approval_definition,
+			revoke_required = EXCLUDED.revoke_required,
+			revoke_definition = EXCLUDED.revoke_definition,
+			nrfrolelevel = EXCLUDED.nrfrolelevel,
+			role_level = EXCLUDED.role_level,
+			role_level_key = EXCLUDED.role_level_key,
+			role_level_name = EXCLUDED.role_level_name,
+			display_name = EXCLUDED.display_name,
+			nrflocalizednames = EXCLUDED.nrflocalizednames,
+			nrflocalizeddescrs = EXCLUDED.nrflocalizeddescrs,
+			nrfrolecategorykey = EXCLUDED.nrfrolecategorykey,
+			updated_at = $7,
+			is_deleted = FALSE
+		RETURNING (xmax = 0)`,
+	)
+	if err != nil {
+		log.Error("Fehler beim Vorbereiten des Statements für Rollen", keyError, err)
+		return counts, parentCounts, fmt.Errorf("Fehler beim Vorbereiten des Statements für Rollen: %w", err)
+	}
+	defer roleStmt.Close()
+
+	timestampStr := run.start.Format(time.RFC3339)
+
+	for _, role := range roles {
+		var inserted bool
+		err := roleStmt.QueryRow(role.DN, role.RoleLevel, mustJSON(role.LocalizedNames), mustJSON(role.LocalizedDescrs), role.CategoryKey, timestampStr, timestampStr, false, run.source, role.DisplayName,
+			nullInt(role.Level), nullString(string(role.LevelKey)), nullString(role.LevelName),
+			nullBool(role.ApprovalRequired), nullString(role.ApprovalDefinition), nullBool(role.RevokeRequired), nullString(role.RevokeDefinition),
+			nullString(role.OriginalDN), nullString(role.GUID)).Scan(&inserted)
+		if err != nil {
+			log.Error("Fehler beim Einfügen der Rolle", keyDN, role.DN, keyError, err)
+			return counts, parentCounts, fmt.Errorf("Fehler beim Einfügen der Rolle %s: %w", role.DN, err)
+		}
+		countUpsert(log, &counts, role.DN, inserted)
+	}
+	log.Info("Phase 1 abgeschlossen. Rollen erfolgreich eingefügt.", keyCounts, counts)
+
+	// Phase 2: Junction-Tabelle mit den Parent-Beziehungen füllen
+	plog := run.phaseLogger("roles", "viz_roles_parents").With(keySink, s.Name())
+	plog.Info("Phase 2: Füge Parent-Beziehungen in die Tabelle viz_roles_parents ein...")
+	parentStmt, err := tx.Prepare(
+		`INSERT INTO ` + run.table("viz_roles_parents") + ` (child_dn, parent_dn, created_at, updated_at, is_deleted, source) VALUES ($1, $2, $3, $3, FALSE, $4)
+		ON CONFLICT (source, child_dn, parent_dn) DO UPDATE SET
+			updated_at = $3,
+			is_deleted = FALSE
+		RETURNING (xmax = 0)`,
+	)
+	if err != nil {
+		plog.Error("Fehler beim Vorbereiten des Statements für Rollenbeziehungen", keyError, err)
+		return counts, parentCounts, fmt.Errorf("Fehler beim Vorbereiten des Statements für Rollenbeziehungen: %w", err)
+	}
+	defer parentStmt.Close()
+
+	for _, role := range roles {
+		for _, link := range role.parentLinks() {
+			var inserted bool
+			err := parentStmt.QueryRow(link.ChildDN, link.ParentDN, timestampStr, run.source).Scan(&inserted)
+			if err != nil {
+				plog.Error("Fehler beim Einfügen der Parent-Beziehung", keyDN, link.ChildDN, "parent_dn", link.ParentDN, keyError, err)
+				return counts, parentCounts, fmt.Errorf("Fehler beim Einfügen der Parent-Beziehung %s: %w", link.ChildDN, err)
+			}
+			countUpsert(plog.With("parent_dn", link.ParentDN), &parentCounts, link.ChildDN, inserted)
+		}
+	}
+	plog.Info("Phase 2 abgeschlossen. Parent-Beziehungen erfolgreich eingefügt.", keyCounts, parentCounts)
+
+	if err := tx.Commit(); err != nil {
+		log.Error("Fehler beim Abschließen der Transaktion", keyError, err)
+		return counts, parentCounts, fmt.Errorf("Fehler beim Abschließen der Transaktion für Rollen: %w", err)
+	}
+	return counts, parentCounts, nil
+}
+
+// renameByGUID stellt über die GUID erkannte Umbenennungen und Verschiebungen
+// in der Transaktion um und hält sie im Laufprotokoll viz_sync_renames fest.
+func (s *postgresSink) renameByGUID(run *syncRun, tx *sql.Tx, log *slog.Logger, target renameTarget, objects []guidDN) (int, error) {
+	if err := deferConstraints(tx); err != nil {
+		return 0, fmt.Errorf("Fehler beim Zurückstellen der Fremdschlüssel: %w", err)
+	}
+	events, err := applyRenames(tx, log, run.source, run.table, func(n int) string { return fmt.Sprintf("$%d", n) }, target, objects)
+	if err != nil {
+		return 0, fmt.Errorf("Fehler beim Umstellen umbenannter Datensätze in Tabelle %s: %w", target.table, err)
+	}
+	for _, event := range events {
+		_, err := tx.Exec(`INSERT INTO `+run.table("viz_sync_renames")+` (run_id, source, object_table, guid, old_dn, new_dn, kind, detected_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT DO NOTHING`,
+			run.id, run.source, event.Table, event.GUID, event.OldDN, event.NewDN, event.Kind, run.start)
+		if err != nil {
+			return 0, fmt.Errorf("Fehler beim Schreiben der Umbenennung von %s: %w", event.NewDN, err)
+		}
+	}
+	return len(events), nil
+}
+
+// WriteResources schreibt die Ressourcen in einer Transaktion.
+func (s *postgresSink) WriteResources(run *syncRun, resources []resourceRecord) (counts tableCounts, err error) {
+	log := run.phaseLogger("resources", "viz_resources").With(keySink, s.Name())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Error("Fehler beim Starten der Transaktion für Ressourcen", keyError, err)
+		return counts, fmt.Errorf("Fehler beim Starten der Transaktion für Ressourcen: %w", err)
+	}
+	defer tx.Rollback()
+
+	if counts.Renamed, err = s.renameByGUID(run, tx, log, resourceRenames, resourceGUIDs(resources)); err != nil {
+		log.Error("Fehler beim Umstellen umbenannter Ressourcen", keyError, err)
+		return counts, err
+	}
+
+	stmt, err := tx.Prepare(
+		`INSERT INTO ` + run.table("viz_resources") + ` (
+            dn, nrflocalizednames, nrflocalizeddescrs, nrfCategoryKey, nrfAllowMulti,
+            entitlement_driver, entitlement_status, entitlement_xml, entitlement_xml_src,
+            entitlement_xml_id, entitlement_xml_param_id, entitlement_xml_param_id2, entitlement_xml_param_id3,
+            created_at, updated_at, is_deleted, source, display_name, allow_multi,
+            approval_required, approval_definition, revoke_required, revoke_definition, original_dn, guid
+        ) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21, $22, $23, $24, $25)
+        ON CONFLICT (source, dn) DO UPDATE SET
+            original_dn = EXCLUDED.original_dn,
+            guid = EXCLUDED.guid,
+            approval_required = EXCLUDED.approval_required,
+            approval_definition = EXCLUDED.approval_definition,
+            revoke_required = EXCLUDED.revoke_required,
+            revoke_definition = EXCLUDED.revoke_definition,
+            display_name = EXCLUDED.display_name,
+            allow_multi = EXCLUDED.allow_multi,
+            nrflocalizednames = EXCLUDED.nrflocalizednames,
+            nrflocalizeddescrs = EXCLUDED.nrflocalizeddescrs,
+            nrfcategorykey = EXCLUDED.nrfcategorykey,
+            nrfallowmulti = EXCLUDED.nrfallowmulti,
+            entitlement_driver = EXCLUDED.entitlement_driver,
+            entitlement_status = EXCLUDED.entitlement_status,
+            entitlement_xml = EXCLUDED.entitlement_xml,
+            entitlement_xml_src = EXCLUDED.entitlement_xml_src,
+            entitlement_xml_id = EXCLUDED.entitlement_xml_id,
+            entitlement_xml_param_id = EXCLUDED.entitlement_xml_param_id,
+            entitlement_xml_param_id2 = EXCLUDED.entitlement_xml_param_id2,
+            entitlement_xml_param_id3 = EXCLUDED.entitlement_xml_param_id3,
+            updated_at = $15,
+            is_deleted = FALSE
+        RETURNING (xmax = 0)`,
+	)
+	if err != nil {
+		log.Error("Fehler beim Vorbereiten des Statements für Ressourcen", keyError, err)
+		return counts, fmt.Errorf("Fehler beim Vorbereiten des Statements für Ressourcen: %w", err)
+	}
+	defer stmt.Close()
+
+	timestampStr := run.start.Format(time.RFC3339)
+
+	for _, res := range resources {
+		var inserted bool
+		err = stmt.QueryRow(
+			res.DN,
+			mustJSON(res.LocalizedNames),
+			mustJSON(res.LocalizedDescrs),
+			res.CategoryKey,
+			res.AllowMulti,
+			res.EntitlementDriver,
+			res.EntitlementStatus,
+			res.EntitlementXML,
+			res.EntitlementXMLSrc,
+			res.EntitlementXMLID,
+			res.EntitlementXMLParamID,
+			res.EntitlementXMLParamID2,
+			res.EntitlementXMLParamID3,
+			timestampStr,
+			timestampStr,
+			false,
+			run.source,
+			res.DisplayName,
+			nullBool(res.AllowMultiFlag),
+			nullBool(res.ApprovalRequired),
+			nullString(res.ApprovalDefinition),
+			nullBool(res.RevokeRequired),
+			nullString(res.RevokeDefinition),
+			nullString(res.OriginalDN),
+			nullString(res.GUID),
+		).Scan(&inserted)
+		if err != nil {
+			log.Error("Fehler beim Einfügen der Ressource", keyDN, res.DN, keyError, err)
+			return counts, fmt.Errorf("Fehler beim Einfügen der Ressource %s: %w", res.DN, err)
+		}
+		countUpsert(log, &counts, res.DN, inserted)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error("Fehler beim Abschließen der Transaktion", keyError, err)
+		return counts, fmt.Errorf("Fehler beim Abschließen der Transaktion für Ressourcen: %w", err)
+	}
+	return counts, nil
+}
+
+// WriteAssociations schreibt die Assoziationen in einer Transaktion. Einzelne
+// fehlerhafte Datensätze werden übersprungen.
+func (s *postgresSink) WriteAssociations(run *syncRun, associations []associationRecord) (counts tableCounts, err error) {
+	log := run.phaseLogger("associations", "viz_roles_resources").With(keySink, s.Name())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Error("Fehler beim Starten der Transaktion für Assoziationen", keyError, err)
+		return counts, fmt.Errorf("Fehler beim Starten der Transaktion für Assoziationen: %w", err)
+	}
+	defer tx.Rollback()
+
+	if counts.Renamed, err = s.renameByGUID(run, tx, log, associationRenames, associationGUIDs(associations)); err != nil {
+		log.Error("Fehler beim Umstellen umbenannter Assoziationen", keyError, err)
+		return counts, err
+	}
+
+	stmt, err := tx.Prepare(
+		`INSERT INTO ` + run.table("viz_roles_resources") + ` AS existing (
+			dn, nrfRole, nrfResource, nrfDynamicParmVals, nrfdynamicparmvals_value_json, nrfStatus, createTimestamp, modifyTimestamp,
+			created_at, updated_at, is_deleted, source, nrfdynamicparmvals_parameters,
+			status_code, status_key, status_name, ldap_created_at, ldap_modified_at,
+			approval, approval_required, status_changed_at, original_dn, guid
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $10, $21, $22)
+		 ON CONFLICT (source, dn) DO UPDATE SET
+		 	original_dn = EXCLUDED.original_dn,
+		 	guid = EXCLUDED.guid,
+		 	nrfrole = EXCLUDED.nrfrole,
+		 	nrfresource = EXCLUDED.nrfresource,
+		 	nrfdynamicparmvals = EXCLUDED.nrfdynamicparmvals,
+		 	nrfdynamicparmvals_value_json = EXCLUDED.nrfdynamicparmvals_value_json,
+		 	nrfdynamicparmvals_parameters = EXCLUDED.nrfdynamicparmvals_parameters,
+		 	nrfstatus = EXCLUDED.nrfstatus,
+		 	createTimestamp = EXCLUDED.createTimestamp,
+		 	modifyTimestamp = EXCLUDED.modifyTimestamp,
+		 	status_code = EXCLUDED.status_code,
+		 	status_key = EXCLUDED.status_key,
+		 	status_name = EXCLUDED.status_name,
+		 	ldap_created_at = EXCLUDED.ldap_created_at,
+		 	ldap_modified_at = EXCLUDED.ldap_modified_at,
+		 	approval = EXCLUDED.approval,
+		 	approval_required = EXCLUDED.approval_required,
+		 	status_changed_at = CASE WHEN existing.status_key IS DISTINCT FROM EXCLUDED.status_key THEN $10 ELSE existing.status_changed_at END,
+			updated_at = $10,
+			is_deleted = FALSE
+		 RETURNING (xmax = 0)`,
+	)
+	if err != nil {
+		log.Error("Fehler beim Vorbereiten des Statements für Assoziationen", keyError, err)
+		return counts, fmt.Errorf("Fehler beim Vorbereiten des Statements für Assoziationen: %w", err)
+	}
+	defer stmt.Close()
+
+	// Die Parameter einer Assoziation werden bei jedem Lauf vollständig ersetzt
+	deleteParams, err := tx.Prepare(`DELETE FROM ` + run.table("viz_association_parameters") + ` WHERE source = $1 AND association_dn = $2`)
+	if err != nil {
+		log.Error("Fehler beim Vorbereiten des Statements für Parameter", keyError, err)
+		return counts, fmt.Errorf("Fehler beim Vorbereiten des Statements für Parameter: %w", err)
+	}
+	defer deleteParams.Close()
+	insertParam, err := tx.Prepare(`INSERT INTO ` + run.table("viz_association_parameters") + ` (association_dn, position, name, type, value, value_json, updated_at, source)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`)
+	if err != nil {
+		log.Error("Fehler beim Vorbereiten des Statements für Parameter", keyError, err)
+		return counts, fmt.Errorf("Fehler beim Vorbereiten des Statements für Parameter: %w", err)
+	}
+	defer insertParam.Close()
+
+	timestampStr := run.start.Format(time.RFC3339)
+
+	for _, assoc := range associations {
+		var inserted bool
+		err := stmt.QueryRow(assoc.DN, assoc.Role, assoc.Resource, assoc.DynamicParmVals, assoc.DynamicParmValsValueJSON, assoc.Status, assoc.CreateTimestamp, assoc.ModifyTimestamp, timestampStr, timestampStr, false, run.source, assoc.parametersJSON(),
+			nullInt(assoc.StatusCode), nullString(string(assoc.StatusKey)), nullString(assoc.StatusName), nullTime(assoc.LDAPCreatedAt), nullTime(assoc.LDAPModifiedAt),
+			assoc.approvalJSON(), nullBool(assoc.ApprovalRequired), nullString(assoc.OriginalDN), nullString(assoc.GUID)).Scan(&inserted)
+		if err != nil {
+			counts.Skipped++
+			log.Error("Fehler beim Einfügen der Assoziation", keyDN, assoc.DN, keyError, err)
+			logDecision(log, assoc.DN, decisionSkipped, keyError, err)
+			continue
+		}
+		countUpsert(log, &counts, assoc.DN, inserted)
+		if _, err := deleteParams.Exec(run.source, assoc.DN); err != nil {
+			return counts, fmt.Errorf("Fehler beim Löschen der Parameter von %s: %w", assoc.DN, err)
+		}
+		for i, param := range assoc.DynamicParameters {
+			if _, err := insertParam.Exec(assoc.DN, i, param.Name, param.Type, param.Value, nullJSON(param.ValueJSON), timestampStr, run.source); err != nil {
+				return counts, fmt.Errorf("Fehler beim Einfügen der Parameter von %s: %w", assoc.DN, err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error("Fehler beim Abschließen der Transaktion", keyError, err)
+		return counts, fmt.Errorf("Fehler beim Abschließen der Transaktion für Assoziationen: %w", err)
+	}
+	return counts, nil
+}
+
+// WriteEffectiveResources ersetzt die effektiven Ressourcen der Quelle in
+// einer Transaktion, Leser sehen also immer einen vollständigen Stand.
+func (s *postgresSink) WriteEffectiveResources(run *syncRun, grants []effectiveGrant) (counts tableCounts, err error) {
+	log := run.phaseLogger("effective", "viz_role_effective_resources").With(keySink, s.Name())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Error("Fehler beim Starten der Transaktion für effektive Ressourcen", keyError, err)
+		return counts, fmt.Errorf("Fehler beim Starten der Transaktion für effektive Ressourcen: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM `+run.table("viz_role_effective_resources")+` WHERE source = $1`, run.source); err != nil {
+		return counts, fmt.Errorf("Fehler beim Leeren der effektiven Ressourcen: %w", err)
+	}
+	stmt, err := tx.Prepare(
+		`INSERT INTO ` + run.table("viz_role_effective_resources") + ` (role_dn, resource_dn, association_dn, inherited_from, path, depth, updated_at, source)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+	)
+	if err != nil {
+		log.Error("Fehler beim Vorbereiten des Statements für effektive Ressourcen", keyError, err)
+		return counts, fmt.Errorf("Fehler beim Vorbereiten des Statements für effektive Ressourcen: %w", err)
+	}
+	defer stmt.Close()
+
+	timestampStr := run.start.Format(time.RFC3339)
+
+	for _, g := range grants {
+		if _, err := stmt.Exec(g.RoleDN, g.ResourceDN, g.AssociationDN, g.inheritedFrom(), mustJSON(g.Path), len(g.Path)-1, timestampStr, run.source); err != nil {
+			log.Error("Fehler beim Einfügen der effektiven Ressource", keyDN, g.RoleDN, "resource_dn", g.ResourceDN, keyError, err)
+			return counts, fmt.Errorf("Fehler beim Einfügen der effektiven Ressource %s für %s: %w", g.ResourceDN, g.RoleDN, err)
+		}
+		counts.Inserted++
+		logDecision(log, g.RoleDN, decisionInserted, "resource_dn", g.ResourceDN)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error("Fehler beim Abschließen der Transaktion", keyError, err)
+		return counts, fmt.Errorf("Fehler beim Abschließen der Transaktion für effektive Ressourcen: %w", err)
+	}
+	return counts, nil
+}
+
+// WriteGovernance ersetzt die Eigentümer und Genehmiger der Quelle in einer
+// Transaktion.
+func (s *postgresSink) WriteGovernance(run *syncRun, links []principalLink) (ownerCounts, approverCounts tableCounts, err error) {
+	log := run.phaseLogger("governance", "viz_owners").With(keySink, s.Name())
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Error("Fehler beim Starten der Transaktion für Eigentümer und Genehmiger", keyError, err)
+		return ownerCounts, approverCounts, fmt.Errorf("Fehler beim Starten der Transaktion für Eigentümer und Genehmiger: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"viz_owners", "viz_approvers"} {
+		if _, err := tx.Exec(`DELETE FROM `+run.table(table)+` WHERE source = $1`, run.source); err != nil {
+			return ownerCounts, approverCounts, fmt.Errorf("Fehler beim Leeren der Tabelle %s: %w", table, err)
+		}
+	}
+	ownerStmt, err := tx.Prepare(
+		`INSERT INTO ` + run.table("viz_owners") + ` (object_dn, object_type, owner_dn, owner_type, display_name, updated_at, source)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+	)
+	if err != nil {
+		log.Error("Fehler beim Vorbereiten des Statements für Eigentümer", keyError, err)
+		return ownerCounts, approverCounts, fmt.Errorf("Fehler beim Vorbereiten des Statements für Eigentümer: %w", err)
+	}
+	defer ownerStmt.Close()
+	approverStmt, err := tx.Prepare(
+		`INSERT INTO ` + run.table("viz_approvers") + ` (object_dn, object_type, kind, approver_dn, approver_type, display_name, updated_at, source)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+	)
+	if err != nil {
+		log.Error("Fehler beim Vorbereiten des Statements für Genehmiger", keyError, err)
+		return ownerCounts, approverCounts, fmt.Errorf("Fehler beim Vorbereiten des Statements für Genehmiger: %w", err)
+	}
+	defer approverStmt.Close()
+
+	timestampStr := run.start.Format(time.RFC3339)
+
+	for _, l := range links {
+		if l.isOwner() {
+			_, err = ownerStmt.Exec(l.ObjectDN, l.ObjectType, l.PrincipalDN, l.PrincipalType, l.DisplayName, timestampStr, run.source)
+		} else {
+			_, err = approverStmt.Exec(l.ObjectDN, l.ObjectType, l.Kind, l.PrincipalDN, l.PrincipalType, l.DisplayName, timestampStr, run.source)
+		}
+		if err != nil {
+			log.Error("Fehler beim Einfügen des Eigentümers bzw. Genehmigers", keyDN, l.ObjectDN, "principal_dn", l.PrincipalDN, keyError, err)
+			return ownerCounts, approverCounts, fmt.Errorf("Fehler beim Einfügen von %s für %s: %w", l.PrincipalDN, l.ObjectDN, err)
+		}
+		if l.isOwner() {
+			ownerCounts.Inserted++
+		} else {
+			approverCounts.Inserted++
+		}
+		logDecision(log, l.ObjectDN, decisionInserted, "kind", l.Kind, "principal_dn", l.PrincipalDN)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error("Fehler beim Abschließen der Transaktion", keyError, err)
+		return ownerCounts, approverCounts, fmt.Errorf("Fehler beim Abschließen der Transaktion für Eigentümer und Genehmiger: %w", err)
+	}
+	return ownerCounts, approverCounts, nil
+}
+
+// MarkDeleted markiert einzeln gemeldete Löschungen in einer Transaktion.
+func (s *postgresSink) MarkDeleted(run *syncRun, table, column string, dns []string) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("Fehler beim Starten der Transaktion für Tabelle %s: %w", table, err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`UPDATE ` + run.table(table) + ` SET is_deleted = TRUE WHERE source = $1 AND ` + column + ` = $2 AND updated_at < $3 AND is_deleted = FALSE`)
+	if err != nil {
+		return 0, fmt.Errorf("Fehler beim Vorbereiten des Statements für Tabelle %s: %w", table, err)
+	}
+	defer stmt.Close()
+
+	var marked int64
+	timestampStr := run.start.Format(time.RFC3339)
+	for _, dn := range dns {
+		result, err := stmt.Exec(run.source, dn, timestampStr)
+		if err != nil {
+			return 0, fmt.Errorf("Fehler beim Markieren von %s in Tabelle %s: %w", dn, table, err)
+		}
+		n, _ := result.RowsAffected()
+		marked += n
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("Fehler beim Abschließen der Transaktion für Tabelle %s: %w", table, err)
+	}
+	return marked, nil
+}
+
+// FinishSource markiert bzw. löscht die veralteten Datensätze der Quelle, wenn
+// die Sicherheitsschwellen eingehalten sind, und protokolliert das Ergebnis
+// der Quelle in viz_sync_source_runs.
+func (s *postgresSink) FinishSource(run *syncRun, syncErr error) error {
+	err := checkSafetyThresholds(run, s.db, s.cfg.Safety, syncErr)
+	if err == nil {
+		err = markAndPurge(run, s.db, s.cfg.Retention)
+	}
+	recordSourceRun(run, s.db, errors.Join(syncErr, err))
+	return err
+}
+
+// Finish aktiviert im Blue/Green-Betrieb das Schattenschema, wenn alle Quellen
+// erfolgreich waren, und schreibt das Laufprotokoll in viz_sync_runs.
+func (s *postgresSink) Finish(run *syncRun, runErr error) error {
+	var err error
+	if s.cfg.Target.BlueGreen {
+		if runErr == nil {
+			err = swapShadow(run, s.db, s.cfg.Target)
+		} else {
+			run.log.Warn("Schattenschema wird wegen Fehlern nicht aktiviert", keyPhase, "swap", "schema", s.cfg.Target.ShadowSchema)
+		}
+		// Das Laufprotokoll gehört in jedem Fall in das Zielschema
+		run.tables = s.cfg.Target.names()
+	}
+	recordRun(run, s.db, errors.Join(runErr, err))
+	return err
+}
+
+func (s *postgresSink) Close() error {
+	s.unlockRun()
+	return s.db.Close()
+}
+
+// lockRun holt die Laufsperre, sofern sie nicht bereits gehalten wird.
+func (s *postgresSink) lockRun(run *syncRun) error {
+	if s.lock != nil {
+		return nil
+	}
+	lock, err := acquireRunLock(run, s.db, s.cfg.Lock, s.cfg.Target)
+	if err != nil {
+		return err
+	}
+	s.lock = lock
+	return nil
+}
+
+// unlockRun gibt die Laufsperre frei, falls sie gehalten wird.
+func (s *postgresSink) unlockRun() {
+	if s.lock != nil {
+		s.lock.release()
+		s.lock = nil
+	}
+}
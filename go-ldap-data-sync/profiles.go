@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Name des Quellprofils, das ohne LDAP_SOURCES aus LDAP_HOST usw. gebildet wird.
+// Bestehende Datensätze ohne Quelle werden bei der Migration diesem Profil zugeordnet.
+const defaultSourceName = "default"
+
+// sourceProfile ist eine benannte IDM-Instanz mit eigener LDAP-Verbindung und
+// eigenen Suchbasen. Alle Profile werden in dieselben Tabellen synchronisiert,
+// ihre Datensätze unterscheiden sich in der Spalte source.
+type sourceProfile struct {
+	Name         string
+	LDAPHost     string
+	LDAPPort     string
+	LDAPUser     string
+	LDAPPassword string
+	Bases        searchBases
+	// Präfix der Umgebungsvariablen des Profils, z.B. LDAP_ oder LDAP_PROD_
+	envPrefix string
+}
+
+// url liefert die LDAP-URL des Profils.
+func (p sourceProfile) url() string {
+	return fmt.Sprintf("ldap://%s:%s", p.LDAPHost, p.LDAPPort)
+}
+
+// validate prüft, ob die Verbindungsdaten des Profils vollständig sind.
+func (p sourceProfile) validate() error {
+	if p.LDAPHost == "" || p.LDAPUser == "" || p.LDAPPassword == "" {
+		return fmt.Errorf("Bitte setzen Sie die erforderlichen Umgebungsvariablen für LDAP (%[1]sHOST, %[1]sUSERNAME, %[1]sPASSWORD).", p.envPrefix)
+	}
+	return nil
+}
+
+// sourceEnvPrefix liefert das Präfix der Umgebungsvariablen eines Profils.
+func sourceEnvPrefix(name string) string {
+	return "LDAP_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+}
+
+// initSourceProfiles liest die Quellprofile. LDAP_SOURCES enthält eine
+// kommagetrennte Liste von Namen; je Name werden LDAP_<NAME>_HOST, _PORT,
+// _USERNAME, _PASSWORD und optional _DRIVER_DN bzw. _ROLES_BASE,
+// _RESOURCES_BASE und _ASSOCIATIONS_BASE gelesen. Ohne LDAP_SOURCES gibt es
+// genau ein Profil "default" aus LDAP_HOST, LDAP_PORT usw.
+func initSourceProfiles(src *configSource) []sourceProfile {
+	names := src.str("LDAP_SOURCES", "")
+	if strings.TrimSpace(names) == "" {
+		return []sourceProfile{readSourceProfile(src, defaultSourceName, "LDAP_")}
+	}
+
+	var profiles []sourceProfile
+	for _, name := range strings.Split(names, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		profiles = append(profiles, readSourceProfile(src, name, sourceEnvPrefix(name)))
+	}
+	return profiles
+}
+
+// readSourceProfile liest ein Profil aus den Einstellungen mit dem Präfix prefix.
+func readSourceProfile(src *configSource, name, prefix string) sourceProfile {
+	p := sourceProfile{
+		Name:         name,
+		LDAPHost:     src.str(prefix+"HOST", ""),
+		LDAPPort:     src.str(prefix+"PORT", "389"),
+		LDAPUser:     src.str(prefix+"USERNAME", ""),
+		LDAPPassword: src.secret(prefix + "PASSWORD"),
+		Bases:        searchBasesFor(src.str(prefix+"DRIVER_DN", "")),
+		envPrefix:    prefix,
+	}
+	if v := src.str(prefix+"ROLES_BASE", ""); v != "" {
+		p.Bases.Roles = v
+	}
+	if v := src.str(prefix+"RESOURCES_BASE", ""); v != "" {
+		p.Bases.Resources = v
+	}
+	if v := src.str(prefix+"ASSOCIATIONS_BASE", ""); v != "" {
+		p.Bases.Associations = v
+	}
+	return p
+}
+
+// sourceProfileByName sucht ein Quellprofil.
+func sourceProfileByName(cfg config, name string) (sourceProfile, bool) {
+	for _, p := range cfg.Sources {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return sourceProfile{}, false
+}
+
+// Primärschlüssel der Tabellen. Die Quelle ist immer Teil des Schlüssels, damit
+// gleiche DNs aus verschiedenen IDM-Instanzen nebeneinander existieren können.
+var tablePrimaryKey = map[string]string{
+	"viz_roles":           "source, dn",
+	"viz_resources":       "source, dn",
+	"viz_roles_resources": "source, dn",
+	"viz_roles_parents":   "source, child_dn, parent_dn",
+}
+
+// primaryKeyHasSource prüft, ob der Primärschlüssel einer Tabelle die Spalte source enthält.
+func primaryKeyHasSource(tx *sql.Tx, table string) (bool, error) {
+	var ok bool
+	err := tx.QueryRow(`
+      SELECT EXISTS (
+        SELECT 1 FROM pg_index i
+        JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+        WHERE i.indrelid = $1::regclass AND i.indisprimary AND a.attname = 'source'
+      )`, table).Scan(&ok)
+	return ok, err
+}
+
+// migrateSourceKeys stellt Tabellen aus der Zeit vor den Quellprofilen um: Die
+// Spalte source wird ergänzt (bestehende Datensätze erhalten "default") und
+// in die Primärschlüssel sowie den Fremdschlüssel der Parent-Beziehungen
+// aufgenommen. Bereits umgestellte Tabellen bleiben unverändert.
+func migrateSourceKeys(run *syncRun, db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("Fehler beim Starten der Migration: %w", err)
+	}
+	defer tx.Rollback()
+
+	var pending []string
+	for _, table := range managedTables {
+		if _, err := tx.Exec(`ALTER TABLE ` + run.table(table) + ` ADD COLUMN IF NOT EXISTS source TEXT NOT NULL DEFAULT '` + defaultSourceName + `'`); err != nil {
+			return fmt.Errorf("Fehler beim Ergänzen der Spalte source in Tabelle %s: %w", table, err)
+		}
+		ok, err := primaryKeyHasSource(tx, run.table(table))
+		if err != nil {
+			return fmt.Errorf("Fehler beim Prüfen des Primärschlüssels von Tabelle %s: %w", table, err)
+		}
+		if !ok {
+			pending = append(pending, table)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	// Der alte Fremdschlüssel hängt am Primärschlüssel von viz_roles und muss zuerst weichen
+	if _, err := tx.Exec(`ALTER TABLE ` + run.table("viz_roles_parents") + ` DROP CONSTRAINT IF EXISTS ` + pgx.Identifier{run.tables.name("viz_roles_parents") + "_child_dn_fkey"}.Sanitize()); err != nil {
+		return fmt.Errorf("Fehler beim Entfernen des Fremdschlüssels von viz_roles_parents: %w", err)
+	}
+	for _, table := range pending {
+		_, err := tx.Exec(`ALTER TABLE ` + run.table(table) + ` DROP CONSTRAINT IF EXISTS ` + pgx.Identifier{run.tables.name(table) + "_pkey"}.Sanitize() + `, ADD PRIMARY KEY (` + tablePrimaryKey[table] + `)`)
+		if err != nil {
+			return fmt.Errorf("Fehler beim Umstellen des Primärschlüssels von Tabelle %s: %w", table, err)
+		}
+	}
+	parents := run.table("viz_roles_parents")
+	fkey := run.tables.name("viz_roles_parents") + "_source_child_dn_fkey"
+	var hasForeignKey bool
+	err = tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = $1::regclass AND conname = $2)`, parents, fkey).Scan(&hasForeignKey)
+	if err == nil && !hasForeignKey {
+		_, err = tx.Exec(`ALTER TABLE ` + parents + ` ADD CONSTRAINT ` + pgx.Identifier{fkey}.Sanitize() + `
+          FOREIGN KEY (source, child_dn) REFERENCES ` + run.table("viz_roles") + `(source, dn) ON DELETE CASCADE`)
+	}
+	if err != nil {
+		return fmt.Errorf("Fehler beim Anlegen des Fremdschlüssels von viz_roles_parents: %w", err)
+	}
+	return tx.Commit()
+}
+
+// recordSourceRun schreibt das Ergebnis einer Quelle in viz_sync_source_runs.
+// Die Zähler dienen dem nächsten Lauf als Vergleichsbasis für die
+// Sicherheitsschwellen dieser Quelle.
+func recordSourceRun(run *syncRun, db *sql.DB, runErr error) {
+	countsJSON, _ := json.Marshal(run.metrics.foundBySource(run.source))
+
+	status, errText := "success", ""
+	if runErr != nil {
+		status, errText = "failed", runErr.Error()
+	}
+	_, err := db.Exec(
+		`INSERT INTO `+run.table("viz_sync_source_runs")+` (run_id, source, started_at, finished_at, status, counts, error) VALUES ($1, $2, $3, NOW(), $4, $5, NULLIF($6, ''))`,
+		run.id, run.source, run.start, status, countsJSON, errText,
+	)
+	if err != nil {
+		run.log.Error("Fehler beim Schreiben des Laufprotokolls", keyTable, "viz_sync_source_runs", keyError, err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"log/slog"
+	"slices"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Arten einer erkannten DN-Änderung in viz_sync_renames.
+const (
+	renameRename     = "rename"
+	renameMove       = "move"
+	renameRenameMove = "rename_move"
+)
+
+// columnRef ist eine Spalte, die auf den DN eines Datensatzes verweist.
+type columnRef struct {
+	table  string
+	column string
+}
+
+// renameTarget beschreibt eine Tabelle mit GUID und die Verweise anderer
+// Tabellen, die bei einer Umbenennung mitgeführt werden. Die Verweise in den
+// je Lauf ersetzten Tabellen werden ebenfalls umgestellt, damit sie bis zum
+// Ersetzen nicht ins Leere zeigen.
+type renameTarget struct {
+	table string
+	refs  []columnRef
+}
+
+var (
+	roleRenames = renameTarget{table: "viz_roles", refs: []columnRef{
+		{"viz_roles_parents", "child_dn"},
+		{"viz_roles_parents", "parent_dn"},
+		{"viz_roles_resources", "nrfRole"},
+		{"viz_role_effective_resources", "role_dn"},
+		{"viz_role_effective_resources", "inherited_from"},
+		{"viz_owners", "object_dn"},
+		{"viz_approvers", "object_dn"},
+	}}
+	resourceRenames = renameTarget{table: "viz_resources", refs: []columnRef{
+		{"viz_roles_resources", "nrfResource"},
+		{"viz_role_effective_resources", "resource_dn"},
+		{"viz_owners", "object_dn"},
+		{"viz_approvers", "object_dn"},
+	}}
+	associationRenames = renameTarget{table: "viz_roles_resources", refs: []columnRef{
+		{"viz_association_parameters", "association_dn"},
+		{"viz_role_effective_resources", "association_dn"},
+	}}
+)
+
+// guidDN ist der kanonische DN eines gelesenen Eintrags mit seiner GUID.
+type guidDN struct {
+	DN   string
+	GUID string
+}
+
+// renameEvent ist eine erkannte Umbenennung oder Verschiebung.
+type renameEvent struct {
+	Table string `json:"table"`
+	GUID  string `json:"guid"`
+	OldDN string `json:"old_dn"`
+	NewDN string `json:"new_dn"`
+	Kind  string `json:"kind"`
+}
+
+// renameKind unterscheidet Umbenennung (gleicher übergeordneter Eintrag),
+// Verschiebung (gleicher RDN) und beides.
+func renameKind(oldDN, newDN string) string {
+	oldParsed, oldErr := ldap.ParseDN(oldDN)
+	newParsed, newErr := ldap.ParseDN(newDN)
+	if oldErr != nil || newErr != nil || len(oldParsed.RDNs) == 0 || len(newParsed.RDNs) == 0 {
+		return renameRenameMove
+	}
+	sameRDN := oldParsed.RDNs[0].EqualFold(newParsed.RDNs[0])
+	sameParent := (&ldap.DN{RDNs: oldParsed.RDNs[1:]}).EqualFold(&ldap.DN{RDNs: newParsed.RDNs[1:]})
+	switch {
+	case sameParent:
+		return renameRename
+	case sameRDN:
+		return renameMove
+	default:
+		return renameRenameMove
+	}
+}
+
+// applyRenames erkennt Einträge, deren GUID in der Tabelle bereits unter einem
+// anderen DN der Quelle gespeichert ist, und stellt den Datensatz samt Verweisen
+// in der Transaktion auf den neuen DN um. Historie (created_at) und abhängige
+// Datensätze bleiben so erhalten, statt dass der alte Datensatz als gelöscht
+// markiert wird. Gibt es den neuen DN bereits, bleibt es beim Markieren.
+// table liefert den maskierten Tabellennamen, param den Platzhalter für den
+// n-ten Parameter ($n bzw. ?n). Die Fremdschlüssel müssen bis zum Ende der
+// Transaktion zurückgestellt sein.
+func applyRenames(tx *sql.Tx, log *slog.Logger, source string, table func(string) string, param func(int) string, target renameTarget, objects []guidDN) ([]renameEvent, error) {
+	if !slices.ContainsFunc(objects, func(o guidDN) bool { return o.GUID != "" }) {
+		return nil, nil
+	}
+
+	// Je GUID gilt der zuletzt aktualisierte Datensatz
+	rows, err := tx.Query(`SELECT guid, dn FROM `+table(target.table)+` WHERE source = `+param(1)+` AND guid IS NOT NULL ORDER BY updated_at DESC`, source)
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]string{}
+	for rows.Next() {
+		var guid, dn string
+		if err := rows.Scan(&guid, &dn); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if _, ok := known[guid]; !ok {
+			known[guid] = dn
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var events []renameEvent
+	for _, o := range objects {
+		oldDN, ok := known[o.GUID]
+		if o.GUID == "" || !ok || oldDN == o.DN {
+			continue
+		}
+		var exists bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM `+table(target.table)+` WHERE source = `+param(1)+` AND dn = `+param(2)+`)`, source, o.DN).Scan(&exists); err != nil {
+			return events, err
+		}
+		if exists {
+			log.Warn("GUID unter neuem DN gefunden, der neue DN existiert aber bereits", keyDN, o.DN, "old_dn", oldDN, "guid", o.GUID)
+			continue
+		}
+		updates := append([]columnRef{{target.table, "dn"}}, target.refs...)
+		for _, ref := range updates {
+			if _, err := tx.Exec(`UPDATE `+table(ref.table)+` SET `+ref.column+` = `+param(1)+` WHERE source = `+param(2)+` AND `+ref.column+` = `+param(3), o.DN, source, oldDN); err != nil {
+				return events, err
+			}
+		}
+		event := renameEvent{Table: target.table, GUID: o.GUID, OldDN: oldDN, NewDN: o.DN, Kind: renameKind(oldDN, o.DN)}
+		log.Info("Umbenennung erkannt, Datensatz und Verweise umgestellt", keyDN, event.NewDN, "old_dn", event.OldDN, "guid", event.GUID, "kind", event.Kind)
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// roleGUIDs liefert DN und GUID der Rollen.
+func roleGUIDs(roles []roleRecord) []guidDN {
+	objects := make([]guidDN, len(roles))
+	for i, role := range roles {
+		objects[i] = guidDN{DN: role.DN, GUID: role.GUID}
+	}
+	return objects
+}
+
+// resourceGUIDs liefert DN und GUID der Ressourcen.
+func resourceGUIDs(resources []resourceRecord) []guidDN {
+	objects := make([]guidDN, len(resources))
+	for i, res := range resources {
+		objects[i] = guidDN{DN: res.DN, GUID: res.GUID}
+	}
+	return objects
+}
+
+// associationGUIDs liefert DN und GUID der Assoziationen.
+func associationGUIDs(associations []associationRecord) []guidDN {
+	objects := make([]guidDN, len(associations))
+	for i, assoc := range associations {
+		objects[i] = guidDN{DN: assoc.DN, GUID: assoc.GUID}
+	}
+	return objects
+}
@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestRenameKind(t *testing.T) {
+	tests := []struct {
+		oldDN, newDN string
+		want         string
+	}{
+		{"cn=Admin,ou=Roles,o=Data", "cn=Verwalter,ou=Roles,o=Data", renameRename},
+		{"cn=Admin,ou=Roles,o=Data", "cn=Admin,ou=Archiv,o=Data", renameMove},
+		{"cn=Admin,ou=Roles,o=Data", "CN=admin,OU=Archiv,O=Data", renameMove},
+		{"cn=Admin,ou=Roles,o=Data", "cn=Verwalter,ou=Archiv,o=Data", renameRenameMove},
+		{"kein DN", "cn=Admin,o=Data", renameRenameMove},
+		{"", "cn=Admin,o=Data", renameRenameMove},
+	}
+	for _, tt := range tests {
+		if got := renameKind(tt.oldDN, tt.newDN); got != tt.want {
+			t.Errorf("renameKind(%q, %q) = %q, erwartet %q", tt.oldDN, tt.newDN, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Archivierungsarten für endgültig gelöschte Datensätze.
+const (
+	archiveNone  = "none"
+	archiveTable = "table"
+	archiveFile  = "file"
+)
+
+// Anzeigeschlüssel je Tabelle für die Vorschau des purge-Kommandos.
+var tableKeyExpr = map[string]string{
+	"viz_roles":           "dn",
+	"viz_resources":       "dn",
+	"viz_roles_resources": "dn",
+	"viz_roles_parents":   "child_dn || ' -> ' || parent_dn",
+}
+
+// retentionConfig legt fest, wie lange als gelöscht markierte Datensätze je
+// Tabelle aufbewahrt und ob sie vor dem Löschen archiviert werden.
+type retentionConfig struct {
+	Days       map[string]int
+	Archive    string
+	ArchiveDir string
+}
+
+// initRetentionConfig liest PURGE_AGE_IN_DAYS als Standard sowie die
+// tabellenspezifischen Varianten (z.B. PURGE_AGE_IN_DAYS_ASSOCIATIONS) und die
+// Archivierung aus PURGE_ARCHIVE (none, table, file) und PURGE_ARCHIVE_DIR.
+func initRetentionConfig(src *configSource, defaultDays int) retentionConfig {
+	cfg := retentionConfig{
+		Days:       make(map[string]int),
+		Archive:    src.oneOf("PURGE_ARCHIVE", archiveNone, archiveNone, archiveTable, archiveFile),
+		ArchiveDir: src.str("PURGE_ARCHIVE_DIR", "."),
+	}
+	for _, table := range managedTables {
+		cfg.Days[table] = src.int("PURGE_AGE_IN_DAYS_"+tableEnvSuffix[table], defaultDays)
+	}
+	return cfg
+}
+
+// purgeCutoff liefert den Zeitpunkt, vor dem gelöschte Datensätze einer Tabelle entfernt werden.
+func (c retentionConfig) purgeCutoff(table string, now time.Time) time.Time {
+	return now.AddDate(0, 0, -c.Days[table])
+}
+
+// purgeOrder liefert die Tabellen in einer Reihenfolge, in der abhängige
+// Datensätze vor den referenzierten gelöscht werden. So werden Parent-Beziehungen
+// archiviert, bevor sie per ON DELETE CASCADE mit der Rolle verschwinden.
+func purgeOrder() []string {
+	order := make([]string, 0, len(managedTables))
+	for i := len(managedTables) - 1; i >= 0; i-- {
+		order = append(order, managedTables[i])
+	}
+	return order
+}
+
+// ensureArchiveTables legt die Archivtabellen an, falls in Tabellen archiviert wird.
+func ensureArchiveTables(run *syncRun, db *sql.DB) error {
+	for _, table := range managedTables {
+		_, err := db.Exec(`
+          CREATE TABLE IF NOT EXISTS ` + run.table(table+"_archive") + ` (
+            archived_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+            run_id TEXT,
+            row_data JSONB NOT NULL
+          );
+        `)
+		if err != nil {
+			return fmt.Errorf("Fehler beim Erstellen der Tabelle %s_archive: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// archiveWriter schreibt archivierte Datensätze als gzip-komprimierte JSON Lines.
+// Die Datei wird erst mit dem ersten Datensatz angelegt, sodass Läufe ohne
+// abgelaufene Datensätze keine leeren Archive hinterlassen.
+type archiveWriter struct {
+	name string
+	file *os.File
+	gz   *gzip.Writer
+	buf  *bufio.Writer
+}
+
+// newArchiveWriter bereitet die Archivdatei eines Laufs und einer Quelle vor.
+// Die Quelle gehört zum Namen, da jede Quelle des Laufs getrennt löscht; ein
+// leeres source (Kommando purge) steht für alle Quellen.
+func newArchiveWriter(dir, runID, source string, now time.Time) *archiveWriter {
+	if source == "" {
+		source = "all"
+	}
+	source = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, source)
+	name := filepath.Join(dir, fmt.Sprintf("purge-%s-%s-%s.jsonl.gz", now.UTC().Format("20060102T150405Z"), runID, source))
+	return &archiveWriter{name: name}
+}
+
+// open legt die Archivdatei an, falls das noch nicht geschehen ist.
+func (w *archiveWriter) open() error {
+	if w.file != nil {
+		return nil
+	}
+	file, err := os.OpenFile(w.name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("Archivdatei konnte nicht erstellt werden: %w", err)
+	}
+	w.file = file
+	w.gz = gzip.NewWriter(file)
+	w.buf = bufio.NewWriter(w.gz)
+	return nil
+}
+
+// write hängt einen Datensatz mit Tabellenname und Archivierungszeitpunkt an.
+func (w *archiveWriter) write(table, runID string, archivedAt time.Time, row json.RawMessage) error {
+	line, err := json.Marshal(struct {
+		Table      string          `json:"table"`
+		RunID      string          `json:"run_id"`
+		ArchivedAt time.Time       `json:"archived_at"`
+		Row        json.RawMessage `json:"row"`
+	}{table, runID, archivedAt, row})
+	if err != nil {
+		return err
+	}
+	if err := w.open(); err != nil {
+		return err
+	}
+	w.buf.Write(line)
+	return w.buf.WriteByte('\n')
+}
+
+// flush schreibt gepufferte Daten in die Datei, damit sie vor dem Commit sicher sind.
+func (w *archiveWriter) flush() error {
+	if w.file == nil {
+		return nil
+	}
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if err := w.gz.Flush(); err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+func (w *archiveWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	return errors.Join(w.buf.Flush(), w.gz.Close(), w.file.Close())
+}
+
+// purgeTables löscht als gelöscht markierte Datensätze, deren Aufbewahrungsfrist
+// abgelaufen ist, und archiviert sie vorher je nach Konfiguration. Ist für den
+// Lauf eine Quelle gesetzt, werden nur deren Datensätze gelöscht.
+func purgeTables(run *syncRun, db *sql.DB, cfg retentionConfig) error {
+	defer run.timePhase("purge")()
+	log := run.log.With(keyPhase, "purge")
+	log.Info("Lösche alte, gelöschte Datensätze...", "archive", cfg.Archive)
+
+	var archive *archiveWriter
+	switch cfg.Archive {
+	case archiveTable:
+		if err := ensureArchiveTables(run, db); err != nil {
+			return err
+		}
+	case archiveFile:
+		archive = newArchiveWriter(cfg.ArchiveDir, run.id, run.source, run.start)
+		defer func() {
+			if err := archive.Close(); err != nil {
+				log.Error("Fehler beim Schließen der Archivdatei", "file", archive.name, keyError, err)
+			}
+		}()
+	}
+
+	var errs []error
+	for _, table := range purgeOrder() {
+		cutoff := cfg.purgeCutoff(table, run.start)
+		purged, err := purgeTable(run, db, table, cutoff, run.source, cfg.Archive, archive)
+		if err != nil {
+			log.Error("Fehler beim Löschen alter Datensätze", keyTable, table, keyError, err)
+			errs = append(errs, fmt.Errorf("Fehler beim Löschen alter Datensätze in Tabelle %s: %w", table, err))
+			continue
+		}
+		run.tableMetrics(table).purged += purged
+		log.Info("Alte Datensätze gelöscht", keyTable, table, "retention_days", cfg.Days[table], keyCounts, slog.GroupValue(slog.Int64("purged", purged)))
+	}
+	return errors.Join(errs...)
+}
+
+// purgeTable löscht und archiviert die abgelaufenen Datensätze einer Tabelle
+// innerhalb einer Transaktion. Ein leeres source steht für alle Quellen.
+func purgeTable(run *syncRun, db *sql.DB, table string, cutoff time.Time, source, mode string, archive *archiveWriter) (int64, error) {
+	switch mode {
+	case archiveTable:
+		result, err := db.Exec(`
+          WITH purged AS (
+            DELETE FROM `+run.table(table)+` AS t WHERE is_deleted = TRUE AND updated_at < $1 AND ($3 = '' OR source = $3)
+            RETURNING to_jsonb(t.*) AS row_data
+          )
+          INSERT INTO `+run.table(table+"_archive")+` (archived_at, run_id, row_data)
+          SELECT NOW(), $2, row_data FROM purged`,
+			cutoff, run.id, source)
+		if err != nil {
+			return 0, err
+		}
+		return result.RowsAffected()
+
+	case archiveFile:
+		tx, err := db.Begin()
+		if err != nil {
+			return 0, err
+		}
+		defer tx.Rollback()
+		rows, err := tx.Query(`DELETE FROM `+run.table(table)+` AS t WHERE is_deleted = TRUE AND updated_at < $1 AND ($2 = '' OR source = $2) RETURNING to_jsonb(t.*)`, cutoff, source)
+		if err != nil {
+			return 0, err
+		}
+		var purged int64
+		now := time.Now()
+		for rows.Next() {
+			var row []byte
+			if err := rows.Scan(&row); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			if err := archive.write(table, run.id, now, row); err != nil {
+				rows.Close()
+				return 0, fmt.Errorf("Archivierung fehlgeschlagen: %w", err)
+			}
+			purged++
+		}
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		// Erst wenn das Archiv geschrieben ist, wird das Löschen festgeschrieben
+		if err := archive.flush(); err != nil {
+			return 0, fmt.Errorf("Archivierung fehlgeschlagen: %w", err)
+		}
+		return purged, tx.Commit()
+
+	default:
+		result, err := db.Exec(`DELETE FROM `+run.table(table)+` WHERE is_deleted = TRUE AND updated_at < $1 AND ($2 = '' OR source = $2)`, cutoff, source)
+		if err != nil {
+			return 0, err
+		}
+		return result.RowsAffected()
+	}
+}
+
+// purgePreview beschreibt, was das purge-Kommando in einer Tabelle löschen würde.
+type purgePreview struct {
+	Table         string
+	RetentionDays int
+	Cutoff        time.Time
+	Count         int
+	Keys          []string
+}
+
+// previewPurge ermittelt die zu löschenden Datensätze, ohne etwas zu verändern.
+func previewPurge(run *syncRun, db *sql.DB, cfg retentionConfig, now time.Time, limit int) ([]purgePreview, error) {
+	var previews []purgePreview
+	for _, table := range purgeOrder() {
+		p := purgePreview{Table: table, RetentionDays: cfg.Days[table], Cutoff: cfg.purgeCutoff(table, now)}
+		err := db.QueryRow(`SELECT COUNT(*) FROM `+run.table(table)+` WHERE is_deleted = TRUE AND updated_at < $1`, p.Cutoff).Scan(&p.Count)
+		if err != nil {
+			return nil, fmt.Errorf("Fehler bei der Vorschau für Tabelle %s: %w", table, err)
+		}
+		if p.Count > 0 && limit > 0 {
+			rows, err := db.Query(`SELECT source || ': ' || `+tableKeyExpr[table]+` FROM `+run.table(table)+` WHERE is_deleted = TRUE AND updated_at < $1 ORDER BY updated_at LIMIT $2`, p.Cutoff, limit)
+			if err != nil {
+				return nil, fmt.Errorf("Fehler bei der Vorschau für Tabelle %s: %w", table, err)
+			}
+			for rows.Next() {
+				var key string
+				if err := rows.Scan(&key); err != nil {
+					rows.Close()
+					return nil, err
+				}
+				p.Keys = append(p.Keys, key)
+			}
+			rows.Close()
+		}
+		previews = append(previews, p)
+	}
+	return previews, nil
+}
+
+// printPurgePreview gibt die Vorschau in lesbarer Form aus.
+func printPurgePreview(w io.Writer, previews []purgePreview) {
+	for _, p := range previews {
+		fmt.Fprintf(w, "%s: %d Datensätze älter als %d Tage (vor %s)\n", p.Table, p.Count, p.RetentionDays, p.Cutoff.Format(time.RFC3339))
+		for _, key := range p.Keys {
+			fmt.Fprintf(w, "  - %s\n", key)
+		}
+		if rest := p.Count - len(p.Keys); rest > 0 && len(p.Keys) > 0 {
+			fmt.Fprintf(w, "  ... und %d weitere\n", rest)
+		}
+	}
+}
+
+// runPurgeCommand implementiert das Kommando `purge`. Ohne --execute wird nur
+// angezeigt, was gelöscht würde; mit --execute wird gelöscht und archiviert.
+func runPurgeCommand(args []string) int {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	execute := fs.Bool("execute", false, "Datensätze tatsächlich löschen statt nur eine Vorschau anzuzeigen")
+	limit := fs.Int("limit", 20, "Anzahl der in der Vorschau aufgelisteten Datensätze je Tabelle")
+	fs.Parse(args)
+
+	cfg, err := initConfig()
+	if err != nil {
+		slog.Error("Konfiguration konnte nicht geladen werden", keyError, err)
+		return 1
+	}
+	run := newSyncRun("purge")
+	run.tables = cfg.Target.names()
+	db, err := openDatabase(cfg, !*execute)
+	if err != nil {
+		run.finish(err)
+		return 1
+	}
+	defer db.Close()
+
+	if !*execute {
+		previews, err := previewPurge(run, db, cfg.Retention, run.start, *limit)
+		if err != nil {
+			run.finish(err)
+			return 1
+		}
+		printPurgePreview(os.Stdout, previews)
+		return 0
+	}
+
+	lock, err := acquireRunLock(run, db, cfg.Lock, cfg.Target)
+	if err != nil {
+		run.finish(err)
+		return 1
+	}
+	defer lock.release()
+	err = purgeTables(run, db, cfg.Retention)
+	run.finish(err)
+	publishMetrics(run, cfg)
+	if err != nil {
+		return 1
+	}
+	return 0
+}
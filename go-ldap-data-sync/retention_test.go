@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchiveWriterPerSourceAndLazy(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 3, 1, 5, 0, 0, 0, time.UTC)
+
+	// Zwei Quellen desselben Laufs schreiben in getrennte Dateien
+	for _, source := range []string{"prod", "tochter/a"} {
+		w := newArchiveWriter(dir, "run1", source, start)
+		if err := w.write("viz_roles", "run1", start, []byte(`{"dn":"cn=a"}`)); err != nil {
+			t.Fatalf("write(%s): %v", source, err)
+		}
+		if err := w.flush(); err != nil {
+			t.Fatalf("flush(%s): %v", source, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("Close(%s): %v", source, err)
+		}
+	}
+
+	// Ohne Datensätze entsteht keine Datei
+	empty := newArchiveWriter(dir, "run1", "leer", start)
+	if err := empty.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := empty.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(dir, "purge-20240301T050000Z-run1-prod.jsonl.gz"),
+		filepath.Join(dir, "purge-20240301T050000Z-run1-tochter_a.jsonl.gz"),
+	}
+	if len(files) != len(want) || files[0] != want[0] || files[1] != want[1] {
+		t.Fatalf("Archivdateien = %v, erwartet %v", files, want)
+	}
+	if info, err := os.Stat(want[0]); err != nil || info.Size() == 0 {
+		t.Fatalf("Archivdatei leer oder fehlt: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Kurznamen der Tabellen für tabellenspezifische Umgebungsvariablen.
+var tableEnvSuffix = map[string]string{
+	"viz_roles":           "ROLES",
+	"viz_resources":       "RESOURCES",
+	"viz_roles_resources": "ASSOCIATIONS",
+	"viz_roles_parents":   "PARENTS",
+}
+
+// dropThreshold beschreibt, wie stark die Anzahl gefundener Einträge einer
+// Tabelle gegenüber dem letzten erfolgreichen Lauf sinken darf. Ein Wert von
+// 0 deaktiviert die jeweilige Prüfung.
+type dropThreshold struct {
+	MaxDropAbs     int
+	MaxDropPercent float64
+}
+
+// safetyConfig enthält die Schwellen je Tabelle und den Override-Schalter.
+type safetyConfig struct {
+	Tables map[string]dropThreshold
+	Force  bool
+}
+
+// initSafetyConfig liest die Schwellen aus SAFETY_MAX_DROP_ABS und
+// SAFETY_MAX_DROP_PERCENT sowie den tabellenspezifischen Varianten
+// (z.B. SAFETY_MAX_DROP_PERCENT_ROLES).
+func initSafetyConfig(src *configSource) safetyConfig {
+	defaults := dropThreshold{
+		MaxDropAbs:     src.int("SAFETY_MAX_DROP_ABS", 0),
+		MaxDropPercent: src.float("SAFETY_MAX_DROP_PERCENT", 50),
+	}
+	cfg := safetyConfig{Tables: make(map[string]dropThreshold)}
+	for _, table := range managedTables {
+		suffix := tableEnvSuffix[table]
+		cfg.Tables[table] = dropThreshold{
+			MaxDropAbs:     src.int("SAFETY_MAX_DROP_ABS_"+suffix, defaults.MaxDropAbs),
+			MaxDropPercent: src.float("SAFETY_MAX_DROP_PERCENT_"+suffix, defaults.MaxDropPercent),
+		}
+	}
+	return cfg
+}
+
+// loadPreviousCounts liest die gefundenen Einträge je Tabelle aus dem letzten
+// erfolgreichen Lauf einer Quelle. Für die Quelle "default" dienen Läufe aus
+// der Zeit vor den Quellprofilen als Rückfall. Gibt es keinen, ist ok false.
+func loadPreviousCounts(run *syncRun, db *sql.DB) (runID string, counts map[string]int, ok bool, err error) {
+	var raw []byte
+	err = sql.ErrNoRows
+	if exists, existsErr := tableExists(db, run.table("viz_sync_source_runs")); existsErr != nil {
+		return "", nil, false, fmt.Errorf("Fehler beim Lesen des letzten Laufs: %w", existsErr)
+	} else if exists {
+		err = db.QueryRow(`SELECT run_id, counts FROM `+run.table("viz_sync_source_runs")+` WHERE source = $1 AND status = 'success' ORDER BY finished_at DESC LIMIT 1`, run.source).Scan(&runID, &raw)
+	}
+	if errors.Is(err, sql.ErrNoRows) && run.source == defaultSourceName {
+		err = db.QueryRow(`SELECT run_id, counts FROM `+run.table("viz_sync_runs")+` WHERE status = 'success' ORDER BY finished_at DESC LIMIT 1`).Scan(&runID, &raw)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, false, nil
+	}
+	if err != nil {
+		return "", nil, false, fmt.Errorf("Fehler beim Lesen des letzten Laufs: %w", err)
+	}
+	if err := json.Unmarshal(raw, &counts); err != nil {
+		return "", nil, false, fmt.Errorf("Fehler beim Lesen der Zähler des letzten Laufs %s: %w", runID, err)
+	}
+	return runID, counts, true, nil
+}
+
+// checkDrop prüft eine einzelne Tabelle gegen ihre Schwelle.
+func checkDrop(table string, previous, current int, t dropThreshold) error {
+	drop := previous - current
+	if drop <= 0 {
+		return nil
+	}
+	percent := float64(drop) * 100 / float64(previous)
+	if t.MaxDropAbs > 0 && drop > t.MaxDropAbs {
+		return fmt.Errorf("Tabelle %s: %d statt %d Einträge gefunden (Rückgang um %d, erlaubt sind %d)", table, current, previous, drop, t.MaxDropAbs)
+	}
+	if t.MaxDropPercent > 0 && percent > t.MaxDropPercent {
+		return fmt.Errorf("Tabelle %s: %d statt %d Einträge gefunden (Rückgang um %.1f %%, erlaubt sind %.1f %%)", table, current, previous, percent, t.MaxDropPercent)
+	}
+	return nil
+}
+
+// checkSafetyThresholds entscheidet, ob markAndPurge für die Quelle des Laufs
+// ausgeführt werden darf. War die Synchronisation fehlerhaft, wird nie
+// markiert, auch nicht mit --force: Die fehlenden Einträge wurden dann nur
+// nicht gelesen. Außerdem verhindert sie das Markieren, wenn deutlich weniger
+// Einträge als im letzten erfolgreichen Lauf dieser Quelle gefunden wurden.
+func checkSafetyThresholds(run *syncRun, db *sql.DB, cfg safetyConfig, syncErr error) error {
+	if syncErr != nil {
+		return fmt.Errorf("Markieren und Löschen abgebrochen, die Synchronisation war fehlerhaft: %w", syncErr)
+	}
+
+	previousRunID, previous, ok, err := loadPreviousCounts(run, db)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		run.log.Info("Kein vorheriger erfolgreicher Lauf gefunden, Schwellenprüfung übersprungen.", keyPhase, "safety")
+		return nil
+	}
+	return checkCounts(run, cfg, previousRunID, previous)
+}
+
+// checkCounts prüft die gefundenen Einträge je Tabelle gegen die des letzten
+// erfolgreichen Laufs. Mit --force werden die Verstöße nur protokolliert.
+func checkCounts(run *syncRun, cfg safetyConfig, previousRunID string, previous map[string]int) error {
+	log := run.log.With(keyPhase, "safety")
+
+	var violations []error
+	for _, table := range managedTables {
+		current := run.tableMetrics(table).found
+		if err := checkDrop(table, previous[table], current, cfg.Tables[table]); err != nil {
+			violations = append(violations, err)
+		}
+	}
+
+	if len(violations) == 0 {
+		log.Info("Sicherheitsschwellen eingehalten.", "previous_run_id", previousRunID)
+		return nil
+	}
+	if cfg.Force {
+		for _, v := range violations {
+			log.Warn("Sicherheitsschwelle überschritten, wird wegen --force ignoriert", keyError, v)
+		}
+		return nil
+	}
+	return fmt.Errorf("Markieren und Löschen abgebrochen, Sicherheitsschwelle überschritten (mit --force übersteuerbar): %w", errors.Join(violations...))
+}
+
+// recordRun schreibt das Ergebnis eines Laufs über alle Quellen in
+// viz_sync_runs. Die Zähler sind über alle Quellen summiert.
+func recordRun(run *syncRun, db *sql.DB, runErr error) {
+	countsJSON, _ := json.Marshal(run.metrics.foundBySource(""))
+
+	status, errText := "success", ""
+	if runErr != nil {
+		status, errText = "failed", runErr.Error()
+	}
+	_, err := db.Exec(
+		`INSERT INTO `+run.table("viz_sync_runs")+` (run_id, started_at, finished_at, status, counts, error) VALUES ($1, $2, NOW(), $3, $4, NULLIF($5, ''))`,
+		run.id, run.start, status, countsJSON, errText,
+	)
+	if err != nil {
+		run.log.Error("Fehler beim Schreiben des Laufprotokolls", keyTable, "viz_sync_runs", keyError, err)
+	}
+}
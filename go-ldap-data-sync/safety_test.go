@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckDrop(t *testing.T) {
+	tests := []struct {
+		name              string
+		previous, current int
+		threshold         dropThreshold
+		wantErr           bool
+	}{
+		{"kein Rückgang", 100, 120, dropThreshold{MaxDropAbs: 1, MaxDropPercent: 1}, false},
+		{"gleich viele", 100, 100, dropThreshold{MaxDropAbs: 1, MaxDropPercent: 1}, false},
+		{"Prozent eingehalten", 100, 50, dropThreshold{MaxDropPercent: 50}, false},
+		{"Prozent überschritten", 100, 49, dropThreshold{MaxDropPercent: 50}, true},
+		{"absolut eingehalten", 100, 90, dropThreshold{MaxDropAbs: 10}, false},
+		{"absolut überschritten", 100, 89, dropThreshold{MaxDropAbs: 10}, true},
+		{"Schwellen deaktiviert", 100, 0, dropThreshold{}, false},
+		{"alles verschwunden", 100, 0, dropThreshold{MaxDropPercent: 50}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkDrop("viz_roles", tt.previous, tt.current, tt.threshold)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkDrop(%d, %d) = %v, Fehler erwartet: %v", tt.previous, tt.current, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckCounts(t *testing.T) {
+	tables := map[string]dropThreshold{}
+	for _, table := range managedTables {
+		tables[table] = dropThreshold{MaxDropPercent: 50}
+	}
+	previous := map[string]int{"viz_roles": 100}
+
+	tests := []struct {
+		name    string
+		found   int
+		force   bool
+		wantErr bool
+	}{
+		{"eingehalten", 80, false, false},
+		{"überschritten", 10, false, true},
+		{"überschritten mit --force", 10, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run := newSyncRun("test").forSource("default")
+			run.tableMetrics("viz_roles").found = tt.found
+			err := checkCounts(run, safetyConfig{Tables: tables, Force: tt.force}, "vorher", previous)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkCounts() = %v, Fehler erwartet: %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckSafetyThresholdsSyncErrorNotOverridable(t *testing.T) {
+	syncErr := errors.New("LDAP-Suche abgebrochen")
+	for _, force := range []bool{false, true} {
+		run := newSyncRun("test").forSource("default")
+		// Ohne Datenbank: Nach einem Fehler darf nicht einmal gelesen werden
+		err := checkSafetyThresholds(run, nil, safetyConfig{Force: force}, syncErr)
+		if !errors.Is(err, syncErr) {
+			t.Fatalf("force=%v: checkSafetyThresholds() = %v, erwartet wird der Synchronisationsfehler", force, err)
+		}
+	}
+}
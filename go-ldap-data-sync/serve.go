@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Status eines Laufs im Service-Modus, wie in viz_sync_runs.
+const (
+	runRunning = "running"
+	runSuccess = "success"
+	runFailed  = "failed"
+)
+
+// Auslöser eines Laufs im Service-Modus.
+const (
+	triggerSchedule = "schedule"
+	triggerAPI      = "api"
+)
+
+// serveConfig steuert das Kommando `serve`.
+type serveConfig struct {
+	Addr string
+	// Zeitplan der Läufe im Cron-Format, off = nur auf Anforderung über die API
+	Schedule string
+	// Bearer-Token für die API (nicht für die Health-Checks)
+	Token string
+	// Anzahl der Läufe, die in der Historie gehalten werden
+	History int
+}
+
+// initServeConfig liest SERVE_ADDR, SERVE_SCHEDULE, SERVE_TOKEN und SERVE_HISTORY.
+// SERVE_SCHEDULE wird erst von `serve` geprüft, damit ein ungültiger Zeitplan
+// die übrigen Kommandos nicht verhindert.
+func initServeConfig(src *configSource) serveConfig {
+	cfg := serveConfig{
+		Addr:     src.str("SERVE_ADDR", ":8080"),
+		Schedule: src.str("SERVE_SCHEDULE", "0 5 * * *"),
+		Token:    src.secret("SERVE_TOKEN"),
+		History:  src.int("SERVE_HISTORY", 50),
+	}
+	if cfg.History < 1 {
+		src.problem(errors.New("SERVE_HISTORY: muss größer als 0 sein"))
+		cfg.History = 50
+	}
+	return cfg
+}
+
+// schedule liest SERVE_SCHEDULE. Bei off ist das Ergebnis nil.
+func (c serveConfig) schedule() (*cronSchedule, error) {
+	if strings.EqualFold(strings.TrimSpace(c.Schedule), "off") {
+		return nil, nil
+	}
+	schedule, err := parseCron(c.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("SERVE_SCHEDULE: %w", err)
+	}
+	return &schedule, nil
+}
+
+// cronSchedule ist ein Zeitplan mit den fünf Feldern von cron (Minute, Stunde,
+// Tag, Monat, Wochentag), z.B. "0 5 * * *" wie im CronJob des Helm-Charts.
+// Jedes Feld ist eine Bitmaske der zulässigen Werte.
+type cronSchedule struct {
+	minute, hour, day, month, weekday uint64
+	// Tag und Wochentag eingeschränkt (keins der Felder beginnt mit *): wie
+	// bei cron genügt einer von beiden
+	dayOrWeekday bool
+}
+
+// parseCron liest einen Zeitplan. Je Feld sind *, Werte, Bereiche (1-5),
+// Listen (1,15) und Schrittweiten (*/15, 0-30/10) erlaubt; Wochentag 7 ist Sonntag.
+func parseCron(spec string) (cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return cronSchedule{}, fmt.Errorf("%q: erwartet fünf Felder (Minute Stunde Tag Monat Wochentag)", spec)
+	}
+	var c cronSchedule
+	var err error
+	bounds := []struct {
+		mask     *uint64
+		min, max int
+	}{{&c.minute, 0, 59}, {&c.hour, 0, 23}, {&c.day, 1, 31}, {&c.month, 1, 12}, {&c.weekday, 0, 7}}
+	for i, b := range bounds {
+		if *b.mask, err = parseCronField(fields[i], b.min, b.max); err != nil {
+			return cronSchedule{}, fmt.Errorf("%q: Feld %d: %w", spec, i+1, err)
+		}
+	}
+	if c.weekday&(1<<7) != 0 {
+		c.weekday |= 1
+	}
+	c.dayOrWeekday = !strings.HasPrefix(fields[2], "*") && !strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+// parseCronField wandelt ein Feld in eine Bitmaske um.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("ungültige Schrittweite %q", stepPart)
+			}
+			step = n
+		}
+		from, to := min, max
+		if rangePart != "*" {
+			lo, hi, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if from, err = strconv.Atoi(lo); err != nil {
+				return 0, fmt.Errorf("ungültiger Wert %q", lo)
+			}
+			to = from
+			if isRange {
+				if to, err = strconv.Atoi(hi); err != nil {
+					return 0, fmt.Errorf("ungültiger Wert %q", hi)
+				}
+			} else if hasStep {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return 0, fmt.Errorf("%q liegt nicht im Bereich %d-%d", part, min, max)
+		}
+		for v := from; v <= to; v += step {
+			mask |= 1 << v
+		}
+	}
+	return mask, nil
+}
+
+// next liefert den ersten Zeitpunkt nach after, der zum Zeitplan passt. Alle
+// Sprünge rechnen in der Ortszeit von after, denn Truncate arbeitet auf der
+// absoluten Zeit und träfe bei Zonen mit halbstündigem Versatz nie die volle Stunde.
+func (c cronSchedule) next(after time.Time) time.Time {
+	t := time.Date(after.Year(), after.Month(), after.Day(), after.Hour(), after.Minute()+1, 0, 0, after.Location())
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// matchesDay prüft Tag und Wochentag.
+func (c cronSchedule) matchesDay(t time.Time) bool {
+	day := c.day&(1<<t.Day()) != 0
+	weekday := c.weekday&(1<<int(t.Weekday())) != 0
+	if c.dayOrWeekday {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+// runRecord ist ein Lauf in der Historie des Service-Modus.
+type runRecord struct {
+	ID         string         `json:"run_id"`
+	Trigger    string         `json:"trigger"`
+	Force      bool           `json:"force"`
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+	Status     string         `json:"status"`
+	Error      string         `json:"error,omitempty"`
+	Counts     map[string]int `json:"counts,omitempty"`
+}
+
+// syncService führt Läufe aus dem Zeitplan und auf Anforderung über die API
+// aus. Es läuft höchstens ein Lauf gleichzeitig; mu schützt den Zustand.
+type syncService struct {
+	cfg config
+	mu  sync.Mutex
+	// Laufender Lauf oder nil
+	current *runRecord
+	// Abgeschlossene Läufe, der jüngste zuerst
+	history []runRecord
+	// Zeitplan aus SERVE_SCHEDULE, nil = nur auf Anforderung
+	cron *cronSchedule
+	// Nächster geplanter Lauf, Nullwert ohne Zeitplan
+	nextRun time.Time
+	// Datenbank für die Readiness, erst bei Bedarf geöffnet; dbMu hält den
+	// Verbindungsaufbau von mu fern
+	dbMu    sync.Mutex
+	db      *sql.DB
+	running sync.WaitGroup
+}
+
+// runServeCommand implementiert das Kommando `serve` und liefert den Exit-Code.
+// Es läuft, bis das Programm mit SIGINT oder SIGTERM beendet wird; ein
+// laufender Lauf wird vorher abgeschlossen.
+func runServeCommand(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	fs.Parse(args)
+
+	cfg, err := initConfig()
+	if err != nil {
+		slog.Error("Konfiguration konnte nicht geladen werden", keyError, err)
+		return 1
+	}
+	if cfg.Serve.Token == "" {
+		slog.Error("Bitte setzen Sie SERVE_TOKEN (oder SERVE_TOKEN_FILE) für die Authentifizierung der API.")
+		return 1
+	}
+	schedule, err := cfg.Serve.schedule()
+	if err != nil {
+		slog.Error("Konfiguration konnte nicht geladen werden", keyError, err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	s := &syncService{cfg: cfg, cron: schedule}
+	defer s.close()
+	if err := s.serve(ctx); err != nil {
+		slog.Error("Service-Modus beendet", keyCommand, "serve", keyError, err)
+		return 1
+	}
+	return 0
+}
+
+// serve startet Zeitplan und HTTP-Server.
+func (s *syncService) serve(ctx context.Context) error {
+	log := slog.Default().With(keyCommand, "serve")
+	server := &http.Server{Addr: s.cfg.Serve.Addr, Handler: s.routes(), ReadHeaderTimeout: 10 * time.Second}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.ListenAndServe() }()
+	log.Info("Service-Modus gestartet", "addr", s.cfg.Serve.Addr, "schedule", s.cron != nil)
+
+	go s.schedule(ctx, log)
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	log.Info("Service-Modus wird beendet")
+	s.mu.Lock()
+	running := s.current != nil
+	s.mu.Unlock()
+	if running {
+		log.Info("Warte auf den laufenden Lauf")
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	s.running.Wait()
+	return err
+}
+
+// schedule startet Läufe nach SERVE_SCHEDULE. Läuft zum geplanten Zeitpunkt
+// noch ein Lauf, entfällt der geplante.
+func (s *syncService) schedule(ctx context.Context, log *slog.Logger) {
+	if s.cron == nil {
+		return
+	}
+	for {
+		next := s.cron.next(time.Now())
+		if next.IsZero() {
+			log.Warn("SERVE_SCHEDULE ergibt keinen weiteren Zeitpunkt")
+			return
+		}
+		s.mu.Lock()
+		s.nextRun = next
+		s.mu.Unlock()
+		log.Info("Nächster geplanter Lauf", "at", next)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		if current, started := s.start(triggerSchedule, false); !started {
+			log.Warn("Geplanter Lauf entfällt, es läuft bereits ein Lauf", keyRunID, current.ID)
+		}
+	}
+}
+
+// start beginnt einen Lauf im Hintergrund. Läuft bereits einer, wird dieser
+// mit started false zurückgegeben.
+func (s *syncService) start(trigger string, force bool) (record runRecord, started bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != nil {
+		return *s.current, false
+	}
+
+	cfg := s.cfg
+	cfg.Safety.Force = force
+	run := newSyncRun("serve")
+	run.languages = cfg.Languages
+	s.current = &runRecord{ID: run.id, Trigger: trigger, Force: force, StartedAt: run.start, Status: runRunning}
+	run.log.Info("Lauf gestartet", "trigger", trigger, "force", force)
+
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		_, err := runSync(run, cfg)
+		run.finish(err)
+		publishMetrics(run, cfg)
+		s.finish(run, err)
+	}()
+	return *s.current, true
+}
+
+// finish übernimmt das Ergebnis des laufenden Laufs in die Historie.
+func (s *syncService) finish(run *syncRun, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record := *s.current
+	finished := run.metrics.finishedAt
+	record.FinishedAt = &finished
+	record.Status = runSuccess
+	if err != nil {
+		record.Status, record.Error = runFailed, err.Error()
+	}
+	record.Counts = run.metrics.foundBySource("")
+	s.history = append([]runRecord{record}, s.history...)
+	if len(s.history) > s.cfg.Serve.History {
+		s.history = s.history[:s.cfg.Serve.History]
+	}
+	s.current = nil
+}
+
+// close schließt die Datenbankverbindung der Readiness.
+func (s *syncService) close() {
+	if s.db != nil {
+		s.db.Close()
+	}
+}
+
+// routes legt die Endpunkte fest. Health-Checks sind ohne Token erreichbar.
+func (s *syncService) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", s.handleHealth)
+	mux.HandleFunc("GET /readyz", s.handleReady)
+	mux.Handle("POST /api/runs", s.authorized(s.handleTrigger))
+	mux.Handle("GET /api/runs", s.authorized(s.handleRuns))
+	mux.Handle("GET /api/runs/{id}", s.authorized(s.handleRun))
+	mux.Handle("GET /api/status", s.authorized(s.handleStatus))
+	mux.Handle("GET /api/last-error", s.authorized(s.handleLastError))
+	return mux
+}
+
+// authorized prüft das Bearer-Token aus SERVE_TOKEN.
+func (s *syncService) authorized(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Serve.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="idm_ldap_sync"`)
+			writeJSONError(w, http.StatusUnauthorized, "Nicht angemeldet")
+			return
+		}
+		next(w, r)
+	})
+}
+
+// handleHealth meldet, dass der Prozess antwortet (Liveness).
+func (s *syncService) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReady meldet, ob die Datenbank der Sink postgres erreichbar ist (Readiness).
+func (s *syncService) handleReady(w http.ResponseWriter, r *http.Request) {
+	if err := s.ping(r.Context()); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "not ready", "error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// ping prüft die Datenbankverbindung, falls die Sink postgres konfiguriert ist.
+func (s *syncService) ping(ctx context.Context) error {
+	if !s.cfg.hasSink(sinkPostgres) || s.cfg.DryRun {
+		return nil
+	}
+	s.dbMu.Lock()
+	defer s.dbMu.Unlock()
+	if s.db == nil {
+		db, err := openDatabase(s.cfg, true)
+		if err != nil {
+			return err
+		}
+		s.db = db
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return s.db.PingContext(ctx)
+}
+
+// handleTrigger startet einen Lauf; ?force=true übersteuert die Sicherheitsschwellen.
+func (s *syncService) handleTrigger(w http.ResponseWriter, r *http.Request) {
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	record, started := s.start(triggerAPI, force)
+	if !started {
+		writeJSON(w, http.StatusConflict, map[string]any{"error": "Es läuft bereits ein Lauf", "run": record})
+		return
+	}
+	w.Header().Set("Location", "/api/runs/"+record.ID)
+	writeJSON(w, http.StatusAccepted, record)
+}
+
+// handleRuns liefert den laufenden Lauf und die Historie.
+func (s *syncService) handleRuns(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]any{"current": s.current, "history": s.history})
+}
+
+// handleRun liefert einen Lauf anhand seiner ID.
+func (s *syncService) handleRun(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != nil && s.current.ID == id {
+		writeJSON(w, http.StatusOK, s.current)
+		return
+	}
+	for _, record := range s.history {
+		if record.ID == id {
+			writeJSON(w, http.StatusOK, record)
+			return
+		}
+	}
+	writeJSONError(w, http.StatusNotFound, "Lauf nicht gefunden")
+}
+
+// handleStatus liefert laufenden und letzten Lauf, den letzten Fehler und den
+// nächsten geplanten Lauf.
+func (s *syncService) handleStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := map[string]any{"running": s.current != nil, "current": s.current}
+	if len(s.history) > 0 {
+		status["last_run"] = s.history[0]
+	}
+	if failed, ok := s.lastFailed(); ok {
+		status["last_error"] = failed
+	}
+	if !s.nextRun.IsZero() {
+		status["next_run"] = s.nextRun
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleLastError liefert den letzten fehlgeschlagenen Lauf.
+func (s *syncService) handleLastError(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	failed, ok := s.lastFailed()
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "Kein fehlgeschlagener Lauf in der Historie")
+		return
+	}
+	writeJSON(w, http.StatusOK, failed)
+}
+
+// lastFailed liefert den jüngsten fehlgeschlagenen Lauf der Historie.
+// Aufruf nur mit gehaltenem mu.
+func (s *syncService) lastFailed() (runRecord, bool) {
+	for _, record := range s.history {
+		if record.Status == runFailed {
+			return record, true
+		}
+	}
+	return runRecord{}, false
+}
+
+// writeJSON schreibt eine JSON-Antwort.
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeJSONError schreibt eine Fehlermeldung als JSON.
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
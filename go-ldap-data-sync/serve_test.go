@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"0 5 * *",
+		"0 5 * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("parseCron(%q): Fehler erwartet", spec)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	ist := time.FixedZone("IST", 5*3600+30*60)
+	tests := []struct {
+		spec  string
+		after time.Time
+		want  time.Time
+	}{
+		{"0 5 * * *", time.Date(2024, 3, 1, 4, 59, 30, 0, time.UTC), time.Date(2024, 3, 1, 5, 0, 0, 0, time.UTC)},
+		{"0 5 * * *", time.Date(2024, 3, 1, 5, 0, 0, 0, time.UTC), time.Date(2024, 3, 2, 5, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 3, 1, 10, 7, 0, 0, time.UTC), time.Date(2024, 3, 1, 10, 15, 0, 0, time.UTC)},
+		{"0-30/10 8 * * *", time.Date(2024, 3, 1, 8, 25, 0, 0, time.UTC), time.Date(2024, 3, 1, 8, 30, 0, 0, time.UTC)},
+		// Montag bis Freitag: von Samstag auf Montag
+		{"0 6 * * 1-5", time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC), time.Date(2024, 3, 4, 6, 0, 0, 0, time.UTC)},
+		// Wochentag 7 ist Sonntag
+		{"0 0 * * 7", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC)},
+		// Tag und Wochentag eingeschränkt: einer von beiden genügt
+		{"0 0 13 * 5", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 8, 0, 0, 0, 0, time.UTC)},
+		// Beginnt eines der Felder mit *, müssen wie bei cron beide passen:
+		// ungerade Tage und Montag
+		{"0 0 */2 * 1", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Zone mit halbstündigem Versatz
+		{"0 5 * * *", time.Date(2024, 3, 1, 1, 10, 0, 0, ist), time.Date(2024, 3, 1, 5, 0, 0, 0, ist)},
+		{"30 * * * *", time.Date(2024, 3, 1, 1, 40, 0, 0, ist), time.Date(2024, 3, 1, 2, 30, 0, 0, ist)},
+		{"0 0 31 2 *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Time{}},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.spec)
+		if err != nil {
+			t.Fatalf("parseCron(%q): %v", tt.spec, err)
+		}
+		if got := c.next(tt.after); !got.Equal(tt.want) {
+			t.Errorf("%q.next(%s) = %s, erwartet %s", tt.spec, tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestServeConfigSchedule(t *testing.T) {
+	if c, err := (serveConfig{Schedule: "off"}).schedule(); c != nil || err != nil {
+		t.Errorf("off: %v, %v", c, err)
+	}
+	if c, err := (serveConfig{Schedule: "0 5 * * *"}).schedule(); c == nil || err != nil {
+		t.Errorf("0 5 * * *: %v, %v", c, err)
+	}
+	if _, err := (serveConfig{Schedule: "0 25 * * *"}).schedule(); err == nil {
+		t.Error("0 25 * * *: Fehler erwartet")
+	}
+}
+
+func TestInitServeConfigHistory(t *testing.T) {
+	for _, value := range []string{"0", "-1"} {
+		t.Setenv("SERVE_HISTORY", value)
+		src := newConfigSource("")
+		if cfg := initServeConfig(src); cfg.History != 50 || src.err() == nil {
+			t.Errorf("SERVE_HISTORY=%s: History = %d, Fehler %v", value, cfg.History, src.err())
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Sink nimmt die aus LDAP gelesenen und abgebildeten Datensätze eines Laufs
+// entgegen. Ein Lauf kann mehrere Sinks gleichzeitig beschreiben; die
+// Datensätze werden jeder Sink nacheinander übergeben.
+//
+// Die Write-Methoden werden je Quellprofil einmal aufgerufen und liefern die
+// Zähler für eingefügte, aktualisierte und übersprungene Datensätze.
+type Sink interface {
+	// Name bezeichnet die Sink in Logs und Fehlermeldungen, z.B. "postgres".
+	Name() string
+	// Prepare wird einmal je Lauf vor der ersten Quelle aufgerufen.
+	Prepare(run *syncRun) error
+	WriteRoles(run *syncRun, roles []roleRecord) (roleCounts, parentCounts tableCounts, err error)
+	WriteResources(run *syncRun, resources []resourceRecord) (tableCounts, error)
+	WriteAssociations(run *syncRun, associations []associationRecord) (tableCounts, error)
+	// WriteEffectiveResources ersetzt die aus der Hierarchie abgeleiteten
+	// Ressourcen aller Rollen der Quelle.
+	WriteEffectiveResources(run *syncRun, grants []effectiveGrant) (tableCounts, error)
+	// WriteGovernance ersetzt die Eigentümer und Genehmiger aller Rollen und
+	// Ressourcen der Quelle.
+	WriteGovernance(run *syncRun, links []principalLink) (ownerCounts, approverCounts tableCounts, err error)
+	// MarkDeleted markiert im Daemon-Modus einzelne Datensätze der Quelle als
+	// gelöscht, deren Spalte column einen der DNs enthält und die im Lauf nicht
+	// geschrieben wurden. Liefert die Anzahl markierter Datensätze.
+	MarkDeleted(run *syncRun, table, column string, dns []string) (int64, error)
+	// FinishSource schließt eine Quelle ab, z.B. durch Markieren veralteter
+	// Datensätze. syncErr ist der bisherige Fehler der Quelle.
+	FinishSource(run *syncRun, syncErr error) error
+	// Finish schließt den Lauf ab. runErr ist der Fehler über alle Quellen.
+	Finish(run *syncRun, runErr error) error
+	Close() error
+}
+
+// Namen der Sinks in SINKS. Dateibasierte Sinks erwarten den Pfad nach einem
+// Doppelpunkt, z.B. jsonl:/data/rollenmodell.jsonl.
+const (
+	sinkPostgres = "postgres"
+	sinkJSONL    = "jsonl"
+	sinkStdout   = "stdout"
+)
+
+// parseSinks zerlegt die kommagetrennte Liste aus SINKS.
+func parseSinks(value string) ([]string, error) {
+	var specs []string
+	for _, spec := range strings.Split(value, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		kind, path, _ := strings.Cut(spec, ":")
+		switch kind {
+		case sinkPostgres, sinkStdout:
+			if path != "" {
+				return nil, fmt.Errorf("SINKS: %q erwartet keinen Pfad", spec)
+			}
+		case sinkJSONL, sinkSQLite:
+			if path == "" {
+				return nil, fmt.Errorf("SINKS: %q erwartet einen Pfad (%s:<datei>)", spec, kind)
+			}
+		default:
+			return nil, fmt.Errorf("SINKS: unbekannte Sink %q (erlaubt: %s, %s:<datei>, %s:<datei>, %s)", spec, sinkPostgres, sinkSQLite, sinkJSONL, sinkStdout)
+		}
+		specs = append(specs, spec)
+	}
+	if len(specs) == 0 {
+		return nil, errors.New("SINKS: mindestens eine Sink ist erforderlich")
+	}
+	return specs, nil
+}
+
+// hasSink meldet, ob eine Sink dieser Art konfiguriert ist.
+func (cfg config) hasSink(kind string) bool {
+	for _, spec := range cfg.Sinks {
+		if k, _, _ := strings.Cut(spec, ":"); k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// openSinks öffnet alle konfigurierten Sinks. Schlägt eine fehl, werden die
+// bereits geöffneten wieder geschlossen.
+func openSinks(run *syncRun, cfg config) ([]Sink, error) {
+	var sinks []Sink
+	for _, spec := range cfg.Sinks {
+		kind, path, _ := strings.Cut(spec, ":")
+		var s Sink
+		var err error
+		switch kind {
+		case sinkPostgres:
+			s, err = newPostgresSink(run, cfg)
+		case sinkSQLite:
+			s, err = newSQLiteSink(path, cfg)
+		case sinkJSONL:
+			s, err = newJSONLFileSink(path)
+		case sinkStdout:
+			s = newJSONLSink(sinkStdout, os.Stdout)
+		}
+		if err != nil {
+			closeSinks(run, sinks)
+			return nil, fmt.Errorf("Sink %s: %w", spec, err)
+		}
+		sinks = append(sinks, s)
+	}
+	return sinks, nil
+}
+
+// closeSinks schließt alle Sinks und protokolliert Fehler.
+func closeSinks(run *syncRun, sinks []Sink) {
+	for _, s := range sinks {
+		if err := s.Close(); err != nil {
+			run.log.Error("Fehler beim Schließen der Sink", keySink, s.Name(), keyError, err)
+		}
+	}
+}
+
+// jsonlRecord ist eine Zeile der JSON-Lines-Ausgabe.
+type jsonlRecord struct {
+	Type   string `json:"type"`
+	Source string `json:"source"`
+	RunID  string `json:"run_id"`
+	Record any    `json:"record"`
+}
+
+// jsonlSink schreibt jeden Datensatz als JSON-Zeile mit Typ, Quelle und Lauf.
+// Sie hält keinen Zustand zwischen Läufen, daher gibt es kein Markieren oder Löschen.
+type jsonlSink struct {
+	name string
+	buf  *bufio.Writer
+	// Bei Dateien wird in eine temporäre Datei geschrieben, die erst am Ende
+	// des Laufs an ihren Platz verschoben wird.
+	tmp  *os.File
+	path string
+}
+
+// newJSONLSink schreibt nach w, z.B. auf die Standardausgabe.
+func newJSONLSink(name string, w io.Writer) *jsonlSink {
+	return &jsonlSink{name: name, buf: bufio.NewWriter(w)}
+}
+
+// newJSONLFileSink schreibt in eine Datei, die am Ende des Laufs atomar ersetzt wird.
+func newJSONLFileSink(path string) (*jsonlSink, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".sink-*.jsonl")
+	if err != nil {
+		return nil, fmt.Errorf("temporäre Datei konnte nicht erstellt werden: %w", err)
+	}
+	s := newJSONLSink(sinkJSONL+":"+path, tmp)
+	s.tmp, s.path = tmp, path
+	return s, nil
+}
+
+func (s *jsonlSink) Name() string { return s.name }
+
+func (s *jsonlSink) Prepare(run *syncRun) error { return nil }
+
+// write schreibt einen Datensatz.
+func (s *jsonlSink) write(run *syncRun, kind string, record any) error {
+	line, err := json.Marshal(jsonlRecord{Type: kind, Source: run.source, RunID: run.id, Record: record})
+	if err != nil {
+		return err
+	}
+	s.buf.Write(line)
+	return s.buf.WriteByte('\n')
+}
+
+func (s *jsonlSink) WriteRoles(run *syncRun, roles []roleRecord) (tableCounts, tableCounts, error) {
+	var roleCounts, parentCounts tableCounts
+	for _, role := range roles {
+		if err := s.write(run, "role", role); err != nil {
+			return roleCounts, parentCounts, err
+		}
+		roleCounts.Inserted++
+		for _, link := range role.parentLinks() {
+			if err := s.write(run, "parent", link); err != nil {
+				return roleCounts, parentCounts, err
+			}
+			parentCounts.Inserted++
+		}
+	}
+	return roleCounts, parentCounts, nil
+}
+
+func (s *jsonlSink) WriteResources(run *syncRun, resources []resourceRecord) (tableCounts, error) {
+	var counts tableCounts
+	for _, res := range resources {
+		if err := s.write(run, "resource", res); err != nil {
+			return counts, err
+		}
+		counts.Inserted++
+	}
+	return counts, nil
+}
+
+func (s *jsonlSink) WriteAssociations(run *syncRun, associations []associationRecord) (tableCounts, error) {
+	var counts tableCounts
+	for _, assoc := range associations {
+		if err := s.write(run, "association", assoc); err != nil {
+			return counts, err
+		}
+		counts.Inserted++
+	}
+	return counts, nil
+}
+
+func (s *jsonlSink) WriteEffectiveResources(run *syncRun, grants []effectiveGrant) (tableCounts, error) {
+	var counts tableCounts
+	for _, g := range grants {
+		if err := s.write(run, "effective_resource", g); err != nil {
+			return counts, err
+		}
+		counts.Inserted++
+	}
+	return counts, nil
+}
+
+func (s *jsonlSink) WriteGovernance(run *syncRun, links []principalLink) (tableCounts, tableCounts, error) {
+	var ownerCounts, approverCounts tableCounts
+	for _, link := range links {
+		kind, counts := "approver", &approverCounts
+		if link.isOwner() {
+			kind, counts = "owner", &ownerCounts
+		}
+		if err := s.write(run, kind, link); err != nil {
+			return ownerCounts, approverCounts, err
+		}
+		counts.Inserted++
+	}
+	return ownerCounts, approverCounts, nil
+}
+
+// MarkDeleted hat keine Wirkung, die Ausgabe enthält nur gefundene Datensätze.
+func (s *jsonlSink) MarkDeleted(run *syncRun, table, column string, dns []string) (int64, error) {
+	return 0, nil
+}
+
+func (s *jsonlSink) FinishSource(run *syncRun, syncErr error) error {
+	return s.buf.Flush()
+}
+
+// Finish schreibt die Ausgabe fest. Auch bei Fehlern einzelner Quellen wird
+// die Datei ersetzt, sie enthält dann die erfolgreich gelesenen Datensätze.
+func (s *jsonlSink) Finish(run *syncRun, runErr error) error {
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if s.tmp == nil {
+		return nil
+	}
+	if err := s.tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(s.tmp.Name(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(s.tmp.Name(), s.path); err != nil {
+		return err
+	}
+	s.tmp = nil
+	run.log.Info("Ausgabe geschrieben", keySink, s.name, "file", s.path)
+	return nil
+}
+
+// Close verwirft eine nicht festgeschriebene temporäre Datei.
+func (s *jsonlSink) Close() error {
+	if s.tmp == nil {
+		return nil
+	}
+	s.tmp.Close()
+	return os.Remove(s.tmp.Name())
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// entrySource liefert LDAP-Einträge für eine Suchbasis und einen Filter. Neben
+// einer Live-Verbindung können so auch LDIF-Exporte und Snapshots als Quelle
+// für das Rollenmodell dienen.
+type entrySource interface {
+	search(base, filter string, attributes []string) ([]*ldap.Entry, error)
+	Close() error
+}
+
+// defaultDriverDN ist der User-Application-Treiber, unterhalb dessen die
+// Suchbasen aus main.go liegen.
+const defaultDriverDN = "cn=UserApplication,cn=DriverSet,o=System"
+
+// searchBases sind die Suchbasen des Rollenmodells einer Umgebung.
+type searchBases struct {
+	Roles        string `json:"roles"`
+	Resources    string `json:"resources"`
+	Associations string `json:"associations"`
+}
+
+// searchBasesFor liefert die Suchbasen unterhalb eines User-Application-Treibers.
+// Umgebungen mit anders benanntem Driver-Set lassen sich so vergleichen.
+func searchBasesFor(driverDN string) searchBases {
+	if driverDN == "" {
+		return searchBases{Roles: rolesSearchBase, Resources: resourcesSearchBase, Associations: associationsSearchBase}
+	}
+	return searchBases{
+		Roles:        "cn=RoleDefs,cn=RoleConfig,cn=AppConfig," + driverDN,
+		Resources:    "cn=ResourceDefs,cn=RoleConfig,cn=AppConfig," + driverDN,
+		Associations: "cn=ResourceAssociations,cn=RoleConfig,cn=AppConfig," + driverDN,
+	}
+}
+
+// ldapSource ist eine gebundene LDAP-Verbindung.
+type ldapSource struct {
+	conn *ldap.Conn
+}
+
+func (s ldapSource) search(base, filter string, attributes []string) ([]*ldap.Entry, error) {
+	return ldapSearch(s.conn, base, filter, attributes)
+}
+
+func (s ldapSource) Close() error {
+	return s.conn.Close()
+}
+
+// dialLDAP verbindet sich mit dem LDAP-Server unter url und bindet sich mit
+// den angegebenen Anmeldedaten.
+func dialLDAP(url, user, password string, timeout time.Duration) (*ldap.Conn, error) {
+	// Konfiguriere einen Dialer mit Timeout
+	dialer := &net.Dialer{Timeout: timeout}
+
+	conn, err := ldap.DialURL(url, ldap.DialWithDialer(dialer))
+	if err != nil {
+		return nil, fmt.Errorf("Fehler beim Verbinden zu LDAP: %w", err)
+	}
+	if err := conn.Bind(user, password); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Fehler beim Binden an LDAP: %w", err)
+	}
+	return conn, nil
+}
+
+// openSource öffnet eine Quelle anhand ihrer Angabe und liefert zusätzlich die
+// Suchbasen, unter denen ihr Rollenmodell liegt:
+//   - env: die über LDAP_HOST, LDAP_USERNAME usw. konfigurierte Verbindung
+//   - source:<name>: das Quellprofil <name> aus LDAP_SOURCES
+//   - ldap://host:port bzw. ldaps://host:port mit user und password
+//   - ldif:/pfad/export.ldif
+//   - snapshot:/pfad/snapshot.json (erstellt mit dem Kommando `snapshot`)
+func openSource(cfg config, spec, user, password string) (entrySource, searchBases, error) {
+	switch {
+	case spec == "env":
+		if cfg.LDAPHost == "" || cfg.LDAPUser == "" || cfg.LDAPPassword == "" {
+			return nil, searchBases{}, errors.New("Bitte setzen Sie die erforderlichen Umgebungsvariablen für LDAP (LDAP_HOST, LDAP_USERNAME, LDAP_PASSWORD).")
+		}
+		conn, err := dialLDAP(fmt.Sprintf("ldap://%s:%s", cfg.LDAPHost, cfg.LDAPPort), cfg.LDAPUser, cfg.LDAPPassword, cfg.LDAPTimeout)
+		if err != nil {
+			return nil, searchBases{}, err
+		}
+		return ldapSource{conn: conn}, searchBasesFor(""), nil
+	case strings.HasPrefix(spec, "source:"):
+		profile, ok := sourceProfileByName(cfg, strings.TrimPrefix(spec, "source:"))
+		if !ok {
+			return nil, searchBases{}, fmt.Errorf("unbekanntes Quellprofil %q", strings.TrimPrefix(spec, "source:"))
+		}
+		if err := profile.validate(); err != nil {
+			return nil, searchBases{}, err
+		}
+		conn, err := dialLDAP(profile.url(), profile.LDAPUser, profile.LDAPPassword, cfg.LDAPTimeout)
+		if err != nil {
+			return nil, searchBases{}, err
+		}
+		return ldapSource{conn: conn}, profile.Bases, nil
+	case strings.HasPrefix(spec, "ldap://"), strings.HasPrefix(spec, "ldaps://"):
+		conn, err := dialLDAP(spec, user, password, cfg.LDAPTimeout)
+		if err != nil {
+			return nil, searchBases{}, err
+		}
+		return ldapSource{conn: conn}, searchBasesFor(""), nil
+	case strings.HasPrefix(spec, "ldif:"):
+		entries, err := readLDIFFile(strings.TrimPrefix(spec, "ldif:"))
+		if err != nil {
+			return nil, searchBases{}, err
+		}
+		src, err := newMemorySource(entries)
+		return src, searchBasesFor(""), err
+	case strings.HasPrefix(spec, "snapshot:"):
+		snap, err := readSnapshot(strings.TrimPrefix(spec, "snapshot:"))
+		if err != nil {
+			return nil, searchBases{}, err
+		}
+		src, err := newMemorySource(snap.entries())
+		return src, snap.Bases, err
+	default:
+		return nil, searchBases{}, fmt.Errorf("unbekannte Quelle %q (erlaubt: env, source:<name>, ldap://…, ldaps://…, ldif:<datei>, snapshot:<datei>)", spec)
+	}
+}
+
+// memorySource durchsucht eingelesene Einträge (LDIF oder Snapshot) wie ein
+// LDAP-Server mit Scope Subtree.
+type memorySource struct {
+	entries []*ldap.Entry
+	dns     []*ldap.DN
+}
+
+func newMemorySource(entries []*ldap.Entry) (*memorySource, error) {
+	s := &memorySource{entries: entries, dns: make([]*ldap.DN, len(entries))}
+	for i, entry := range entries {
+		dn, err := ldap.ParseDN(entry.DN)
+		if err != nil {
+			return nil, fmt.Errorf("ungültiger DN %q: %w", entry.DN, err)
+		}
+		s.dns[i] = dn
+	}
+	return s, nil
+}
+
+func (s *memorySource) search(base, filter string, attributes []string) ([]*ldap.Entry, error) {
+	baseDN, err := ldap.ParseDN(base)
+	if err != nil {
+		return nil, fmt.Errorf("ungültige Suchbasis %q: %w", base, err)
+	}
+	compiled, err := ldap.CompileFilter(filter)
+	if err != nil {
+		return nil, fmt.Errorf("ungültiger Filter %q: %w", filter, err)
+	}
+
+	var result []*ldap.Entry
+	for i, entry := range s.entries {
+		if !baseDN.EqualFold(s.dns[i]) && !baseDN.AncestorOfFold(s.dns[i]) {
+			continue
+		}
+		ok, err := matchFilter(compiled, entry)
+		if err != nil {
+			return nil, fmt.Errorf("Filter %q: %w", filter, err)
+		}
+		if ok {
+			result = append(result, projectEntry(entry, attributes))
+		}
+	}
+	return result, nil
+}
+
+func (s *memorySource) Close() error {
+	return nil
+}
+
+// projectEntry liefert nur die angeforderten Attribute, und zwar in der
+// angeforderten Schreibweise. LDIF-Exporte schreiben Attributnamen oft klein,
+// die Abbildung auf Datensätze erwartet aber z.B. nrfRoleLevel.
+func projectEntry(entry *ldap.Entry, attributes []string) *ldap.Entry {
+	values := make(map[string][]string)
+	for _, name := range attributes {
+		if strings.EqualFold(name, "dn") {
+			continue
+		}
+		if v := entry.GetEqualFoldAttributeValues(name); len(v) > 0 {
+			values[name] = v
+		}
+	}
+	return ldap.NewEntry(entry.DN, values)
+}
+
+// matchFilter wertet einen mit ldap.CompileFilter übersetzten Filter gegen einen
+// Eintrag aus. Vergleiche erfolgen ohne Beachtung der Groß-/Kleinschreibung.
+func matchFilter(packet *ber.Packet, entry *ldap.Entry) (bool, error) {
+	switch packet.Tag {
+	case ldap.FilterAnd:
+		for _, child := range packet.Children {
+			ok, err := matchFilter(child, entry)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case ldap.FilterOr:
+		for _, child := range packet.Children {
+			ok, err := matchFilter(child, entry)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case ldap.FilterNot:
+		ok, err := matchFilter(packet.Children[0], entry)
+		return !ok, err
+	case ldap.FilterPresent:
+		return len(entry.GetEqualFoldAttributeValues(packet.Data.String())) > 0, nil
+	case ldap.FilterEqualityMatch:
+		attribute, condition := packet.Children[0].Data.String(), packet.Children[1].Data.String()
+		for _, value := range entry.GetEqualFoldAttributeValues(attribute) {
+			if strings.EqualFold(value, condition) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case ldap.FilterSubstrings:
+		attribute := packet.Children[0].Data.String()
+		for _, value := range entry.GetEqualFoldAttributeValues(attribute) {
+			if matchSubstrings(strings.ToLower(value), packet.Children[1].Children) {
+				return true, nil
+			}
+		}
+		return false, nil
+	default:
+		return false, fmt.Errorf("Filtertyp %q wird für Dateiquellen nicht unterstützt", ldap.FilterMap[uint64(packet.Tag)])
+	}
+}
+
+// matchSubstrings prüft einen Wert gegen die Teile eines Substring-Filters.
+func matchSubstrings(value string, parts []*ber.Packet) bool {
+	for _, part := range parts {
+		s := strings.ToLower(part.Data.String())
+		switch part.Tag {
+		case ldap.FilterSubstringsInitial:
+			if !strings.HasPrefix(value, s) {
+				return false
+			}
+			value = value[len(s):]
+		case ldap.FilterSubstringsAny:
+			i := strings.Index(value, s)
+			if i < 0 {
+				return false
+			}
+			value = value[i+len(s):]
+		case ldap.FilterSubstringsFinal:
+			if !strings.HasSuffix(value, s) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// readLDIFFile liest alle Einträge aus einer LDIF-Datei.
+func readLDIFFile(path string) ([]*ldap.Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Fehler beim Öffnen der LDIF-Datei: %w", err)
+	}
+	defer file.Close()
+	entries, err := readLDIF(file)
+	if err != nil {
+		return nil, fmt.Errorf("Fehler beim Lesen der LDIF-Datei %s: %w", path, err)
+	}
+	return entries, nil
+}
+
+// readLDIF liest Inhaltseinträge im LDIF-Format (RFC 2849). Unterstützt werden
+// Kommentare, Fortsetzungszeilen und base64-kodierte Werte; Änderungseinträge
+// außer changetype: add werden abgelehnt.
+func readLDIF(r io.Reader) ([]*ldap.Entry, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	var entries []*ldap.Entry
+	var lines []string
+	lineNo, recordStart, inComment := 0, 0, false
+
+	flush := func() error {
+		if len(lines) == 0 {
+			return nil
+		}
+		entry, err := parseLDIFRecord(lines)
+		if err != nil {
+			return fmt.Errorf("Eintrag ab Zeile %d: %w", recordStart, err)
+		}
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+		lines = nil
+		return nil
+	}
+
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		switch {
+		case line == "":
+			inComment = false
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(line, " "):
+			if inComment {
+				continue
+			}
+			if len(lines) == 0 {
+				return nil, fmt.Errorf("Zeile %d: Fortsetzungszeile ohne vorherige Zeile", lineNo)
+			}
+			lines[len(lines)-1] += line[1:]
+		case strings.HasPrefix(line, "#"):
+			inComment = true
+		default:
+			inComment = false
+			if len(lines) == 0 {
+				recordStart = lineNo
+			}
+			lines = append(lines, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// parseLDIFRecord wandelt die logischen Zeilen eines LDIF-Eintrags in einen
+// Eintrag um. Ein Eintrag, der nur aus der Versionszeile besteht, ergibt nil.
+func parseLDIFRecord(lines []string) (*ldap.Entry, error) {
+	if strings.HasPrefix(strings.ToLower(lines[0]), "version:") {
+		lines = lines[1:]
+		if len(lines) == 0 {
+			return nil, nil
+		}
+	}
+
+	var dn string
+	values := make(map[string][]string)
+	for i, line := range lines {
+		name, value, err := parseLDIFLine(line)
+		if err != nil {
+			return nil, err
+		}
+		if i == 0 {
+			if !strings.EqualFold(name, "dn") {
+				return nil, fmt.Errorf("erwartet dn:, gefunden %q", name)
+			}
+			dn = value
+			continue
+		}
+		switch strings.ToLower(name) {
+		case "changetype":
+			if !strings.EqualFold(value, "add") {
+				return nil, fmt.Errorf("changetype %q wird nicht unterstützt", value)
+			}
+		case "control":
+		default:
+			values[name] = append(values[name], value)
+		}
+	}
+	return ldap.NewEntry(dn, values), nil
+}
+
+// parseLDIFLine zerlegt eine logische Zeile in Attributname und Wert.
+func parseLDIFLine(line string) (name, value string, err error) {
+	name, rest, ok := strings.Cut(line, ":")
+	if !ok {
+		return "", "", fmt.Errorf("ungültige Zeile %q", line)
+	}
+	switch {
+	case strings.HasPrefix(rest, ":"):
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(rest[1:]))
+		if err != nil {
+			return "", "", fmt.Errorf("Attribut %s: ungültiger base64-Wert: %w", name, err)
+		}
+		return name, string(decoded), nil
+	case strings.HasPrefix(rest, "<"):
+		return "", "", fmt.Errorf("Attribut %s: Werte aus URLs werden nicht unterstützt", name)
+	default:
+		return name, strings.TrimLeft(rest, " "), nil
+	}
+}
+
+// snapshotFile ist der Inhalt einer mit `snapshot` erstellten Datei. Sie
+// enthält die Rohdaten aller Objekte des Rollenmodells, damit spätere
+// Vergleiche dieselbe Abbildung wie eine Live-Quelle verwenden.
+type snapshotFile struct {
+	Source  string          `json:"source"`
+	Bases   searchBases     `json:"search_bases"`
+	TakenAt time.Time       `json:"taken_at"`
+	Entries []snapshotEntry `json:"entries"`
+}
+
+// snapshotEntry ist ein einzelner LDAP-Eintrag in einem Snapshot.
+type snapshotEntry struct {
+	DN         string              `json:"dn"`
+	Attributes map[string][]string `json:"attributes"`
+}
+
+// entries wandelt die Einträge des Snapshots in LDAP-Einträge um.
+func (s snapshotFile) entries() []*ldap.Entry {
+	entries := make([]*ldap.Entry, 0, len(s.Entries))
+	for _, e := range s.Entries {
+		entries = append(entries, ldap.NewEntry(e.DN, e.Attributes))
+	}
+	return entries
+}
+
+// readSnapshot liest eine Snapshot-Datei.
+func readSnapshot(path string) (snapshotFile, error) {
+	var snap snapshotFile
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return snap, fmt.Errorf("Fehler beim Lesen des Snapshots: %w", err)
+	}
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return snap, fmt.Errorf("Fehler beim Lesen des Snapshots %s: %w", path, err)
+	}
+	return snap, nil
+}
+
+// takeSnapshot liest alle Objekte des Rollenmodells mitsamt objectClass aus
+// der Quelle, so dass sich der Snapshot später wieder filtern lässt.
+func takeSnapshot(src entrySource, description string, bases searchBases) (snapshotFile, error) {
+	snap := snapshotFile{Source: description, Bases: bases, TakenAt: time.Now()}
+	searches := []struct {
+		base, filter string
+		attributes   []string
+	}{
+		{bases.Roles, rolesFilter, roleAttributes},
+		{bases.Resources, resourcesFilter, resourceAttributes},
+		{bases.Associations, associationsFilter, associationAttributes},
+	}
+	for _, s := range searches {
+		entries, err := src.search(s.base, s.filter, append([]string{"objectClass"}, s.attributes...))
+		if err != nil {
+			return snap, err
+		}
+		for _, entry := range entries {
+			e := snapshotEntry{DN: entry.DN, Attributes: make(map[string][]string)}
+			for _, attr := range entry.Attributes {
+				e.Attributes[attr.Name] = attr.Values
+			}
+			snap.Entries = append(snap.Entries, e)
+		}
+	}
+	return snap, nil
+}
@@ -0,0 +1,701 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"time"
+
+	_ "modernc.org/sqlite" // CGO-freier SQLite-Treiber "sqlite", passend zum scratch-Image
+)
+
+// Name der SQLite-Sink in SINKS, z.B. sqlite:/data/rollenmodell.db.
+const sinkSQLite = "sqlite"
+
+// sqliteSink schreibt das Rollenmodell in eine einzelne SQLite-Datei mit
+// demselben Aufbau wie die PostgreSQL-Tabellen, z.B. zur Analyse auf dem
+// Laptop. JSON-Spalten werden als Text gespeichert und lassen sich mit den
+// JSON-Funktionen von SQLite abfragen. DNs werden ohne Beachtung der
+// Groß-/Kleinschreibung verglichen, wie in LDAP.
+//
+// Nicht mehr gefundene Datensätze einer Quelle werden als gelöscht markiert;
+// Aufbewahrungsfristen und Sicherheitsschwellen gibt es nur in PostgreSQL.
+type sqliteSink struct {
+	db    *sql.DB
+	path  string
+	names tableNames
+}
+
+// newSQLiteSink öffnet bzw. erstellt die SQLite-Datei.
+func newSQLiteSink(path string, cfg config) (*sqliteSink, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("Fehler beim Öffnen der SQLite-Datei: %w", err)
+	}
+	// SQLite erlaubt nur einen Schreiber, eine Verbindung vermeidet Sperrkonflikte
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Fehler beim Öffnen der SQLite-Datei: %w", err)
+	}
+	return &sqliteSink{db: db, path: path, names: tableNames{prefix: cfg.Target.Prefix}}, nil
+}
+
+func (s *sqliteSink) Name() string { return sinkSQLite + ":" + s.path }
+
+// table liefert den maskierten Namen einer Tabelle in der SQLite-Datei.
+func (s *sqliteSink) table(name string) string {
+	return s.names.qualified(name)
+}
+
+// index liefert den maskierten Namen eines Index zu einer Tabelle.
+func (s *sqliteSink) index(table, suffix string) string {
+	return `"` + s.names.name(table) + "_" + suffix + `"`
+}
+
+// Prepare legt Tabellen und Indizes an. Die Indizes decken die üblichen
+// Abfragen Rolle → Ressource, Ressource → Rolle und die Rollenhierarchie ab.
+func (s *sqliteSink) Prepare(run *syncRun) error {
+	statements := []string{
+		`CREATE TABLE IF NOT EXISTS ` + s.table("viz_roles") + ` (
+        source TEXT NOT NULL DEFAULT 'default',
+        dn TEXT NOT NULL COLLATE NOCASE,
+        nrfRoleLevel TEXT,
+        role_level INTEGER,
+        role_level_key TEXT,
+        role_level_name TEXT,
+        approval_required INTEGER,
+        approval_definition TEXT,
+        revoke_required INTEGER,
+        revoke_definition TEXT,
+        nrflocalizednames TEXT,
+        nrflocalizeddescrs TEXT,
+        nrfRoleCategoryKey TEXT,
+        display_name TEXT,
+        created_at TEXT,
+        updated_at TEXT,
+        is_deleted INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY (source, dn)
+      )`,
+		`CREATE TABLE IF NOT EXISTS ` + s.table("viz_roles_parents") + ` (
+        source TEXT NOT NULL DEFAULT 'default',
+        child_dn TEXT NOT NULL COLLATE NOCASE,
+        parent_dn TEXT NOT NULL COLLATE NOCASE,
+        created_at TEXT,
+        updated_at TEXT,
+        is_deleted INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY (source, child_dn, parent_dn),
+        FOREIGN KEY (source, child_dn) REFERENCES ` + s.table("viz_roles") + `(source, dn) ON DELETE CASCADE
+      )`,
+		`CREATE TABLE IF NOT EXISTS ` + s.table("viz_resources") + ` (
+        source TEXT NOT NULL DEFAULT 'default',
+        dn TEXT NOT NULL COLLATE NOCASE,
+        nrflocalizednames TEXT,
+        nrflocalizeddescrs TEXT,
+        nrfCategoryKey TEXT,
+        nrfAllowMulti TEXT,
+        allow_multi INTEGER,
+        approval_required INTEGER,
+        approval_definition TEXT,
+        revoke_required INTEGER,
+        revoke_definition TEXT,
+        entitlement_driver TEXT,
+        entitlement_status TEXT,
+        entitlement_xml TEXT,
+        entitlement_xml_src TEXT,
+        entitlement_xml_id TEXT,
+        entitlement_xml_param_id TEXT,
+        entitlement_xml_param_id2 TEXT,
+        entitlement_xml_param_id3 TEXT,
+        display_name TEXT,
+        created_at TEXT,
+        updated_at TEXT,
+        is_deleted INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY (source, dn)
+      )`,
+		`CREATE TABLE IF NOT EXISTS ` + s.table("viz_roles_resources") + ` (
+        source TEXT NOT NULL DEFAULT 'default',
+        dn TEXT NOT NULL COLLATE NOCASE,
+        nrfRole TEXT COLLATE NOCASE,
+        nrfResource TEXT COLLATE NOCASE,
+        nrfDynamicParmVals TEXT,
+        nrfdynamicparmvals_value_json TEXT,
+        nrfdynamicparmvals_parameters TEXT,
+        nrfStatus TEXT,
+        createTimestamp TEXT,
+        modifyTimestamp TEXT,
+        status_code INTEGER,
+        status_key TEXT,
+        status_name TEXT,
+        ldap_created_at TEXT,
+        ldap_modified_at TEXT,
+        approval TEXT,
+        approval_required INTEGER,
+        status_changed_at TEXT,
+        created_at TEXT,
+        updated_at TEXT,
+        is_deleted INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY (source, dn)
+      )`,
+		`CREATE TABLE IF NOT EXISTS ` + s.table("viz_association_parameters") + ` (
+        source TEXT NOT NULL DEFAULT 'default',
+        association_dn TEXT NOT NULL COLLATE NOCASE,
+        position INTEGER NOT NULL,
+        name TEXT,
+        type TEXT,
+        value TEXT,
+        value_json TEXT,
+        updated_at TEXT,
+        PRIMARY KEY (source, association_dn, position),
+        FOREIGN KEY (source, association_dn) REFERENCES ` + s.table("viz_roles_resources") + `(source, dn) ON DELETE CASCADE
+      )`,
+		`CREATE TABLE IF NOT EXISTS ` + s.table("viz_role_effective_resources") + ` (
+        source TEXT NOT NULL DEFAULT 'default',
+        role_dn TEXT NOT NULL COLLATE NOCASE,
+        resource_dn TEXT NOT NULL COLLATE NOCASE,
+        association_dn TEXT COLLATE NOCASE,
+        inherited_from TEXT COLLATE NOCASE,
+        path TEXT,
+        depth INTEGER,
+        updated_at TEXT,
+        PRIMARY KEY (source, role_dn, resource_dn)
+      )`,
+		`CREATE TABLE IF NOT EXISTS ` + s.table("viz_owners") + ` (
+        source TEXT NOT NULL DEFAULT 'default',
+        object_dn TEXT NOT NULL COLLATE NOCASE,
+        object_type TEXT NOT NULL,
+        owner_dn TEXT NOT NULL COLLATE NOCASE,
+        owner_type TEXT,
+        display_name TEXT,
+        updated_at TEXT,
+        PRIMARY KEY (source, object_dn, owner_dn)
+      )`,
+		`CREATE TABLE IF NOT EXISTS ` + s.table("viz_approvers") + ` (
+        source TEXT NOT NULL DEFAULT 'default',
+        object_dn TEXT NOT NULL COLLATE NOCASE,
+        object_type TEXT NOT NULL,
+        kind TEXT NOT NULL,
+        approver_dn TEXT NOT NULL COLLATE NOCASE,
+        approver_type TEXT,
+        display_name TEXT,
+        updated_at TEXT,
+        PRIMARY KEY (source, object_dn, kind, approver_dn)
+      )`,
+		`CREATE INDEX IF NOT EXISTS ` + s.index("viz_roles_resources", "role_idx") + ` ON ` + s.table("viz_roles_resources") + ` (source, nrfRole)`,
+		`CREATE INDEX IF NOT EXISTS ` + s.index("viz_roles_resources", "resource_idx") + ` ON ` + s.table("viz_roles_resources") + ` (source, nrfResource)`,
+		`CREATE INDEX IF NOT EXISTS ` + s.index("viz_roles_parents", "parent_idx") + ` ON ` + s.table("viz_roles_parents") + ` (source, parent_dn)`,
+		`CREATE INDEX IF NOT EXISTS ` + s.index("viz_association_parameters", "value_idx") + ` ON ` + s.table("viz_association_parameters") + ` (source, name, value)`,
+		`CREATE INDEX IF NOT EXISTS ` + s.index("viz_role_effective_resources", "resource_idx") + ` ON ` + s.table("viz_role_effective_resources") + ` (source, resource_dn)`,
+		`CREATE INDEX IF NOT EXISTS ` + s.index("viz_owners", "owner_idx") + ` ON ` + s.table("viz_owners") + ` (source, owner_dn)`,
+		`CREATE INDEX IF NOT EXISTS ` + s.index("viz_approvers", "approver_idx") + ` ON ` + s.table("viz_approvers") + ` (source, approver_dn)`,
+		`CREATE INDEX IF NOT EXISTS ` + s.index("viz_resources", "driver_idx") + ` ON ` + s.table("viz_resources") + ` (entitlement_driver)`,
+	}
+	for _, stmt := range statements {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return fmt.Errorf("Fehler beim Erstellen der SQLite-Tabellen: %w", err)
+		}
+	}
+	// Nachträglich hinzugefügte Spalten in bestehenden Dateien ergänzen
+	for _, table := range []string{"viz_roles", "viz_resources"} {
+		if err := s.addColumn(table, "display_name", "TEXT"); err != nil {
+			return err
+		}
+	}
+	typedColumns := []struct{ table, column, definition string }{
+		{"viz_roles_resources", "nrfdynamicparmvals_parameters", "TEXT"},
+		{"viz_roles", "role_level", "INTEGER"},
+		{"viz_roles", "role_level_key", "TEXT"},
+		{"viz_roles", "role_level_name", "TEXT"},
+		{"viz_resources", "allow_multi", "INTEGER"},
+		{"viz_roles_resources", "status_code", "INTEGER"},
+		{"viz_roles_resources", "status_key", "TEXT"},
+		{"viz_roles_resources", "status_name", "TEXT"},
+		{"viz_roles_resources", "ldap_created_at", "TEXT"},
+		{"viz_roles_resources", "ldap_modified_at", "TEXT"},
+		{"viz_roles_resources", "approval", "TEXT"},
+		{"viz_roles_resources", "approval_required", "INTEGER"},
+		{"viz_roles_resources", "status_changed_at", "TEXT"},
+		{"viz_roles", "approval_required", "INTEGER"},
+		{"viz_roles", "approval_definition", "TEXT"},
+		{"viz_roles", "revoke_required", "INTEGER"},
+		{"viz_roles", "revoke_definition", "TEXT"},
+		{"viz_resources", "approval_required", "INTEGER"},
+		{"viz_resources", "approval_definition", "TEXT"},
+		{"viz_resources", "revoke_required", "INTEGER"},
+		{"viz_resources", "revoke_definition", "TEXT"},
+		{"viz_roles", "original_dn", "TEXT"},
+		{"viz_roles", "guid", "TEXT"},
+		{"viz_resources", "original_dn", "TEXT"},
+		{"viz_resources", "guid", "TEXT"},
+		{"viz_roles_resources", "original_dn", "TEXT"},
+		{"viz_roles_resources", "guid", "TEXT"},
+	}
+	for _, c := range typedColumns {
+		if err := s.addColumn(c.table, c.column, c.definition); err != nil {
+			return err
+		}
+	}
+	indexes := []string{
+		`CREATE INDEX IF NOT EXISTS ` + s.index("viz_roles_resources", "status_idx") + ` ON ` + s.table("viz_roles_resources") + ` (source, status_key)`,
+		`CREATE INDEX IF NOT EXISTS ` + s.index("viz_roles", "guid_idx") + ` ON ` + s.table("viz_roles") + ` (source, guid)`,
+		`CREATE INDEX IF NOT EXISTS ` + s.index("viz_resources", "guid_idx") + ` ON ` + s.table("viz_resources") + ` (source, guid)`,
+		`CREATE INDEX IF NOT EXISTS ` + s.index("viz_roles_resources", "guid_idx") + ` ON ` + s.table("viz_roles_resources") + ` (source, guid)`,
+	}
+	for _, stmt := range indexes {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return fmt.Errorf("Fehler beim Erstellen der SQLite-Tabellen: %w", err)
+		}
+	}
+	// Bestehende Datensätze auf die typisierten Spalten umstellen
+	converted, err := migrateTypedColumns(s.db, s.table, func(n int) string { return fmt.Sprintf("?%d", n) })
+	if err != nil {
+		return err
+	}
+	if converted > 0 {
+		run.log.Info("Typisierte Spalten für bestehende Datensätze befüllt", keyPhase, "schema", keySink, s.Name(), keyCounts, slog.GroupValue(slog.Int64("converted", converted)))
+	}
+	// Bestehende Datensätze auf kanonische DNs umstellen
+	normalized, err := migrateCanonicalDNs(s.db, s.table, func(n int) string { return fmt.Sprintf("?%d", n) }, func(tx *sql.Tx) error {
+		_, err := tx.Exec(`PRAGMA defer_foreign_keys = ON`)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if normalized.Converted > 0 || normalized.Merged > 0 {
+		run.log.Info("DNs bestehender Datensätze kanonisiert", keyPhase, "schema", keySink, s.Name(), keyCounts, slog.GroupValue(slog.Int64("converted", normalized.Converted), slog.Int64("merged", normalized.Merged)))
+	}
+	run.log.Info("SQLite-Tabellen wurden erstellt oder existieren bereits.", keyPhase, "schema", keySink, s.Name())
+	return nil
+}
+
+// addColumn ergänzt eine Spalte, falls sie fehlt. SQLite kennt kein
+// ADD COLUMN IF NOT EXISTS.
+func (s *sqliteSink) addColumn(table, column, definition string) error {
+	var exists bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pragma_table_info(?1) WHERE name = ?2)`, s.names.name(table), column).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+	if _, err := s.db.Exec(`ALTER TABLE ` + s.table(table) + ` ADD COLUMN ` + column + ` ` + definition); err != nil {
+		return fmt.Errorf("Fehler beim Erweitern der Tabelle %s: %w", table, err)
+	}
+	return nil
+}
+
+// upsertSQLite führt ein vorbereitetes Upsert aus. Ein Datensatz gilt als neu, wenn
+// created_at dem Zeitstempel des Laufs entspricht, da es bei Konflikten nicht
+// überschrieben wird.
+func upsertSQLite(stmt *sql.Stmt, timestamp string, args ...any) (inserted bool, err error) {
+	var createdAt string
+	if err := stmt.QueryRow(args...).Scan(&createdAt); err != nil {
+		return false, err
+	}
+	return createdAt == timestamp, nil
+}
+
+// WriteRoles schreibt Rollen und Parent-Beziehungen in einer Transaktion.
+func (s *sqliteSink) WriteRoles(run *syncRun, roles []roleRecord) (counts, parentCounts tableCounts, err error) {
+	log := run.phaseLogger("roles", "viz_roles").With(keySink, s.Name())
+	plog := run.phaseLogger("roles", "viz_roles_parents").With(keySink, s.Name())
+	tx, err := s.db.Begin()
+	if err != nil {
+		return counts, parentCounts, fmt.Errorf("Fehler beim Starten der Transaktion für Rollen: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Umbenannte Rollen vor dem Einfügen auf ihren neuen DN umstellen
+	if counts.Renamed, err = s.renameByGUID(run, tx, log, roleRenames, roleGUIDs(roles)); err != nil {
+		return counts, parentCounts, err
+	}
+
+	roleStmt, err := tx.Prepare(`INSERT INTO ` + s.table("viz_roles") + ` (dn, nrfRoleLevel, nrflocalizednames, nrflocalizeddescrs, nrfRoleCategoryKey, created_at, updated_at, is_deleted, source, display_name,
+			role_level, role_level_key, role_level_name,
+			approval_required, approval_definition, revoke_required, revoke_definition, original_dn, guid)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?6, 0, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14, ?15, ?16, ?17)
+		ON CONFLICT (source, dn) DO UPDATE SET
+			original_dn = excluded.original_dn,
+			guid = excluded.guid,
+			approval_required = excluded.approval_required,
+			approval_definition = excluded.approval_definition,
+			revoke_required = excluded.revoke_required,
+			revoke_definition = excluded.revoke_definition,
+			display_name = excluded.display_name,
+			nrfRoleLevel = excluded.nrfRoleLevel,
+			role_level = excluded.role_level,
+			role_level_key = excluded.role_level_key,
+			role_level_name = excluded.role_level_name,
+			nrflocalizednames = excluded.nrflocalizednames,
+			nrflocalizeddescrs = excluded.nrflocalizeddescrs,
+			nrfRoleCategoryKey = excluded.nrfRoleCategoryKey,
+			updated_at = ?6,
+			is_deleted = 0
+		RETURNING created_at`)
+	if err != nil {
+		return counts, parentCounts, fmt.Errorf("Fehler beim Vorbereiten des Statements für Rollen: %w", err)
+	}
+	defer roleStmt.Close()
+	parentStmt, err := tx.Prepare(`INSERT INTO ` + s.table("viz_roles_parents") + ` (child_dn, parent_dn, created_at, updated_at, is_deleted, source) VALUES (?1, ?2, ?3, ?3, 0, ?4)
+		ON CONFLICT (source, child_dn, parent_dn) DO UPDATE SET
+			updated_at = ?3,
+			is_deleted = 0
+		RETURNING created_at`)
+	if err != nil {
+		return counts, parentCounts, fmt.Errorf("Fehler beim Vorbereiten des Statements für Rollenbeziehungen: %w", err)
+	}
+	defer parentStmt.Close()
+
+	timestampStr := run.start.Format(time.RFC3339)
+	for _, role := range roles {
+		inserted, err := upsertSQLite(roleStmt, timestampStr, role.DN, role.RoleLevel, string(mustJSON(role.LocalizedNames)), string(mustJSON(role.LocalizedDescrs)), role.CategoryKey, timestampStr, run.source, role.DisplayName,
+			nullInt(role.Level), nullString(string(role.LevelKey)), nullString(role.LevelName),
+			nullBool(role.ApprovalRequired), nullString(role.ApprovalDefinition), nullBool(role.RevokeRequired), nullString(role.RevokeDefinition),
+			nullString(role.OriginalDN), nullString(role.GUID))
+		if err != nil {
+			return counts, parentCounts, fmt.Errorf("Fehler beim Einfügen der Rolle %s: %w", role.DN, err)
+		}
+		countUpsert(log, &counts, role.DN, inserted)
+	}
+	// Parent-Beziehungen erst nach allen Rollen, wegen des Fremdschlüssels
+	for _, role := range roles {
+		for _, link := range role.parentLinks() {
+			inserted, err := upsertSQLite(parentStmt, timestampStr, link.ChildDN, link.ParentDN, timestampStr, run.source)
+			if err != nil {
+				return counts, parentCounts, fmt.Errorf("Fehler beim Einfügen der Parent-Beziehung %s: %w", link.ChildDN, err)
+			}
+			countUpsert(plog.With("parent_dn", link.ParentDN), &parentCounts, link.ChildDN, inserted)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return counts, parentCounts, fmt.Errorf("Fehler beim Abschließen der Transaktion für Rollen: %w", err)
+	}
+	return counts, parentCounts, nil
+}
+
+// renameByGUID stellt über die GUID erkannte Umbenennungen und Verschiebungen
+// in der Transaktion um. Ein Laufprotokoll gibt es nur in postgres, die
+// Umbenennungen werden daher nur protokolliert.
+func (s *sqliteSink) renameByGUID(run *syncRun, tx *sql.Tx, log *slog.Logger, target renameTarget, objects []guidDN) (int, error) {
+	if _, err := tx.Exec(`PRAGMA defer_foreign_keys = ON`); err != nil {
+		return 0, fmt.Errorf("Fehler beim Zurückstellen der Fremdschlüssel: %w", err)
+	}
+	events, err := applyRenames(tx, log, run.source, s.table, func(n int) string { return fmt.Sprintf("?%d", n) }, target, objects)
+	if err != nil {
+		return 0, fmt.Errorf("Fehler beim Umstellen umbenannter Datensätze in Tabelle %s: %w", target.table, err)
+	}
+	return len(events), nil
+}
+
+// WriteResources schreibt die Ressourcen in einer Transaktion.
+func (s *sqliteSink) WriteResources(run *syncRun, resources []resourceRecord) (counts tableCounts, err error) {
+	log := run.phaseLogger("resources", "viz_resources").With(keySink, s.Name())
+	tx, err := s.db.Begin()
+	if err != nil {
+		return counts, fmt.Errorf("Fehler beim Starten der Transaktion für Ressourcen: %w", err)
+	}
+	defer tx.Rollback()
+
+	if counts.Renamed, err = s.renameByGUID(run, tx, log, resourceRenames, resourceGUIDs(resources)); err != nil {
+		return counts, err
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO ` + s.table("viz_resources") + ` (
+            dn, nrflocalizednames, nrflocalizeddescrs, nrfCategoryKey, nrfAllowMulti,
+            entitlement_driver, entitlement_status, entitlement_xml, entitlement_xml_src,
+            entitlement_xml_id, entitlement_xml_param_id, entitlement_xml_param_id2, entitlement_xml_param_id3,
+            created_at, updated_at, is_deleted, source, display_name, allow_multi,
+            approval_required, approval_definition, revoke_required, revoke_definition, original_dn, guid
+        ) VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?10, ?11, ?12, ?13, ?14, ?14, 0, ?15, ?16, ?17, ?18, ?19, ?20, ?21, ?22, ?23)
+        ON CONFLICT (source, dn) DO UPDATE SET
+            original_dn = excluded.original_dn,
+            guid = excluded.guid,
+            approval_required = excluded.approval_required,
+            approval_definition = excluded.approval_definition,
+            revoke_required = excluded.revoke_required,
+            revoke_definition = excluded.revoke_definition,
+            display_name = excluded.display_name,
+            allow_multi = excluded.allow_multi,
+            nrflocalizednames = excluded.nrflocalizednames,
+            nrflocalizeddescrs = excluded.nrflocalizeddescrs,
+            nrfCategoryKey = excluded.nrfCategoryKey,
+            nrfAllowMulti = excluded.nrfAllowMulti,
+            entitlement_driver = excluded.entitlement_driver,
+            entitlement_status = excluded.entitlement_status,
+            entitlement_xml = excluded.entitlement_xml,
+            entitlement_xml_src = excluded.entitlement_xml_src,
+            entitlement_xml_id = excluded.entitlement_xml_id,
+            entitlement_xml_param_id = excluded.entitlement_xml_param_id,
+            entitlement_xml_param_id2 = excluded.entitlement_xml_param_id2,
+            entitlement_xml_param_id3 = excluded.entitlement_xml_param_id3,
+            updated_at = ?14,
+            is_deleted = 0
+        RETURNING created_at`)
+	if err != nil {
+		return counts, fmt.Errorf("Fehler beim Vorbereiten des Statements für Ressourcen: %w", err)
+	}
+	defer stmt.Close()
+
+	timestampStr := run.start.Format(time.RFC3339)
+	for _, res := range resources {
+		inserted, err := upsertSQLite(stmt, timestampStr,
+			res.DN,
+			string(mustJSON(res.LocalizedNames)),
+			string(mustJSON(res.LocalizedDescrs)),
+			res.CategoryKey,
+			res.AllowMulti,
+			res.EntitlementDriver,
+			res.EntitlementStatus,
+			res.EntitlementXML,
+			res.EntitlementXMLSrc,
+			res.EntitlementXMLID,
+			res.EntitlementXMLParamID,
+			res.EntitlementXMLParamID2,
+			res.EntitlementXMLParamID3,
+			timestampStr,
+			run.source,
+			res.DisplayName,
+			nullBool(res.AllowMultiFlag),
+			nullBool(res.ApprovalRequired),
+			nullString(res.ApprovalDefinition),
+			nullBool(res.RevokeRequired),
+			nullString(res.RevokeDefinition),
+			nullString(res.OriginalDN),
+			nullString(res.GUID),
+		)
+		if err != nil {
+			return counts, fmt.Errorf("Fehler beim Einfügen der Ressource %s: %w", res.DN, err)
+		}
+		countUpsert(log, &counts, res.DN, inserted)
+	}
+	if err := tx.Commit(); err != nil {
+		return counts, fmt.Errorf("Fehler beim Abschließen der Transaktion für Ressourcen: %w", err)
+	}
+	return counts, nil
+}
+
+// WriteAssociations schreibt die Assoziationen in einer Transaktion. Einzelne
+// fehlerhafte Datensätze werden übersprungen.
+func (s *sqliteSink) WriteAssociations(run *syncRun, associations []associationRecord) (counts tableCounts, err error) {
+	log := run.phaseLogger("associations", "viz_roles_resources").With(keySink, s.Name())
+	tx, err := s.db.Begin()
+	if err != nil {
+		return counts, fmt.Errorf("Fehler beim Starten der Transaktion für Assoziationen: %w", err)
+	}
+	defer tx.Rollback()
+
+	if counts.Renamed, err = s.renameByGUID(run, tx, log, associationRenames, associationGUIDs(associations)); err != nil {
+		return counts, err
+	}
+
+	stmt, err := tx.Prepare(`INSERT INTO ` + s.table("viz_roles_resources") + ` (
+			dn, nrfRole, nrfResource, nrfDynamicParmVals, nrfdynamicparmvals_value_json, nrfStatus, createTimestamp, modifyTimestamp,
+			created_at, updated_at, is_deleted, source, nrfdynamicparmvals_parameters,
+			status_code, status_key, status_name, ldap_created_at, ldap_modified_at,
+			approval, approval_required, status_changed_at, original_dn, guid
+		) VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9, ?9, 0, ?10, ?11, ?12, ?13, ?14, ?15, ?16, ?17, ?18, ?9, ?19, ?20)
+		ON CONFLICT (source, dn) DO UPDATE SET
+			original_dn = excluded.original_dn,
+			guid = excluded.guid,
+			nrfRole = excluded.nrfRole,
+			nrfResource = excluded.nrfResource,
+			nrfDynamicParmVals = excluded.nrfDynamicParmVals,
+			nrfdynamicparmvals_value_json = excluded.nrfdynamicparmvals_value_json,
+			nrfdynamicparmvals_parameters = excluded.nrfdynamicparmvals_parameters,
+			nrfStatus = excluded.nrfStatus,
+			createTimestamp = excluded.createTimestamp,
+			modifyTimestamp = excluded.modifyTimestamp,
+			status_code = excluded.status_code,
+			status_key = excluded.status_key,
+			status_name = excluded.status_name,
+			ldap_created_at = excluded.ldap_created_at,
+			ldap_modified_at = excluded.ldap_modified_at,
+			approval = excluded.approval,
+			approval_required = excluded.approval_required,
+			status_changed_at = CASE WHEN status_key IS NOT excluded.status_key THEN ?9 ELSE status_changed_at END,
+			updated_at = ?9,
+			is_deleted = 0
+		RETURNING created_at`)
+	if err != nil {
+		return counts, fmt.Errorf("Fehler beim Vorbereiten des Statements für Assoziationen: %w", err)
+	}
+	defer stmt.Close()
+
+	// Die Parameter einer Assoziation werden bei jedem Lauf vollständig ersetzt
+	deleteParams, err := tx.Prepare(`DELETE FROM ` + s.table("viz_association_parameters") + ` WHERE source = ?1 AND association_dn = ?2`)
+	if err != nil {
+		return counts, fmt.Errorf("Fehler beim Vorbereiten des Statements für Parameter: %w", err)
+	}
+	defer deleteParams.Close()
+	insertParam, err := tx.Prepare(`INSERT INTO ` + s.table("viz_association_parameters") + ` (association_dn, position, name, type, value, value_json, updated_at, source)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8)`)
+	if err != nil {
+		return counts, fmt.Errorf("Fehler beim Vorbereiten des Statements für Parameter: %w", err)
+	}
+	defer insertParam.Close()
+
+	timestampStr := run.start.Format(time.RFC3339)
+	for _, assoc := range associations {
+		inserted, err := upsertSQLite(stmt, timestampStr, assoc.DN, assoc.Role, assoc.Resource, assoc.DynamicParmVals, assoc.DynamicParmValsValueJSON, assoc.Status, assoc.CreateTimestamp, assoc.ModifyTimestamp, timestampStr, run.source, assoc.parametersJSON(),
+			nullInt(assoc.StatusCode), nullString(string(assoc.StatusKey)), nullString(assoc.StatusName), nullTime(assoc.LDAPCreatedAt), nullTime(assoc.LDAPModifiedAt),
+			assoc.approvalJSON(), nullBool(assoc.ApprovalRequired), nullString(assoc.OriginalDN), nullString(assoc.GUID))
+		if err != nil {
+			counts.Skipped++
+			log.Error("Fehler beim Einfügen der Assoziation", keyDN, assoc.DN, keyError, err)
+			logDecision(log, assoc.DN, decisionSkipped, keyError, err)
+			continue
+		}
+		countUpsert(log, &counts, assoc.DN, inserted)
+		if _, err := deleteParams.Exec(run.source, assoc.DN); err != nil {
+			return counts, fmt.Errorf("Fehler beim Löschen der Parameter von %s: %w", assoc.DN, err)
+		}
+		for i, param := range assoc.DynamicParameters {
+			if _, err := insertParam.Exec(assoc.DN, i, param.Name, param.Type, param.Value, nullJSON(param.ValueJSON), timestampStr, run.source); err != nil {
+				return counts, fmt.Errorf("Fehler beim Einfügen der Parameter von %s: %w", assoc.DN, err)
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return counts, fmt.Errorf("Fehler beim Abschließen der Transaktion für Assoziationen: %w", err)
+	}
+	return counts, nil
+}
+
+// WriteEffectiveResources ersetzt die effektiven Ressourcen der Quelle in
+// einer Transaktion.
+func (s *sqliteSink) WriteEffectiveResources(run *syncRun, grants []effectiveGrant) (counts tableCounts, err error) {
+	log := run.phaseLogger("effective", "viz_role_effective_resources").With(keySink, s.Name())
+	tx, err := s.db.Begin()
+	if err != nil {
+		return counts, fmt.Errorf("Fehler beim Starten der Transaktion für effektive Ressourcen: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM `+s.table("viz_role_effective_resources")+` WHERE source = ?1`, run.source); err != nil {
+		return counts, fmt.Errorf("Fehler beim Leeren der effektiven Ressourcen: %w", err)
+	}
+	stmt, err := tx.Prepare(`INSERT INTO ` + s.table("viz_role_effective_resources") + ` (role_dn, resource_dn, association_dn, inherited_from, path, depth, updated_at, source)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8)`)
+	if err != nil {
+		return counts, fmt.Errorf("Fehler beim Vorbereiten des Statements für effektive Ressourcen: %w", err)
+	}
+	defer stmt.Close()
+
+	timestampStr := run.start.Format(time.RFC3339)
+	for _, g := range grants {
+		if _, err := stmt.Exec(g.RoleDN, g.ResourceDN, g.AssociationDN, g.inheritedFrom(), string(mustJSON(g.Path)), len(g.Path)-1, timestampStr, run.source); err != nil {
+			return counts, fmt.Errorf("Fehler beim Einfügen der effektiven Ressource %s für %s: %w", g.ResourceDN, g.RoleDN, err)
+		}
+		counts.Inserted++
+		logDecision(log, g.RoleDN, decisionInserted, "resource_dn", g.ResourceDN)
+	}
+	if err := tx.Commit(); err != nil {
+		return counts, fmt.Errorf("Fehler beim Abschließen der Transaktion für effektive Ressourcen: %w", err)
+	}
+	return counts, nil
+}
+
+// WriteGovernance ersetzt die Eigentümer und Genehmiger der Quelle in einer
+// Transaktion.
+func (s *sqliteSink) WriteGovernance(run *syncRun, links []principalLink) (ownerCounts, approverCounts tableCounts, err error) {
+	log := run.phaseLogger("governance", "viz_owners").With(keySink, s.Name())
+	tx, err := s.db.Begin()
+	if err != nil {
+		return ownerCounts, approverCounts, fmt.Errorf("Fehler beim Starten der Transaktion für Eigentümer und Genehmiger: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"viz_owners", "viz_approvers"} {
+		if _, err := tx.Exec(`DELETE FROM `+s.table(table)+` WHERE source = ?1`, run.source); err != nil {
+			return ownerCounts, approverCounts, fmt.Errorf("Fehler beim Leeren der Tabelle %s: %w", table, err)
+		}
+	}
+	ownerStmt, err := tx.Prepare(`INSERT INTO ` + s.table("viz_owners") + ` (object_dn, object_type, owner_dn, owner_type, display_name, updated_at, source)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7)`)
+	if err != nil {
+		return ownerCounts, approverCounts, fmt.Errorf("Fehler beim Vorbereiten des Statements für Eigentümer: %w", err)
+	}
+	defer ownerStmt.Close()
+	approverStmt, err := tx.Prepare(`INSERT INTO ` + s.table("viz_approvers") + ` (object_dn, object_type, kind, approver_dn, approver_type, display_name, updated_at, source)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8)`)
+	if err != nil {
+		return ownerCounts, approverCounts, fmt.Errorf("Fehler beim Vorbereiten des Statements für Genehmiger: %w", err)
+	}
+	defer approverStmt.Close()
+
+	timestampStr := run.start.Format(time.RFC3339)
+	for _, l := range links {
+		if l.isOwner() {
+			_, err = ownerStmt.Exec(l.ObjectDN, l.ObjectType, l.PrincipalDN, l.PrincipalType, l.DisplayName, timestampStr, run.source)
+		} else {
+			_, err = approverStmt.Exec(l.ObjectDN, l.ObjectType, l.Kind, l.PrincipalDN, l.PrincipalType, l.DisplayName, timestampStr, run.source)
+		}
+		if err != nil {
+			return ownerCounts, approverCounts, fmt.Errorf("Fehler beim Einfügen von %s für %s: %w", l.PrincipalDN, l.ObjectDN, err)
+		}
+		if l.isOwner() {
+			ownerCounts.Inserted++
+		} else {
+			approverCounts.Inserted++
+		}
+		logDecision(log, l.ObjectDN, decisionInserted, "kind", l.Kind, "principal_dn", l.PrincipalDN)
+	}
+	if err := tx.Commit(); err != nil {
+		return ownerCounts, approverCounts, fmt.Errorf("Fehler beim Abschließen der Transaktion für Eigentümer und Genehmiger: %w", err)
+	}
+	return ownerCounts, approverCounts, nil
+}
+
+// MarkDeleted markiert einzeln gemeldete Löschungen in einer Transaktion.
+func (s *sqliteSink) MarkDeleted(run *syncRun, table, column string, dns []string) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("Fehler beim Starten der Transaktion für Tabelle %s: %w", table, err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`UPDATE ` + s.table(table) + ` SET is_deleted = 1 WHERE source = ?1 AND ` + column + ` = ?2 AND updated_at < ?3 AND is_deleted = 0`)
+	if err != nil {
+		return 0, fmt.Errorf("Fehler beim Vorbereiten des Statements für Tabelle %s: %w", table, err)
+	}
+	defer stmt.Close()
+
+	var marked int64
+	timestampStr := run.start.Format(time.RFC3339)
+	for _, dn := range dns {
+		result, err := stmt.Exec(run.source, dn, timestampStr)
+		if err != nil {
+			return 0, fmt.Errorf("Fehler beim Markieren von %s in Tabelle %s: %w", dn, table, err)
+		}
+		n, _ := result.RowsAffected()
+		marked += n
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("Fehler beim Abschließen der Transaktion für Tabelle %s: %w", table, err)
+	}
+	return marked, nil
+}
+
+// FinishSource markiert nach einer fehlerfreien Synchronisation alle nicht
+// mehr gefundenen Datensätze der Quelle als gelöscht.
+func (s *sqliteSink) FinishSource(run *syncRun, syncErr error) error {
+	if syncErr != nil {
+		run.log.Warn("Markieren in SQLite übersprungen, die Synchronisation war fehlerhaft", keyPhase, "mark", keySink, s.Name())
+		return nil
+	}
+	timestampStr := run.start.Format(time.RFC3339)
+	for _, table := range managedTables {
+		if _, err := s.db.Exec(`UPDATE `+s.table(table)+` SET is_deleted = 1 WHERE source = ?1 AND updated_at < ?2 AND is_deleted = 0`, run.source, timestampStr); err != nil {
+			return fmt.Errorf("Fehler beim Markieren von Datensätzen in Tabelle %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+func (s *sqliteSink) Finish(run *syncRun, runErr error) error {
+	run.log.Info("SQLite-Datei geschrieben", keySink, s.Name())
+	return nil
+}
+
+func (s *sqliteSink) Close() error {
+	return s.db.Close()
+}
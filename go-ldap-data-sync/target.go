@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Standardpräfix der Tabellennamen. Im Programm werden die Tabellen immer
+// unter ihrem logischen Namen (viz_roles usw.) geführt, z.B. in Logs, Metriken
+// und tabellenspezifischen Einstellungen; erst in SQL wird der physische Name
+// aus Schema und Präfix gebildet.
+const defaultTablePrefix = "viz_"
+
+// Zulässige Präfixe und Schemanamen, damit zusammengesetzte Namen gültige
+// PostgreSQL-Bezeichner bleiben.
+var identifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Vom Programm verwaltete Tabellen, die beim Blue/Green-Betrieb in das
+// Schattenschema übernommen werden, in Abhängigkeitsreihenfolge.
+var shadowCopyTables = append(append([]string{}, managedTables...), "viz_association_parameters", "viz_role_effective_resources", "viz_owners", "viz_approvers", "viz_sync_runs", "viz_sync_source_runs", "viz_sync_renames")
+
+// targetConfig legt fest, in welches Schema und mit welchem Tabellenpräfix
+// geschrieben wird. Mit BlueGreen lädt ein Lauf in ein Schattenschema, das nach
+// Erfolg atomar gegen das Zielschema getauscht wird.
+type targetConfig struct {
+	Schema       string
+	Prefix       string
+	BlueGreen    bool
+	ShadowSchema string
+	// Rollen, die im Schattenschema vor dem Tausch Leserechte erhalten
+	GrantRoles []string
+}
+
+// initTargetConfig liest DB_SCHEMA, DB_TABLE_PREFIX und die Einstellungen für
+// den Blue/Green-Betrieb.
+func initTargetConfig(src *configSource) targetConfig {
+	cfg := targetConfig{
+		Schema:    src.str("DB_SCHEMA", ""),
+		Prefix:    src.str("DB_TABLE_PREFIX", defaultTablePrefix),
+		BlueGreen: src.bool("DB_BLUE_GREEN", false),
+	}
+	shadow := ""
+	if cfg.Schema != "" {
+		shadow = cfg.Schema + "_shadow"
+	}
+	cfg.ShadowSchema = src.str("DB_SHADOW_SCHEMA", shadow)
+	for _, role := range strings.Split(src.str("DB_BLUE_GREEN_GRANT_ROLES", ""), ",") {
+		if role = strings.TrimSpace(role); role != "" {
+			cfg.GrantRoles = append(cfg.GrantRoles, role)
+		}
+	}
+	return cfg
+}
+
+// validate prüft Schema, Präfix und die Voraussetzungen für Blue/Green.
+func (c targetConfig) validate() error {
+	var errs []error
+	if c.Prefix != "" && !identifierPattern.MatchString(c.Prefix) {
+		errs = append(errs, fmt.Errorf("DB_TABLE_PREFIX: %q ist kein gültiger Bezeichner", c.Prefix))
+	}
+	if c.Schema != "" && !identifierPattern.MatchString(c.Schema) {
+		errs = append(errs, fmt.Errorf("DB_SCHEMA: %q ist kein gültiger Bezeichner", c.Schema))
+	}
+	if c.BlueGreen {
+		// Beim Tausch wird das gesamte Schema ersetzt, es muss dem Programm allein gehören
+		if c.Schema == "" || c.Schema == "public" {
+			errs = append(errs, errors.New("DB_BLUE_GREEN erfordert ein eigenes DB_SCHEMA (nicht public)"))
+		}
+		if !identifierPattern.MatchString(c.ShadowSchema) || c.ShadowSchema == c.Schema || c.ShadowSchema == c.previousSchema() {
+			errs = append(errs, fmt.Errorf("DB_SHADOW_SCHEMA: %q ist ungültig oder gleich dem Zielschema", c.ShadowSchema))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// previousSchema ist das Schema, unter dem der vorherige Stand nach einem
+// Tausch erhalten bleibt (für ein manuelles Zurückrollen).
+func (c targetConfig) previousSchema() string {
+	return c.Schema + "_previous"
+}
+
+// names liefert die Tabellennamen im Zielschema.
+func (c targetConfig) names() tableNames {
+	return tableNames{schema: c.Schema, prefix: c.Prefix}
+}
+
+// shadowNames liefert die Tabellennamen im Schattenschema.
+func (c targetConfig) shadowNames() tableNames {
+	return tableNames{schema: c.ShadowSchema, prefix: c.Prefix}
+}
+
+// tableNames bildet logische Tabellennamen auf physische ab.
+type tableNames struct {
+	schema string
+	prefix string
+}
+
+// defaultTableNames entspricht den Namen ohne Konfiguration (Suchpfad, viz_).
+var defaultTableNames = tableNames{prefix: defaultTablePrefix}
+
+// name liefert den unqualifizierten physischen Namen, z.B. für Constraints.
+func (n tableNames) name(table string) string {
+	return n.prefix + strings.TrimPrefix(table, defaultTablePrefix)
+}
+
+// qualified liefert den maskierten, ggf. schemaqualifizierten Namen für SQL.
+func (n tableNames) qualified(table string) string {
+	if n.schema == "" {
+		return pgx.Identifier{n.name(table)}.Sanitize()
+	}
+	return pgx.Identifier{n.schema, n.name(table)}.Sanitize()
+}
+
+// prepareShadow legt das Schattenschema neu an und übernimmt den aktuellen
+// Stand des Zielschemas. So bleiben created_at, Löschmarkierungen und das
+// Laufprotokoll über den Tausch hinweg erhalten.
+func prepareShadow(run *syncRun, db *sql.DB, target targetConfig) error {
+	defer run.timePhase("shadow")()
+	log := run.log.With(keyPhase, "shadow")
+	live, shadow := target.names(), target.shadowNames()
+
+	// Zielschema anlegen bzw. migrieren, damit die Spalten beider Schemas übereinstimmen
+	run.tables = live
+	if err := createTables(run, db); err != nil {
+		return err
+	}
+
+	schema := pgx.Identifier{target.ShadowSchema}.Sanitize()
+	log.Info("Lege Schattenschema an...", "schema", target.ShadowSchema)
+	if _, err := db.Exec(`DROP SCHEMA IF EXISTS ` + schema + ` CASCADE`); err != nil {
+		return fmt.Errorf("Fehler beim Entfernen des alten Schattenschemas %s: %w", target.ShadowSchema, err)
+	}
+	run.tables = shadow
+	if err := createTables(run, db); err != nil {
+		return err
+	}
+
+	for _, table := range shadowCopyTables {
+		if err := copyTable(db, table, live, shadow); err != nil {
+			return fmt.Errorf("Fehler beim Übernehmen der Tabelle %s in das Schattenschema: %w", table, err)
+		}
+	}
+	for _, table := range managedTables {
+		if err := copyArchiveTable(db, table+"_archive", live, shadow); err != nil {
+			return fmt.Errorf("Fehler beim Übernehmen der Tabelle %s_archive in das Schattenschema: %w", table, err)
+		}
+	}
+	log.Info("Schattenschema vorbereitet", "schema", target.ShadowSchema)
+	return nil
+}
+
+// copyTable kopiert alle Datensätze einer Tabelle spaltenweise nach Namen, da
+// migrierte Tabellen ihre Spalten in anderer Reihenfolge haben können.
+func copyTable(db *sql.DB, table string, from, to tableNames) error {
+	rows, err := db.Query(`SELECT attname FROM pg_attribute WHERE attrelid = to_regclass($1) AND attnum > 0 AND NOT attisdropped ORDER BY attnum`, to.qualified(table))
+	if err != nil {
+		return err
+	}
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			rows.Close()
+			return err
+		}
+		columns = append(columns, pgx.Identifier{column}.Sanitize())
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	list := strings.Join(columns, ", ")
+	_, err = db.Exec(`INSERT INTO ` + to.qualified(table) + ` (` + list + `) SELECT ` + list + ` FROM ` + from.qualified(table))
+	return err
+}
+
+// copyArchiveTable übernimmt eine vorhandene Archivtabelle unverändert.
+func copyArchiveTable(db *sql.DB, table string, from, to tableNames) error {
+	exists, err := tableExists(db, from.qualified(table))
+	if err != nil || !exists {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE ` + to.qualified(table) + ` (LIKE ` + from.qualified(table) + ` INCLUDING ALL)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO ` + to.qualified(table) + ` SELECT * FROM ` + from.qualified(table))
+	return err
+}
+
+// swapShadow tauscht das Schattenschema in einer Transaktion gegen das
+// Zielschema. Der bisherige Stand bleibt bis zum nächsten Tausch als
+// <schema>_previous erhalten.
+func swapShadow(run *syncRun, db *sql.DB, target targetConfig) error {
+	defer run.timePhase("swap")()
+	log := run.log.With(keyPhase, "swap")
+
+	live := pgx.Identifier{target.Schema}.Sanitize()
+	shadow := pgx.Identifier{target.ShadowSchema}.Sanitize()
+	previous := pgx.Identifier{target.previousSchema()}.Sanitize()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("Fehler beim Starten des Schematauschs: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Leserechte vor dem Tausch vergeben, damit Konsumenten nahtlos weiterlesen können
+	for _, role := range target.GrantRoles {
+		grantee := pgx.Identifier{role}.Sanitize()
+		for _, grant := range []string{`GRANT USAGE ON SCHEMA ` + shadow + ` TO ` + grantee, `GRANT SELECT ON ALL TABLES IN SCHEMA ` + shadow + ` TO ` + grantee} {
+			if _, err := tx.Exec(grant); err != nil {
+				return fmt.Errorf("Fehler beim Vergeben der Leserechte an %s: %w", role, err)
+			}
+		}
+	}
+	steps := []string{
+		`DROP SCHEMA IF EXISTS ` + previous + ` CASCADE`,
+		`ALTER SCHEMA ` + live + ` RENAME TO ` + previous,
+		`ALTER SCHEMA ` + shadow + ` RENAME TO ` + live,
+	}
+	for _, step := range steps {
+		if _, err := tx.Exec(step); err != nil {
+			return fmt.Errorf("Fehler beim Schematausch: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Fehler beim Schematausch: %w", err)
+	}
+	log.Info("Schattenschema aktiviert", "schema", target.Schema, "previous", target.previousSchema())
+	return nil
+}
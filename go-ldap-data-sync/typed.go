@@ -0,0 +1,305 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Die Rohwerte aus LDAP bleiben in ihren Spalten (nrfStatus, nrfRoleLevel,
+// createTimestamp usw.) erhalten. Zusätzlich werden sie in typisierte Spalten
+// übernommen, nach denen sich sortieren und filtern lässt.
+
+// associationStatus ist der dekodierte nrfStatus einer Assoziation.
+type associationStatus string
+
+const (
+	statusPendingApproval associationStatus = "pending_approval"
+	statusApproved        associationStatus = "approved"
+	statusDenied          associationStatus = "denied"
+	statusRetracted       associationStatus = "retracted"
+	statusActive          associationStatus = "active"
+	statusUnknown         associationStatus = "unknown"
+)
+
+// roleLevel ist die Ebene einer Rolle nach nrfRoleLevel.
+type roleLevel string
+
+const (
+	levelPermission roleLevel = "permission"
+	levelIT         roleLevel = "it"
+	levelBusiness   roleLevel = "business"
+	levelCustom     roleLevel = "custom"
+)
+
+// Bekannte nrfStatus-Codes mit Anzeigenamen.
+var associationStatuses = map[int]struct {
+	status associationStatus
+	name   string
+}{
+	10: {statusPendingApproval, "Genehmigung ausstehend"},
+	20: {statusApproved, "Genehmigt"},
+	30: {statusDenied, "Abgelehnt"},
+	40: {statusRetracted, "Zurückgezogen"},
+	50: {statusActive, "Aktiv"},
+}
+
+// Standardebenen des Rollenmodells mit Anzeigenamen. Andere numerische Level
+// sind im IDM konfigurierbar und werden als "custom" geführt.
+var roleLevels = map[int]struct {
+	level roleLevel
+	name  string
+}{
+	10: {levelPermission, "Berechtigungsrolle"},
+	20: {levelIT, "IT-Rolle"},
+	30: {levelBusiness, "Business-Rolle"},
+}
+
+// Zulässige Formate von LDAP Generalized Time, z.B. 20240131120000Z oder
+// 20240131120000.5+0100. Minuten und Sekunden sind optional.
+var generalizedTimeLayouts = []string{
+	"20060102150405Z0700",
+	"20060102150405.999999999Z0700",
+	"20060102150405Z07",
+	"20060102150405.999999999Z07",
+	"200601021504Z0700",
+	"200601021504Z07",
+	"2006010215Z0700",
+	"2006010215Z07",
+}
+
+// parseGeneralizedTime wandelt LDAP Generalized Time in einen Zeitpunkt in UTC
+// um. Ein leerer Wert ergibt den Nullwert ohne Fehler.
+func parseGeneralizedTime(attribute, value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	// Dezimalkomma ist in Generalized Time zulässig
+	normalized := strings.Replace(value, ",", ".", 1)
+	for _, layout := range generalizedTimeLayouts {
+		if t, err := time.Parse(layout, normalized); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%s: %q ist keine gültige Generalized Time", attribute, value)
+}
+
+// decodeStatus dekodiert nrfStatus. Unbekannte Codes ergeben statusUnknown,
+// ein nicht numerischer Wert zusätzlich einen Fehler.
+func decodeStatus(value string) (code *int, status associationStatus, name string, err error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, "", "", nil
+	}
+	n, convErr := strconv.Atoi(value)
+	if convErr != nil {
+		return nil, statusUnknown, "Unbekannt", fmt.Errorf("nrfStatus: %q ist kein numerischer Status", value)
+	}
+	if known, ok := associationStatuses[n]; ok {
+		return &n, known.status, known.name, nil
+	}
+	return &n, statusUnknown, fmt.Sprintf("Unbekannt (%d)", n), nil
+}
+
+// decodeRoleLevel dekodiert nrfRoleLevel. Ein nicht numerischer Wert ergibt
+// einen Fehler, die Rolle bleibt ohne typisiertes Level.
+func decodeRoleLevel(value string) (code *int, level roleLevel, name string, err error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, "", "", nil
+	}
+	n, convErr := strconv.Atoi(value)
+	if convErr != nil {
+		return nil, "", "", fmt.Errorf("nrfRoleLevel: %q ist kein numerisches Level", value)
+	}
+	if known, ok := roleLevels[n]; ok {
+		return &n, known.level, known.name, nil
+	}
+	return &n, levelCustom, fmt.Sprintf("Level %d", n), nil
+}
+
+// parseLDAPBool wandelt einen booleschen LDAP-Wert (TRUE/FALSE, in IDM-
+// Attributen auch true/false oder 1/0) um. Ein leerer Wert ergibt nil.
+func parseLDAPBool(attribute, value string) (*bool, error) {
+	var b bool
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "":
+		return nil, nil
+	case "true", "1", "yes":
+		b = true
+	case "false", "0", "no":
+		b = false
+	default:
+		return nil, fmt.Errorf("%s: %q ist kein boolescher Wert", attribute, value)
+	}
+	return &b, nil
+}
+
+// nullTime liefert einen Zeitpunkt als Spaltenwert, den Nullwert als NULL.
+func nullTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// nullInt liefert eine optionale Zahl als Spaltenwert.
+func nullInt(n *int) any {
+	if n == nil {
+		return nil
+	}
+	return *n
+}
+
+// nullString liefert einen leeren Text als NULL.
+func nullString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// nullBool liefert einen optionalen Wahrheitswert als Spaltenwert. SQLite
+// speichert ihn wie is_deleted als 0/1.
+func nullBool(b *bool) any {
+	if b == nil {
+		return nil
+	}
+	return *b
+}
+
+// typedMigration beschreibt, wie die typisierten Spalten einer Tabelle für
+// bestehende Datensätze aus den Rohwerten befüllt werden.
+type typedMigration struct {
+	table string
+	// Rohwerte, die nach source und dn gelesen werden
+	raw []string
+	// Bedingung für Datensätze, deren typisierte Spalten noch fehlen
+	pending string
+	// Typisierte Spalten in der Reihenfolge der Rückgabe von decode
+	typed  []string
+	decode func(raw []string) []any
+}
+
+var typedMigrations = []typedMigration{
+	{
+		table:   "viz_roles",
+		raw:     []string{"nrfRoleLevel"},
+		pending: "role_level IS NULL AND COALESCE(nrfRoleLevel, '') <> ''",
+		typed:   []string{"role_level", "role_level_key", "role_level_name"},
+		decode: func(raw []string) []any {
+			r := roleRecord{RoleLevel: raw[0]}
+			r.decodeTyped()
+			return []any{nullInt(r.Level), nullString(string(r.LevelKey)), nullString(r.LevelName)}
+		},
+	},
+	{
+		table:   "viz_resources",
+		raw:     []string{"nrfAllowMulti"},
+		pending: "allow_multi IS NULL AND COALESCE(nrfAllowMulti, '') <> ''",
+		typed:   []string{"allow_multi"},
+		decode: func(raw []string) []any {
+			r := resourceRecord{AllowMulti: raw[0]}
+			r.decodeTyped()
+			return []any{nullBool(r.AllowMultiFlag)}
+		},
+	},
+	{
+		table: "viz_roles_resources",
+		raw:   []string{"nrfStatus", "createTimestamp", "modifyTimestamp"},
+		pending: "(status_key IS NULL AND COALESCE(nrfStatus, '') <> '')" +
+			" OR (ldap_created_at IS NULL AND COALESCE(createTimestamp, '') <> '')" +
+			" OR (ldap_modified_at IS NULL AND COALESCE(modifyTimestamp, '') <> '')",
+		typed: []string{"status_code", "status_key", "status_name", "ldap_created_at", "ldap_modified_at"},
+		decode: func(raw []string) []any {
+			r := associationRecord{Status: raw[0], CreateTimestamp: raw[1], ModifyTimestamp: raw[2]}
+			r.decodeTyped()
+			return []any{nullInt(r.StatusCode), nullString(string(r.StatusKey)), nullString(r.StatusName), nullTime(r.LDAPCreatedAt), nullTime(r.LDAPModifiedAt)}
+		},
+	},
+}
+
+// migrateTypedColumns befüllt die typisierten Spalten bestehender Datensätze,
+// z.B. als gelöscht markierter, die kein Lauf mehr schreibt. Neue Datensätze
+// erhalten die Werte direkt beim Schreiben. table liefert den maskierten
+// Tabellennamen, param den Platzhalter für den n-ten Parameter ($n bzw. ?n).
+// Nicht lesbare Rohwerte bleiben NULL und werden beim nächsten Mal erneut
+// geprüft.
+func migrateTypedColumns(db *sql.DB, table func(string) string, param func(int) string) (int64, error) {
+	var converted int64
+	for _, m := range typedMigrations {
+		n, err := m.run(db, table(m.table), param)
+		if err != nil {
+			return converted, fmt.Errorf("Fehler beim Umstellen der typisierten Spalten in Tabelle %s: %w", m.table, err)
+		}
+		converted += n
+	}
+	return converted, nil
+}
+
+func (m typedMigration) run(db *sql.DB, table string, param func(int) string) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Erst alle Datensätze lesen, eine Verbindung kann nicht gleichzeitig
+	// lesen und schreiben
+	rows, err := tx.Query(`SELECT source, dn, ` + coalesceText(m.raw) + ` FROM ` + table + ` WHERE ` + m.pending)
+	if err != nil {
+		return 0, err
+	}
+	type pendingRow struct {
+		source, dn string
+		raw        []string
+	}
+	var pending []pendingRow
+	for rows.Next() {
+		row := pendingRow{raw: make([]string, len(m.raw))}
+		dest := []any{&row.source, &row.dn}
+		for i := range row.raw {
+			dest = append(dest, &row.raw[i])
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		pending = append(pending, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if len(pending) == 0 {
+		return 0, nil
+	}
+
+	sets := make([]string, len(m.typed))
+	for i, column := range m.typed {
+		sets[i] = column + " = " + param(i+3)
+	}
+	stmt, err := tx.Prepare(`UPDATE ` + table + ` SET ` + strings.Join(sets, ", ") + ` WHERE source = ` + param(1) + ` AND dn = ` + param(2))
+	if err != nil {
+		return 0, err
+	}
+	defer stmt.Close()
+	for _, row := range pending {
+		if _, err := stmt.Exec(append([]any{row.source, row.dn}, m.decode(row.raw)...)...); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(pending)), tx.Commit()
+}
+
+// coalesceText liest Textspalten ohne NULL.
+func coalesceText(columns []string) string {
+	exprs := make([]string, len(columns))
+	for i, column := range columns {
+		exprs[i] = "COALESCE(" + column + ", '')"
+	}
+	return strings.Join(exprs, ", ")
+}
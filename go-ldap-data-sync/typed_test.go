@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseGeneralizedTime(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{"", time.Time{}, false},
+		{"20240131120000Z", time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC), false},
+		{"20240131120000+0100", time.Date(2024, 1, 31, 11, 0, 0, 0, time.UTC), false},
+		{"20240131120000.5Z", time.Date(2024, 1, 31, 12, 0, 0, 500000000, time.UTC), false},
+		{"20240131120000,5Z", time.Date(2024, 1, 31, 12, 0, 0, 500000000, time.UTC), false},
+		{"20240131120000-05", time.Date(2024, 1, 31, 17, 0, 0, 0, time.UTC), false},
+		{"202401311200Z", time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC), false},
+		{"2024013112Z", time.Date(2024, 1, 31, 12, 0, 0, 0, time.UTC), false},
+		{"20240131120000", time.Time{}, true},
+		{"2024-01-31T12:00:00Z", time.Time{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseGeneralizedTime("modifyTimestamp", tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseGeneralizedTime(%q) = %v, Fehler erwartet: %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) || got.Location() != time.UTC {
+			t.Errorf("parseGeneralizedTime(%q) = %v, erwartet %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeStatus(t *testing.T) {
+	tests := []struct {
+		value    string
+		wantCode int
+		status   associationStatus
+		name     string
+		wantErr  bool
+	}{
+		{"", -1, "", "", false},
+		{"50", 50, statusActive, "Aktiv", false},
+		{" 10 ", 10, statusPendingApproval, "Genehmigung ausstehend", false},
+		{"99", 99, statusUnknown, "Unbekannt (99)", false},
+		{"aktiv", -1, statusUnknown, "Unbekannt", true},
+	}
+	for _, tt := range tests {
+		code, status, name, err := decodeStatus(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("decodeStatus(%q) = %v, Fehler erwartet: %v", tt.value, err, tt.wantErr)
+		}
+		gotCode := -1
+		if code != nil {
+			gotCode = *code
+		}
+		if gotCode != tt.wantCode || status != tt.status || name != tt.name {
+			t.Errorf("decodeStatus(%q) = %d, %q, %q, erwartet %d, %q, %q", tt.value, gotCode, status, name, tt.wantCode, tt.status, tt.name)
+		}
+	}
+}
@@ -0,0 +1,670 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Arten der Änderungserkennung im Daemon-Modus (WATCH_MODE). Bei auto wird
+// Persistent Search verwendet, wenn der Server das Control anbietet.
+const (
+	watchAuto       = "auto"
+	watchPersistent = "persistent"
+	watchPoll       = "poll"
+)
+
+// OIDs von Persistent Search und Entry Change Notification
+// (draft-ietf-ldapext-psearch), wie sie eDirectory unterstützt.
+const (
+	controlTypePersistentSearch = "2.16.840.1.113730.3.4.3"
+	controlTypeEntryChange      = "2.16.840.1.113730.3.4.7"
+)
+
+// Änderungsarten der Persistent Search, als Bitmaske kombinierbar.
+const (
+	changeAdd    = 1
+	changeDelete = 2
+	changeModify = 4
+	changeModDN  = 8
+)
+
+// watchClockSkew ist der Vorlauf, mit dem die erste Abfrage nach
+// modifyTimestamp vor dem Start des Abgleichs beginnt. Er deckt
+// Uhrenabweichungen zwischen Server und Programm ab.
+const watchClockSkew = time.Minute
+
+// watchConfig steuert das Kommando `watch`.
+type watchConfig struct {
+	Mode string
+	// Abstand der Abfragen nach modifyTimestamp und der Verbindungsversuche
+	PollInterval time.Duration
+	// Abstand der vollständigen Abgleiche, 0 = nur beim Start
+	ReconcileInterval time.Duration
+	// Wartezeit, in der Änderungen der Persistent Search gesammelt werden
+	BatchDelay time.Duration
+}
+
+// initWatchConfig liest WATCH_MODE, WATCH_POLL_INTERVAL_SECONDS,
+// WATCH_RECONCILE_INTERVAL_MINUTES und WATCH_BATCH_SECONDS.
+func initWatchConfig(src *configSource) watchConfig {
+	cfg := watchConfig{
+		Mode:              src.oneOf("WATCH_MODE", watchAuto, watchAuto, watchPersistent, watchPoll),
+		PollInterval:      time.Duration(src.int("WATCH_POLL_INTERVAL_SECONDS", 30)) * time.Second,
+		ReconcileInterval: time.Duration(src.int("WATCH_RECONCILE_INTERVAL_MINUTES", 60)) * time.Minute,
+		BatchDelay:        time.Duration(src.int("WATCH_BATCH_SECONDS", 5)) * time.Second,
+	}
+	if cfg.PollInterval == 0 {
+		src.problem(errors.New("WATCH_POLL_INTERVAL_SECONDS: muss größer als 0 sein"))
+		cfg.PollInterval = 30 * time.Second
+	}
+	return cfg
+}
+
+// watchKind ist eine Objektart des Rollenmodells mit Filter und Attributen.
+type watchKind struct {
+	phase      string
+	table      string
+	filter     string
+	attributes []string
+	base       func(searchBases) string
+}
+
+// Objektarten in der Reihenfolge, in der Änderungen übernommen werden.
+var watchKinds = []watchKind{
+	{"roles", "viz_roles", rolesFilter, roleAttributes, func(b searchBases) string { return b.Roles }},
+	{"resources", "viz_resources", resourcesFilter, resourceAttributes, func(b searchBases) string { return b.Resources }},
+	{"associations", "viz_roles_resources", associationsFilter, associationAttributes, func(b searchBases) string { return b.Associations }},
+}
+
+// Indizes in watchKinds.
+const (
+	kindRoles = iota
+	kindResources
+	kindAssociations
+)
+
+// watchAttributes ergänzt modifyTimestamp, der als Cursor für die Abfragen dient.
+func (k watchKind) watchAttributes() []string {
+	if slices.Contains(k.attributes, "modifyTimestamp") {
+		return k.attributes
+	}
+	return append(slices.Clip(k.attributes), "modifyTimestamp")
+}
+
+// changeBatch sammelt Änderungen je Objektart. Je kanonischem DN zählt die
+// letzte Meldung.
+type changeBatch struct {
+	entries [3]map[string]*ldap.Entry
+	deleted [3]map[string]bool
+}
+
+func newChangeBatch() *changeBatch {
+	b := &changeBatch{}
+	for i := range watchKinds {
+		b.entries[i] = map[string]*ldap.Entry{}
+		b.deleted[i] = map[string]bool{}
+	}
+	return b
+}
+
+// add übernimmt eine Änderung. Bei einer Verschiebung wird der vorherige DN als
+// gelöscht gemeldet; hat der Eintrag eine GUID, stellt die Sink den Datensatz
+// ohnehin vorher um und die Löschung trifft nichts mehr.
+func (b *changeBatch) add(kind int, entry *ldap.Entry, deleted bool, previousDN string) {
+	dn, _ := canonicalDN(entry.DN)
+	if deleted {
+		delete(b.entries[kind], dn)
+		b.deleted[kind][dn] = true
+	} else {
+		b.entries[kind][dn] = entry
+		delete(b.deleted[kind], dn)
+	}
+	if previousDN == "" {
+		return
+	}
+	if previous, _ := canonicalDN(previousDN); previous != dn {
+		delete(b.entries[kind], previous)
+		b.deleted[kind][previous] = true
+	}
+}
+
+// empty meldet, ob keine Änderungen gesammelt wurden.
+func (b *changeBatch) empty() bool {
+	for i := range watchKinds {
+		if len(b.entries[i]) > 0 || len(b.deleted[i]) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// list liefert die geänderten Einträge einer Objektart.
+func (b *changeBatch) list(kind int) []*ldap.Entry {
+	entries := make([]*ldap.Entry, 0, len(b.entries[kind]))
+	for _, entry := range b.entries[kind] {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// deletedDNs liefert die gelöschten DNs einer Objektart.
+func (b *changeBatch) deletedDNs(kind int) []string {
+	dns := make([]string, 0, len(b.deleted[kind]))
+	for dn := range b.deleted[kind] {
+		dns = append(dns, dn)
+	}
+	slices.Sort(dns)
+	return dns
+}
+
+// changeCursor merkt sich den jüngsten übernommenen modifyTimestamp. Da
+// Generalized Time nur sekundengenau ist, wird mit >= gesucht und Einträge
+// dieser Sekunde werden kein zweites Mal übernommen.
+type changeCursor struct {
+	since time.Time
+	seen  map[string]bool
+}
+
+func newChangeCursor(since time.Time) *changeCursor {
+	return &changeCursor{since: since.UTC().Truncate(time.Second), seen: map[string]bool{}}
+}
+
+// filter ergänzt einen Filter um die Bedingung auf modifyTimestamp.
+func (c *changeCursor) filter(filter string) string {
+	return "(&" + filter + "(modifyTimestamp>=" + c.since.Format("20060102150405Z") + "))"
+}
+
+// fresh meldet, ob ein Eintrag noch nicht übernommen wurde.
+func (c *changeCursor) fresh(entry *ldap.Entry) bool {
+	modified, err := parseGeneralizedTime("modifyTimestamp", entry.GetAttributeValue("modifyTimestamp"))
+	if err != nil || modified.IsZero() {
+		return true
+	}
+	dn, _ := canonicalDN(entry.DN)
+	return modified.After(c.since) || (modified.Equal(c.since) && !c.seen[dn])
+}
+
+// advance rückt den Cursor auf den jüngsten modifyTimestamp der übernommenen
+// Einträge vor.
+func (c *changeCursor) advance(entries []*ldap.Entry) {
+	modified := make([]time.Time, len(entries))
+	for i, entry := range entries {
+		modified[i], _ = parseGeneralizedTime("modifyTimestamp", entry.GetAttributeValue("modifyTimestamp"))
+		if modified[i].After(c.since) {
+			c.since, c.seen = modified[i], map[string]bool{}
+		}
+	}
+	for i, entry := range entries {
+		if modified[i].Equal(c.since) {
+			dn, _ := canonicalDN(entry.DN)
+			c.seen[dn] = true
+		}
+	}
+}
+
+// newPersistentSearchControl liefert das Control für eine Persistent Search,
+// die nur Änderungen meldet und jede mit einer Entry Change Notification versieht.
+func newPersistentSearchControl() ldap.Control {
+	value := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Persistent Search")
+	value.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, changeAdd|changeDelete|changeModify|changeModDN, "changeTypes"))
+	value.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "changesOnly"))
+	value.AppendChild(ber.NewBoolean(ber.ClassUniversal, ber.TypePrimitive, ber.TagBoolean, true, "returnECs"))
+	return ldap.NewControlString(controlTypePersistentSearch, true, string(value.Bytes()))
+}
+
+// decodeEntryChange liest Änderungsart und vorherigen DN aus der Entry Change
+// Notification eines Eintrags. Ohne Control gilt der Eintrag als geändert.
+func decodeEntryChange(controls []ldap.Control) (changeType int64, previousDN string, err error) {
+	for _, control := range controls {
+		c, ok := control.(*ldap.ControlString)
+		if !ok || c.ControlType != controlTypeEntryChange {
+			continue
+		}
+		packet, err := ber.DecodePacketErr([]byte(c.ControlValue))
+		if err != nil {
+			return 0, "", fmt.Errorf("ungültige Entry Change Notification: %w", err)
+		}
+		if len(packet.Children) == 0 {
+			return 0, "", errors.New("Entry Change Notification ohne changeType")
+		}
+		changeType, ok = packet.Children[0].Value.(int64)
+		if !ok {
+			return 0, "", errors.New("Entry Change Notification mit ungültigem changeType")
+		}
+		if len(packet.Children) > 1 && packet.Children[1].Tag == ber.TagOctetString {
+			previousDN, _ = packet.Children[1].Value.(string)
+		}
+		return changeType, previousDN, nil
+	}
+	return changeModify, "", nil
+}
+
+// supportsPersistentSearch prüft im Root DSE, ob der Server Persistent Search anbietet.
+func supportsPersistentSearch(conn *ldap.Conn) (bool, error) {
+	sr, err := conn.Search(ldap.NewSearchRequest("", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 0, false, "(objectClass=*)", []string{"supportedControl"}, nil))
+	if err != nil {
+		return false, fmt.Errorf("Fehler beim Lesen des Root DSE: %w", err)
+	}
+	if len(sr.Entries) == 0 {
+		return false, nil
+	}
+	return slices.Contains(sr.Entries[0].GetAttributeValues("supportedControl"), controlTypePersistentSearch), nil
+}
+
+// watcher ist der Zustand des Kommandos `watch`. mu serialisiert die
+// vollständigen Abgleiche und die inkrementellen Änderungen, damit das
+// Markieren eines Abgleichs keine gleichzeitig geschriebenen Datensätze erfasst.
+type watcher struct {
+	cfg config
+	// Sinks mit Zustand für die inkrementellen Änderungen
+	sinks []Sink
+	mu    sync.Mutex
+	// Rollenmodell je Quelle aus dem letzten Abgleich, fortgeschrieben mit den Änderungen
+	models map[string]*roleModel
+	// Start des ersten Abgleichs, ab dem nach Änderungen gesucht wird
+	reconciledAt time.Time
+}
+
+// runWatchCommand implementiert das Kommando `watch` und liefert den Exit-Code.
+// Es läuft, bis das Programm mit SIGINT oder SIGTERM beendet wird.
+func runWatchCommand(args []string) int {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	force := fs.Bool("force", false, "Sicherheitsschwellen für das Markieren und Löschen der Abgleiche übersteuern")
+	fs.Parse(args)
+
+	cfg, err := initConfig()
+	if err != nil {
+		slog.Error("Konfiguration konnte nicht geladen werden", keyError, err)
+		return 1
+	}
+	cfg.Safety.Force = *force
+	if cfg.DryRun {
+		slog.Error("Der Daemon-Modus unterstützt keinen Trockenlauf (DRY_RUN)")
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	w := &watcher{cfg: cfg, models: map[string]*roleModel{}}
+	if err := w.run(ctx); err != nil {
+		slog.Error("Daemon-Modus beendet", keyCommand, "watch", keyError, err)
+		return 1
+	}
+	return 0
+}
+
+// run führt den ersten Abgleich aus, startet die Änderungserkennung je Quelle
+// und wiederholt den Abgleich im Abstand von WATCH_RECONCILE_INTERVAL_MINUTES.
+func (w *watcher) run(ctx context.Context) error {
+	incremental := w.cfg
+	incremental.Sinks = slices.DeleteFunc(slices.Clone(w.cfg.Sinks), func(spec string) bool {
+		kind, _, _ := strings.Cut(spec, ":")
+		return kind != sinkPostgres && kind != sinkSQLite
+	})
+	if len(incremental.Sinks) == 0 {
+		return errors.New("SINKS: der Daemon-Modus benötigt postgres oder sqlite:<datei>")
+	}
+
+	w.reconcile()
+
+	run := w.newRun()
+	sinks, err := openSinks(run, incremental)
+	if err != nil {
+		return err
+	}
+	defer closeSinks(run, sinks)
+	w.sinks = sinks
+
+	var wg sync.WaitGroup
+	for _, profile := range w.cfg.Sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.watchSource(ctx, profile)
+		}()
+	}
+	defer wg.Wait()
+
+	var reconcile <-chan time.Time
+	if w.cfg.Watch.ReconcileInterval > 0 {
+		ticker := time.NewTicker(w.cfg.Watch.ReconcileInterval)
+		defer ticker.Stop()
+		reconcile = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			slog.Info("Daemon-Modus wird beendet", keyCommand, "watch")
+			return nil
+		case <-reconcile:
+			w.reconcile()
+		}
+	}
+}
+
+// newRun startet einen Lauf für inkrementelle Änderungen. Er schreibt direkt
+// in das Zielschema, auch im Blue/Green-Betrieb.
+func (w *watcher) newRun() *syncRun {
+	run := newSyncRun("watch")
+	run.languages = w.cfg.Languages
+	run.tables = w.cfg.Target.names()
+	return run
+}
+
+// reconcile führt einen vollständigen Lauf wie `sync` aus und übernimmt die
+// gelesenen Rollenmodelle. Fehler werden protokolliert, der Daemon läuft weiter.
+func (w *watcher) reconcile() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	run := newSyncRun("watch")
+	run.languages = w.cfg.Languages
+	run.log.Info("Starte vollständigen Abgleich", keyPhase, "reconcile")
+	models, err := runSync(run, w.cfg)
+	run.finish(err)
+	publishMetrics(run, w.cfg)
+
+	// Quellen ohne vollständiges Modell bis zum nächsten Abgleich nur fortschreiben
+	w.models = models
+	if w.reconciledAt.IsZero() {
+		w.reconciledAt = run.start
+	}
+}
+
+// watchSource erkennt Änderungen einer Quelle, bis ctx beendet wird. Nach
+// Verbindungsfehlern wird es im Abstand von WATCH_POLL_INTERVAL_SECONDS erneut
+// versucht; bis dahin verpasste Änderungen holt die Abfrage nach modifyTimestamp nach.
+func (w *watcher) watchSource(ctx context.Context, profile sourceProfile) {
+	log := slog.Default().With(keyCommand, "watch", keySource, profile.Name)
+	cursor := newChangeCursor(w.reconciledAt.Add(-watchClockSkew))
+	for ctx.Err() == nil {
+		err := w.followSource(ctx, log, profile, cursor)
+		if err == nil || ctx.Err() != nil {
+			continue
+		}
+		log.Error("Änderungserkennung unterbrochen, neuer Versuch folgt", keyError, err, "retry_in", w.cfg.Watch.PollInterval.String())
+		select {
+		case <-ctx.Done():
+		case <-time.After(w.cfg.Watch.PollInterval):
+		}
+	}
+}
+
+// followSource verbindet sich mit der Quelle und verfolgt ihre Änderungen per
+// Persistent Search oder Abfragen nach modifyTimestamp.
+func (w *watcher) followSource(ctx context.Context, log *slog.Logger, profile sourceProfile, cursor *changeCursor) error {
+	if err := profile.validate(); err != nil {
+		return err
+	}
+	conn, err := dialLDAP(profile.url(), profile.LDAPUser, profile.LDAPPassword, w.cfg.LDAPTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	mode := w.cfg.Watch.Mode
+	if mode == watchAuto {
+		supported, err := supportsPersistentSearch(conn)
+		if err != nil {
+			log.Warn("Unterstützte Controls konnten nicht gelesen werden", keyError, err)
+		}
+		mode = watchPoll
+		if supported {
+			mode = watchPersistent
+		}
+	}
+	log.Info("Änderungserkennung gestartet", "mode", mode, "since", cursor.since)
+
+	// Änderungen seit dem Abgleich bzw. der Unterbrechung nachholen
+	if err := w.poll(log, conn, profile, cursor); err != nil {
+		return err
+	}
+	if mode == watchPersistent {
+		return w.followPersistent(ctx, log, conn, profile, cursor)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(w.cfg.Watch.PollInterval):
+		}
+		if err := w.poll(log, conn, profile, cursor); err != nil {
+			return err
+		}
+	}
+}
+
+// poll sucht die seit dem Cursor geänderten Einträge und übernimmt sie.
+// Löschungen erkennt erst der nächste Abgleich.
+func (w *watcher) poll(log *slog.Logger, conn *ldap.Conn, profile sourceProfile, cursor *changeCursor) error {
+	batch := newChangeBatch()
+	var found []*ldap.Entry
+	for i, kind := range watchKinds {
+		entries, err := ldapSearch(conn, kind.base(profile.Bases), cursor.filter(kind.filter), kind.watchAttributes())
+		if err != nil {
+			return fmt.Errorf("Fehler beim Abfragen geänderter Einträge (%s): %w", kind.phase, err)
+		}
+		for _, entry := range entries {
+			if cursor.fresh(entry) {
+				batch.add(i, entry, false, "")
+				found = append(found, entry)
+			}
+		}
+	}
+	if err := w.apply(log, conn, profile, batch); err != nil {
+		return err
+	}
+	cursor.advance(found)
+	return nil
+}
+
+// psearchResult ist eine Meldung einer der Persistent Searches.
+type psearchResult struct {
+	kind       int
+	entry      *ldap.Entry
+	deleted    bool
+	previousDN string
+}
+
+// followPersistent startet je Objektart eine Persistent Search und übernimmt
+// die gemeldeten Änderungen gesammelt nach WATCH_BATCH_SECONDS.
+func (w *watcher) followPersistent(ctx context.Context, log *slog.Logger, conn *ldap.Conn, profile sourceProfile, cursor *changeCursor) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan psearchResult)
+	errs := make(chan error, len(watchKinds))
+	for i, kind := range watchKinds {
+		request := ldap.NewSearchRequest(kind.base(profile.Bases), ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			kind.filter, kind.watchAttributes(), []ldap.Control{newPersistentSearchControl()})
+		response := conn.SearchAsync(ctx, request, 64)
+		go func() {
+			for response.Next() {
+				if response.Entry() == nil {
+					continue
+				}
+				changeType, previousDN, err := decodeEntryChange(response.Controls())
+				if err != nil {
+					log.Warn("Änderungsmeldung nicht lesbar, Eintrag gilt als geändert", keyDN, response.Entry().DN, keyError, err)
+				}
+				select {
+				case results <- psearchResult{kind: i, entry: response.Entry(), deleted: changeType == changeDelete, previousDN: previousDN}:
+				case <-ctx.Done():
+					return
+				}
+			}
+			err := response.Err()
+			if err == nil {
+				err = errors.New("vom Server beendet")
+			}
+			errs <- fmt.Errorf("Persistent Search (%s): %w", kind.phase, err)
+		}()
+	}
+
+	batch := newChangeBatch()
+	var found []*ldap.Entry
+	var flush <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errs:
+			return err
+		case result := <-results:
+			batch.add(result.kind, result.entry, result.deleted, result.previousDN)
+			if !result.deleted {
+				found = append(found, result.entry)
+			}
+			if flush == nil {
+				flush = time.After(w.cfg.Watch.BatchDelay)
+			}
+		case <-flush:
+			if err := w.apply(log, conn, profile, batch); err != nil {
+				return err
+			}
+			cursor.advance(found)
+			batch, found, flush = newChangeBatch(), nil, nil
+		}
+	}
+}
+
+// apply schreibt die Änderungen einer Quelle in die Sinks mit Zustand, markiert
+// gelöschte Einträge und berechnet effektive Ressourcen sowie Eigentümer und
+// Genehmiger aus dem fortgeschriebenen Rollenmodell neu.
+func (w *watcher) apply(log *slog.Logger, conn *ldap.Conn, profile sourceProfile, batch *changeBatch) error {
+	if batch.empty() {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	run := w.newRun().forSource(profile.Name)
+	run.log.Info("Übernehme Änderungen", keyPhase, "watch",
+		"roles", len(batch.entries[kindRoles]), "resources", len(batch.entries[kindResources]), "associations", len(batch.entries[kindAssociations]),
+		"deleted", len(batch.deleted[kindRoles])+len(batch.deleted[kindResources])+len(batch.deleted[kindAssociations]))
+
+	unlock, err := lockSinks(run, w.sinks)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var errs []error
+	var roles []roleRecord
+	var resources []resourceRecord
+	var associations []associationRecord
+	if entries := batch.list(kindRoles); len(entries) > 0 {
+		var err error
+		roles, err = writeRoles(run, run.phaseLogger("roles", "viz_roles"), w.sinks, entries)
+		errs = append(errs, err)
+		// Parent-Beziehungen, die eine geänderte Rolle nicht mehr nennt
+		errs = append(errs, markDeleted(run, w.sinks, "viz_roles_parents", "child_dn", recordDNs(roles, func(r roleRecord) string { return r.DN })))
+	}
+	if entries := batch.list(kindResources); len(entries) > 0 {
+		var err error
+		resources, err = writeResources(run, run.phaseLogger("resources", "viz_resources"), w.sinks, entries)
+		errs = append(errs, err)
+	}
+	if entries := batch.list(kindAssociations); len(entries) > 0 {
+		var err error
+		associations, err = writeAssociations(run, run.phaseLogger("associations", "viz_roles_resources"), w.sinks, entries)
+		errs = append(errs, err)
+	}
+	errs = append(errs,
+		markDeleted(run, w.sinks, "viz_roles", "dn", batch.deletedDNs(kindRoles)),
+		markDeleted(run, w.sinks, "viz_roles_parents", "child_dn", batch.deletedDNs(kindRoles)),
+		markDeleted(run, w.sinks, "viz_resources", "dn", batch.deletedDNs(kindResources)),
+		markDeleted(run, w.sinks, "viz_roles_resources", "dn", batch.deletedDNs(kindAssociations)),
+	)
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	model := w.models[profile.Name]
+	if model == nil {
+		run.log.Warn("Kein vollständiges Rollenmodell der Quelle, effektive Ressourcen sowie Eigentümer und Genehmiger folgen mit dem nächsten Abgleich", keyPhase, "watch")
+		return nil
+	}
+	model.Roles = mergeRecords(model.Roles, roles, batch.deleted[kindRoles], func(r roleRecord) (string, string) { return r.DN, r.GUID })
+	model.Resources = mergeRecords(model.Resources, resources, batch.deleted[kindResources], func(r resourceRecord) (string, string) { return r.DN, r.GUID })
+	model.Associations = mergeRecords(model.Associations, associations, batch.deleted[kindAssociations], func(a associationRecord) (string, string) { return a.DN, a.GUID })
+
+	rolesChanged := len(roles) > 0 || len(batch.deleted[kindRoles]) > 0
+	if rolesChanged || len(associations) > 0 || len(batch.deleted[kindAssociations]) > 0 {
+		errs = append(errs, syncEffectiveResources(run, w.sinks, *model))
+	}
+	if rolesChanged || len(resources) > 0 || len(batch.deleted[kindResources]) > 0 {
+		errs = append(errs, syncGovernance(run, conn, w.sinks, model.Roles, model.Resources))
+	}
+	return errors.Join(errs...)
+}
+
+// markDeleted markiert einzeln gemeldete Löschungen in allen Sinks. In die
+// Metriken geht wie bei writeToSinks nur die erste Sink ein.
+func markDeleted(run *syncRun, sinks []Sink, table, column string, dns []string) error {
+	if len(dns) == 0 {
+		return nil
+	}
+	log := run.phaseLogger("mark", table)
+	var errs []error
+	for i, s := range sinks {
+		marked, err := s.MarkDeleted(run, table, column, dns)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Sink %s: %w", s.Name(), err))
+			continue
+		}
+		if i == 0 {
+			run.tableMetrics(table).markedDeleted += marked
+		}
+		log.Info("Datensätze als gelöscht markiert", keySink, s.Name(), keyCounts, slog.GroupValue(slog.Int64("marked_deleted", marked)))
+	}
+	return errors.Join(errs...)
+}
+
+// recordDNs liefert die DNs von Datensätzen.
+func recordDNs[T any](records []T, dn func(T) string) []string {
+	dns := make([]string, len(records))
+	for i, r := range records {
+		dns[i] = dn(r)
+	}
+	return dns
+}
+
+// mergeRecords schreibt Datensätze des Rollenmodells fort: Geänderte ersetzen
+// den Datensatz mit gleichem DN oder gleicher GUID (Umbenennung), gelöschte
+// entfallen.
+func mergeRecords[T any](records, changed []T, deleted map[string]bool, key func(T) (dn, guid string)) []T {
+	if len(changed) == 0 && len(deleted) == 0 {
+		return records
+	}
+	dns, guids := map[string]bool{}, map[string]bool{}
+	for _, r := range changed {
+		dn, guid := key(r)
+		dns[dn] = true
+		if guid != "" {
+			guids[guid] = true
+		}
+	}
+	merged := make([]T, 0, len(records)+len(changed))
+	for _, r := range records {
+		dn, guid := key(r)
+		if dns[dn] || deleted[dn] || (guid != "" && guids[guid]) {
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return append(merged, changed...)
+}
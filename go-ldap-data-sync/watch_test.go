@@ -0,0 +1,78 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+func TestChangeBatchAdd(t *testing.T) {
+	entry := func(dn string) *ldap.Entry { return &ldap.Entry{DN: dn} }
+	type change struct {
+		dn         string
+		deleted    bool
+		previousDN string
+	}
+	tests := []struct {
+		name        string
+		changes     []change
+		wantEntries []string
+		wantDeleted []string
+	}{
+		{"geändert", []change{{dn: "CN=A,o=Data"}}, []string{"cn=a,o=data"}, []string{}},
+		{"gelöscht", []change{{dn: "cn=a,o=Data", deleted: true}}, []string{}, []string{"cn=a,o=data"}},
+		{"letzte Meldung zählt", []change{{dn: "cn=a,o=Data"}, {dn: "CN=A,o=Data", deleted: true}}, []string{}, []string{"cn=a,o=data"}},
+		{"wieder angelegt", []change{{dn: "cn=a,o=Data", deleted: true}, {dn: "cn=a,o=Data"}}, []string{"cn=a,o=data"}, []string{}},
+		{"verschoben", []change{{dn: "cn=old,o=Data"}, {dn: "cn=new,o=Data", previousDN: "CN=old,o=Data"}}, []string{"cn=new,o=data"}, []string{"cn=old,o=data"}},
+		{"vorheriger DN gleich", []change{{dn: "cn=a,o=Data", previousDN: "CN=A,O=Data"}}, []string{"cn=a,o=data"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newChangeBatch()
+			for _, c := range tt.changes {
+				b.add(kindRoles, entry(c.dn), c.deleted, c.previousDN)
+			}
+			entries := []string{}
+			for dn := range b.entries[kindRoles] {
+				entries = append(entries, dn)
+			}
+			slices.Sort(entries)
+			if !slices.Equal(entries, tt.wantEntries) {
+				t.Errorf("geänderte Einträge %v, erwartet %v", entries, tt.wantEntries)
+			}
+			if deleted := b.deletedDNs(kindRoles); !slices.Equal(deleted, tt.wantDeleted) {
+				t.Errorf("gelöschte DNs %v, erwartet %v", deleted, tt.wantDeleted)
+			}
+			if len(b.entries[kindResources]) > 0 || len(b.deleted[kindResources]) > 0 {
+				t.Error("Änderung bei einer anderen Objektart gesammelt")
+			}
+		})
+	}
+}
+
+func TestMergeRecords(t *testing.T) {
+	type record struct{ dn, guid, value string }
+	key := func(r record) (string, string) { return r.dn, r.guid }
+	records := []record{{"cn=a", "g1", "alt"}, {"cn=b", "g2", "alt"}, {"cn=c", "", "alt"}}
+
+	tests := []struct {
+		name    string
+		changed []record
+		deleted map[string]bool
+		want    []record
+	}{
+		{"keine Änderungen", nil, nil, records},
+		{"geändert", []record{{"cn=a", "g1", "neu"}}, nil, []record{{"cn=b", "g2", "alt"}, {"cn=c", "", "alt"}, {"cn=a", "g1", "neu"}}},
+		{"umbenannt", []record{{"cn=b2", "g2", "neu"}}, nil, []record{{"cn=a", "g1", "alt"}, {"cn=c", "", "alt"}, {"cn=b2", "g2", "neu"}}},
+		{"gelöscht", nil, map[string]bool{"cn=c": true}, []record{{"cn=a", "g1", "alt"}, {"cn=b", "g2", "alt"}}},
+		{"neu", []record{{"cn=d", "", "neu"}}, nil, append(slices.Clone(records), record{"cn=d", "", "neu"})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeRecords(records, tt.changed, tt.deleted, key); !slices.Equal(got, tt.want) {
+				t.Errorf("mergeRecords() = %v, erwartet %v", got, tt.want)
+			}
+		})
+	}
+}